@@ -11,6 +11,7 @@ import (
 	"syscall"
 	"time"
 
+	"practic/internal/logger/sl"
 	"practic/internal/server"
 )
 
@@ -30,7 +31,7 @@ func gracefulShutdown(log *slog.Logger, apiServer *http.Server, done chan bool)
 	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
 	defer cancel()
 	if err := apiServer.Shutdown(ctx); err != nil {
-		log.Info("Server forced to shutdown with error: %v", err)
+		log.Info("Server forced to shutdown with error", sl.Err(err))
 	}
 
 	log.Info("Server exiting")
@@ -41,7 +42,10 @@ func gracefulShutdown(log *slog.Logger, apiServer *http.Server, done chan bool)
 
 func main() {
 	log := slog.New(slog.NewTextHandler(os.Stdout, &slog.HandlerOptions{Level: slog.LevelDebug}))
-	server := server.NewServer(log)
+	server, err := server.NewServer(log)
+	if err != nil {
+		panic(fmt.Sprintf("server init error: %s", err))
+	}
 
 	// Create a done channel to signal when the shutdown is complete
 	done := make(chan bool, 1)
@@ -49,7 +53,7 @@ func main() {
 	// Run graceful shutdown in a separate goroutine
 	go gracefulShutdown(log, server, done)
 	log.Info("Server started")
-	err := server.ListenAndServe()
+	err = server.ListenAndServe()
 	if err != nil && !errors.Is(err, http.ErrServerClosed) {
 		panic(fmt.Sprintf("http server error: %s", err))
 	}
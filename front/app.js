@@ -1,7 +1,11 @@
 let currentPage = 1;
 let editingId = null;
+let editingVersion = null;
+let editingListing = null;
 let hasNextPage = true;
 let hasPrevPage = false;
+// pageCursors[i] — курсор, с которого начинается страница i + 1
+let pageCursors = [''];
 
 
 function formatDate(isoDateString) {
@@ -16,25 +20,76 @@ function formatDate(isoDateString) {
     });
 }
 
+// сервер ставит cookie csrf_token, её значение нужно повторять в заголовке во всех изменяющих запросах
+function withCSRF(options = {}) {
+    const match = document.cookie.match(/(?:^|;\s*)csrf_token=([^;]*)/);
+    return {
+        ...options,
+        headers: { ...options.headers, 'X-CSRF-Token': match ? decodeURIComponent(match[1]) : '' }
+    };
+}
+
+// fetch, который при истёкшем токене один раз обновляет его и повторяет запрос
+async function apiFetch(url, options = {}) {
+    options = withCSRF(options);
+    let res = await fetch(url, options);
+    if (res.status === 401) {
+        const refreshed = await fetch("/api/token/refresh", withCSRF({method: "POST"}));
+        if (refreshed.ok) {
+            res = await fetch(url, options);
+        }
+    }
+    return res;
+}
+
 function logout() {
-    fetch("/api/logout", {
+    fetch("/api/logout", withCSRF({
         method: "POST",
-    }).then(res => {
+    })).then(res => {
         if (res.redirected) {
             window.location.href = res.url;
         }
     });
 }
 
+// listingSearchParams собирает параметры поиска из формы .search-form (кабинет и админ-панель)
+function listingSearchParams() {
+    const params = new URLSearchParams();
+    const fields = {
+        q: 'search-q', type: 'search-type', status: 'search-status', deal: 'search-deal',
+        price_min: 'search-price-min', price_max: 'search-price-max',
+        created_from: 'search-created-from', created_to: 'search-created-to', sort: 'search-sort',
+    };
+    for (const [name, id] of Object.entries(fields)) {
+        const value = document.getElementById(id).value.trim();
+        if (value) params.set(name, value);
+    }
+    if (params.has('sort')) params.set('order', document.getElementById('search-order').value);
+    return params;
+}
+
+function searchListings() {
+    currentPage = 1;
+    pageCursors = [''];
+    updateListings();
+}
+
 async function updateListings() {
-    const filter = document.getElementById('filter').value;
-    const res = await fetch(`/api/listings?page=${currentPage}&filter=${filter}`, {
+    const params = listingSearchParams();
+    if (pageCursors[currentPage - 1]) params.set('cursor', pageCursors[currentPage - 1]);
+    const city = document.getElementById('filter').value;
+    if (city) params.set('city', city);
+    const res = await apiFetch(`/api/listings?${params}`, {
     });
-    const data = await res.json();
+    if (res.status === 400) {
+        showToast(await res.text(), "#f87171", 4000);
+        return;
+    }
+    const page = await res.json();
     const tbody = document.getElementById('listings');
     tbody.innerHTML = '';
 
-    if (data === null) {
+    if (page.items.length === 0) {
         hasNextPage = false;
         if (currentPage > 1) {
             currentPage--;
@@ -45,19 +100,20 @@ async function updateListings() {
         tr.innerHTML = `<td colspan="9" style="text-align:center; padding: 10px;">Нет объявлений</td>`;
         tbody.appendChild(tr);
     } else {
-        hasNextPage = data.length === 10;
+        hasNextPage = Boolean(page.next_cursor);
         hasPrevPage = currentPage > 1;
+        if (hasNextPage) pageCursors[currentPage] = page.next_cursor;
 
-        data.forEach((item, index) => {
+        page.items.forEach((item, index) => {
 
             const tr = document.createElement('tr');
-            const itemNumber = (currentPage - 1) * 10 + index + 1; // глобальный номер
+            const itemNumber = (currentPage - 1) * page.page_size + index + 1; // глобальный номер
             tr.innerHTML = `
        <td>${itemNumber}</td>
       <td><strong>${item.Name}</strong></td>
       <td>${item.Typel}</td>
       <td>${item.Description}</td>
-      <td>${item.Status}</td>
+      <td>${statusLabel(item.Status)}<br>${dealLabel(item.Deal)}</td>
       <td>${item.Price.toLocaleString("ru-RU", {
                 style: "currency",
                 currency: "RUB"
@@ -65,25 +121,475 @@ async function updateListings() {
       <td>${item.City}</td>
       <td>${formatDate(item.Date_created)}</td>
       
-      <td><button class="action-button edit-btn" onclick=openModal(${JSON.stringify(item)})>Изменить</button> <button class="action-button delete-btn" onclick="deleteListing(${item.ID})">Удалить</button></td>
+      <td>${listingButtons(item)}</td>
     `;
             tbody.appendChild(tr);
         });
     }
-    document.getElementById('page-info').textContent = currentPage;
+    const pages = Math.max(1, Math.ceil(page.total / page.page_size));
+    document.getElementById('page-info').textContent = `${currentPage} из ${pages} (всего ${page.total})`;
     document.getElementById("prev-button").disabled = !hasPrevPage;
     document.getElementById("next-button").disabled = !hasNextPage;
 
 }
 
+// кнопки зависят от действий, которые сервер разрешил для объявления
+function listingButtons(item) {
+    const actions = item.Actions || [];
+    let html = '';
+    if (actions.includes('edit')) {
+        html += `<button class="action-button edit-btn" onclick=openModal(${JSON.stringify(item)})>Изменить</button> `;
+    }
+    if (actions.includes('delete')) {
+        html += `<button class="action-button delete-btn" onclick="deleteListing(${item.ID})">Удалить</button> `;
+    }
+    if (actions.includes('share')) {
+        html += `<button class="action-button edit-btn" onclick="shareListing(${item.ID})">Доступ</button> `;
+    }
+    html += `<button class="action-button edit-btn" onclick="openFiles(${item.ID}, ${actions.includes('edit')})">Файлы</button>`;
+    if (actions.includes('edit')) {
+        html += `<button class="action-button edit-btn" onclick="changeStatus(${item.ID}, '${item.Status}', ${item.Version})">Статус</button> `;
+    }
+    html += `<button class="action-button edit-btn" onclick="showHistory(${item.ID})">История</button> `;
+    if (actions.includes('edit')) {
+        html += `<button class="action-button edit-btn" onclick="openFeedModal(${item.ID})">Площадки</button> `;
+    }
+    if (item.Share) {
+        html += `<span class="share-badge">${item.Share === 'edit' ? 'общий: правка' : 'общий: чтение'}</span>`;
+    }
+    return html;
+}
+
+// жизненный цикл объявления, как его описывает сервер
+let listingStatuses = [];
+
+async function loadStatuses() {
+    listingStatuses = await apiFetch('/api/listings/statuses').then(res => res.json());
+    const select = document.getElementById('search-status');
+    for (const status of listingStatuses) {
+        const option = document.createElement('option');
+        option.value = status.name;
+        option.textContent = status.label;
+        select.appendChild(option);
+    }
+}
+
+function statusLabel(name) {
+    const status = listingStatuses.find(s => s.name === name);
+    return status ? status.label : name;
+}
+
+function dealLabel(deal) {
+    return deal === 'rent' ? 'аренда' : 'продажа';
+}
+
+async function changeStatus(id, current, version) {
+    const status = listingStatuses.find(s => s.name === current);
+    if (!status || status.next.length === 0) {
+        showToast("Из этого статуса перейти некуда", "#f87171");
+        return;
+    }
+    const options = status.next.map((name, i) => `${i + 1} — ${statusLabel(name)}`).join('\n');
+    const choice = prompt(`Сейчас: ${statusLabel(current)}\nНовый статус:\n${options}`);
+    const to = status.next[parseInt(choice) - 1];
+    if (!to) return;
+    const comment = prompt("Комментарий (необязательно)", "") ?? '';
+
+    const res = await apiFetch(`/api/listings/${id}/transition`, {
+        method: 'POST',
+        headers: {'Content-Type': 'application/json', 'If-Match': `"${version}"`},
+        body: JSON.stringify({to, comment}),
+    });
+    if (res.ok) {
+        showToast(`Статус: ${statusLabel(to)}`, "#22c55e");
+    } else if (res.status === 412) {
+        showToast("Объявление уже изменили, обновите страницу", "#f87171", 4000);
+    } else {
+        showToast(await res.text(), "#f87171", 4000);
+    }
+    updateListings();
+}
+
+async function showHistory(id) {
+    const [statusRes, pricesRes] = await Promise.all([
+        apiFetch(`/api/listings/${id}/history`),
+        apiFetch(`/api/listings/${id}/prices`),
+    ]);
+    if (!statusRes.ok || !pricesRes.ok) {
+        showToast("Не удалось получить историю", "#f87171");
+        return;
+    }
+    const statuses = (await statusRes.json()).map(c => c.from === null
+        ? `${formatDate(c.created_at)} ${c.user_name}: создано как «${statusLabel(c.to)}»`
+        : `${formatDate(c.created_at)} ${c.user_name}: ${statusLabel(c.from)} → ${statusLabel(c.to)}${c.comment ? ` (${c.comment})` : ''}`);
+    const prices = (await pricesRes.json()).map(c =>
+        `${formatDate(c.created_at)} ${c.user_name}: ${c.old_price.toLocaleString()} ₽ → ${c.new_price.toLocaleString()} ₽`);
+    alert(`Статус:\n${statuses.join('\n')}\n\nЦена:\n${prices.join('\n') || 'ещё не менялась'}`);
+}
+
+let filesListingId = null;
+let filesCanEdit = false;
+let listingPhotos = [];
+
+async function openFiles(id, canEdit) {
+    filesListingId = id;
+    filesCanEdit = canEdit;
+    document.querySelectorAll('.files-edit').forEach(el => el.classList.toggle('hidden', !canEdit));
+    document.getElementById('files-modal').classList.remove('hidden');
+    await renderFiles();
+}
+
+function closeFiles() {
+    document.getElementById('files-modal').classList.add('hidden');
+    filesListingId = null;
+}
+
+async function renderFiles() {
+    const res = await apiFetch(`/api/listings/${filesListingId}/files`);
+    if (!res.ok) {
+        showToast("Не удалось получить файлы", "#f87171");
+        return;
+    }
+    const files = await res.json();
+    listingPhotos = files.filter(f => f.kind === 'photo');
+
+    document.getElementById('files-photos').innerHTML = listingPhotos.map((f, i) => `
+        <figure class="photo${f.cover ? ' cover' : ''}">
+            <a href="${f.url}" target="_blank"><img src="${f.thumb_url}" alt="${f.name}"></a>
+            <figcaption>
+                ${f.cover ? '<span class="share-badge">обложка</span>' : ''}
+                ${filesCanEdit ? `
+                <button onclick="movePhoto(${i}, -1)" ${i === 0 ? 'disabled' : ''}>←</button>
+                <button onclick="movePhoto(${i}, 1)" ${i === listingPhotos.length - 1 ? 'disabled' : ''}>→</button>
+                ${f.cover ? '' : `<button onclick="setCover(${f.id})">Обложка</button>`}
+                <button onclick="deleteFile(${f.id})">Удалить</button>` : ''}
+            </figcaption>
+        </figure>
+    `).join('') || 'Нет фотографий';
+
+    document.getElementById('files-documents').innerHTML = files.filter(f => f.kind === 'document').map(f => `
+        <li>
+            <a href="${f.url}">${f.name}</a> (${Math.ceil(f.size / 1024)} КБ)
+            ${filesCanEdit ? `<button onclick="deleteFile(${f.id})">Удалить</button>` : ''}
+        </li>
+    `).join('') || '<li>Нет документов</li>';
+}
+
+// kind — photos или documents, как в адресе загрузки
+async function uploadFiles(kind) {
+    const input = document.getElementById(`upload-${kind}`);
+    if (input.files.length === 0) return;
+    const form = new FormData();
+    for (const file of input.files) form.append('file', file);
+
+    const res = await apiFetch(`/api/listings/${filesListingId}/${kind}`, {method: 'POST', body: form});
+    input.value = '';
+    if (res.ok) {
+        showToast("Файлы загружены", "#4ade80");
+    } else {
+        showToast(await res.text(), "#f87171", 4000);
+    }
+    await renderFiles();
+}
+
+async function movePhoto(index, delta) {
+    const ids = listingPhotos.map(f => f.id);
+    [ids[index], ids[index + delta]] = [ids[index + delta], ids[index]];
+    await apiFetch(`/api/listings/${filesListingId}/files/order`, {
+        method: 'PUT',
+        headers: {'Content-Type': 'application/json'},
+        body: JSON.stringify({kind: 'photo', ids}),
+    });
+    await renderFiles();
+}
+
+async function setCover(fileId) {
+    await apiFetch(`/api/listings/${filesListingId}/files/${fileId}/cover`, {method: 'POST'});
+    await renderFiles();
+}
+
+async function deleteFile(fileId) {
+    if (!confirm("Удалить файл?")) return;
+    await apiFetch(`/api/listings/${filesListingId}/files/${fileId}`, {method: 'DELETE'});
+    await renderFiles();
+}
+
+async function shareListing(id) {
+    const res = await apiFetch(`/api/listings/${id}/shares`, {});
+    if (!res.ok) {
+        showToast("Не удалось получить доступы", "#f87171");
+        return;
+    }
+    const shares = await res.json() || [];
+    const current = shares.map(s => `${s.login}: ${s.access}`).join('\n') || 'нет';
+    const login = prompt(`Текущие доступы:\n${current}\n\nЛогин пользователя (чтобы отозвать доступ, введите -логин):`);
+    if (!login) return;
+
+    if (login.startsWith('-')) {
+        const share = shares.find(s => s.login === login.slice(1).trim());
+        if (!share) {
+            showToast("Доступ не найден", "#f87171");
+            return;
+        }
+        const del = await apiFetch(`/api/listings/${id}/shares/${share.user_id}`, {method: 'DELETE'});
+        showToast(del.ok ? "Доступ отозван" : "Не удалось отозвать доступ", del.ok ? "#4ade80" : "#f87171");
+        return;
+    }
+
+    const access = prompt("Права: read или edit", "read");
+    if (!access) return;
+    const post = await apiFetch(`/api/listings/${id}/shares`, {
+        method: 'POST',
+        headers: {'Content-Type': 'application/json'},
+        body: JSON.stringify({login: login.trim(), access: access.trim()}),
+    });
+    if (post.ok) {
+        showToast("Доступ предоставлен", "#4ade80");
+    } else {
+        showToast(await post.text(), "#f87171");
+    }
+}
+
 async function deleteListing(id) {
     if (!confirm("Вы уверены, что хотите удалить объявление?")) return;
-    await fetch(`/api/listings/${id}`, {
+    await apiFetch(`/api/listings/${id}`, {
         method: 'DELETE',
     });
     await updateListings();
     await updateAnalytics();
-    showToast("Объявление удалено", "#f87171");
+    await loadTrash();
+    showToast("Объявление перемещено в корзину", "#f87171");
+}
+
+// выгрузка с теми же фильтрами, что и список; файл скачивает сам браузер
+function exportListings(format) {
+    const admin = document.getElementById('users') !== null;
+    const params = new URLSearchParams(admin ? agencyQuery() : '');
+    for (const [name, value] of listingSearchParams()) params.set(name, value);
+    params.set('format', format);
+    window.location.href = `${admin ? '/api/admin/listings/export' : '/api/listings/export'}?${params}`;
+}
+
+// импорт таблицы: сначала можно проверить файл без записи (dry run)
+async function importListings(dryRun) {
+    const file = document.getElementById('import-file').files[0];
+    if (!file) {
+        showToast("Выберите файл", "#f87171");
+        return;
+    }
+    const type = file.name.toLowerCase().endsWith('.json') ? 'application/json' : 'text/csv';
+    const res = await apiFetch('/api/listings/import' + (dryRun ? '?dry_run=1' : ''), {
+        method: 'POST',
+        headers: {'Content-Type': type},
+        body: file,
+    });
+    if (!res.ok) {
+        showToast(await res.text(), "#f87171", 4000);
+        return;
+    }
+    const report = await res.json();
+    const errors = report.rows
+        .filter(r => r.result === 'failed')
+        .map(r => `строка ${r.row}: ${r.errors.join('; ')}`);
+    const summary = dryRun
+        ? `Проверка: будет создано ${report.created}, пропущено ${report.skipped}, с ошибками ${report.failed}`
+        : `Импорт: создано ${report.created}, пропущено ${report.skipped}, с ошибками ${report.failed}`;
+    alert(summary + (errors.length ? '\n\n' + errors.join('\n') : ''));
+    if (!dryRun && report.created > 0) {
+        await updateListings();
+        await loadCities();
+        await updateAnalytics();
+    }
+}
+
+// привязка SSO к уже открытому аккаунту; результат приходит в ?sso= после возврата от провайдера
+const ssoLinkMessages = {
+    linked: ['SSO привязан, теперь можно входить через него', "#22c55e"],
+    taken: ['Эта учётная запись SSO уже привязана к другому аккаунту', "#f87171"],
+    error: ['Не удалось привязать SSO', "#f87171"],
+};
+
+async function showSSOLink() {
+    const { enabled, name } = await fetch('/api/oidc/config').then(res => res.json());
+    if (enabled) {
+        const button = document.getElementById('sso-link');
+        button.textContent = `Привязать ${name}`;
+        button.classList.remove('hidden');
+    }
+    const result = ssoLinkMessages[new URLSearchParams(window.location.search).get('sso')];
+    if (result) showToast(result[0], result[1], 4000);
+}
+
+async function linkSSO() {
+    const res = await apiFetch('/api/oidc/link', { method: 'POST' });
+    if (!res.ok) {
+        showToast(await res.text(), "#f87171");
+        return;
+    }
+    window.location.href = (await res.json()).url;
+}
+
+// выгрузка на площадки: ссылки на фиды и объявления, которые площадки не примут
+const feedFields = {
+    status: 'не опубликовано', type: 'тип (только квартира или дом)', price: 'цена', address: 'адрес',
+    area: 'площадь', rooms: 'комнаты', floor: 'этаж', floors: 'этажность', description: 'описание',
+    phone: 'телефон агента', photos: 'фото',
+};
+let feedEnabled = false;
+
+function feedURL(path = '') {
+    const admin = document.getElementById('users') !== null;
+    return admin ? `/api/admin/feeds${path}${agencyQuery()}` : `/api/feeds${path}`;
+}
+
+async function loadFeed() {
+    const info = document.getElementById('feed-info');
+    const res = await apiFetch(feedURL());
+    if (!res.ok) {
+        info.textContent = await res.text();
+        return;
+    }
+    const report = await res.json();
+    feedEnabled = report.token !== null;
+    document.getElementById('feed-off').disabled = !feedEnabled;
+    const phone = document.getElementById('feed-phone');
+    if (phone) phone.value = report.phone || '';
+
+    const state = feedEnabled
+        ? `Фиды включены ${formatDate(report.token.created_at)}, площадки ${report.token.last_used_at ? 'забирали их ' + formatDate(report.token.last_used_at) : 'их ещё не забирали'}.`
+        : 'Фиды выключены.';
+    info.textContent = `${state} Отмечено для площадок: ${report.listings}, в фиде Яндекса: ${report.ready.yandex || 0}, Авито: ${report.ready.avito || 0}.`;
+    const missing = fields => (fields || []).map(f => feedFields[f] || f).join(', ') || '—';
+    document.getElementById('feed-problems').innerHTML = report.problems.map(p => `
+      <tr>
+        <td>${p.id}</td>
+        <td>${p.title}</td>
+        <td>${missing(p.missing.yandex)}</td>
+        <td>${missing(p.missing.avito)}</td>
+      </tr>`).join('') || '<tr><td colspan="4">Все отмеченные объявления попадут в фиды</td></tr>';
+}
+
+async function createFeedToken() {
+    if (feedEnabled && !confirm("Старые ссылки перестанут работать, их придётся заменить в кабинетах площадок. Продолжить?")) return;
+    const res = await apiFetch(feedURL('/token'), { method: 'POST' });
+    if (!res.ok) {
+        showToast(await res.text(), "#f87171", 4000);
+        return;
+    }
+    const urls = await res.json();
+    // токен в ссылке показывается один раз
+    alert(`Яндекс.Недвижимость:\n${urls.yandex}\n\nАвито:\n${urls.avito}\n\nСохраните ссылки: больше они показаны не будут.`);
+    await loadFeed();
+}
+
+async function deleteFeedToken() {
+    if (!confirm("Отключить фиды? Площадки перестанут получать объявления.")) return;
+    const res = await apiFetch(feedURL('/token'), { method: 'DELETE' });
+    if (!res.ok) {
+        showToast(await res.text(), "#f87171");
+        return;
+    }
+    showToast("Фиды отключены", "#f87171");
+    await loadFeed();
+}
+
+async function savePhone() {
+    const res = await apiFetch('/api/me/phone', {
+        method: 'PUT',
+        headers: {'Content-Type': 'application/json'},
+        body: JSON.stringify({phone: document.getElementById('feed-phone').value}),
+    });
+    if (!res.ok) {
+        showToast(await res.text(), "#f87171");
+        return;
+    }
+    showToast("Телефон сохранён", "#22c55e");
+    await loadFeed();
+}
+
+let feedListing = null;
+
+async function openFeedModal(id) {
+    const res = await apiFetch(`/api/listings/${id}`);
+    if (!res.ok) {
+        showToast("Не удалось получить объявление", "#f87171");
+        return;
+    }
+    feedListing = await res.json();
+    document.getElementById('feed-address').value = feedListing.Address;
+    document.getElementById('feed-area').value = feedListing.Area || '';
+    document.getElementById('feed-rooms').value = feedListing.Rooms || '';
+    document.getElementById('feed-floor').value = feedListing.Floor || '';
+    document.getElementById('feed-floors').value = feedListing.Floors || '';
+    document.getElementById('feed-syndicate').checked = feedListing.Syndicate;
+    document.getElementById('feed-modal').classList.remove('hidden');
+}
+
+function closeFeedModal() {
+    document.getElementById('feed-modal').classList.add('hidden');
+    feedListing = null;
+}
+
+async function saveFeedFields() {
+    const number = id => Number(document.getElementById(id).value) || 0;
+    const res = await apiFetch(`/api/listings/${feedListing.ID}`, {
+        method: 'PATCH',
+        headers: {'Content-Type': 'application/merge-patch+json', 'If-Match': `"${feedListing.Version}"`},
+        body: JSON.stringify({
+            address: document.getElementById('feed-address').value,
+            area: number('feed-area'),
+            rooms: Math.trunc(number('feed-rooms')),
+            floor: Math.trunc(number('feed-floor')),
+            floors: Math.trunc(number('feed-floors')),
+            syndicate: document.getElementById('feed-syndicate').checked,
+        }),
+    });
+    if (res.status === 412) {
+        showToast("Объявление уже изменили, откройте его заново", "#f87171", 4000);
+        return;
+    }
+    if (!res.ok) {
+        showToast(await res.text(), "#f87171", 4000);
+        return;
+    }
+    showToast("Сохранено", "#22c55e");
+    closeFeedModal();
+    await updateListings();
+    await loadFeed();
+}
+
+// корзина: удалённые объявления, которые ещё можно восстановить
+async function loadTrash(query = '') {
+    const res = await apiFetch('/api/listings/trash' + query);
+    if (!res.ok) return;
+    const page = await res.json();
+    document.getElementById('trash').innerHTML = page.items.map(l => `
+      <tr>
+        <td>${l.ID}</td>
+        <td>${l.Name}</td>
+        <td>${l.Agent}</td>
+        <td>${formatDate(l.DeletedAt)}</td>
+        <td><button class="action-button edit-btn" onclick="restoreListing(${l.ID})">Восстановить</button></td>
+      </tr>`).join('') || '<tr><td colspan="5">Корзина пуста</td></tr>';
+    document.getElementById('trash-total').textContent =
+        page.total > page.items.length ? `Показано ${page.items.length} из ${page.total}` : '';
+}
+
+async function restoreListing(id) {
+    const res = await apiFetch(`/api/listings/${id}/restore`, { method: 'POST' });
+    if (!res.ok) {
+        showToast(await res.text(), "#f87171");
+        return;
+    }
+    showToast("Объявление восстановлено", "#22c55e");
+    // страница админа перезагружает всё сама, кабинет — свои списки
+    if (document.getElementById('users')) {
+        fetchAdminData();
+        return;
+    }
+    await updateListings();
+    await updateAnalytics();
+    await loadTrash();
 }
 
 function openModal(listing = null) {
@@ -94,18 +600,21 @@ function openModal(listing = null) {
     const cityInput = document.getElementById('modal-city');
     const typeInput = document.getElementById('modal-type');
     const descriptionInput = document.getElementById('modal-description');
-    const statusInput = document.getElementById('modal-status');
+    const dealInput = document.getElementById('modal-deal');
     const label = document.getElementById('modal-title-label')
 
     if (listing) {
         // режим редактирования
         editingId = listing.ID;
+        editingVersion = listing.Version;
+        editingListing = listing;
         typeInput.value = listing.Typel
         descriptionInput.value = listing.Description;
-        statusInput.value = listing.Status;
+        dealInput.value = listing.Deal;
         titleInput.value = listing.Name;
         priceInput.value = listing.Price;
         cityInput.value = listing.City;
+        document.getElementById('modal-publish-label').classList.add('hidden');
         saveBtn.textContent = "Сохранить";
         label.textContent = "Редактировать объявление";
     } else {
@@ -114,6 +623,9 @@ function openModal(listing = null) {
         titleInput.value = "";
         priceInput.value = "";
         cityInput.value = "";
+        dealInput.value = "sale";
+        document.getElementById('modal-publish').checked = false;
+        document.getElementById('modal-publish-label').classList.remove('hidden');
         saveBtn.textContent = "Создать";
         label.textContent = "Новое объявление";
     }
@@ -128,10 +640,10 @@ function openModal(listing = null) {
 }
 
 async function updateAnalytics() {
-    const res = await fetch('/api/analytics', {});
+    const res = await apiFetch('/api/analytics', {});
     const data = await res.json();
 
-    const topCitiesText = data.top_cities
+    const topCitiesText = (data.top_cities || [])
         .map(c => `${c.city} (${c.count})`)
         .join(", ");
 
@@ -139,7 +651,8 @@ async function updateAnalytics() {
     container.innerHTML = `
     <strong>Объявлений:</strong> ${data.total_listings} &nbsp;|&nbsp;
     <strong>Средняя цена:</strong> ${data.avg_price.toLocaleString()} ₽ &nbsp;|&nbsp;
-    <strong>Топ города:</strong> ${topCitiesText}
+    <strong>Топ города:</strong> ${topCitiesText} &nbsp;|&nbsp;
+    <strong>Снижена цена:</strong> ${data.reduced_listings} (в среднем на ${data.avg_reduction_percent.toFixed(1)}%)
   `;
 }
 
@@ -168,24 +681,26 @@ function closeModal() {
     document.getElementById('modal-city').value = '';
     document.getElementById('modal-type').value = '';
     document.getElementById('modal-description').value = '';
-    document.getElementById('modal-status').value = '';
+    document.getElementById('modal-deal').value = 'sale';
 }
 
 async function createListing() {
     const title = document.getElementById('modal-title').value;
     const type = document.getElementById('modal-type').value;
     const description = document.getElementById('modal-description').value;
-    const status = document.getElementById('modal-status').value;
+    const deal = document.getElementById('modal-deal').value;
+    // без галочки объявление создаётся черновиком
+    const status = document.getElementById('modal-publish').checked ? 'active' : 'draft';
     const price = parseInt(document.getElementById('modal-price').value);
     const city = document.getElementById('modal-city').value;
 
-    await fetch('/api/listings', {
+    await apiFetch('/api/listings', {
         method: 'POST',
         // headers: {
         //     'Content-Type': 'application/json',
         //     'Authorization': `Bearer ${getToken()}`
         // },
-        body: JSON.stringify({ title, type, description, status, price, city })
+        body: JSON.stringify({ title, type, description, status, deal, price, city })
     }).then(res => {
         if (res.ok){
             showToast("успешно добавленно", "#22c55e")
@@ -200,7 +715,7 @@ async function createListing() {
 }
 
 async function loadCities() {
-    const res = await fetch("/api/cities", {
+    const res = await apiFetch("/api/cities", {
         // headers: { Authorization: `Bearer ${getToken()}` }
     });
     const cities = await res.json();
@@ -218,20 +733,35 @@ async function updateListing(id) {
     const title = document.getElementById('modal-title').value;
     const type = document.getElementById('modal-type').value;
     const description = document.getElementById('modal-description').value;
-    const status = document.getElementById('modal-status').value;
+    const deal = document.getElementById('modal-deal').value;
     const price = parseInt(document.getElementById('modal-price').value);
     const city = document.getElementById('modal-city').value;
 
-    await fetch(`/api/listings/${id}`, {
-        method: 'PUT',
-        // headers: {
-        //     'Content-Type': 'application/json',
-        //     'Authorization': `Bearer ${getToken()}`
-        // },
-        body: JSON.stringify({ title, type, description, status, price, city })
-    }).then(res => {
+    // отправляем только изменённые поля, остальные сервер не трогает
+    const original = {
+        title: editingListing.Name, type: editingListing.Typel, description: editingListing.Description,
+        deal: editingListing.Deal, price: editingListing.Price, city: editingListing.City,
+    };
+    const patch = {};
+    for (const [key, value] of Object.entries({ title, type, description, deal, price, city })) {
+        if (value !== original[key]) patch[key] = value;
+    }
+
+    await apiFetch(`/api/listings/${id}`, {
+        method: 'PATCH',
+        // версия, которую пользователь открыл: если объявление успели изменить, сервер ответит 412
+        headers: {
+            'Content-Type': 'application/merge-patch+json',
+            'If-Match': `"${editingVersion}"`,
+        },
+        body: JSON.stringify(patch)
+    }).then(async res => {
             if (res.ok){
                 showToast("успешно Изменено", "#22c55e")
+            } else if (res.status === 412) {
+                showToast("Объявление уже изменили, откройте его заново", "#f87171", 4000)
+            } else if (res.status === 400) {
+                showToast(await res.text(), "#f87171", 4000)
             }
         }
     );
@@ -259,17 +789,152 @@ function showToast(text, background = "#2dd4bf", duration = 2000) {
 
 let allUsers = [];
 let allListings = [];
+let allRoles = [];
+let allAgencies = [];
+let canManageAgencies = false;
+// курсоры следующих страниц пользователей и объявлений в админ-панели
+let usersCursor = '';
+let listingsCursor = '';
+
+// agencyQuery — выбранное суперадминистратором агентство; остальные всегда видят только своё
+function agencyQuery() {
+    const agencyId = canManageAgencies ? document.getElementById('agency-scope').value : '0';
+    return agencyId !== '0' ? `?agency_id=${agencyId}` : '';
+}
+
+function agencyName(id) {
+    const agency = allAgencies.find(a => a.id === id);
+    return agency ? agency.name : id;
+}
 
 async function fetchAdminData() {
-    const users = await fetch('/api/admin/users').then(res => res.json());
-    const listings = await fetch('/api/admin/listings').then(res => res.json());
+    const me = await apiFetch('/api/me').then(res => res.json());
+    // менеджер видит только объявления, управление пользователями — у ролей с users.manage
+    const canManageUsers = me.permissions.includes('users.manage');
+    canManageAgencies = me.permissions.includes('agencies.manage');
+    document.querySelectorAll('.users-only').forEach(el => el.classList.toggle('hidden', !canManageUsers));
+    document.querySelectorAll('.agencies-only').forEach(el => el.classList.toggle('hidden', !canManageAgencies));
+    document.getElementById('registration-mode').disabled = !canManageAgencies;
+    // фид агентства общий, суперадминистратор сначала выбирает агентство
+    const canManageFeeds = me.permissions.includes('listings.edit_any') && (!canManageAgencies || agencyQuery() !== '');
+    document.querySelectorAll('.feeds-only').forEach(el => el.classList.toggle('hidden', !canManageFeeds));
 
-    allUsers = users;
-    allListings = listings;
+    if (canManageAgencies) {
+        allAgencies = await apiFetch('/api/admin/agencies').then(res => res.json());
+        renderAgencies();
+    }
+
+    await loadStatuses();
+    await fetchAdminListings();
+    if (canManageUsers) {
+        await fetchAdminUsers();
+        allRoles = await apiFetch('/api/admin/roles').then(res => res.json());
+        renderUsers();
+        fetchRegistrationData();
+    } else {
+        allUsers = [...new Set(allListings.map(l => l.Agent))].map(name => ({ name }));
+    }
 
-    renderUsers();
     renderUserFilter();
     renderListings();
+    fetchAgencyAnalytics();
+    loadTrash(agencyQuery());
+    if (canManageFeeds) loadFeed();
+}
+
+// more — дописать следующую страницу к уже загруженным
+async function fetchAdminUsers(more = false) {
+    const params = new URLSearchParams(agencyQuery());
+    if (more) params.set('cursor', usersCursor);
+    const page = await apiFetch(`/api/admin/users?${params}`).then(res => res.json());
+    allUsers = more ? allUsers.concat(page.items) : page.items;
+    usersCursor = page.next_cursor || '';
+    document.getElementById('users-more').classList.toggle('hidden', !usersCursor);
+    document.getElementById('users-total').textContent = `Показано ${allUsers.length} из ${page.total}`;
+    if (more) {
+        renderUsers();
+        filterUsers();
+    }
+}
+
+async function fetchAdminListings(more = false) {
+    const params = new URLSearchParams(agencyQuery());
+    for (const [name, value] of listingSearchParams()) params.set(name, value);
+    if (more) params.set('cursor', listingsCursor);
+    const res = await apiFetch(`/api/admin/listings?${params}`);
+    if (res.status === 400) {
+        showToast(await res.text(), "#f87171", 4000);
+        return;
+    }
+    const page = await res.json();
+    allListings = more ? allListings.concat(page.items) : page.items;
+    listingsCursor = page.next_cursor || '';
+    document.getElementById('listings-more').classList.toggle('hidden', !listingsCursor);
+    document.getElementById('listings-total').textContent = `Показано ${allListings.length} из ${page.total}`;
+    renderListings();
+}
+
+function renderAgencies() {
+    const select = document.getElementById('agency-scope');
+    const selected = select.value;
+    select.innerHTML = '<option value="0">Все агентства</option>' +
+        allAgencies.map(a => `<option value="${a.id}">${a.name}</option>`).join('');
+    select.value = selected;
+
+    const agenciesEl = document.getElementById('agencies');
+    agenciesEl.innerHTML = allAgencies.map(a => `
+          <tr>
+            <td>${a.id}</td>
+            <td>${a.name}</td>
+            <td>${a.users}</td>
+            <td>${a.listings}</td>
+          </tr>
+        `).join('');
+}
+
+async function createAgency() {
+    const name = prompt("Название агентства");
+    if (!name) return;
+    const res = await apiFetch('/api/admin/agencies', {
+        method: 'POST',
+        headers: { 'Content-Type': 'application/json' },
+        body: JSON.stringify({ name })
+    });
+    if (!res.ok) {
+        showToast("Не удалось создать агентство", "#ef4444");
+        return;
+    }
+    showToast("Агентство создано");
+    fetchAdminData();
+}
+
+async function setAgency(userId, agencyId) {
+    const res = await apiFetch('/api/admin/set-agency', {
+        method: 'POST',
+        headers: { 'Content-Type': 'application/json' },
+        body: JSON.stringify({ user_id: userId, agency_id: parseInt(agencyId, 10) })
+    });
+    if (!res.ok) {
+        showToast("Не удалось перевести пользователя", "#ef4444");
+        return;
+    }
+    showToast("Пользователь переведён");
+    fetchAdminData();
+}
+
+async function fetchAgencyAnalytics() {
+    const res = await apiFetch('/api/admin/analytics' + agencyQuery());
+    if (!res.ok) return;
+    const data = await res.json();
+    document.getElementById('agency-total').textContent = data.total_listings;
+    document.getElementById('agency-avg').textContent = data.avg_price.toLocaleString("ru-RU", {
+        style: "currency",
+        currency: "RUB"
+    });
+    document.getElementById('agency-reduced').textContent = data.reduced_listings;
+    document.getElementById('agency-reduction').textContent = data.avg_reduction_percent.toFixed(1);
+    document.getElementById('agency-cities').textContent =
+        (data.top_cities || []).map(c => `${c.city} (${c.count})`).join(', ') || '—';
 }
 
 function renderUsers() {
@@ -282,11 +947,19 @@ function renderUsers() {
             <td>${u.name}</td>
             <td>${u.login}</td>
             <td>${u.total}</td>
-            <td>${u.role}</td>
             <td>
-              <button onclick="setRole(${u.id}, '${u.role === 'admin' ? 'agent' : 'admin'}')">
-                Сделать ${u.role === 'admin' ? 'агентом' : 'админом'}
-              </button>
+              <select onchange="setRole(${u.id}, this.value)">
+                ${allRoles.map(r => `<option value="${r.name}" ${r.name === u.role ? 'selected' : ''}>${r.name}</option>`).join('')}
+              </select>
+            </td>
+            <td>
+              ${canManageAgencies ? `<select onchange="setAgency(${u.id}, this.value)">
+                ${allAgencies.map(a => `<option value="${a.id}" ${a.id === u.agency_id ? 'selected' : ''}>${a.name}</option>`).join('')}
+              </select>` : u.agency}
+            </td>
+            <td>${u.status === 'pending' ? 'ожидает одобрения' : 'активен'}</td>
+            <td>
+              ${u.status === 'pending' ? `<button onclick="approveUser(${u.id})">Одобрить</button>` : `<button onclick="impersonate(${u.id})">Войти как</button>`}
               <button onclick="deleteUser(${u.id})" class="action-button delete-btn">Удалить</button>
             </td>
           </tr>
@@ -294,19 +967,45 @@ function renderUsers() {
     });
 }
 
+async function impersonate(userId) {
+    const res = await apiFetch(`/api/admin/impersonate/${userId}`, { method: 'POST' });
+    if (!res.ok) {
+        showToast(await res.text(), "#ef4444");
+        return;
+    }
+    window.location.href = "/dashboard";
+}
+
+// баннер показывается, пока администратор работает под чужим аккаунтом
+function showImpersonationBanner(me) {
+    if (!me.impersonator) return;
+    document.getElementById("impersonation-text").textContent =
+        `Вы (${me.impersonator.login}) просматриваете кабинет пользователя ${me.login}`;
+    document.getElementById("impersonation-banner").classList.remove("hidden");
+}
+
+async function stopImpersonation() {
+    await apiFetch('/api/impersonation/stop', { method: 'POST' });
+    window.location.href = "/admin";
+}
+
 async function setRole(userId, role) {
-    await fetch('/api/admin/set-role', {
+    const res = await apiFetch('/api/admin/set-role', {
         method: 'POST',
         headers: { 'Content-Type': 'application/json' },
         body: JSON.stringify({ user_id: userId, role })
     });
+    if (!res.ok) {
+        showToast("Не удалось изменить роль", "#ef4444");
+        return;
+    }
     showToast("Роль обновлена");
     fetchAdminData();
 }
 
 async function deleteUser(userId) {
     if (!confirm("Удалить пользователя?")) return;
-    await fetch('/api/admin/delete-user', {
+    await apiFetch('/api/admin/delete-user', {
         method: 'POST',
         headers: { 'Content-Type': 'application/json' },
         body: JSON.stringify({ user_id: userId })
@@ -315,6 +1014,76 @@ async function deleteUser(userId) {
     fetchAdminData();
 }
 
+async function approveUser(userId) {
+    await apiFetch('/api/admin/approve-user', {
+        method: 'POST',
+        headers: { 'Content-Type': 'application/json' },
+        body: JSON.stringify({ user_id: userId })
+    });
+    showToast("Пользователь одобрен");
+    fetchAdminData();
+}
+
+async function fetchRegistrationData() {
+    const { mode } = await apiFetch('/api/admin/registration-mode').then(res => res.json());
+    document.getElementById("registration-mode").value = mode;
+
+    const invites = await apiFetch('/api/admin/invites' + agencyQuery()).then(res => res.json());
+    const invitesEl = document.getElementById("invites");
+    invitesEl.innerHTML = "";
+    invites.forEach(i => {
+        invitesEl.innerHTML += `
+          <tr>
+            <td>${i.id}</td>
+            <td>${agencyName(i.agency_id)}</td>
+            <td>${new Date(i.created_at).toLocaleString()}</td>
+            <td>${i.expires_at ? new Date(i.expires_at).toLocaleString() : 'бессрочно'}</td>
+            <td>${i.used_at ? new Date(i.used_at).toLocaleString() : '—'}</td>
+            <td>${i.used_at ? '' : `<button onclick="revokeInvite(${i.id})" class="action-button delete-btn">Отозвать</button>`}</td>
+          </tr>
+        `;
+    });
+}
+
+async function setRegistrationMode(mode) {
+    await apiFetch('/api/admin/registration-mode', {
+        method: 'POST',
+        headers: { 'Content-Type': 'application/json' },
+        body: JSON.stringify({ mode })
+    });
+    showToast("Режим регистрации обновлён");
+}
+
+async function createInvite() {
+    const days = prompt("Срок действия в днях (0 — бессрочно)", "7");
+    if (days === null) return;
+    // суперадминистратор приглашает в выбранное агентство
+    const agencyId = canManageAgencies ? parseInt(document.getElementById('agency-scope').value, 10) : 0;
+    const res = await apiFetch('/api/admin/invites', {
+        method: 'POST',
+        headers: { 'Content-Type': 'application/json' },
+        body: JSON.stringify({ expires_in_days: parseInt(days, 10) || 0, agency_id: agencyId })
+    });
+    if (!res.ok) {
+        showToast("Не удалось создать приглашение", "#ef4444");
+        return;
+    }
+    const { code } = await res.json();
+    // код больше нигде не показывается
+    prompt("Код приглашения (скопируйте, он показывается один раз)", code);
+    fetchRegistrationData();
+}
+
+async function revokeInvite(id) {
+    await apiFetch('/api/admin/revoke-invite', {
+        method: 'POST',
+        headers: { 'Content-Type': 'application/json' },
+        body: JSON.stringify({ id })
+    });
+    showToast("Приглашение отозвано", "#f87171");
+    fetchRegistrationData();
+}
+
 function filterUsers() {
     const term = document.getElementById("user-search").value.toLowerCase();
     const rows = document.querySelectorAll("#users tr");
@@ -355,7 +1124,7 @@ function renderListings() {
               <td>${l.Name}</td>
               <td>${l.Typel}</td>
               <td>${l.Description}</td>
-              <td>${l.Status}</td>
+              <td>${statusLabel(l.Status)}<br>${dealLabel(l.Deal)}</td>
               <td>${l.Price.toLocaleString("ru-RU", {
                 style: "currency",
                 currency: "RUB"
@@ -363,6 +1132,7 @@ function renderListings() {
                 <td>${l.City}</td>
                 <td>${new Date(l.Date_created).toLocaleDateString()}</td>
                 <td>${l.Agent}</td>
+                <td>${agencyName(l.AgencyID)}</td>
                 <td>
                   <button onclick="deleteAdminListing(${l.ID})" class="delete-btn action-button" ">Удалить</button>
                 </td>
@@ -373,7 +1143,7 @@ function renderListings() {
 
 async function deleteAdminListing(id) {
     if (!confirm("Вы уверены, что хотите удалить объявление?")) return;
-    await fetch(`/api/listings/${id}`, {
+    await apiFetch(`/api/listings/${id}`, {
         method: 'DELETE',
     });
     showToast("Объявление удалено", "#f87171");
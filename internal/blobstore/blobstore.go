@@ -0,0 +1,113 @@
+package blobstore
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log/slog"
+	"os"
+	"path/filepath"
+
+	_ "github.com/joho/godotenv/autoload"
+)
+
+var ErrNotFound = errors.New("blob not found")
+
+// BlobStore keeps uploaded files under slash-separated keys such as
+// "listings/12/3f9a.jpg".
+type BlobStore interface {
+	Put(key string, r io.Reader) error
+	Open(key string) (io.ReadCloser, error)
+	Delete(key string) error
+}
+
+// New picks the implementation by BLOB_DRIVER. Only "local" exists for now:
+// files are kept in UPLOADS_DIR.
+func New(log *slog.Logger) (BlobStore, error) {
+	switch driver := os.Getenv("BLOB_DRIVER"); driver {
+	case "", "local":
+		dir := os.Getenv("UPLOADS_DIR")
+		if dir == "" {
+			dir = "./uploads"
+		}
+		log.Info("uploads are stored on disk", slog.String("dir", dir))
+		return &Local{Dir: dir}, nil
+	default:
+		return nil, fmt.Errorf("unknown BLOB_DRIVER %q", driver)
+	}
+}
+
+// Local stores every blob as a file in Dir.
+type Local struct {
+	Dir string
+}
+
+func (s *Local) path(key string) (string, error) {
+	if !fs.ValidPath(key) || key == "." {
+		return "", fmt.Errorf("invalid blob key %q", key)
+	}
+	return filepath.Join(s.Dir, filepath.FromSlash(key)), nil
+}
+
+// Put writes the blob to a temporary file first, so a failed upload never
+// leaves a partial file under the key.
+func (s *Local) Put(key string, r io.Reader) error {
+	const op = "blobstore.Local.Put"
+
+	path, err := s.path(key)
+	if err != nil {
+		return fmt.Errorf("%s: %w", op, err)
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return fmt.Errorf("%s: %w", op, err)
+	}
+	f, err := os.CreateTemp(filepath.Dir(path), ".upload-*")
+	if err != nil {
+		return fmt.Errorf("%s: %w", op, err)
+	}
+	defer os.Remove(f.Name())
+
+	if _, err := io.Copy(f, r); err != nil {
+		f.Close()
+		return fmt.Errorf("%s: %w", op, err)
+	}
+	if err := f.Close(); err != nil {
+		return fmt.Errorf("%s: %w", op, err)
+	}
+	if err := os.Rename(f.Name(), path); err != nil {
+		return fmt.Errorf("%s: %w", op, err)
+	}
+	return nil
+}
+
+func (s *Local) Open(key string) (io.ReadCloser, error) {
+	const op = "blobstore.Local.Open"
+
+	path, err := s.path(key)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", op, err)
+	}
+	f, err := os.Open(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, fmt.Errorf("%s: %w", op, ErrNotFound)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", op, err)
+	}
+	return f, nil
+}
+
+// Delete removes the blob; deleting a missing blob is not an error.
+func (s *Local) Delete(key string) error {
+	const op = "blobstore.Local.Delete"
+
+	path, err := s.path(key)
+	if err != nil {
+		return fmt.Errorf("%s: %w", op, err)
+	}
+	if err := os.Remove(path); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("%s: %w", op, err)
+	}
+	return nil
+}
@@ -0,0 +1,136 @@
+package database
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"practic/internal/models"
+	"strings"
+	"time"
+)
+
+var ErrAccessTokenNotFound = errors.New("access token not found")
+
+// CreateAccessToken stores a personal access token. A zero ttl means the
+// token never expires.
+func (s *service) CreateAccessToken(userID int64, name, tokenHash string, scopes []string, ttl time.Duration) (id int64, err error) {
+	const op = "sqlite.database.CreateAccessToken"
+	const query = `
+		INSERT INTO access_tokens (user_id, name, token_hash, scopes, expires_at) VALUES (?, ?, ?, ?, datetime('now', ?)) RETURNING id;
+	`
+
+	stmt, err := s.db.Prepare(query)
+	if err != nil {
+		return 0, fmt.Errorf("%s: %w", op, err)
+	}
+
+	var expires any
+	if ttl > 0 {
+		expires = durationModifier(ttl)
+	}
+	resp, err := stmt.Exec(userID, name, tokenHash, strings.Join(scopes, " "), expires)
+	if err != nil {
+		return 0, fmt.Errorf("%s: %w", op, err)
+	}
+	id, err = resp.LastInsertId()
+	if err != nil {
+		return 0, fmt.Errorf("%s: %w", op, err)
+	}
+
+	return id, nil
+}
+
+// AccessTokenUser resolves an active token to its owner and marks it as used.
+// A token older than its user belonged to an earlier account with the same id
+// and is never accepted.
+func (s *service) AccessTokenUser(tokenHash string) (models.UserDB, models.AccessToken, error) {
+	const op = "sqlite.database.AccessTokenUser"
+	const query = `
+		UPDATE access_tokens SET last_used_at = datetime('now')
+		WHERE token_hash = ? AND revoked_at IS NULL AND (expires_at IS NULL OR expires_at > datetime('now'))
+			AND NOT EXISTS (SELECT 1 FROM users WHERE users.id = access_tokens.user_id AND users.created_at > access_tokens.created_at)
+		RETURNING id, user_id, name, scopes;
+	`
+
+	stmt, err := s.db.Prepare(query)
+	if err != nil {
+		return models.UserDB{}, models.AccessToken{}, fmt.Errorf("%s: %w", op, err)
+	}
+
+	var token models.AccessToken
+	var userID int64
+	var scopes string
+	err = stmt.QueryRow(tokenHash).Scan(&token.ID, &userID, &token.Name, &scopes)
+	if errors.Is(err, sql.ErrNoRows) {
+		return models.UserDB{}, models.AccessToken{}, fmt.Errorf("%s: %w", op, ErrAccessTokenNotFound)
+	}
+	if err != nil {
+		return models.UserDB{}, models.AccessToken{}, fmt.Errorf("%s: %w", op, err)
+	}
+	token.Scopes = strings.Fields(scopes)
+
+	user, err := s.UserByID(userID)
+	if err != nil {
+		return models.UserDB{}, models.AccessToken{}, fmt.Errorf("%s: %w", op, err)
+	}
+
+	return user, token, nil
+}
+
+func (s *service) GetAccessTokens(userID int64) ([]models.AccessToken, error) {
+	const op = "sqlite.database.GetAccessTokens"
+	const query = `
+		SELECT id, name, scopes, created_at, last_used_at, expires_at
+		FROM access_tokens
+		WHERE user_id = ? AND revoked_at IS NULL AND (expires_at IS NULL OR expires_at > datetime('now'))
+		ORDER BY created_at DESC
+	`
+
+	stmt, err := s.db.Prepare(query)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", op, err)
+	}
+
+	rows, err := stmt.Query(userID)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", op, err)
+	}
+	defer rows.Close()
+
+	var tokens []models.AccessToken
+	for rows.Next() {
+		var t models.AccessToken
+		var scopes string
+		if err := rows.Scan(&t.ID, &t.Name, &scopes, &t.CreatedAt, &t.LastUsedAt, &t.ExpiresAt); err != nil {
+			return nil, fmt.Errorf("%s: %w", op, err)
+		}
+		t.Scopes = strings.Fields(scopes)
+		tokens = append(tokens, t)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("%s: %w", op, err)
+	}
+
+	return tokens, nil
+}
+
+func (s *service) RevokeAccessToken(id int64, userID int64) error {
+	const op = "sqlite.database.RevokeAccessToken"
+	const query = `
+		UPDATE access_tokens SET revoked_at = datetime('now') WHERE id = ? AND user_id = ? AND revoked_at IS NULL;
+	`
+
+	stmt, err := s.db.Prepare(query)
+	if err != nil {
+		return fmt.Errorf("%s: %w", op, err)
+	}
+	resp, err := stmt.Exec(id, userID)
+	if err != nil {
+		return fmt.Errorf("%s: %w", op, err)
+	}
+	if n, _ := resp.RowsAffected(); n == 0 {
+		return fmt.Errorf("%s: %w", op, ErrAccessTokenNotFound)
+	}
+	return nil
+}
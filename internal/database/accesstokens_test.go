@@ -0,0 +1,55 @@
+package database
+
+import (
+	"errors"
+	"testing"
+)
+
+// A deleted user's token must not resolve to whoever registers next, even
+// if they end up with the same id.
+func TestAccessTokenOfDeletedUser(t *testing.T) {
+	s := newTestService(t)
+
+	alice, err := s.CreateUser("Alice", "alice", "", []byte("hash"), "active", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.CreateAccessToken(alice, "ci", "alice-token", []string{"listings:read"}, 0); err != nil {
+		t.Fatal(err)
+	}
+	if user, _, err := s.AccessTokenUser("alice-token"); err != nil || user.ID != alice {
+		t.Fatalf("AccessTokenUser before deletion = %d, %v", user.ID, err)
+	}
+
+	if err := s.DeleteUser(alice); err != nil {
+		t.Fatal(err)
+	}
+	bob, err := s.CreateUser("Bob", "bob", "", []byte("hash"), "active", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bob == alice {
+		t.Errorf("bob got the id of deleted alice: %d", bob)
+	}
+	if user, _, err := s.AccessTokenUser("alice-token"); !errors.Is(err, ErrAccessTokenNotFound) {
+		t.Errorf("AccessTokenUser after deletion = %s, %v, want ErrAccessTokenNotFound", user.Login, err)
+	}
+}
+
+// Rows left from before ids stopped being reused carry an older created_at
+// than the account now holding the id.
+func TestAccessTokenOlderThanUser(t *testing.T) {
+	s := newTestService(t)
+
+	bob, err := s.CreateUser("Bob", "bob", "", []byte("hash"), "active", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = s.db.Exec(`INSERT INTO access_tokens (user_id, name, token_hash, scopes, created_at) VALUES (?, 'old', 'stale-token', '', datetime('now', '-1 day'));`, bob)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if user, _, err := s.AccessTokenUser("stale-token"); !errors.Is(err, ErrAccessTokenNotFound) {
+		t.Errorf("AccessTokenUser = %s, %v, want ErrAccessTokenNotFound", user.Login, err)
+	}
+}
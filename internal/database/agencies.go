@@ -0,0 +1,166 @@
+package database
+
+import (
+	"errors"
+	"fmt"
+	"practic/internal/models"
+)
+
+var (
+	ErrAgencyNotFound = errors.New("agency not found")
+	ErrAgencyExists   = errors.New("agency already exists")
+)
+
+func (s *service) CreateAgency(name string) (id int64, err error) {
+	const op = "sqlite.database.CreateAgency"
+	const query = `
+		INSERT INTO agencies (name) VALUES (?) RETURNING id;
+	`
+
+	stmt, err := s.db.Prepare(query)
+	if err != nil {
+		return 0, fmt.Errorf("%s: %w", op, err)
+	}
+	resp, err := stmt.Exec(name)
+	if isUniqueViolation(err) {
+		return 0, fmt.Errorf("%s: %w", op, ErrAgencyExists)
+	}
+	if err != nil {
+		return 0, fmt.Errorf("%s: %w", op, err)
+	}
+	id, err = resp.LastInsertId()
+	if err != nil {
+		return 0, fmt.Errorf("%s: %w", op, err)
+	}
+	return id, nil
+}
+
+func (s *service) GetAgencies() ([]models.Agency, error) {
+	const op = "sqlite.database.GetAgencies"
+	const query = `
+		SELECT agencies.id, agencies.name, agencies.created_at,
+			(SELECT COUNT(*) FROM users WHERE users.agency_id = agencies.id),
+			(SELECT COUNT(*) FROM listings WHERE listings.agency_id = agencies.id AND listings.deleted_at IS NULL)
+		FROM agencies
+		ORDER BY agencies.id;
+	`
+
+	stmt, err := s.db.Prepare(query)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", op, err)
+	}
+
+	rows, err := stmt.Query()
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", op, err)
+	}
+	defer rows.Close()
+
+	agencies := []models.Agency{}
+	for rows.Next() {
+		var a models.Agency
+		if err := rows.Scan(&a.ID, &a.Name, &a.CreatedAt, &a.Users, &a.Listings); err != nil {
+			return nil, fmt.Errorf("%s: %w", op, err)
+		}
+		agencies = append(agencies, a)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("%s: %w", op, err)
+	}
+
+	return agencies, nil
+}
+
+// SetUserAgency moves a user and their listings to another agency and
+// invalidates their tokens. Shares that would cross agencies are revoked.
+func (s *service) SetUserAgency(userID, agencyID int64) error {
+	const op = "sqlite.database.SetUserAgency"
+	const userQuery = `
+		UPDATE users SET agency_id = ?, token_version = token_version + 1 WHERE id = ?;
+	`
+	const listingsQuery = `
+		UPDATE listings SET agency_id = ? WHERE user_id = ?;
+	`
+	const sharesQuery = `
+		DELETE FROM listing_shares
+		WHERE (user_id = ? AND listing_id IN (SELECT id FROM listings WHERE agency_id != ?))
+			OR (listing_id IN (SELECT id FROM listings WHERE user_id = ?) AND user_id IN (SELECT id FROM users WHERE agency_id != ?));
+	`
+
+	tx, err := s.db.Begin()
+	if err != nil {
+		return fmt.Errorf("%s: %w", op, err)
+	}
+	defer tx.Rollback()
+
+	var exists bool
+	err = tx.QueryRow(`SELECT EXISTS (SELECT 1 FROM agencies WHERE id = ?);`, agencyID).Scan(&exists)
+	if err != nil {
+		return fmt.Errorf("%s: %w", op, err)
+	}
+	if !exists {
+		return fmt.Errorf("%s: %w", op, ErrAgencyNotFound)
+	}
+
+	resp, err := tx.Exec(userQuery, agencyID, userID)
+	if err != nil {
+		return fmt.Errorf("%s: %w", op, err)
+	}
+	if n, _ := resp.RowsAffected(); n == 0 {
+		return fmt.Errorf("%s: %w", op, ErrUserNotFound)
+	}
+	if _, err = tx.Exec(listingsQuery, agencyID, userID); err != nil {
+		return fmt.Errorf("%s: %w", op, err)
+	}
+	if _, err = tx.Exec(sharesQuery, userID, agencyID, userID, agencyID); err != nil {
+		return fmt.Errorf("%s: %w", op, err)
+	}
+	if err = tx.Commit(); err != nil {
+		return fmt.Errorf("%s: %w", op, err)
+	}
+	return nil
+}
+
+// GetAgencyAnalytics computes the analytics over all listings of an agency,
+// of all agencies if agencyID is 0.
+func (s *service) GetAgencyAnalytics(agencyID int64) (map[string]any, error) {
+	return s.analytics("sqlite.database.GetAgencyAnalytics", "? = 0 OR agency_id = ?", agencyID, agencyID)
+}
+
+// GetAgencyCities lists the cities of an agency's listings, of all agencies
+// if agencyID is 0.
+func (s *service) GetAgencyCities(agencyID int64) ([]string, error) {
+	const op = "sqlite.database.GetAgencyCities"
+	const query = `
+		SELECT DISTINCT city FROM listings
+		WHERE deleted_at IS NULL AND (? = 0 OR agency_id = ?)
+		ORDER BY city
+	`
+
+	stmt, err := s.db.Prepare(query)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", op, err)
+	}
+
+	rows, err := stmt.Query(agencyID, agencyID)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", op, err)
+	}
+	defer rows.Close()
+
+	cities := []string{}
+	for rows.Next() {
+		var city string
+		if err := rows.Scan(&city); err != nil {
+			return nil, fmt.Errorf("%s: %w", op, err)
+		}
+		cities = append(cities, city)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("%s: %w", op, err)
+	}
+
+	return cities, nil
+}
@@ -3,16 +3,20 @@ package database
 import (
 	"context"
 	"database/sql"
+	"errors"
 	"fmt"
 	"log/slog"
 	"os"
 	"practic/internal/logger/sl"
 	"practic/internal/models"
+	"practic/internal/policy"
 	"strconv"
+	"strings"
 	"time"
 
 	_ "github.com/joho/godotenv/autoload"
-	_ "modernc.org/sqlite"
+	"modernc.org/sqlite"
+	sqlite3 "modernc.org/sqlite/lib"
 )
 
 // Service represents a service that interacts with a database.
@@ -24,20 +28,114 @@ type Service interface {
 	// Close terminates the database connection.
 	// It returns an error if the connection cannot be closed.
 	Close() error
-	CreateUser(name, login string, password []byte) (uid int64, err error)
+	CreateUser(name, login, email string, password []byte, status, inviteHash string) (uid int64, err error)
 	User(login string) (models.UserDB, error)
-	CreateListing(name, type_l, description, status, city string, price int64, user_id int64) (uid int64, err error)
-	GetListings(userID int64, offset int64, filter string) ([]models.ListingDB, error)
+	CreateListing(l models.Listing) (uid int64, err error)
+	ImportListings(userID int64, listings []models.Listing, dryRun bool) ([]int64, error)
+	GetListings(userID int64, filter models.ListingFilter, page models.PageRequest) (models.Page[models.ListingDB], error)
 	GetCities(userID int64) ([]string, error)
-	UpdateListing(name, typel, description, status, city string, price int64, id int64) error
-	DeleteListing(id int64, userID int64) error
+	ExportListings(userID int64, filter models.ListingFilter, each func(models.ListingDB) error) error
+	UpdateListing(l models.Listing, id int64, version int64, userID int64) (int64, error)
+	PatchListing(id int64, fields map[string]any, version int64, userID int64) (int64, error)
+	GetListing(id int64, userID int64) (models.ListingDB, error)
+	DeleteListing(id int64) error
+	GetDeletedListings(userID int64, editAny bool, agencyID int64, page models.PageRequest) (models.Page[models.ListingDB], error)
+	RestoreListing(id int64, userID int64) error
+	PurgeListings(deletedBefore time.Time) (blobKeys []string, err error)
+	ListingFacts(id int64, userID int64) (policy.ListingFacts, error)
+	GetListingShares(id int64) ([]models.ListingShare, error)
+	ShareListing(id int64, userID int64, access string) error
+	UnshareListing(id int64, userID int64) error
+	GetListingStatuses() ([]models.ListingStatus, error)
+	TransitionListing(id int64, to string, userID int64, comment string, version int64) (int64, error)
+	GetStatusHistory(id int64) ([]models.StatusChange, error)
+	GetPriceHistory(id int64) ([]models.PriceChange, error)
+	AddListingFile(f models.ListingFile) (int64, error)
+	GetListingFiles(listingID int64) ([]models.ListingFile, error)
+	GetListingFile(listingID, fileID int64) (models.ListingFile, error)
+	DeleteListingFile(listingID, fileID int64) (models.ListingFile, error)
+	ReorderListingFiles(listingID int64, kind string, ids []int64) error
+	SetListingCover(listingID, fileID int64) error
 	GetAnalytics(userID int64) (map[string]any, error)
-	GetAllUsers() (users []models.UserAdmin, err error)
-	GetAllListings() (listings []models.ListingDB, err error)
+	GetAllUsers(agencyID int64, page models.PageRequest) (models.Page[models.UserAdmin], error)
+	GetAllListings(agencyID int64, filter models.ListingFilter, page models.PageRequest) (models.Page[models.ListingDB], error)
+	ExportAllListings(agencyID int64, filter models.ListingFilter, each func(models.ListingDB) error) error
 	SetUserRole(userID int64, role string) error
 	DeleteUser(userID int64) error
+	ApproveUser(userID int64) error
+	RolePermissions(role string) ([]string, error)
+	GetRoles() ([]models.Role, error)
+	UserByIdentity(issuer, subject string) (models.UserDB, error)
+	LinkIdentity(userID int64, issuer, subject, email string) error
+	CreateIdentityUser(name, login, email, role, status, issuer, subject string) (uid int64, err error)
+	UserByID(userID int64) (models.UserDB, error)
+	UserByEmail(email string) (models.UserDB, error)
+	SetUserEmail(userID int64, email string) error
+	UpdatePassword(userID int64, password []byte) error
+
+	CreatePasswordReset(userID int64, tokenHash string, ttl time.Duration) error
+	ConsumePasswordReset(tokenHash string) (userID int64, err error)
+	CreateEmailChange(userID int64, email, tokenHash string, ttl time.Duration) error
+	ConfirmEmailChange(tokenHash string) (userID int64, err error)
+
+	SetTOTPSecret(userID int64, secret string) error
+	EnableTOTP(userID int64, recoveryHashes []string) error
+	DisableTOTP(userID int64) error
+	UseTOTPStep(userID int64, step int64) (bool, error)
+	UseRecoveryCode(userID int64, codeHash string) (bool, error)
+	ReplaceRecoveryCodes(userID int64, recoveryHashes []string) error
+	Setting(key string) (string, error)
+	SetSetting(key, value string) error
+
+	CreateAccessToken(userID int64, name, tokenHash string, scopes []string, ttl time.Duration) (id int64, err error)
+	AccessTokenUser(tokenHash string) (models.UserDB, models.AccessToken, error)
+	GetAccessTokens(userID int64) ([]models.AccessToken, error)
+	RevokeAccessToken(id int64, userID int64) error
+
+	SetFeedToken(owner models.FeedOwner, tokenHash string, createdBy int64) error
+	DeleteFeedToken(owner models.FeedOwner) error
+	GetFeedToken(owner models.FeedOwner) (models.FeedToken, error)
+	FeedOwnerByToken(tokenHash string) (models.FeedOwner, error)
+	GetFeedListings(owner models.FeedOwner) ([]models.FeedListing, error)
+	GetFeedPhoto(owner models.FeedOwner, fileID int64, statuses []string) (models.ListingFile, error)
+	UserPhone(userID int64) (string, error)
+	SetUserPhone(userID int64, phone string) error
+
+	LoginLockout(login, ip string) (time.Duration, error)
+	RecordLoginFailure(kind, value string) (failures int64, err error)
+	LockLogin(kind, value string, duration time.Duration) error
+	ClearLoginFailures(kind, value string) error
+	GetLoginFailures() ([]models.LoginFailure, error)
+
+	CreateInvite(createdBy, agencyID int64, codeHash string, ttl time.Duration) (id int64, err error)
+	GetInvites(agencyID int64) ([]models.Invite, error)
+	RevokeInvite(id, agencyID int64) error
+
+	CreateAgency(name string) (id int64, err error)
+	GetAgencies() ([]models.Agency, error)
+	SetUserAgency(userID, agencyID int64) error
+	GetAgencyAnalytics(agencyID int64) (map[string]any, error)
+	GetAgencyCities(agencyID int64) ([]string, error)
+
+	CreateSession(userID int64, refreshHash, userAgent, ip string, mfa bool, ttl time.Duration) (sid int64, err error)
+	RotateSession(oldHash, newHash string, ttl time.Duration) (models.SessionDB, error)
+	SessionTokenVersion(sid int64) (int64, error)
+	SessionMFA(sid int64) (bool, error)
+	GetSessions(userID int64) ([]models.Session, error)
+	RevokeSession(sid int64, userID int64) error
+	RevokeSessionByRefresh(refreshHash string) error
+	RevokeUserSessions(userID int64) error
 }
 
+var (
+	ErrUserNotFound = errors.New("user not found")
+	ErrEmailTaken   = errors.New("email already in use")
+	ErrLoginTaken   = errors.New("login already in use")
+
+	ErrListingNotFound = errors.New("listing not found")
+	ErrVersionConflict = errors.New("listing was changed by someone else")
+)
+
 type service struct {
 	log *slog.Logger
 	db  *sql.DB
@@ -48,6 +146,11 @@ var (
 	dbInstance *service
 )
 
+func isUniqueViolation(err error) bool {
+	var sqliteErr *sqlite.Error
+	return errors.As(err, &sqliteErr) && sqliteErr.Code() == sqlite3.SQLITE_CONSTRAINT_UNIQUE
+}
+
 func New(log *slog.Logger) Service {
 	// Reuse Connection
 	if dbInstance != nil {
@@ -124,22 +227,32 @@ func (s *service) Health() map[string]string {
 // If the connection is successfully closed, it returns nil.
 // If an error occurs while closing the connection, it returns the error.
 func (s *service) Close() error {
-	s.log.Info("Disconnected from database: %s", dburl)
+	s.log.Info("Disconnected from database", slog.String("url", dburl))
 	return s.db.Close()
 }
 
-func (s *service) CreateUser(name, login string, password []byte) (uid int64, err error) {
+// CreateUser inserts a user with the given status. A non-empty inviteHash
+// must match an unused, unexpired invite, which is redeemed in the same
+// transaction.
+func (s *service) CreateUser(name, login, email string, password []byte, status, inviteHash string) (uid int64, err error) {
 	const op = "sqlite.database.CreateUser"
 	const query = `
-		INSERT INTO users (username, password, name) VALUES (?, ?, ?) RETURNING id;
+		INSERT INTO users (username, password, name, email, status, created_at) VALUES (?, ?, ?, NULLIF(?, ''), ?, datetime('now')) RETURNING id;
 	`
 
-	stmt, err := s.db.Prepare(query)
+	tx, err := s.db.Begin()
 	if err != nil {
 		return 0, fmt.Errorf("%s: %w", op, err)
 	}
+	defer tx.Rollback()
 
-	resp, err := stmt.Exec(login, password, name)
+	resp, err := tx.Exec(query, login, password, name, email, status)
+	if isUniqueViolation(err) {
+		if strings.Contains(err.Error(), "users.email") {
+			return 0, fmt.Errorf("%s: %w", op, ErrEmailTaken)
+		}
+		return 0, fmt.Errorf("%s: %w", op, ErrLoginTaken)
+	}
 	if err != nil {
 		return 0, fmt.Errorf("%s: %w", op, err)
 	}
@@ -148,13 +261,36 @@ func (s *service) CreateUser(name, login string, password []byte) (uid int64, er
 		return 0, fmt.Errorf("%s: %w", op, err)
 	}
 
+	// приглашённый попадает в агентство приглашения, остальные — в главный офис
+	if inviteHash != "" {
+		agencyID, err := redeemInvite(tx, inviteHash, id)
+		if err != nil {
+			return 0, fmt.Errorf("%s: %w", op, err)
+		}
+		if _, err = tx.Exec(`UPDATE users SET agency_id = ? WHERE id = ?;`, agencyID, id); err != nil {
+			return 0, fmt.Errorf("%s: %w", op, err)
+		}
+	}
+	if err = tx.Commit(); err != nil {
+		return 0, fmt.Errorf("%s: %w", op, err)
+	}
+
 	return id, nil
 }
 
+// userColumns is the column list read by scanUser.
+const userColumns = `id, username, password, name, role, status, agency_id, token_version, COALESCE(email, ''),
+		COALESCE(totp_secret, ''), totp_enabled, totp_last_step`
+
+func scanUser(row *sql.Row, user *models.UserDB) error {
+	return row.Scan(&user.ID, &user.Login, &user.Password, &user.Name, &user.Role, &user.Status, &user.AgencyID, &user.TokenVersion, &user.Email,
+		&user.TOTPSecret, &user.TOTPEnabled, &user.TOTPLastStep)
+}
+
 func (s *service) User(login string) (models.UserDB, error) {
 	const op = "sqlite.database.User"
 	const query = `
-		SELECT id, username, password, name, role
+		SELECT ` + userColumns + `
 		FROM users
 		WHERE username = ?
 	`
@@ -166,7 +302,10 @@ func (s *service) User(login string) (models.UserDB, error) {
 
 	var user models.UserDB
 
-	err = stmt.QueryRow(login).Scan(&user.ID, &user.Login, &user.Password, &user.Name, &user.Role)
+	err = scanUser(stmt.QueryRow(login), &user)
+	if errors.Is(err, sql.ErrNoRows) {
+		return models.UserDB{}, fmt.Errorf("%s: %w", op, ErrUserNotFound)
+	}
 	if err != nil {
 		return models.UserDB{}, fmt.Errorf("%s: %w", op, err)
 	}
@@ -175,82 +314,192 @@ func (s *service) User(login string) (models.UserDB, error) {
 
 }
 
-func (s *service) CreateListing(name, type_l, description, status, city string, price int64, user_id int64) (uid int64, err error) {
-	const op = "sqlite.database.CreateListing"
+func (s *service) UserByID(userID int64) (models.UserDB, error) {
+	const op = "sqlite.database.UserByID"
 	const query = `
-		INSERT INTO listings (name, type, description, status, price, city, user_id) VALUES (?, ?, ?, ?, ?, ?, ?) RETURNING id;
+		SELECT ` + userColumns + `
+		FROM users
+		WHERE id = ?
 	`
+
 	stmt, err := s.db.Prepare(query)
 	if err != nil {
-		return 0, fmt.Errorf("%s: %w", op, err)
+		return models.UserDB{}, fmt.Errorf("%s: %w", op, err)
+	}
+
+	var user models.UserDB
+
+	err = scanUser(stmt.QueryRow(userID), &user)
+	if errors.Is(err, sql.ErrNoRows) {
+		return models.UserDB{}, fmt.Errorf("%s: %w", op, ErrUserNotFound)
+	}
+	if err != nil {
+		return models.UserDB{}, fmt.Errorf("%s: %w", op, err)
+	}
+
+	return user, nil
+}
+
+func (s *service) UserByEmail(email string) (models.UserDB, error) {
+	const op = "sqlite.database.UserByEmail"
+	const query = `
+		SELECT ` + userColumns + `
+		FROM users
+		WHERE email = ?
+	`
+
+	stmt, err := s.db.Prepare(query)
+	if err != nil {
+		return models.UserDB{}, fmt.Errorf("%s: %w", op, err)
+	}
+
+	var user models.UserDB
+
+	err = scanUser(stmt.QueryRow(email), &user)
+	if errors.Is(err, sql.ErrNoRows) {
+		return models.UserDB{}, fmt.Errorf("%s: %w", op, ErrUserNotFound)
+	}
+	if err != nil {
+		return models.UserDB{}, fmt.Errorf("%s: %w", op, err)
+	}
+
+	return user, nil
+}
+
+func (s *service) SetUserEmail(userID int64, email string) error {
+	const op = "sqlite.database.SetUserEmail"
+	const query = `
+		UPDATE users SET email = NULLIF(?, '') WHERE id = ?;
+	`
+	stmt, err := s.db.Prepare(query)
+	if err != nil {
+		return fmt.Errorf("%s: %w", op, err)
+	}
+	_, err = stmt.Exec(email, userID)
+	if err != nil {
+		if isUniqueViolation(err) {
+			return fmt.Errorf("%s: %w", op, ErrEmailTaken)
+		}
+		return fmt.Errorf("%s: %w", op, err)
 	}
-	resp, err := stmt.Exec(name, type_l, description, status, price, city, user_id)
+	return nil
+}
+
+// UpdatePassword stores a new password hash and signs the user out of every
+// session, so a leaked password or token stops working right away.
+func (s *service) UpdatePassword(userID int64, password []byte) error {
+	const op = "sqlite.database.UpdatePassword"
+	const query = `
+		UPDATE users SET password = ?, token_version = token_version + 1 WHERE id = ?;
+	`
+	const sessionsQuery = `
+		UPDATE sessions SET revoked_at = datetime('now') WHERE user_id = ? AND revoked_at IS NULL;
+	`
+	tx, err := s.db.Begin()
+	if err != nil {
+		return fmt.Errorf("%s: %w", op, err)
+	}
+	defer tx.Rollback()
+
+	if _, err = tx.Exec(query, password, userID); err != nil {
+		return fmt.Errorf("%s: %w", op, err)
+	}
+	if _, err = tx.Exec(sessionsQuery, userID); err != nil {
+		return fmt.Errorf("%s: %w", op, err)
+	}
+	if err = tx.Commit(); err != nil {
+		return fmt.Errorf("%s: %w", op, err)
+	}
+	return nil
+}
+
+// CreateListing adds a listing owned by l.UserID to the owner's agency.
+func (s *service) CreateListing(l models.Listing) (uid int64, err error) {
+	const op = "sqlite.database.CreateListing"
+	const query = `
+		INSERT INTO listings (name, type, description, status, deal, price, city, address, area, rooms, floor, floors, syndicate,
+			user_id, agency_id, updated_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, (SELECT agency_id FROM users WHERE id = ?), datetime('now')) RETURNING id;
+	`
+	tx, err := s.db.Begin()
 	if err != nil {
 		return 0, fmt.Errorf("%s: %w", op, err)
 	}
-	id, err := resp.LastInsertId()
+	defer tx.Rollback()
+
+	err = tx.QueryRow(query, l.Name, l.Typel, l.Description, l.Status, l.Deal, l.Price, l.City,
+		l.Address, l.Area, l.Rooms, l.Floor, l.Floors, l.Syndicate, l.UserID, l.UserID).Scan(&uid)
 	if err != nil {
 		return 0, fmt.Errorf("%s: %w", op, err)
 	}
+	if _, err = tx.Exec(initialStatusQuery, uid, l.Status, l.UserID); err != nil {
+		return 0, fmt.Errorf("%s: %w", op, err)
+	}
+	if err = tx.Commit(); err != nil {
+		return 0, fmt.Errorf("%s: %w", op, err)
+	}
 
-	return id, nil
+	return uid, nil
 }
 
-func (s *service) GetListings(userID int64, offset int64, filter string) ([]models.ListingDB, error) {
+// GetListings returns a page of the listings userID owns or was given
+// access to.
+func (s *service) GetListings(userID int64, filter models.ListingFilter, page models.PageRequest) (models.Page[models.ListingDB], error) {
 	const op = "sqlite.database.GetListings"
-	const queryWithFilter = `
-		SELECT id, name, type, description, status, price, city, user_id, date_created
-		FROM listings where user_id = ? and city = ? limit 10 offset ?
-	`
-	const queryWithoutFilter = `
-		SELECT id, name, type, description, status, price, city, user_id, date_created
-		from listings where user_id = ? limit 10 offset ?
+	const from = `
+		FROM listings LEFT JOIN listing_shares ON listing_shares.listing_id = listings.id AND listing_shares.user_id = ?
+		WHERE listings.deleted_at IS NULL AND (listings.user_id = ? OR listing_shares.user_id IS NOT NULL)`
+	result := models.Page[models.ListingDB]{Items: []models.ListingDB{}, PageSize: page.Size}
+
+	where, args := listingFilterSQL(filter)
+	err := s.db.QueryRow(`SELECT COUNT(*)`+from+where+`;`, append([]any{userID, userID}, args...)...).Scan(&result.Total)
+	if err != nil {
+		return result, fmt.Errorf("%s: %w", op, err)
+	}
+
+	where, args, orderBy, err := listingPageSQL(filter, page.Cursor)
+	if err != nil {
+		return result, fmt.Errorf("%s: %w", op, err)
+	}
+	query := `
+		SELECT listings.id, name, type, description, status, deal, price, city, listings.user_id, listings.agency_id, date_created,
+			version, updated_at, COALESCE(listing_shares.access, ''), address, area, rooms, floor, floors, syndicate` + from + where + orderBy + `
+		LIMIT ?;
 	`
-	var rows *sql.Rows // Prepare the query based on whether a filter is provided
-	if filter != "" {
-		//filter = "%" + filter + "%"
-		stmt, err := s.db.Prepare(queryWithFilter)
-		if err != nil {
-			return nil, fmt.Errorf("%s: %w", op, err)
-		}
-		rows, err = stmt.Query(userID, filter, offset)
-		if err != nil {
-			return nil, fmt.Errorf("%s: %w", op, err)
-		}
-		defer rows.Close()
-	} else {
-		stmt, err := s.db.Prepare(queryWithoutFilter)
-		if err != nil {
-			return nil, fmt.Errorf("%s: %w", op, err)
-		}
-		rows, err = stmt.Query(userID, offset)
-		if err != nil {
-			return nil, fmt.Errorf("%s: %w", op, err)
-		}
-		defer rows.Close()
+	// одна лишняя строка показывает, есть ли следующая страница
+	rows, err := s.db.Query(query, append(append([]any{userID, userID}, args...), page.Size+1)...)
+	if err != nil {
+		return result, fmt.Errorf("%s: %w", op, err)
 	}
+	defer rows.Close()
 
-	var listings []models.ListingDB
 	for rows.Next() {
 		var l models.ListingDB
-		if err := rows.Scan(&l.ID, &l.Name, &l.Typel, &l.Description, &l.Status, &l.Price, &l.City, &l.UserID, &l.Date_created); err != nil {
-			return nil, fmt.Errorf("%s: %w", op, err)
+		if err := rows.Scan(&l.ID, &l.Name, &l.Typel, &l.Description, &l.Status, &l.Deal, &l.Price, &l.City, &l.UserID, &l.AgencyID, &l.Date_created, &l.Version, &l.UpdatedAt, &l.Share,
+			&l.Address, &l.Area, &l.Rooms, &l.Floor, &l.Floors, &l.Syndicate); err != nil {
+			return result, fmt.Errorf("%s: %w", op, err)
 		}
 
-		listings = append(listings, l)
+		result.Items = append(result.Items, l)
 	}
 
 	if err := rows.Err(); err != nil {
-		return nil, fmt.Errorf("%s: %w", op, err)
+		return result, fmt.Errorf("%s: %w", op, err)
+	}
+	if len(result.Items) > page.Size {
+		result.Items = result.Items[:page.Size]
+		result.NextCursor = nextListingCursor(filter, result.Items[page.Size-1])
 	}
 
-	return listings, nil
+	return result, nil
 }
 
 func (s *service) GetCities(userID int64) ([]string, error) {
 	const op = "sqlite.database.GetCities"
 	const query = `
-		SELECT DISTINCT city FROM listings WHERE user_id = ? ORDER BY city
+		SELECT DISTINCT city FROM listings
+		WHERE deleted_at IS NULL AND (user_id = ? OR id IN (SELECT listing_id FROM listing_shares WHERE user_id = ?))
+		ORDER BY city
 	`
 
 	stmt, err := s.db.Prepare(query)
@@ -258,7 +507,7 @@ func (s *service) GetCities(userID int64) ([]string, error) {
 		return nil, fmt.Errorf("%s: %w", op, err)
 	}
 
-	rows, err := stmt.Query(userID)
+	rows, err := stmt.Query(userID, userID)
 	if err != nil {
 		return nil, fmt.Errorf("%s: %w", op, err)
 	}
@@ -281,44 +530,185 @@ func (s *service) GetCities(userID int64) ([]string, error) {
 
 }
 
-func (s *service) UpdateListing(name, typel, description, status, city string, price int64, id int64) error {
+// UpdateListing overwrites a listing if it is still at version and returns
+// the new version. ErrVersionConflict means someone saved it in between.
+// A new price is recorded in the price history as changed by userID.
+func (s *service) UpdateListing(l models.Listing, id int64, version int64, userID int64) (int64, error) {
 	const op = "sqlite.database.UpdateListing"
 	const query = `
-		UPDATE listings SET name = ?, type = ?, description = ?, status = ?, price = ?, city = ? WHERE id = ?;
+		UPDATE listings SET name = ?, type = ?, description = ?, deal = ?, price = ?, city = ?,
+			address = ?, area = ?, rooms = ?, floor = ?, floors = ?, syndicate = ?,
+			version = version + 1, updated_at = datetime('now')
+		WHERE id = ? AND version = ?
+		RETURNING version;
 	`
-	stmt, err := s.db.Prepare(query)
+	tx, err := s.db.Begin()
 	if err != nil {
-		return fmt.Errorf("%s: %w", op, err)
+		return 0, fmt.Errorf("%s: %w", op, err)
+	}
+	defer tx.Rollback()
+
+	var oldPrice, current int64
+	err = tx.QueryRow(`SELECT price, version FROM listings WHERE id = ? AND deleted_at IS NULL;`, id).Scan(&oldPrice, &current)
+	if errors.Is(err, sql.ErrNoRows) {
+		return 0, fmt.Errorf("%s: %w", op, ErrListingNotFound)
 	}
-	_, err = stmt.Exec(name, typel, description, status, price, city, id)
 	if err != nil {
-		return fmt.Errorf("%s: %w", op, err)
+		return 0, fmt.Errorf("%s: %w", op, err)
 	}
-	return nil
+	if version != current {
+		return 0, fmt.Errorf("%s: %w", op, ErrVersionConflict)
+	}
+
+	var newVersion int64
+	err = tx.QueryRow(query, l.Name, l.Typel, l.Description, l.Deal, l.Price, l.City,
+		l.Address, l.Area, l.Rooms, l.Floor, l.Floors, l.Syndicate, id, version).Scan(&newVersion)
+	if errors.Is(err, sql.ErrNoRows) {
+		return 0, fmt.Errorf("%s: %w", op, ErrVersionConflict)
+	}
+	if err != nil {
+		return 0, fmt.Errorf("%s: %w", op, err)
+	}
+	if err = recordPriceChange(tx, id, oldPrice, l.Price, userID); err != nil {
+		return 0, fmt.Errorf("%s: %w", op, err)
+	}
+	if err = tx.Commit(); err != nil {
+		return 0, fmt.Errorf("%s: %w", op, err)
+	}
+	return newVersion, nil
 }
 
-func (s *service) DeleteListing(id int64, userID int64) error {
-	const op = "sqlite.database.DeleteListing"
-	const query = `
-	DELETE FROM listings WHERE id = ? AND (user_id = ? OR ? = (SELECT id FROM users Where role = 'admin'));
-`
+// patchableColumns are the listing columns PatchListing may set.
+var patchableColumns = []string{
+	"name", "type", "description", "deal", "price", "city",
+	"address", "area", "rooms", "floor", "floors", "syndicate",
+}
+
+// PatchListing sets only the given columns of a listing and returns its new
+// version. A zero version skips the optimistic lock check; an empty patch
+// changes nothing and returns the current version. A new price is recorded
+// in the price history as changed by userID.
+func (s *service) PatchListing(id int64, fields map[string]any, version int64, userID int64) (int64, error) {
+	const op = "sqlite.database.PatchListing"
+
+	var (
+		set  []string
+		args []any
+	)
+	for _, column := range patchableColumns {
+		if value, ok := fields[column]; ok {
+			set = append(set, column+" = ?")
+			args = append(args, value)
+		}
+	}
+	if len(set) != len(fields) {
+		return 0, fmt.Errorf("%s: unknown column in patch", op)
+	}
+
+	tx, err := s.db.Begin()
+	if err != nil {
+		return 0, fmt.Errorf("%s: %w", op, err)
+	}
+	defer tx.Rollback()
+
+	var oldPrice, current int64
+	err = tx.QueryRow(`SELECT price, version FROM listings WHERE id = ? AND deleted_at IS NULL;`, id).Scan(&oldPrice, &current)
+	if errors.Is(err, sql.ErrNoRows) {
+		return 0, fmt.Errorf("%s: %w", op, ErrListingNotFound)
+	}
+	if err != nil {
+		return 0, fmt.Errorf("%s: %w", op, err)
+	}
+	if version == 0 {
+		version = current
+	}
+	if version != current {
+		return 0, fmt.Errorf("%s: %w", op, ErrVersionConflict)
+	}
+	if len(set) == 0 {
+		return current, nil
+	}
 
+	query := `UPDATE listings SET ` + strings.Join(set, ", ") + `, version = version + 1, updated_at = datetime('now')
+		WHERE id = ? AND version = ?
+		RETURNING version;`
+	args = append(args, id, version)
+	var newVersion int64
+	err = tx.QueryRow(query, args...).Scan(&newVersion)
+	if errors.Is(err, sql.ErrNoRows) {
+		// listing changed or was deleted between the two statements
+		return 0, fmt.Errorf("%s: %w", op, ErrVersionConflict)
+	}
+	if err != nil {
+		return 0, fmt.Errorf("%s: %w", op, err)
+	}
+	if price, ok := fields["price"].(int64); ok {
+		if err = recordPriceChange(tx, id, oldPrice, price, userID); err != nil {
+			return 0, fmt.Errorf("%s: %w", op, err)
+		}
+	}
+	if err = tx.Commit(); err != nil {
+		return 0, fmt.Errorf("%s: %w", op, err)
+	}
+	return newVersion, nil
+}
+
+// GetListing returns a single listing with the share userID holds on it.
+func (s *service) GetListing(id int64, userID int64) (models.ListingDB, error) {
+	const op = "sqlite.database.GetListing"
+	const query = `
+		SELECT listings.id, listings.name, type, description, listings.status, deal, price, city, listings.user_id, COALESCE(users.name, ''),
+			listings.agency_id, date_created, version, updated_at, COALESCE(listing_shares.access, ''),
+			address, area, rooms, floor, floors, syndicate
+		FROM listings
+			LEFT JOIN users ON users.id = listings.user_id
+			LEFT JOIN listing_shares ON listing_shares.listing_id = listings.id AND listing_shares.user_id = ?
+		WHERE listings.id = ? AND listings.deleted_at IS NULL;
+	`
 	stmt, err := s.db.Prepare(query)
 	if err != nil {
-		return fmt.Errorf("%s: %w", op, err)
+		return models.ListingDB{}, fmt.Errorf("%s: %w", op, err)
+	}
+
+	var l models.ListingDB
+	err = stmt.QueryRow(userID, id).Scan(&l.ID, &l.Name, &l.Typel, &l.Description, &l.Status, &l.Deal, &l.Price, &l.City, &l.UserID, &l.Agent,
+		&l.AgencyID, &l.Date_created, &l.Version, &l.UpdatedAt, &l.Share, &l.Address, &l.Area, &l.Rooms, &l.Floor, &l.Floors, &l.Syndicate)
+	if errors.Is(err, sql.ErrNoRows) {
+		return models.ListingDB{}, fmt.Errorf("%s: %w", op, ErrListingNotFound)
 	}
-	_, err = stmt.Exec(id, userID, userID, userID)
+	if err != nil {
+		return models.ListingDB{}, fmt.Errorf("%s: %w", op, err)
+	}
+	return l, nil
+}
+
+// DeleteListing moves a listing to the trash. Its shares, history and files
+// stay until the listing is restored or purged. Callers check access with
+// the listing policy first.
+func (s *service) DeleteListing(id int64) error {
+	const op = "sqlite.database.DeleteListing"
+	const query = `
+		UPDATE listings SET deleted_at = datetime('now') WHERE id = ? AND deleted_at IS NULL;
+	`
+	resp, err := s.db.Exec(query, id)
 	if err != nil {
 		return fmt.Errorf("%s: %w", op, err)
 	}
+	if n, _ := resp.RowsAffected(); n == 0 {
+		return fmt.Errorf("%s: %w", op, ErrListingNotFound)
+	}
 	return nil
 }
 
 func (s *service) GetAnalytics(userID int64) (map[string]any, error) {
-	const op = "sqlite.database.AnalyticsHandler"
-	const query = `
-		SELECT COUNT(*), AVG(price)
-		FROM listings where user_id = ?;
+	return s.analytics("sqlite.database.AnalyticsHandler", "user_id = ?", userID)
+}
+
+// analytics computes listing statistics over the listings matching where.
+func (s *service) analytics(op, where string, args ...any) (map[string]any, error) {
+	query := `
+		SELECT COUNT(*), COALESCE(AVG(price), 0)
+		FROM listings WHERE deleted_at IS NULL AND (` + where + `);
 	`
 
 	stmt, err := s.db.Prepare(query)
@@ -328,15 +718,15 @@ func (s *service) GetAnalytics(userID int64) (map[string]any, error) {
 
 	var count int64
 	var avgPrice float64
-	err = stmt.QueryRow(userID).Scan(&count, &avgPrice)
+	err = stmt.QueryRow(args...).Scan(&count, &avgPrice)
 	if err != nil {
 		return nil, fmt.Errorf("%s: %w", op, err)
 	}
 
-	const query2 = `
+	query2 := `
 		SELECT city, COUNT(*) as count
 		FROM listings
-		WHERE user_id = ?
+		WHERE deleted_at IS NULL AND (` + where + `)
 		GROUP BY city
 		ORDER BY count DESC
 		LIMIT 3
@@ -350,7 +740,7 @@ func (s *service) GetAnalytics(userID int64) (map[string]any, error) {
 		City  string `json:"city"`
 		Count int    `json:"count"`
 	}
-	rows, err := stmt.Query(userID)
+	rows, err := stmt.Query(args...)
 	if err != nil {
 		return nil, fmt.Errorf("%s: %w", op, err)
 	}
@@ -364,104 +754,247 @@ func (s *service) GetAnalytics(userID int64) (map[string]any, error) {
 		}
 	}
 
+	// a listing counts as reduced when it is now cheaper than its first
+	// recorded price
+	query3 := `
+		SELECT COUNT(*), COALESCE(AVG((first_price.old_price - listings.price) * 100.0 / first_price.old_price), 0)
+		FROM listings JOIN (
+			SELECT listing_id, old_price FROM listing_price_history
+			WHERE id IN (SELECT MIN(id) FROM listing_price_history GROUP BY listing_id)
+		) AS first_price ON first_price.listing_id = listings.id
+		WHERE listings.deleted_at IS NULL AND (` + where + `) AND listings.price < first_price.old_price;
+	`
+	var reduced int64
+	var avgReduction float64
+	if err := s.db.QueryRow(query3, args...).Scan(&reduced, &avgReduction); err != nil {
+		return nil, fmt.Errorf("%s: %w", op, err)
+	}
+
 	return map[string]any{
-		"total_listings": count,
-		"avg_price":      avgPrice,
-		"top_cities":     topCities,
+		"total_listings":        count,
+		"avg_price":             avgPrice,
+		"top_cities":            topCities,
+		"reduced_listings":      reduced,
+		"avg_reduction_percent": avgReduction,
 	}, nil
 }
 
-func (s *service) GetAllUsers() (users []models.UserAdmin, err error) {
+// GetAllUsers returns a page of the users of an agency, newest first, of all
+// agencies if agencyID is 0.
+func (s *service) GetAllUsers(agencyID int64, page models.PageRequest) (models.Page[models.UserAdmin], error) {
 	const op = "sqlite.database.GetAllUsers"
-	const query = `
-		SELECT users.id, users.username, users.name, users.role, COUNT(listings.id) AS total FROM users LEFT JOIN listings ON users.id = listings.user_id GROUP BY users.id
-		ORDER BY total DESC;
-	`
-	stmt, err := s.db.Prepare(query)
+	result := models.Page[models.UserAdmin]{Items: []models.UserAdmin{}, PageSize: page.Size}
+
+	err := s.db.QueryRow(`SELECT COUNT(*) FROM users WHERE ? = 0 OR agency_id = ?;`, agencyID, agencyID).Scan(&result.Total)
 	if err != nil {
-		return nil, fmt.Errorf("%s: %w", op, err)
+		return result, fmt.Errorf("%s: %w", op, err)
 	}
 
-	rows, err := stmt.Query()
+	where, args := "", []any{agencyID, agencyID}
+	c, ok, err := decodeCursor(page.Cursor, "created_at", true)
 	if err != nil {
-		return nil, fmt.Errorf("%s: %w", op, err)
+		return result, fmt.Errorf("%s: %w", op, err)
+	}
+	if ok {
+		keyset, keysetArgs := keysetSQL("users.created_at", "users.id", true, c)
+		where, args = keyset, append(args, keysetArgs...)
+	}
+	query := `
+		SELECT users.id, users.username, users.name, users.role, users.status, users.agency_id, agencies.name, users.created_at,
+			(SELECT COUNT(*) FROM listings WHERE listings.user_id = users.id AND listings.deleted_at IS NULL) AS total
+		FROM users JOIN agencies ON agencies.id = users.agency_id
+		WHERE (? = 0 OR users.agency_id = ?)` + where + `
+		ORDER BY users.created_at DESC, users.id DESC
+		LIMIT ?;
+	`
+	rows, err := s.db.Query(query, append(args, page.Size+1)...)
+	if err != nil {
+		return result, fmt.Errorf("%s: %w", op, err)
 	}
 	defer rows.Close()
 
 	for rows.Next() {
 		var u models.UserAdmin
-		if err := rows.Scan(&u.ID, &u.Login, &u.Name, &u.Role, &u.Total); err != nil {
-			return nil, fmt.Errorf("%s: %w", op, err)
+		if err := rows.Scan(&u.ID, &u.Login, &u.Name, &u.Role, &u.Status, &u.AgencyID, &u.Agency, &u.CreatedAt, &u.Total); err != nil {
+			return result, fmt.Errorf("%s: %w", op, err)
 		}
-		users = append(users, u)
+		result.Items = append(result.Items, u)
 	}
 
 	if err := rows.Err(); err != nil {
-		return nil, fmt.Errorf("%s: %w", op, err)
+		return result, fmt.Errorf("%s: %w", op, err)
+	}
+	if len(result.Items) > page.Size {
+		result.Items = result.Items[:page.Size]
+		last := result.Items[page.Size-1]
+		result.NextCursor = cursor{Sort: "created_at", Desc: true, Value: last.CreatedAt.UTC().Format(dateCreatedLayout), ID: last.ID}.encode()
 	}
 
-	return users, nil
+	return result, nil
 }
 
-func (s *service) GetAllListings() (listings []models.ListingDB, err error) {
+// GetAllListings returns a page of the listings of an agency matching
+// filter, of all agencies if agencyID is 0.
+func (s *service) GetAllListings(agencyID int64, filter models.ListingFilter, page models.PageRequest) (models.Page[models.ListingDB], error) {
 	const op = "sqlite.database.GetAllListings"
-	const query = `
-		SELECT listings.id, listings.name, listings.type, listings.description, listings.status, listings.price, listings.city, users.name, listings.date_created FROM listings JOIN users ON listings.user_id = users.id ORDER BY listings.date_created DESC;
-	`
-	stmt, err := s.db.Prepare(query)
+	const from = `
+		FROM listings JOIN users ON listings.user_id = users.id
+		WHERE listings.deleted_at IS NULL AND (? = 0 OR listings.agency_id = ?)`
+	result := models.Page[models.ListingDB]{Items: []models.ListingDB{}, PageSize: page.Size}
+
+	where, args := listingFilterSQL(filter)
+	err := s.db.QueryRow(`SELECT COUNT(*)`+from+where+`;`, append([]any{agencyID, agencyID}, args...)...).Scan(&result.Total)
 	if err != nil {
-		return nil, fmt.Errorf("%s: %w", op, err)
+		return result, fmt.Errorf("%s: %w", op, err)
 	}
 
-	rows, err := stmt.Query()
+	where, args, orderBy, err := listingPageSQL(filter, page.Cursor)
 	if err != nil {
-		return nil, fmt.Errorf("%s: %w", op, err)
+		return result, fmt.Errorf("%s: %w", op, err)
+	}
+	query := `
+		SELECT listings.id, listings.name, listings.type, listings.description, listings.status, listings.deal, listings.price, listings.city, listings.user_id, users.name, listings.agency_id, listings.date_created,
+			listings.version, listings.updated_at, listings.address, listings.area, listings.rooms, listings.floor, listings.floors,
+			listings.syndicate` + from + where + orderBy + `
+		LIMIT ?;
+	`
+	rows, err := s.db.Query(query, append(append([]any{agencyID, agencyID}, args...), page.Size+1)...)
+	if err != nil {
+		return result, fmt.Errorf("%s: %w", op, err)
 	}
 	defer rows.Close()
 
 	for rows.Next() {
 		var l models.ListingDB
-		if err := rows.Scan(&l.ID, &l.Name, &l.Typel, &l.Description, &l.Status, &l.Price, &l.City, &l.Agent, &l.Date_created); err != nil {
-			return nil, fmt.Errorf("%s: %w", op, err)
+		if err := rows.Scan(&l.ID, &l.Name, &l.Typel, &l.Description, &l.Status, &l.Deal, &l.Price, &l.City, &l.UserID, &l.Agent, &l.AgencyID, &l.Date_created, &l.Version, &l.UpdatedAt,
+			&l.Address, &l.Area, &l.Rooms, &l.Floor, &l.Floors, &l.Syndicate); err != nil {
+			return result, fmt.Errorf("%s: %w", op, err)
 		}
-		listings = append(listings, l)
+		result.Items = append(result.Items, l)
 	}
 
 	if err := rows.Err(); err != nil {
-		return nil, fmt.Errorf("%s: %w", op, err)
+		return result, fmt.Errorf("%s: %w", op, err)
+	}
+	if len(result.Items) > page.Size {
+		result.Items = result.Items[:page.Size]
+		result.NextCursor = nextListingCursor(filter, result.Items[page.Size-1])
 	}
 
-	return listings, nil
+	return result, nil
 }
 
+// SetUserRole changes the role of a user and invalidates their tokens. The
+// role must exist in the roles table.
 func (s *service) SetUserRole(userID int64, role string) error {
 	const op = "sqlite.database.SetUserRole"
 	const query = `
-		UPDATE users SET role = ? WHERE id = ?;
+		UPDATE users SET role = ?, token_version = token_version + 1 WHERE id = ?;
 	`
-	stmt, err := s.db.Prepare(query)
+	tx, err := s.db.Begin()
 	if err != nil {
 		return fmt.Errorf("%s: %w", op, err)
 	}
-	_, err = stmt.Exec(role, userID)
+	defer tx.Rollback()
+
+	if err = roleExists(tx, role); err != nil {
+		return fmt.Errorf("%s: %w", op, err)
+	}
+	resp, err := tx.Exec(query, role, userID)
 	if err != nil {
 		return fmt.Errorf("%s: %w", op, err)
 	}
+	if n, _ := resp.RowsAffected(); n == 0 {
+		return fmt.Errorf("%s: %w", op, ErrUserNotFound)
+	}
+	if err = tx.Commit(); err != nil {
+		return fmt.Errorf("%s: %w", op, err)
+	}
 	return nil
 }
 
+// DeleteUser removes a user with their sessions, access tokens, recovery
+// and reset codes, feed and the shares they were given. Their listings lose
+// the owner and go to the trash, where an administrator of the agency can
+// restore them.
 func (s *service) DeleteUser(userID int64) error {
 	const op = "sqlite.database.DeleteUser"
 	const query = `
 		DELETE FROM users WHERE id = ?;
 	`
+	const sessionsQuery = `
+		DELETE FROM sessions WHERE user_id = ?;
+	`
+	const identitiesQuery = `
+		DELETE FROM user_identities WHERE user_id = ?;
+	`
+	const sharesQuery = `
+		DELETE FROM listing_shares WHERE user_id = ?;
+	`
+	const listingsQuery = `
+		UPDATE listings SET user_id = NULL, deleted_at = COALESCE(deleted_at, datetime('now')) WHERE user_id = ?;
+	`
+	const feedQuery = `
+		DELETE FROM feed_tokens WHERE user_id = ?;
+	`
+	// внешние ключи в SQLite выключены, ON DELETE CASCADE не срабатывает
+	credentials := []string{
+		`DELETE FROM access_tokens WHERE user_id = ?;`,
+		`DELETE FROM recovery_codes WHERE user_id = ?;`,
+		`DELETE FROM password_resets WHERE user_id = ?;`,
+		`DELETE FROM email_changes WHERE user_id = ?;`,
+	}
+	tx, err := s.db.Begin()
+	if err != nil {
+		return fmt.Errorf("%s: %w", op, err)
+	}
+	defer tx.Rollback()
+
+	if _, err = tx.Exec(sessionsQuery, userID); err != nil {
+		return fmt.Errorf("%s: %w", op, err)
+	}
+	if _, err = tx.Exec(identitiesQuery, userID); err != nil {
+		return fmt.Errorf("%s: %w", op, err)
+	}
+	if _, err = tx.Exec(sharesQuery, userID); err != nil {
+		return fmt.Errorf("%s: %w", op, err)
+	}
+	if _, err = tx.Exec(listingsQuery, userID); err != nil {
+		return fmt.Errorf("%s: %w", op, err)
+	}
+	if _, err = tx.Exec(feedQuery, userID); err != nil {
+		return fmt.Errorf("%s: %w", op, err)
+	}
+	for _, q := range credentials {
+		if _, err = tx.Exec(q, userID); err != nil {
+			return fmt.Errorf("%s: %w", op, err)
+		}
+	}
+	if _, err = tx.Exec(query, userID); err != nil {
+		return fmt.Errorf("%s: %w", op, err)
+	}
+	if err = tx.Commit(); err != nil {
+		return fmt.Errorf("%s: %w", op, err)
+	}
+	return nil
+}
+
+// ApproveUser activates an account that is waiting for approval.
+func (s *service) ApproveUser(userID int64) error {
+	const op = "sqlite.database.ApproveUser"
+	const query = `
+		UPDATE users SET status = 'active' WHERE id = ? AND status = 'pending';
+	`
 	stmt, err := s.db.Prepare(query)
 	if err != nil {
 		return fmt.Errorf("%s: %w", op, err)
 	}
-	_, err = stmt.Exec(userID)
+	resp, err := stmt.Exec(userID)
 	if err != nil {
 		return fmt.Errorf("%s: %w", op, err)
 	}
+	if n, _ := resp.RowsAffected(); n == 0 {
+		return fmt.Errorf("%s: %w", op, ErrUserNotFound)
+	}
 	return nil
 }
@@ -0,0 +1,85 @@
+package database
+
+import (
+	"fmt"
+	"practic/internal/models"
+)
+
+// ExportListings calls each for every listing userID owns or was given
+// access to that matches filter, in the order of the list. Rows are read in
+// batches of exportBatch; an error from each stops the export and is
+// returned.
+func (s *service) ExportListings(userID int64, filter models.ListingFilter, each func(models.ListingDB) error) error {
+	const from = `
+		FROM listings
+			LEFT JOIN users ON users.id = listings.user_id
+			LEFT JOIN listing_shares ON listing_shares.listing_id = listings.id AND listing_shares.user_id = ?
+		WHERE listings.deleted_at IS NULL AND (listings.user_id = ? OR listing_shares.user_id IS NOT NULL)`
+	return s.exportListings("sqlite.database.ExportListings", from, []any{userID, userID}, filter, each)
+}
+
+// ExportAllListings is ExportListings over all listings of an agency, of all
+// agencies if agencyID is 0.
+func (s *service) ExportAllListings(agencyID int64, filter models.ListingFilter, each func(models.ListingDB) error) error {
+	const from = `
+		FROM listings LEFT JOIN users ON users.id = listings.user_id
+		WHERE listings.deleted_at IS NULL AND (? = 0 OR listings.agency_id = ?)`
+	return s.exportListings("sqlite.database.ExportAllListings", from, []any{agencyID, agencyID}, filter, each)
+}
+
+// exportBatch is how many rows an export reads at a time. Rows are read
+// into memory and the cursor is closed before they are handed to each: an
+// open read cursor locks the database for writers for as long as a slow
+// client takes to download.
+const exportBatch = 500
+
+func (s *service) exportListings(op, from string, args []any, filter models.ListingFilter, each func(models.ListingDB) error) error {
+	after := ""
+	for {
+		batch, err := s.exportBatch(from, args, filter, after)
+		if err != nil {
+			return fmt.Errorf("%s: %w", op, err)
+		}
+		for _, l := range batch {
+			if err := each(l); err != nil {
+				return fmt.Errorf("%s: %w", op, err)
+			}
+		}
+		if len(batch) < exportBatch {
+			return nil
+		}
+		after = nextListingCursor(filter, batch[len(batch)-1])
+	}
+}
+
+// exportBatch reads up to exportBatch listings following the cursor after.
+func (s *service) exportBatch(from string, args []any, filter models.ListingFilter, after string) ([]models.ListingDB, error) {
+	where, filterArgs, orderBy, err := listingPageSQL(filter, after)
+	if err != nil {
+		return nil, err
+	}
+	query := `
+		SELECT listings.id, listings.name, listings.type, listings.description, listings.status, listings.deal, listings.price, listings.city,
+			listings.user_id, COALESCE(users.name, ''), listings.agency_id, listings.date_created, listings.version, listings.updated_at,
+			listings.address, listings.area, listings.rooms, listings.floor, listings.floors, listings.syndicate` + from + where + orderBy + `
+		LIMIT ?;
+	`
+	queryArgs := append(append(append([]any{}, args...), filterArgs...), exportBatch)
+	rows, err := s.db.Query(query, queryArgs...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	batch := make([]models.ListingDB, 0, exportBatch)
+	for rows.Next() {
+		var l models.ListingDB
+		if err := rows.Scan(&l.ID, &l.Name, &l.Typel, &l.Description, &l.Status, &l.Deal, &l.Price, &l.City,
+			&l.UserID, &l.Agent, &l.AgencyID, &l.Date_created, &l.Version, &l.UpdatedAt,
+			&l.Address, &l.Area, &l.Rooms, &l.Floor, &l.Floors, &l.Syndicate); err != nil {
+			return nil, err
+		}
+		batch = append(batch, l)
+	}
+	return batch, rows.Err()
+}
@@ -0,0 +1,250 @@
+package database
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"practic/internal/models"
+	"strings"
+)
+
+var ErrFeedTokenNotFound = errors.New("feed token not found")
+
+// feedOwnerSQL limits listings to a feed owner; its arguments come from
+// feedOwnerArgs.
+const feedOwnerSQL = `(? = 0 OR listings.user_id = ?) AND (? = 0 OR listings.agency_id = ?)`
+
+func feedOwnerArgs(owner models.FeedOwner) []any {
+	return []any{owner.UserID, owner.UserID, owner.AgencyID, owner.AgencyID}
+}
+
+// nullableID stores a zero owner ID as NULL, as the feed_tokens check
+// constraint expects.
+func nullableID(id int64) any {
+	if id == 0 {
+		return nil
+	}
+	return id
+}
+
+// SetFeedToken replaces the feed token of owner, so the old feed URL stops
+// working.
+func (s *service) SetFeedToken(owner models.FeedOwner, tokenHash string, createdBy int64) error {
+	const op = "sqlite.database.SetFeedToken"
+
+	tx, err := s.db.Begin()
+	if err != nil {
+		return fmt.Errorf("%s: %w", op, err)
+	}
+	defer tx.Rollback()
+
+	_, err = tx.Exec(`DELETE FROM feed_tokens WHERE user_id = ? OR agency_id = ?;`, nullableID(owner.UserID), nullableID(owner.AgencyID))
+	if err != nil {
+		return fmt.Errorf("%s: %w", op, err)
+	}
+	_, err = tx.Exec(`INSERT INTO feed_tokens (token_hash, user_id, agency_id, created_by) VALUES (?, ?, ?, ?);`,
+		tokenHash, nullableID(owner.UserID), nullableID(owner.AgencyID), createdBy)
+	if err != nil {
+		return fmt.Errorf("%s: %w", op, err)
+	}
+
+	if err = tx.Commit(); err != nil {
+		return fmt.Errorf("%s: %w", op, err)
+	}
+	return nil
+}
+
+// DeleteFeedToken turns the feed of owner off.
+func (s *service) DeleteFeedToken(owner models.FeedOwner) error {
+	const op = "sqlite.database.DeleteFeedToken"
+	const query = `
+		DELETE FROM feed_tokens WHERE user_id = ? OR agency_id = ?;
+	`
+
+	resp, err := s.db.Exec(query, nullableID(owner.UserID), nullableID(owner.AgencyID))
+	if err != nil {
+		return fmt.Errorf("%s: %w", op, err)
+	}
+	n, err := resp.RowsAffected()
+	if err != nil {
+		return fmt.Errorf("%s: %w", op, err)
+	}
+	if n == 0 {
+		return fmt.Errorf("%s: %w", op, ErrFeedTokenNotFound)
+	}
+	return nil
+}
+
+// GetFeedToken returns the feed token of owner.
+func (s *service) GetFeedToken(owner models.FeedOwner) (models.FeedToken, error) {
+	const op = "sqlite.database.GetFeedToken"
+	const query = `
+		SELECT created_at, last_used_at FROM feed_tokens WHERE user_id = ? OR agency_id = ?;
+	`
+
+	var token models.FeedToken
+	err := s.db.QueryRow(query, nullableID(owner.UserID), nullableID(owner.AgencyID)).Scan(&token.CreatedAt, &token.LastUsedAt)
+	if errors.Is(err, sql.ErrNoRows) {
+		return models.FeedToken{}, fmt.Errorf("%s: %w", op, ErrFeedTokenNotFound)
+	}
+	if err != nil {
+		return models.FeedToken{}, fmt.Errorf("%s: %w", op, err)
+	}
+	return token, nil
+}
+
+// FeedOwnerByToken resolves a feed token and marks it as used.
+func (s *service) FeedOwnerByToken(tokenHash string) (models.FeedOwner, error) {
+	const op = "sqlite.database.FeedOwnerByToken"
+	const query = `
+		UPDATE feed_tokens SET last_used_at = datetime('now')
+		WHERE token_hash = ?
+		RETURNING COALESCE(user_id, 0), COALESCE(agency_id, 0);
+	`
+
+	var owner models.FeedOwner
+	err := s.db.QueryRow(query, tokenHash).Scan(&owner.UserID, &owner.AgencyID)
+	if errors.Is(err, sql.ErrNoRows) {
+		return models.FeedOwner{}, fmt.Errorf("%s: %w", op, ErrFeedTokenNotFound)
+	}
+	if err != nil {
+		return models.FeedOwner{}, fmt.Errorf("%s: %w", op, err)
+	}
+	return owner, nil
+}
+
+// GetFeedListings returns the listings of owner its agents opted into the
+// feeds, whatever their status, with their photos, cover first.
+func (s *service) GetFeedListings(owner models.FeedOwner) ([]models.FeedListing, error) {
+	const op = "sqlite.database.GetFeedListings"
+	const from = `
+		FROM listings
+			LEFT JOIN users ON users.id = listings.user_id
+			LEFT JOIN agencies ON agencies.id = listings.agency_id
+		WHERE listings.syndicate = 1 AND listings.deleted_at IS NULL AND ` + feedOwnerSQL
+	const query = `
+		SELECT listings.id, listings.name, listings.type, listings.description, listings.status, listings.deal, listings.price,
+			listings.city, listings.user_id, COALESCE(users.name, ''), listings.agency_id, listings.date_created, listings.version,
+			listings.updated_at, listings.address, listings.area, listings.rooms, listings.floor, listings.floors, listings.syndicate,
+			COALESCE(users.phone, ''), COALESCE(users.email, ''), COALESCE(agencies.name, '')` + from + `
+		ORDER BY listings.id;
+	`
+	const photosQuery = `
+		SELECT listing_files.listing_id, listing_files.id FROM listing_files
+		WHERE listing_files.kind = 'photo' AND listing_files.listing_id IN (SELECT listings.id` + from + `)
+		ORDER BY listing_files.listing_id, listing_files.cover DESC, listing_files.position;
+	`
+
+	rows, err := s.db.Query(query, feedOwnerArgs(owner)...)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", op, err)
+	}
+	defer rows.Close()
+
+	listings := []models.FeedListing{}
+	index := map[int64]int{}
+	for rows.Next() {
+		var l models.FeedListing
+		if err := rows.Scan(&l.ID, &l.Name, &l.Typel, &l.Description, &l.Status, &l.Deal, &l.Price, &l.City, &l.UserID, &l.Agent,
+			&l.AgencyID, &l.Date_created, &l.Version, &l.UpdatedAt, &l.Address, &l.Area, &l.Rooms, &l.Floor, &l.Floors, &l.Syndicate,
+			&l.AgentPhone, &l.AgentEmail, &l.Agency); err != nil {
+			return nil, fmt.Errorf("%s: %w", op, err)
+		}
+		index[l.ID] = len(listings)
+		listings = append(listings, l)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("%s: %w", op, err)
+	}
+
+	photos, err := s.db.Query(photosQuery, feedOwnerArgs(owner)...)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", op, err)
+	}
+	defer photos.Close()
+
+	for photos.Next() {
+		var listingID, fileID int64
+		if err := photos.Scan(&listingID, &fileID); err != nil {
+			return nil, fmt.Errorf("%s: %w", op, err)
+		}
+		// объявление могло появиться между запросами
+		if i, ok := index[listingID]; ok {
+			listings[i].Photos = append(listings[i].Photos, fileID)
+		}
+	}
+	if err := photos.Err(); err != nil {
+		return nil, fmt.Errorf("%s: %w", op, err)
+	}
+	return listings, nil
+}
+
+// GetFeedPhoto returns a photo the feed of owner publishes: one of a
+// syndicated listing with one of the given statuses.
+func (s *service) GetFeedPhoto(owner models.FeedOwner, fileID int64, statuses []string) (models.ListingFile, error) {
+	const op = "sqlite.database.GetFeedPhoto"
+	if len(statuses) == 0 {
+		return models.ListingFile{}, fmt.Errorf("%s: %w", op, ErrFileNotFound)
+	}
+	query := `
+		SELECT ` + prefixColumns("listing_files", fileColumns) + `
+		FROM listing_files JOIN listings ON listings.id = listing_files.listing_id
+		WHERE listing_files.id = ? AND listing_files.kind = 'photo'
+			AND listings.syndicate = 1 AND listings.deleted_at IS NULL
+			AND listings.status IN (?` + strings.Repeat(", ?", len(statuses)-1) + `) AND ` + feedOwnerSQL + `;
+	`
+
+	args := []any{fileID}
+	for _, status := range statuses {
+		args = append(args, status)
+	}
+	f, err := scanFile(s.db.QueryRow(query, append(args, feedOwnerArgs(owner)...)...))
+	if errors.Is(err, sql.ErrNoRows) {
+		return models.ListingFile{}, fmt.Errorf("%s: %w", op, ErrFileNotFound)
+	}
+	if err != nil {
+		return models.ListingFile{}, fmt.Errorf("%s: %w", op, err)
+	}
+	return f, nil
+}
+
+// prefixColumns qualifies a comma-separated column list with a table name.
+func prefixColumns(table, columns string) string {
+	names := strings.Split(columns, ", ")
+	for i, name := range names {
+		names[i] = table + "." + name
+	}
+	return strings.Join(names, ", ")
+}
+
+// UserPhone returns the phone the feeds give for an agent.
+func (s *service) UserPhone(userID int64) (string, error) {
+	const op = "sqlite.database.UserPhone"
+
+	var phone string
+	err := s.db.QueryRow(`SELECT phone FROM users WHERE id = ?;`, userID).Scan(&phone)
+	if errors.Is(err, sql.ErrNoRows) {
+		return "", fmt.Errorf("%s: %w", op, ErrUserNotFound)
+	}
+	if err != nil {
+		return "", fmt.Errorf("%s: %w", op, err)
+	}
+	return phone, nil
+}
+
+func (s *service) SetUserPhone(userID int64, phone string) error {
+	const op = "sqlite.database.SetUserPhone"
+
+	resp, err := s.db.Exec(`UPDATE users SET phone = ? WHERE id = ?;`, phone, userID)
+	if err != nil {
+		return fmt.Errorf("%s: %w", op, err)
+	}
+	n, err := resp.RowsAffected()
+	if err != nil {
+		return fmt.Errorf("%s: %w", op, err)
+	}
+	if n == 0 {
+		return fmt.Errorf("%s: %w", op, ErrUserNotFound)
+	}
+	return nil
+}
@@ -0,0 +1,213 @@
+package database
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"practic/internal/models"
+)
+
+var (
+	ErrFileNotFound = errors.New("file not found")
+	ErrFileOrder    = errors.New("order must list every file of the kind exactly once")
+)
+
+const fileColumns = `id, listing_id, kind, name, content_type, size, width, height, blob_key, thumb_key, position, cover, created_by, created_at`
+
+func scanFile(row interface{ Scan(...any) error }) (models.ListingFile, error) {
+	var f models.ListingFile
+	err := row.Scan(&f.ID, &f.ListingID, &f.Kind, &f.Name, &f.ContentType, &f.Size, &f.Width, &f.Height,
+		&f.BlobKey, &f.ThumbKey, &f.Position, &f.Cover, &f.CreatedBy, &f.CreatedAt)
+	return f, err
+}
+
+// AddListingFile appends a file to the end of its kind. The first photo of a
+// listing becomes its cover.
+func (s *service) AddListingFile(f models.ListingFile) (int64, error) {
+	const op = "sqlite.database.AddListingFile"
+	const query = `
+		INSERT INTO listing_files (listing_id, kind, name, content_type, size, width, height, blob_key, thumb_key, position, cover, created_by)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?,
+			(SELECT COALESCE(MAX(position), 0) + 1 FROM listing_files WHERE listing_id = ? AND kind = ?),
+			? = 'photo' AND NOT EXISTS (SELECT 1 FROM listing_files WHERE listing_id = ? AND cover = 1),
+			?)
+		RETURNING id;
+	`
+	stmt, err := s.db.Prepare(query)
+	if err != nil {
+		return 0, fmt.Errorf("%s: %w", op, err)
+	}
+
+	var id int64
+	err = stmt.QueryRow(f.ListingID, f.Kind, f.Name, f.ContentType, f.Size, f.Width, f.Height, f.BlobKey, f.ThumbKey,
+		f.ListingID, f.Kind, f.Kind, f.ListingID, f.CreatedBy).Scan(&id)
+	if err != nil {
+		return 0, fmt.Errorf("%s: %w", op, err)
+	}
+	return id, nil
+}
+
+// GetListingFiles lists the photos of a listing in order, then its documents.
+func (s *service) GetListingFiles(listingID int64) ([]models.ListingFile, error) {
+	const op = "sqlite.database.GetListingFiles"
+	const query = `
+		SELECT ` + fileColumns + ` FROM listing_files
+		WHERE listing_id = ?
+		ORDER BY kind DESC, position;
+	`
+	stmt, err := s.db.Prepare(query)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", op, err)
+	}
+
+	rows, err := stmt.Query(listingID)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", op, err)
+	}
+	defer rows.Close()
+
+	files := []models.ListingFile{}
+	for rows.Next() {
+		f, err := scanFile(rows)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", op, err)
+		}
+		files = append(files, f)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("%s: %w", op, err)
+	}
+
+	return files, nil
+}
+
+func (s *service) GetListingFile(listingID, fileID int64) (models.ListingFile, error) {
+	const op = "sqlite.database.GetListingFile"
+	const query = `
+		SELECT ` + fileColumns + ` FROM listing_files WHERE id = ? AND listing_id = ?;
+	`
+	stmt, err := s.db.Prepare(query)
+	if err != nil {
+		return models.ListingFile{}, fmt.Errorf("%s: %w", op, err)
+	}
+
+	f, err := scanFile(stmt.QueryRow(fileID, listingID))
+	if errors.Is(err, sql.ErrNoRows) {
+		return models.ListingFile{}, fmt.Errorf("%s: %w", op, ErrFileNotFound)
+	}
+	if err != nil {
+		return models.ListingFile{}, fmt.Errorf("%s: %w", op, err)
+	}
+	return f, nil
+}
+
+// DeleteListingFile removes a file and returns it so its blobs can be
+// deleted. If it was the cover, the next photo takes its place.
+func (s *service) DeleteListingFile(listingID, fileID int64) (models.ListingFile, error) {
+	const op = "sqlite.database.DeleteListingFile"
+	const query = `
+		DELETE FROM listing_files WHERE id = ? AND listing_id = ?
+		RETURNING ` + fileColumns + `;
+	`
+	const coverQuery = `
+		UPDATE listing_files SET cover = 1
+		WHERE id = (SELECT id FROM listing_files WHERE listing_id = ? AND kind = 'photo' ORDER BY position LIMIT 1);
+	`
+	tx, err := s.db.Begin()
+	if err != nil {
+		return models.ListingFile{}, fmt.Errorf("%s: %w", op, err)
+	}
+	defer tx.Rollback()
+
+	f, err := scanFile(tx.QueryRow(query, fileID, listingID))
+	if errors.Is(err, sql.ErrNoRows) {
+		return models.ListingFile{}, fmt.Errorf("%s: %w", op, ErrFileNotFound)
+	}
+	if err != nil {
+		return models.ListingFile{}, fmt.Errorf("%s: %w", op, err)
+	}
+	if f.Cover {
+		if _, err = tx.Exec(coverQuery, listingID); err != nil {
+			return models.ListingFile{}, fmt.Errorf("%s: %w", op, err)
+		}
+	}
+	if err = tx.Commit(); err != nil {
+		return models.ListingFile{}, fmt.Errorf("%s: %w", op, err)
+	}
+	return f, nil
+}
+
+// ReorderListingFiles sets the order of the files of one kind; ids must
+// list all of them.
+func (s *service) ReorderListingFiles(listingID int64, kind string, ids []int64) error {
+	const op = "sqlite.database.ReorderListingFiles"
+	const countQuery = `
+		SELECT COUNT(*) FROM listing_files WHERE listing_id = ? AND kind = ?;
+	`
+	const query = `
+		UPDATE listing_files SET position = ? WHERE id = ? AND listing_id = ? AND kind = ?;
+	`
+	tx, err := s.db.Begin()
+	if err != nil {
+		return fmt.Errorf("%s: %w", op, err)
+	}
+	defer tx.Rollback()
+
+	var count int
+	if err = tx.QueryRow(countQuery, listingID, kind).Scan(&count); err != nil {
+		return fmt.Errorf("%s: %w", op, err)
+	}
+	if count != len(ids) {
+		return fmt.Errorf("%s: %w", op, ErrFileOrder)
+	}
+	seen := make(map[int64]bool, len(ids))
+	for i, id := range ids {
+		if seen[id] {
+			return fmt.Errorf("%s: %w", op, ErrFileOrder)
+		}
+		seen[id] = true
+		resp, err := tx.Exec(query, i+1, id, listingID, kind)
+		if err != nil {
+			return fmt.Errorf("%s: %w", op, err)
+		}
+		if n, _ := resp.RowsAffected(); n == 0 {
+			return fmt.Errorf("%s: %w", op, ErrFileOrder)
+		}
+	}
+	if err = tx.Commit(); err != nil {
+		return fmt.Errorf("%s: %w", op, err)
+	}
+	return nil
+}
+
+// SetListingCover makes a photo the cover of its listing.
+func (s *service) SetListingCover(listingID, fileID int64) error {
+	const op = "sqlite.database.SetListingCover"
+	const resetQuery = `
+		UPDATE listing_files SET cover = 0 WHERE listing_id = ? AND cover = 1;
+	`
+	const query = `
+		UPDATE listing_files SET cover = 1 WHERE id = ? AND listing_id = ? AND kind = 'photo';
+	`
+	tx, err := s.db.Begin()
+	if err != nil {
+		return fmt.Errorf("%s: %w", op, err)
+	}
+	defer tx.Rollback()
+
+	if _, err = tx.Exec(resetQuery, listingID); err != nil {
+		return fmt.Errorf("%s: %w", op, err)
+	}
+	resp, err := tx.Exec(query, fileID, listingID)
+	if err != nil {
+		return fmt.Errorf("%s: %w", op, err)
+	}
+	if n, _ := resp.RowsAffected(); n == 0 {
+		return fmt.Errorf("%s: %w", op, ErrFileNotFound)
+	}
+	if err = tx.Commit(); err != nil {
+		return fmt.Errorf("%s: %w", op, err)
+	}
+	return nil
+}
@@ -0,0 +1,101 @@
+package database
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"practic/internal/models"
+	"strings"
+)
+
+// UserByIdentity returns the user linked to an external identity and records
+// the login time of that identity.
+func (s *service) UserByIdentity(issuer, subject string) (models.UserDB, error) {
+	const op = "sqlite.database.UserByIdentity"
+	const query = `
+		UPDATE user_identities SET last_login_at = datetime('now') WHERE issuer = ? AND subject = ? RETURNING user_id;
+	`
+
+	stmt, err := s.db.Prepare(query)
+	if err != nil {
+		return models.UserDB{}, fmt.Errorf("%s: %w", op, err)
+	}
+
+	var userID int64
+	err = stmt.QueryRow(issuer, subject).Scan(&userID)
+	if errors.Is(err, sql.ErrNoRows) {
+		return models.UserDB{}, fmt.Errorf("%s: %w", op, ErrUserNotFound)
+	}
+	if err != nil {
+		return models.UserDB{}, fmt.Errorf("%s: %w", op, err)
+	}
+
+	user, err := s.UserByID(userID)
+	if err != nil {
+		return models.UserDB{}, fmt.Errorf("%s: %w", op, err)
+	}
+	return user, nil
+}
+
+// LinkIdentity attaches an external identity to an existing user.
+func (s *service) LinkIdentity(userID int64, issuer, subject, email string) error {
+	const op = "sqlite.database.LinkIdentity"
+	const query = `
+		INSERT INTO user_identities (user_id, issuer, subject, email, last_login_at) VALUES (?, ?, ?, NULLIF(?, ''), datetime('now'));
+	`
+
+	stmt, err := s.db.Prepare(query)
+	if err != nil {
+		return fmt.Errorf("%s: %w", op, err)
+	}
+	_, err = stmt.Exec(userID, issuer, subject, email)
+	if err != nil {
+		return fmt.Errorf("%s: %w", op, err)
+	}
+	return nil
+}
+
+// CreateIdentityUser provisions a user for an external identity. The user has
+// no password and can only sign in through the identity provider until they
+// set one with the reset flow.
+func (s *service) CreateIdentityUser(name, login, email, role, status, issuer, subject string) (uid int64, err error) {
+	const op = "sqlite.database.CreateIdentityUser"
+	const query = `
+		INSERT INTO users (username, password, name, email, role, status, created_at) VALUES (?, '', ?, NULLIF(?, ''), ?, ?, datetime('now')) RETURNING id;
+	`
+	const identityQuery = `
+		INSERT INTO user_identities (user_id, issuer, subject, email, last_login_at) VALUES (?, ?, ?, NULLIF(?, ''), datetime('now'));
+	`
+
+	tx, err := s.db.Begin()
+	if err != nil {
+		return 0, fmt.Errorf("%s: %w", op, err)
+	}
+	defer tx.Rollback()
+
+	if err = roleExists(tx, role); err != nil {
+		return 0, fmt.Errorf("%s: %w", op, err)
+	}
+	resp, err := tx.Exec(query, login, name, email, role, status)
+	if isUniqueViolation(err) {
+		if strings.Contains(err.Error(), "users.email") {
+			return 0, fmt.Errorf("%s: %w", op, ErrEmailTaken)
+		}
+		return 0, fmt.Errorf("%s: %w", op, ErrLoginTaken)
+	}
+	if err != nil {
+		return 0, fmt.Errorf("%s: %w", op, err)
+	}
+	id, err := resp.LastInsertId()
+	if err != nil {
+		return 0, fmt.Errorf("%s: %w", op, err)
+	}
+	if _, err = tx.Exec(identityQuery, id, issuer, subject, email); err != nil {
+		return 0, fmt.Errorf("%s: %w", op, err)
+	}
+	if err = tx.Commit(); err != nil {
+		return 0, fmt.Errorf("%s: %w", op, err)
+	}
+
+	return id, nil
+}
@@ -0,0 +1,74 @@
+package database
+
+import (
+	"fmt"
+	"practic/internal/models"
+)
+
+// ImportListings creates listings for userID in a single transaction and
+// returns the id of each, 0 for a listing skipped because userID already has
+// one with the same title, type, city and price (earlier rows of the same
+// import included). A dry run rolls the transaction back, so its ids only
+// tell created rows from skipped ones.
+func (s *service) ImportListings(userID int64, listings []models.Listing, dryRun bool) ([]int64, error) {
+	const op = "sqlite.database.ImportListings"
+	const duplicateQuery = `
+		SELECT EXISTS (
+			SELECT 1 FROM listings
+			WHERE user_id = ? AND deleted_at IS NULL AND name = ? AND type = ? AND city = ? AND price = ?
+		);
+	`
+	const query = `
+		INSERT INTO listings (name, type, description, status, deal, price, city, address, area, rooms, floor, floors, syndicate,
+			user_id, agency_id, updated_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, (SELECT agency_id FROM users WHERE id = ?), datetime('now')) RETURNING id;
+	`
+	tx, err := s.db.Begin()
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", op, err)
+	}
+	defer tx.Rollback()
+
+	duplicate, err := tx.Prepare(duplicateQuery)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", op, err)
+	}
+	defer duplicate.Close()
+	insert, err := tx.Prepare(query)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", op, err)
+	}
+	defer insert.Close()
+	history, err := tx.Prepare(initialStatusQuery)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", op, err)
+	}
+	defer history.Close()
+
+	ids := make([]int64, len(listings))
+	for i, l := range listings {
+		var exists bool
+		if err := duplicate.QueryRow(userID, l.Name, l.Typel, l.City, l.Price).Scan(&exists); err != nil {
+			return nil, fmt.Errorf("%s: %w", op, err)
+		}
+		if exists {
+			continue
+		}
+		err := insert.QueryRow(l.Name, l.Typel, l.Description, l.Status, l.Deal, l.Price, l.City,
+			l.Address, l.Area, l.Rooms, l.Floor, l.Floors, l.Syndicate, userID, userID).Scan(&ids[i])
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", op, err)
+		}
+		if _, err := history.Exec(ids[i], l.Status, userID); err != nil {
+			return nil, fmt.Errorf("%s: %w", op, err)
+		}
+	}
+
+	if dryRun {
+		return ids, nil
+	}
+	if err = tx.Commit(); err != nil {
+		return nil, fmt.Errorf("%s: %w", op, err)
+	}
+	return ids, nil
+}
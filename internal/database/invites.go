@@ -0,0 +1,115 @@
+package database
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"practic/internal/models"
+	"time"
+)
+
+var ErrInviteInvalid = errors.New("invite code is invalid or already used")
+
+// CreateInvite stores an invite code hash for agencyID. A zero ttl means the
+// code never expires.
+func (s *service) CreateInvite(createdBy, agencyID int64, codeHash string, ttl time.Duration) (id int64, err error) {
+	const op = "sqlite.database.CreateInvite"
+	const query = `
+		INSERT INTO invites (created_by, agency_id, code_hash, expires_at) VALUES (?, ?, ?, datetime('now', ?)) RETURNING id;
+	`
+
+	stmt, err := s.db.Prepare(query)
+	if err != nil {
+		return 0, fmt.Errorf("%s: %w", op, err)
+	}
+
+	var expires any
+	if ttl > 0 {
+		expires = durationModifier(ttl)
+	}
+	resp, err := stmt.Exec(createdBy, agencyID, codeHash, expires)
+	if err != nil {
+		return 0, fmt.Errorf("%s: %w", op, err)
+	}
+	id, err = resp.LastInsertId()
+	if err != nil {
+		return 0, fmt.Errorf("%s: %w", op, err)
+	}
+
+	return id, nil
+}
+
+// redeemInvite marks an invite as used by userID and returns the agency it
+// invites to.
+func redeemInvite(tx *sql.Tx, codeHash string, userID int64) (agencyID int64, err error) {
+	err = tx.QueryRow(`
+		UPDATE invites SET used_at = datetime('now'), used_by = ?
+		WHERE code_hash = ? AND used_at IS NULL AND (expires_at IS NULL OR expires_at > datetime('now'))
+		RETURNING agency_id;
+	`, userID, codeHash).Scan(&agencyID)
+	if errors.Is(err, sql.ErrNoRows) {
+		return 0, ErrInviteInvalid
+	}
+	if err != nil {
+		return 0, err
+	}
+	return agencyID, nil
+}
+
+// GetInvites lists the invites of an agency, of all agencies if agencyID is 0.
+func (s *service) GetInvites(agencyID int64) ([]models.Invite, error) {
+	const op = "sqlite.database.GetInvites"
+	const query = `
+		SELECT id, agency_id, created_by, created_at, expires_at, used_at, used_by FROM invites
+		WHERE ? = 0 OR agency_id = ?
+		ORDER BY created_at DESC, id DESC;
+	`
+
+	stmt, err := s.db.Prepare(query)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", op, err)
+	}
+
+	rows, err := stmt.Query(agencyID, agencyID)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", op, err)
+	}
+	defer rows.Close()
+
+	invites := []models.Invite{}
+	for rows.Next() {
+		var i models.Invite
+		if err := rows.Scan(&i.ID, &i.AgencyID, &i.CreatedBy, &i.CreatedAt, &i.ExpiresAt, &i.UsedAt, &i.UsedBy); err != nil {
+			return nil, fmt.Errorf("%s: %w", op, err)
+		}
+		invites = append(invites, i)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("%s: %w", op, err)
+	}
+
+	return invites, nil
+}
+
+// RevokeInvite deletes an invite of agencyID (any agency if 0) that has not
+// been used yet.
+func (s *service) RevokeInvite(id, agencyID int64) error {
+	const op = "sqlite.database.RevokeInvite"
+	const query = `
+		DELETE FROM invites WHERE id = ? AND used_at IS NULL AND (? = 0 OR agency_id = ?);
+	`
+
+	stmt, err := s.db.Prepare(query)
+	if err != nil {
+		return fmt.Errorf("%s: %w", op, err)
+	}
+	resp, err := stmt.Exec(id, agencyID, agencyID)
+	if err != nil {
+		return fmt.Errorf("%s: %w", op, err)
+	}
+	if n, _ := resp.RowsAffected(); n == 0 {
+		return fmt.Errorf("%s: %w", op, ErrInviteInvalid)
+	}
+	return nil
+}
@@ -0,0 +1,36 @@
+package database
+
+import (
+	"practic/internal/models"
+	"testing"
+)
+
+func TestListingFeedFieldsRoundTrip(t *testing.T) {
+	s := newTestService(t)
+
+	l := models.Listing{Name: "Квартира", Typel: "flat", Status: models.StatusActive, Deal: models.DealSale, City: "Москва", Price: 100,
+		UserID: 1, Address: "Тверская, 1", Area: 54.5, Rooms: 2, Floor: 3, Floors: 9, Syndicate: true}
+	id, err := s.CreateListing(l)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := s.GetListing(id, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.Address != l.Address || got.Area != l.Area || got.Rooms != l.Rooms || got.Floor != l.Floor || got.Floors != l.Floors || !got.Syndicate {
+		t.Errorf("created listing = %+v, want the feed fields of %+v", got, l)
+	}
+
+	l.Address, l.Area, l.Rooms, l.Floor, l.Floors, l.Syndicate = "Арбат, 2", 40, 1, -1, 5, false
+	if _, err := s.UpdateListing(l, id, got.Version, 1); err != nil {
+		t.Fatal(err)
+	}
+	got, err = s.GetListing(id, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.Address != l.Address || got.Area != l.Area || got.Rooms != l.Rooms || got.Floor != l.Floor || got.Floors != l.Floors || got.Syndicate {
+		t.Errorf("updated listing = %+v, want the feed fields of %+v", got, l)
+	}
+}
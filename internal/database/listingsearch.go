@@ -0,0 +1,128 @@
+package database
+
+import (
+	"practic/internal/models"
+	"strings"
+	"unicode"
+)
+
+// dateCreatedLayout is how SQLite stores listings.date_created and other
+// datetime('now') values.
+const dateCreatedLayout = "2006-01-02 15:04:05"
+
+var listingSortColumns = map[string]string{
+	models.ListingSortCreated: "listings.date_created",
+	models.ListingSortUpdated: "listings.updated_at",
+	models.ListingSortPrice:   "listings.price",
+	models.ListingSortTitle:   "listings.name",
+	models.ListingSortCity:    "listings.city",
+}
+
+// listingSort returns the sort field of a filter, newest first if unset.
+func listingSort(f models.ListingFilter) (sort string, desc bool) {
+	if _, ok := listingSortColumns[f.Sort]; !ok {
+		return models.ListingSortCreated, true
+	}
+	return f.Sort, f.Desc
+}
+
+// listingSortValue is the value of the sort field of l, as stored in the
+// database, for the cursor following l.
+func listingSortValue(sort string, l models.ListingDB) any {
+	switch sort {
+	case models.ListingSortUpdated:
+		return l.UpdatedAt.UTC().Format(dateCreatedLayout)
+	case models.ListingSortPrice:
+		return l.Price
+	case models.ListingSortTitle:
+		return l.Name
+	case models.ListingSortCity:
+		return l.City
+	default:
+		return l.Date_created.UTC().Format(dateCreatedLayout)
+	}
+}
+
+// listingFilterSQL turns a filter into conditions for a WHERE clause over the
+// listings table, each starting with AND.
+func listingFilterSQL(f models.ListingFilter) (where string, args []any) {
+	var b strings.Builder
+	if f.City != "" {
+		b.WriteString(" AND listings.city = ?")
+		args = append(args, f.City)
+	}
+	if f.Type != "" {
+		b.WriteString(" AND listings.type = ?")
+		args = append(args, f.Type)
+	}
+	if f.Status != "" {
+		b.WriteString(" AND listings.status = ?")
+		args = append(args, f.Status)
+	}
+	if f.Deal != "" {
+		b.WriteString(" AND listings.deal = ?")
+		args = append(args, f.Deal)
+	}
+	if f.PriceMin != nil {
+		b.WriteString(" AND listings.price >= ?")
+		args = append(args, *f.PriceMin)
+	}
+	if f.PriceMax != nil {
+		b.WriteString(" AND listings.price <= ?")
+		args = append(args, *f.PriceMax)
+	}
+	if !f.CreatedFrom.IsZero() {
+		b.WriteString(" AND listings.date_created >= ?")
+		args = append(args, f.CreatedFrom.Format(dateCreatedLayout))
+	}
+	if !f.CreatedTo.IsZero() {
+		b.WriteString(" AND listings.date_created < ?")
+		args = append(args, f.CreatedTo.Format(dateCreatedLayout))
+	}
+	if match := ftsQuery(f.Query); match != "" {
+		b.WriteString(" AND listings.id IN (SELECT rowid FROM listings_fts WHERE listings_fts MATCH ?)")
+		args = append(args, match)
+	}
+	return b.String(), args
+}
+
+// listingPageSQL adds the position of the page to the conditions of
+// listingFilterSQL and returns the ORDER BY clause.
+func listingPageSQL(f models.ListingFilter, after string) (where string, args []any, orderBy string, err error) {
+	where, args = listingFilterSQL(f)
+	sort, desc := listingSort(f)
+	column := listingSortColumns[sort]
+	c, ok, err := decodeCursor(after, sort, desc)
+	if err != nil {
+		return "", nil, "", err
+	}
+	if ok {
+		keyset, keysetArgs := keysetSQL(column, "listings.id", desc, c)
+		where += keyset
+		args = append(args, keysetArgs...)
+	}
+	direction := " ASC"
+	if desc {
+		direction = " DESC"
+	}
+	return where, args, " ORDER BY " + column + direction + ", listings.id" + direction, nil
+}
+
+// nextListingCursor is the cursor following the last listing of a page.
+func nextListingCursor(f models.ListingFilter, last models.ListingDB) string {
+	sort, desc := listingSort(f)
+	return cursor{Sort: sort, Desc: desc, Value: listingSortValue(sort, last), ID: last.ID}.encode()
+}
+
+// ftsQuery makes an FTS5 query from user input: every word must be present,
+// as a prefix, so "двушк центр" finds "двушка в центре". Operators and
+// quotes in the input are treated as plain text.
+func ftsQuery(q string) string {
+	words := strings.FieldsFunc(q, func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	})
+	for i, w := range words {
+		words[i] = `"` + w + `"*`
+	}
+	return strings.Join(words, " ")
+}
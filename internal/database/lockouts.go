@@ -0,0 +1,124 @@
+package database
+
+import (
+	"fmt"
+	"practic/internal/models"
+	"time"
+)
+
+// LoginLockout returns how long the login or the client ip stays locked,
+// zero if neither is.
+func (s *service) LoginLockout(login, ip string) (time.Duration, error) {
+	const op = "sqlite.database.LoginLockout"
+	const query = `
+		SELECT COALESCE(MAX(CAST((julianday(locked_until) - julianday('now')) * 86400 AS INTEGER)), 0)
+		FROM login_failures
+		WHERE ((kind = 'login' AND value = ?) OR (kind = 'ip' AND value = ?)) AND locked_until > datetime('now')
+	`
+
+	stmt, err := s.db.Prepare(query)
+	if err != nil {
+		return 0, fmt.Errorf("%s: %w", op, err)
+	}
+
+	var seconds int64
+	if err := stmt.QueryRow(login, ip).Scan(&seconds); err != nil {
+		return 0, fmt.Errorf("%s: %w", op, err)
+	}
+
+	return time.Duration(seconds) * time.Second, nil
+}
+
+// RecordLoginFailure counts a failed attempt and returns the number of
+// failures in a row. Failures older than a day are forgotten.
+func (s *service) RecordLoginFailure(kind, value string) (failures int64, err error) {
+	const op = "sqlite.database.RecordLoginFailure"
+	const query = `
+		INSERT INTO login_failures (kind, value, failures) VALUES (?, ?, 1)
+		ON CONFLICT (kind, value) DO UPDATE SET
+			failures = CASE WHEN last_failure_at < datetime('now', '-1 day') THEN 1 ELSE failures + 1 END,
+			last_failure_at = datetime('now')
+		RETURNING failures;
+	`
+
+	stmt, err := s.db.Prepare(query)
+	if err != nil {
+		return 0, fmt.Errorf("%s: %w", op, err)
+	}
+
+	if err := stmt.QueryRow(kind, value).Scan(&failures); err != nil {
+		return 0, fmt.Errorf("%s: %w", op, err)
+	}
+
+	return failures, nil
+}
+
+func (s *service) LockLogin(kind, value string, duration time.Duration) error {
+	const op = "sqlite.database.LockLogin"
+	const query = `
+		UPDATE login_failures SET locked_until = datetime('now', ?) WHERE kind = ? AND value = ?;
+	`
+
+	stmt, err := s.db.Prepare(query)
+	if err != nil {
+		return fmt.Errorf("%s: %w", op, err)
+	}
+	_, err = stmt.Exec(durationModifier(duration), kind, value)
+	if err != nil {
+		return fmt.Errorf("%s: %w", op, err)
+	}
+	return nil
+}
+
+func (s *service) ClearLoginFailures(kind, value string) error {
+	const op = "sqlite.database.ClearLoginFailures"
+	const query = `
+		DELETE FROM login_failures WHERE kind = ? AND value = ?;
+	`
+
+	stmt, err := s.db.Prepare(query)
+	if err != nil {
+		return fmt.Errorf("%s: %w", op, err)
+	}
+	_, err = stmt.Exec(kind, value)
+	if err != nil {
+		return fmt.Errorf("%s: %w", op, err)
+	}
+	return nil
+}
+
+func (s *service) GetLoginFailures() ([]models.LoginFailure, error) {
+	const op = "sqlite.database.GetLoginFailures"
+	const query = `
+		SELECT kind, value, failures, last_failure_at, locked_until
+		FROM login_failures
+		WHERE last_failure_at > datetime('now', '-1 day') OR locked_until > datetime('now')
+		ORDER BY last_failure_at DESC
+	`
+
+	stmt, err := s.db.Prepare(query)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", op, err)
+	}
+
+	rows, err := stmt.Query()
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", op, err)
+	}
+	defer rows.Close()
+
+	var failures []models.LoginFailure
+	for rows.Next() {
+		var f models.LoginFailure
+		if err := rows.Scan(&f.Kind, &f.Value, &f.Failures, &f.LastFailureAt, &f.LockedUntil); err != nil {
+			return nil, fmt.Errorf("%s: %w", op, err)
+		}
+		failures = append(failures, f)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("%s: %w", op, err)
+	}
+
+	return failures, nil
+}
@@ -0,0 +1,56 @@
+package database
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+)
+
+var ErrInvalidCursor = errors.New("invalid cursor")
+
+// cursor is the position after the last item of a page: the value of the
+// sort column and the id, which breaks ties. Sort and Desc tie the cursor to
+// the order it was made for.
+type cursor struct {
+	Sort  string `json:"s"`
+	Desc  bool   `json:"d,omitempty"`
+	Value any    `json:"v"`
+	ID    int64  `json:"id"`
+}
+
+func (c cursor) encode() string {
+	b, _ := json.Marshal(c)
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+// decodeCursor reads a cursor made for the given order, the zero cursor for
+// an empty string.
+func decodeCursor(s, sort string, desc bool) (cursor, bool, error) {
+	if s == "" {
+		return cursor{}, false, nil
+	}
+	b, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return cursor{}, false, ErrInvalidCursor
+	}
+	var c cursor
+	if err := json.Unmarshal(b, &c); err != nil || c.Sort != sort || c.Desc != desc {
+		return cursor{}, false, ErrInvalidCursor
+	}
+	switch c.Value.(type) {
+	case string, float64:
+	default:
+		return cursor{}, false, ErrInvalidCursor
+	}
+	return c, true, nil
+}
+
+// keysetSQL is the condition selecting rows after c in the order
+// column, idColumn (both descending if desc).
+func keysetSQL(column, idColumn string, desc bool, c cursor) (string, []any) {
+	op := " > "
+	if desc {
+		op = " < "
+	}
+	return " AND (" + column + op + "? OR (" + column + " = ? AND " + idColumn + op + "?))", []any{c.Value, c.Value, c.ID}
+}
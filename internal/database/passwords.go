@@ -0,0 +1,133 @@
+package database
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+)
+
+var (
+	ErrResetTokenInvalid       = errors.New("reset token is invalid or expired")
+	ErrEmailChangeTokenInvalid = errors.New("email change token is invalid or expired")
+)
+
+// CreatePasswordReset stores a new reset token for the user. Tokens issued
+// earlier stop working, only the latest email link is valid.
+func (s *service) CreatePasswordReset(userID int64, tokenHash string, ttl time.Duration) error {
+	const op = "sqlite.database.CreatePasswordReset"
+	const expireQuery = `
+		UPDATE password_resets SET used_at = datetime('now') WHERE user_id = ? AND used_at IS NULL;
+	`
+	const query = `
+		INSERT INTO password_resets (user_id, token_hash, expires_at) VALUES (?, ?, datetime('now', ?));
+	`
+	tx, err := s.db.Begin()
+	if err != nil {
+		return fmt.Errorf("%s: %w", op, err)
+	}
+	defer tx.Rollback()
+
+	if _, err = tx.Exec(expireQuery, userID); err != nil {
+		return fmt.Errorf("%s: %w", op, err)
+	}
+	if _, err = tx.Exec(query, userID, tokenHash, durationModifier(ttl)); err != nil {
+		return fmt.Errorf("%s: %w", op, err)
+	}
+	if err = tx.Commit(); err != nil {
+		return fmt.Errorf("%s: %w", op, err)
+	}
+	return nil
+}
+
+// ConsumePasswordReset marks the token as used and returns its owner.
+func (s *service) ConsumePasswordReset(tokenHash string) (userID int64, err error) {
+	const op = "sqlite.database.ConsumePasswordReset"
+	const query = `
+		UPDATE password_resets SET used_at = datetime('now')
+		WHERE token_hash = ? AND used_at IS NULL AND expires_at > datetime('now')
+		RETURNING user_id;
+	`
+
+	stmt, err := s.db.Prepare(query)
+	if err != nil {
+		return 0, fmt.Errorf("%s: %w", op, err)
+	}
+
+	err = stmt.QueryRow(tokenHash).Scan(&userID)
+	if errors.Is(err, sql.ErrNoRows) {
+		return 0, fmt.Errorf("%s: %w", op, ErrResetTokenInvalid)
+	}
+	if err != nil {
+		return 0, fmt.Errorf("%s: %w", op, err)
+	}
+
+	return userID, nil
+}
+
+// CreateEmailChange stores a pending change of the user's email, applied once
+// the link sent to the new address is opened. Earlier requests stop working.
+func (s *service) CreateEmailChange(userID int64, email, tokenHash string, ttl time.Duration) error {
+	const op = "sqlite.database.CreateEmailChange"
+	const expireQuery = `
+		UPDATE email_changes SET used_at = datetime('now') WHERE user_id = ? AND used_at IS NULL;
+	`
+	const query = `
+		INSERT INTO email_changes (user_id, email, token_hash, expires_at) VALUES (?, ?, ?, datetime('now', ?));
+	`
+	tx, err := s.db.Begin()
+	if err != nil {
+		return fmt.Errorf("%s: %w", op, err)
+	}
+	defer tx.Rollback()
+
+	if _, err = tx.Exec(expireQuery, userID); err != nil {
+		return fmt.Errorf("%s: %w", op, err)
+	}
+	if _, err = tx.Exec(query, userID, email, tokenHash, durationModifier(ttl)); err != nil {
+		return fmt.Errorf("%s: %w", op, err)
+	}
+	if err = tx.Commit(); err != nil {
+		return fmt.Errorf("%s: %w", op, err)
+	}
+	return nil
+}
+
+// ConfirmEmailChange marks the token as used and sets the email it was issued
+// for on its owner.
+func (s *service) ConfirmEmailChange(tokenHash string) (userID int64, err error) {
+	const op = "sqlite.database.ConfirmEmailChange"
+	const consumeQuery = `
+		UPDATE email_changes SET used_at = datetime('now')
+		WHERE token_hash = ? AND used_at IS NULL AND expires_at > datetime('now')
+		RETURNING user_id, email;
+	`
+	const query = `
+		UPDATE users SET email = ? WHERE id = ?;
+	`
+	tx, err := s.db.Begin()
+	if err != nil {
+		return 0, fmt.Errorf("%s: %w", op, err)
+	}
+	defer tx.Rollback()
+
+	var email string
+	err = tx.QueryRow(consumeQuery, tokenHash).Scan(&userID, &email)
+	if errors.Is(err, sql.ErrNoRows) {
+		return 0, fmt.Errorf("%s: %w", op, ErrEmailChangeTokenInvalid)
+	}
+	if err != nil {
+		return 0, fmt.Errorf("%s: %w", op, err)
+	}
+	_, err = tx.Exec(query, email, userID)
+	if isUniqueViolation(err) {
+		return 0, fmt.Errorf("%s: %w", op, ErrEmailTaken)
+	}
+	if err != nil {
+		return 0, fmt.Errorf("%s: %w", op, err)
+	}
+	if err = tx.Commit(); err != nil {
+		return 0, fmt.Errorf("%s: %w", op, err)
+	}
+	return userID, nil
+}
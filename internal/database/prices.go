@@ -0,0 +1,49 @@
+package database
+
+import (
+	"database/sql"
+	"fmt"
+	"practic/internal/models"
+)
+
+// recordPriceChange adds a price history entry when the price of a listing
+// actually changed.
+func recordPriceChange(tx *sql.Tx, listingID, oldPrice, newPrice, userID int64) error {
+	if oldPrice == newPrice {
+		return nil
+	}
+	_, err := tx.Exec(`INSERT INTO listing_price_history (listing_id, old_price, new_price, changed_by) VALUES (?, ?, ?, ?);`,
+		listingID, oldPrice, newPrice, userID)
+	return err
+}
+
+// GetPriceHistory lists the price changes of a listing, oldest first.
+func (s *service) GetPriceHistory(id int64) ([]models.PriceChange, error) {
+	const op = "sqlite.database.GetPriceHistory"
+	const query = `
+		SELECT listing_price_history.id, old_price, new_price, changed_by, COALESCE(users.name, ''), listing_price_history.created_at
+		FROM listing_price_history LEFT JOIN users ON users.id = listing_price_history.changed_by
+		WHERE listing_id = ?
+		ORDER BY listing_price_history.id;
+	`
+	rows, err := s.db.Query(query, id)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", op, err)
+	}
+	defer rows.Close()
+
+	history := []models.PriceChange{}
+	for rows.Next() {
+		var c models.PriceChange
+		if err := rows.Scan(&c.ID, &c.OldPrice, &c.NewPrice, &c.UserID, &c.UserName, &c.CreatedAt); err != nil {
+			return nil, fmt.Errorf("%s: %w", op, err)
+		}
+		history = append(history, c)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("%s: %w", op, err)
+	}
+
+	return history, nil
+}
@@ -0,0 +1,96 @@
+package database
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"practic/internal/models"
+	"strings"
+)
+
+var ErrRoleNotFound = errors.New("role not found")
+
+// RolePermissions returns the permissions granted to role, none for an
+// unknown role.
+func (s *service) RolePermissions(role string) ([]string, error) {
+	const op = "sqlite.database.RolePermissions"
+	const query = `
+		SELECT permission FROM role_permissions WHERE role = ? ORDER BY permission;
+	`
+
+	stmt, err := s.db.Prepare(query)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", op, err)
+	}
+
+	rows, err := stmt.Query(role)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", op, err)
+	}
+	defer rows.Close()
+
+	permissions := []string{}
+	for rows.Next() {
+		var p string
+		if err := rows.Scan(&p); err != nil {
+			return nil, fmt.Errorf("%s: %w", op, err)
+		}
+		permissions = append(permissions, p)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("%s: %w", op, err)
+	}
+
+	return permissions, nil
+}
+
+func (s *service) GetRoles() ([]models.Role, error) {
+	const op = "sqlite.database.GetRoles"
+	const query = `
+		SELECT roles.name, roles.description, COALESCE(GROUP_CONCAT(role_permissions.permission, ' '), '')
+		FROM roles LEFT JOIN role_permissions ON role_permissions.role = roles.name
+		GROUP BY roles.name
+		ORDER BY COUNT(role_permissions.permission), roles.name;
+	`
+
+	stmt, err := s.db.Prepare(query)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", op, err)
+	}
+
+	rows, err := stmt.Query()
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", op, err)
+	}
+	defer rows.Close()
+
+	var roles []models.Role
+	for rows.Next() {
+		var r models.Role
+		var permissions string
+		if err := rows.Scan(&r.Name, &r.Description, &permissions); err != nil {
+			return nil, fmt.Errorf("%s: %w", op, err)
+		}
+		r.Permissions = strings.Fields(permissions)
+		roles = append(roles, r)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("%s: %w", op, err)
+	}
+
+	return roles, nil
+}
+
+func roleExists(tx *sql.Tx, role string) error {
+	var exists bool
+	err := tx.QueryRow(`SELECT EXISTS (SELECT 1 FROM roles WHERE name = ?);`, role).Scan(&exists)
+	if err != nil {
+		return err
+	}
+	if !exists {
+		return ErrRoleNotFound
+	}
+	return nil
+}
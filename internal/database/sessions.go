@@ -0,0 +1,215 @@
+package database
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"log/slog"
+	"practic/internal/models"
+	"time"
+)
+
+var ErrSessionNotFound = errors.New("session not found")
+
+// durationModifier formats a duration as an sqlite datetime modifier, e.g. "+3600 seconds".
+func durationModifier(d time.Duration) string {
+	return fmt.Sprintf("+%d seconds", int64(d.Seconds()))
+}
+
+func (s *service) CreateSession(userID int64, refreshHash, userAgent, ip string, mfa bool, ttl time.Duration) (sid int64, err error) {
+	const op = "sqlite.database.CreateSession"
+	const query = `
+		INSERT INTO sessions (user_id, refresh_hash, user_agent, ip, mfa, expires_at) VALUES (?, ?, ?, ?, ?, datetime('now', ?)) RETURNING id;
+	`
+
+	stmt, err := s.db.Prepare(query)
+	if err != nil {
+		return 0, fmt.Errorf("%s: %w", op, err)
+	}
+
+	resp, err := stmt.Exec(userID, refreshHash, userAgent, ip, mfa, durationModifier(ttl))
+	if err != nil {
+		return 0, fmt.Errorf("%s: %w", op, err)
+	}
+	id, err := resp.LastInsertId()
+	if err != nil {
+		return 0, fmt.Errorf("%s: %w", op, err)
+	}
+
+	return id, nil
+}
+
+// RotateSession swaps the refresh token of an active session and extends its
+// lifetime. Presenting an already rotated token revokes the whole session,
+// since it means the token was copied.
+func (s *service) RotateSession(oldHash, newHash string, ttl time.Duration) (models.SessionDB, error) {
+	const op = "sqlite.database.RotateSession"
+	const query = `
+		UPDATE sessions SET previous_hash = refresh_hash, refresh_hash = ?, last_used_at = datetime('now'), expires_at = datetime('now', ?)
+		WHERE refresh_hash = ? AND revoked_at IS NULL AND expires_at > datetime('now')
+		RETURNING id, user_id, mfa;
+	`
+	const reuseQuery = `
+		UPDATE sessions SET revoked_at = datetime('now') WHERE previous_hash = ? AND revoked_at IS NULL;
+	`
+
+	stmt, err := s.db.Prepare(query)
+	if err != nil {
+		return models.SessionDB{}, fmt.Errorf("%s: %w", op, err)
+	}
+
+	var session models.SessionDB
+	err = stmt.QueryRow(newHash, durationModifier(ttl), oldHash).Scan(&session.ID, &session.UserID, &session.MFA)
+	if err == nil {
+		return session, nil
+	}
+	if !errors.Is(err, sql.ErrNoRows) {
+		return models.SessionDB{}, fmt.Errorf("%s: %w", op, err)
+	}
+
+	resp, err := s.db.Exec(reuseQuery, oldHash)
+	if err != nil {
+		return models.SessionDB{}, fmt.Errorf("%s: %w", op, err)
+	}
+	if n, _ := resp.RowsAffected(); n > 0 {
+		s.log.Warn("refresh token reuse detected, session revoked", slog.String("op", op))
+	}
+
+	return models.SessionDB{}, fmt.Errorf("%s: %w", op, ErrSessionNotFound)
+}
+
+// SessionTokenVersion returns the current token version of the user that owns
+// an active session. Revoked or expired sessions and deleted users yield
+// ErrSessionNotFound.
+func (s *service) SessionTokenVersion(sid int64) (int64, error) {
+	const op = "sqlite.database.SessionTokenVersion"
+	const query = `
+		SELECT users.token_version FROM sessions JOIN users ON sessions.user_id = users.id
+		WHERE sessions.id = ? AND sessions.revoked_at IS NULL AND sessions.expires_at > datetime('now');
+	`
+
+	stmt, err := s.db.Prepare(query)
+	if err != nil {
+		return 0, fmt.Errorf("%s: %w", op, err)
+	}
+
+	var version int64
+	err = stmt.QueryRow(sid).Scan(&version)
+	if errors.Is(err, sql.ErrNoRows) {
+		return 0, fmt.Errorf("%s: %w", op, ErrSessionNotFound)
+	}
+	if err != nil {
+		return 0, fmt.Errorf("%s: %w", op, err)
+	}
+
+	return version, nil
+}
+
+// SessionMFA reports whether an active session was opened with a second
+// factor.
+func (s *service) SessionMFA(sid int64) (bool, error) {
+	const op = "sqlite.database.SessionMFA"
+	const query = `
+		SELECT mfa FROM sessions WHERE id = ? AND revoked_at IS NULL AND expires_at > datetime('now');
+	`
+
+	var mfa bool
+	err := s.db.QueryRow(query, sid).Scan(&mfa)
+	if errors.Is(err, sql.ErrNoRows) {
+		return false, fmt.Errorf("%s: %w", op, ErrSessionNotFound)
+	}
+	if err != nil {
+		return false, fmt.Errorf("%s: %w", op, err)
+	}
+	return mfa, nil
+}
+
+func (s *service) GetSessions(userID int64) ([]models.Session, error) {
+	const op = "sqlite.database.GetSessions"
+	const query = `
+		SELECT id, user_agent, ip, created_at, last_used_at, expires_at
+		FROM sessions
+		WHERE user_id = ? AND revoked_at IS NULL AND expires_at > datetime('now')
+		ORDER BY last_used_at DESC
+	`
+
+	stmt, err := s.db.Prepare(query)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", op, err)
+	}
+
+	rows, err := stmt.Query(userID)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", op, err)
+	}
+	defer rows.Close()
+
+	var sessions []models.Session
+	for rows.Next() {
+		var ss models.Session
+		if err := rows.Scan(&ss.ID, &ss.UserAgent, &ss.IP, &ss.CreatedAt, &ss.LastUsedAt, &ss.ExpiresAt); err != nil {
+			return nil, fmt.Errorf("%s: %w", op, err)
+		}
+		sessions = append(sessions, ss)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("%s: %w", op, err)
+	}
+
+	return sessions, nil
+}
+
+func (s *service) RevokeSession(sid int64, userID int64) error {
+	const op = "sqlite.database.RevokeSession"
+	const query = `
+		UPDATE sessions SET revoked_at = datetime('now') WHERE id = ? AND user_id = ? AND revoked_at IS NULL;
+	`
+
+	stmt, err := s.db.Prepare(query)
+	if err != nil {
+		return fmt.Errorf("%s: %w", op, err)
+	}
+	resp, err := stmt.Exec(sid, userID)
+	if err != nil {
+		return fmt.Errorf("%s: %w", op, err)
+	}
+	if n, _ := resp.RowsAffected(); n == 0 {
+		return fmt.Errorf("%s: %w", op, ErrSessionNotFound)
+	}
+	return nil
+}
+
+func (s *service) RevokeSessionByRefresh(refreshHash string) error {
+	const op = "sqlite.database.RevokeSessionByRefresh"
+	const query = `
+		UPDATE sessions SET revoked_at = datetime('now') WHERE refresh_hash = ? AND revoked_at IS NULL;
+	`
+
+	stmt, err := s.db.Prepare(query)
+	if err != nil {
+		return fmt.Errorf("%s: %w", op, err)
+	}
+	_, err = stmt.Exec(refreshHash)
+	if err != nil {
+		return fmt.Errorf("%s: %w", op, err)
+	}
+	return nil
+}
+
+func (s *service) RevokeUserSessions(userID int64) error {
+	const op = "sqlite.database.RevokeUserSessions"
+	const query = `
+		UPDATE sessions SET revoked_at = datetime('now') WHERE user_id = ? AND revoked_at IS NULL;
+	`
+
+	stmt, err := s.db.Prepare(query)
+	if err != nil {
+		return fmt.Errorf("%s: %w", op, err)
+	}
+	_, err = stmt.Exec(userID)
+	if err != nil {
+		return fmt.Errorf("%s: %w", op, err)
+	}
+	return nil
+}
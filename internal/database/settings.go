@@ -0,0 +1,45 @@
+package database
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+)
+
+// Setting returns a stored application setting, "" if it was never set.
+func (s *service) Setting(key string) (string, error) {
+	const op = "sqlite.database.Setting"
+	const query = `
+		SELECT value FROM settings WHERE key = ?;
+	`
+	stmt, err := s.db.Prepare(query)
+	if err != nil {
+		return "", fmt.Errorf("%s: %w", op, err)
+	}
+
+	var value string
+	err = stmt.QueryRow(key).Scan(&value)
+	if errors.Is(err, sql.ErrNoRows) {
+		return "", nil
+	}
+	if err != nil {
+		return "", fmt.Errorf("%s: %w", op, err)
+	}
+	return value, nil
+}
+
+func (s *service) SetSetting(key, value string) error {
+	const op = "sqlite.database.SetSetting"
+	const query = `
+		INSERT INTO settings (key, value) VALUES (?, ?) ON CONFLICT (key) DO UPDATE SET value = excluded.value;
+	`
+	stmt, err := s.db.Prepare(query)
+	if err != nil {
+		return fmt.Errorf("%s: %w", op, err)
+	}
+	_, err = stmt.Exec(key, value)
+	if err != nil {
+		return fmt.Errorf("%s: %w", op, err)
+	}
+	return nil
+}
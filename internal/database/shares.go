@@ -0,0 +1,114 @@
+package database
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"practic/internal/models"
+	"practic/internal/policy"
+)
+
+var ErrShareNotFound = errors.New("share not found")
+
+// ListingFacts returns what the listing policy decides on: the owner and
+// agency of a listing and the share userID holds on it.
+func (s *service) ListingFacts(id int64, userID int64) (policy.ListingFacts, error) {
+	const op = "sqlite.database.ListingFacts"
+	const query = `
+		SELECT listings.user_id, listings.agency_id, COALESCE(listing_shares.access, ''), listings.deleted_at IS NOT NULL
+		FROM listings LEFT JOIN listing_shares ON listing_shares.listing_id = listings.id AND listing_shares.user_id = ?
+		WHERE listings.id = ?;
+	`
+
+	stmt, err := s.db.Prepare(query)
+	if err != nil {
+		return policy.ListingFacts{}, fmt.Errorf("%s: %w", op, err)
+	}
+
+	var owner sql.NullInt64
+	var facts policy.ListingFacts
+	err = stmt.QueryRow(userID, id).Scan(&owner, &facts.AgencyID, &facts.Share, &facts.Deleted)
+	if errors.Is(err, sql.ErrNoRows) {
+		return policy.ListingFacts{}, fmt.Errorf("%s: %w", op, ErrListingNotFound)
+	}
+	if err != nil {
+		return policy.ListingFacts{}, fmt.Errorf("%s: %w", op, err)
+	}
+	facts.OwnerID = owner.Int64
+	return facts, nil
+}
+
+func (s *service) GetListingShares(id int64) ([]models.ListingShare, error) {
+	const op = "sqlite.database.GetListingShares"
+	const query = `
+		SELECT users.id, users.username, users.name, listing_shares.access, listing_shares.created_at
+		FROM listing_shares JOIN users ON users.id = listing_shares.user_id
+		WHERE listing_shares.listing_id = ?
+		ORDER BY users.username;
+	`
+
+	stmt, err := s.db.Prepare(query)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", op, err)
+	}
+
+	rows, err := stmt.Query(id)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", op, err)
+	}
+	defer rows.Close()
+
+	shares := []models.ListingShare{}
+	for rows.Next() {
+		var sh models.ListingShare
+		if err := rows.Scan(&sh.UserID, &sh.Login, &sh.Name, &sh.Access, &sh.CreatedAt); err != nil {
+			return nil, fmt.Errorf("%s: %w", op, err)
+		}
+		shares = append(shares, sh)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("%s: %w", op, err)
+	}
+
+	return shares, nil
+}
+
+// ShareListing grants userID read or edit access, replacing an earlier grant.
+func (s *service) ShareListing(id int64, userID int64, access string) error {
+	const op = "sqlite.database.ShareListing"
+	const query = `
+		INSERT INTO listing_shares (listing_id, user_id, access) VALUES (?, ?, ?)
+		ON CONFLICT (listing_id, user_id) DO UPDATE SET access = excluded.access;
+	`
+
+	stmt, err := s.db.Prepare(query)
+	if err != nil {
+		return fmt.Errorf("%s: %w", op, err)
+	}
+	_, err = stmt.Exec(id, userID, access)
+	if err != nil {
+		return fmt.Errorf("%s: %w", op, err)
+	}
+	return nil
+}
+
+func (s *service) UnshareListing(id int64, userID int64) error {
+	const op = "sqlite.database.UnshareListing"
+	const query = `
+		DELETE FROM listing_shares WHERE listing_id = ? AND user_id = ?;
+	`
+
+	stmt, err := s.db.Prepare(query)
+	if err != nil {
+		return fmt.Errorf("%s: %w", op, err)
+	}
+	resp, err := stmt.Exec(id, userID)
+	if err != nil {
+		return fmt.Errorf("%s: %w", op, err)
+	}
+	if n, _ := resp.RowsAffected(); n == 0 {
+		return fmt.Errorf("%s: %w", op, ErrShareNotFound)
+	}
+	return nil
+}
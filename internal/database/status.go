@@ -0,0 +1,156 @@
+package database
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"practic/internal/models"
+)
+
+var (
+	ErrUnknownStatus        = errors.New("unknown listing status")
+	ErrTransitionNotAllowed = errors.New("listing status transition not allowed")
+)
+
+// initialStatusQuery opens the history of a new listing with the status it
+// was created with, in the transaction that inserts it.
+const initialStatusQuery = `
+	INSERT INTO listing_status_history (listing_id, from_status, to_status, changed_by) VALUES (?, NULL, ?, ?);
+`
+
+// GetListingStatuses returns the lifecycle in order, each status with the
+// statuses it may move to.
+func (s *service) GetListingStatuses() ([]models.ListingStatus, error) {
+	const op = "sqlite.database.GetListingStatuses"
+	const query = `
+		SELECT listing_statuses.name, listing_statuses.label, COALESCE(listing_status_transitions.to_status, '')
+		FROM listing_statuses
+			LEFT JOIN listing_status_transitions ON listing_status_transitions.from_status = listing_statuses.name
+			LEFT JOIN listing_statuses AS next ON next.name = listing_status_transitions.to_status
+		ORDER BY listing_statuses.position, next.position;
+	`
+	rows, err := s.db.Query(query)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", op, err)
+	}
+	defer rows.Close()
+
+	statuses := []models.ListingStatus{}
+	for rows.Next() {
+		var name, label, next string
+		if err := rows.Scan(&name, &label, &next); err != nil {
+			return nil, fmt.Errorf("%s: %w", op, err)
+		}
+		if len(statuses) == 0 || statuses[len(statuses)-1].Name != name {
+			statuses = append(statuses, models.ListingStatus{Name: name, Label: label, Next: []string{}})
+		}
+		if next != "" {
+			last := &statuses[len(statuses)-1]
+			last.Next = append(last.Next, next)
+		}
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("%s: %w", op, err)
+	}
+
+	return statuses, nil
+}
+
+// TransitionListing moves a listing to another status of its lifecycle and
+// records the change. A zero version skips the optimistic lock check.
+func (s *service) TransitionListing(id int64, to string, userID int64, comment string, version int64) (int64, error) {
+	const op = "sqlite.database.TransitionListing"
+	const currentQuery = `
+		SELECT status, version FROM listings WHERE id = ? AND deleted_at IS NULL;
+	`
+	const statusQuery = `
+		SELECT EXISTS (SELECT 1 FROM listing_statuses WHERE name = ?),
+			EXISTS (SELECT 1 FROM listing_status_transitions WHERE from_status = ? AND to_status = ?);
+	`
+	const query = `
+		UPDATE listings SET status = ?, version = version + 1, updated_at = datetime('now')
+		WHERE id = ?
+		RETURNING version;
+	`
+	const historyQuery = `
+		INSERT INTO listing_status_history (listing_id, from_status, to_status, changed_by, comment) VALUES (?, ?, ?, ?, ?);
+	`
+	tx, err := s.db.Begin()
+	if err != nil {
+		return 0, fmt.Errorf("%s: %w", op, err)
+	}
+	defer tx.Rollback()
+
+	var from string
+	var current int64
+	err = tx.QueryRow(currentQuery, id).Scan(&from, &current)
+	if errors.Is(err, sql.ErrNoRows) {
+		return 0, fmt.Errorf("%s: %w", op, ErrListingNotFound)
+	}
+	if err != nil {
+		return 0, fmt.Errorf("%s: %w", op, err)
+	}
+	if version != 0 && version != current {
+		return 0, fmt.Errorf("%s: %w", op, ErrVersionConflict)
+	}
+
+	var known, allowed bool
+	if err = tx.QueryRow(statusQuery, to, from, to).Scan(&known, &allowed); err != nil {
+		return 0, fmt.Errorf("%s: %w", op, err)
+	}
+	if !known {
+		return 0, fmt.Errorf("%s: %w", op, ErrUnknownStatus)
+	}
+	if !allowed {
+		return 0, fmt.Errorf("%s: %w", op, ErrTransitionNotAllowed)
+	}
+
+	var newVersion int64
+	if err = tx.QueryRow(query, to, id).Scan(&newVersion); err != nil {
+		return 0, fmt.Errorf("%s: %w", op, err)
+	}
+	if _, err = tx.Exec(historyQuery, id, from, to, userID, comment); err != nil {
+		return 0, fmt.Errorf("%s: %w", op, err)
+	}
+	if err = tx.Commit(); err != nil {
+		return 0, fmt.Errorf("%s: %w", op, err)
+	}
+	return newVersion, nil
+}
+
+// GetStatusHistory lists the transitions of a listing, oldest first.
+func (s *service) GetStatusHistory(id int64) ([]models.StatusChange, error) {
+	const op = "sqlite.database.GetStatusHistory"
+	const query = `
+		SELECT listing_status_history.id, from_status, to_status, changed_by, COALESCE(users.name, ''), comment, listing_status_history.created_at
+		FROM listing_status_history LEFT JOIN users ON users.id = listing_status_history.changed_by
+		WHERE listing_id = ?
+		ORDER BY listing_status_history.id;
+	`
+	stmt, err := s.db.Prepare(query)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", op, err)
+	}
+
+	rows, err := stmt.Query(id)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", op, err)
+	}
+	defer rows.Close()
+
+	history := []models.StatusChange{}
+	for rows.Next() {
+		var c models.StatusChange
+		if err := rows.Scan(&c.ID, &c.From, &c.To, &c.UserID, &c.UserName, &c.Comment, &c.CreatedAt); err != nil {
+			return nil, fmt.Errorf("%s: %w", op, err)
+		}
+		history = append(history, c)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("%s: %w", op, err)
+	}
+
+	return history, nil
+}
@@ -0,0 +1,61 @@
+package database
+
+import (
+	"practic/internal/models"
+	"testing"
+)
+
+func TestNewListingsRecordInitialStatus(t *testing.T) {
+	s := newTestService(t)
+	const userID = 1
+
+	created, err := s.CreateListing(models.Listing{Name: "Квартира", Typel: "flat", Status: models.StatusActive, Deal: models.DealSale, City: "Москва", Price: 100, UserID: userID})
+	if err != nil {
+		t.Fatal(err)
+	}
+	imported, err := s.ImportListings(userID, []models.Listing{
+		{Name: "Дом", Typel: "house", Status: models.StatusDraft, Deal: models.DealSale, City: "Тула", Price: 200},
+	}, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for id, status := range map[int64]string{created: models.StatusActive, imported[0]: models.StatusDraft} {
+		history, err := s.GetStatusHistory(id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(history) != 1 || history[0].From != nil || history[0].To != status || history[0].UserID != userID {
+			t.Errorf("history of listing %d = %+v, want one initial %s row", id, history, status)
+		}
+	}
+
+	if _, err := s.TransitionListing(created, models.StatusArchived, userID, "", 0); err != nil {
+		t.Fatal(err)
+	}
+	history, err := s.GetStatusHistory(created)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(history) != 2 || history[1].From == nil || *history[1].From != models.StatusActive {
+		t.Errorf("history after a transition = %+v", history)
+	}
+}
+
+func TestImportDryRunRecordsNothing(t *testing.T) {
+	s := newTestService(t)
+
+	ids, err := s.ImportListings(1, []models.Listing{
+		{Name: "Дом", Typel: "house", Status: models.StatusDraft, Deal: models.DealSale, City: "Тула", Price: 200},
+	}, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var rows int
+	if err := s.db.QueryRow(`SELECT COUNT(*) FROM listing_status_history;`).Scan(&rows); err != nil {
+		t.Fatal(err)
+	}
+	if ids[0] == 0 || rows != 0 {
+		t.Errorf("dry run: ids %v, %d history rows, want a created id and no rows", ids, rows)
+	}
+}
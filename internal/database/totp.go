@@ -0,0 +1,148 @@
+package database
+
+import (
+	"database/sql"
+	"fmt"
+)
+
+// SetTOTPSecret stores a secret that is not active until EnableTOTP confirms it.
+func (s *service) SetTOTPSecret(userID int64, secret string) error {
+	const op = "sqlite.database.SetTOTPSecret"
+	const query = `
+		UPDATE users SET totp_secret = ?, totp_enabled = 0, totp_last_step = 0 WHERE id = ?;
+	`
+	stmt, err := s.db.Prepare(query)
+	if err != nil {
+		return fmt.Errorf("%s: %w", op, err)
+	}
+	_, err = stmt.Exec(secret, userID)
+	if err != nil {
+		return fmt.Errorf("%s: %w", op, err)
+	}
+	return nil
+}
+
+// EnableTOTP turns on two-factor login, stores the recovery codes and signs the
+// user out of every session that was opened with the password alone.
+func (s *service) EnableTOTP(userID int64, recoveryHashes []string) error {
+	const op = "sqlite.database.EnableTOTP"
+	const query = `
+		UPDATE users SET totp_enabled = 1, token_version = token_version + 1 WHERE id = ? AND totp_secret IS NOT NULL;
+	`
+	const sessionsQuery = `
+		UPDATE sessions SET revoked_at = datetime('now') WHERE user_id = ? AND revoked_at IS NULL;
+	`
+	tx, err := s.db.Begin()
+	if err != nil {
+		return fmt.Errorf("%s: %w", op, err)
+	}
+	defer tx.Rollback()
+
+	if _, err = tx.Exec(query, userID); err != nil {
+		return fmt.Errorf("%s: %w", op, err)
+	}
+	if _, err = tx.Exec(sessionsQuery, userID); err != nil {
+		return fmt.Errorf("%s: %w", op, err)
+	}
+	if err = replaceRecoveryCodes(tx, userID, recoveryHashes); err != nil {
+		return fmt.Errorf("%s: %w", op, err)
+	}
+	if err = tx.Commit(); err != nil {
+		return fmt.Errorf("%s: %w", op, err)
+	}
+	return nil
+}
+
+func (s *service) DisableTOTP(userID int64) error {
+	const op = "sqlite.database.DisableTOTP"
+	const query = `
+		UPDATE users SET totp_secret = NULL, totp_enabled = 0, totp_last_step = 0, token_version = token_version + 1 WHERE id = ?;
+	`
+	tx, err := s.db.Begin()
+	if err != nil {
+		return fmt.Errorf("%s: %w", op, err)
+	}
+	defer tx.Rollback()
+
+	if _, err = tx.Exec(query, userID); err != nil {
+		return fmt.Errorf("%s: %w", op, err)
+	}
+	if err = replaceRecoveryCodes(tx, userID, nil); err != nil {
+		return fmt.Errorf("%s: %w", op, err)
+	}
+	if err = tx.Commit(); err != nil {
+		return fmt.Errorf("%s: %w", op, err)
+	}
+	return nil
+}
+
+// UseTOTPStep records the time step of an accepted code. It reports false if
+// that step or a later one was already used, so a code cannot be replayed.
+func (s *service) UseTOTPStep(userID int64, step int64) (bool, error) {
+	const op = "sqlite.database.UseTOTPStep"
+	const query = `
+		UPDATE users SET totp_last_step = ? WHERE id = ? AND totp_last_step < ?;
+	`
+	stmt, err := s.db.Prepare(query)
+	if err != nil {
+		return false, fmt.Errorf("%s: %w", op, err)
+	}
+	resp, err := stmt.Exec(step, userID, step)
+	if err != nil {
+		return false, fmt.Errorf("%s: %w", op, err)
+	}
+	n, err := resp.RowsAffected()
+	if err != nil {
+		return false, fmt.Errorf("%s: %w", op, err)
+	}
+	return n > 0, nil
+}
+
+func (s *service) UseRecoveryCode(userID int64, codeHash string) (bool, error) {
+	const op = "sqlite.database.UseRecoveryCode"
+	const query = `
+		UPDATE recovery_codes SET used_at = datetime('now') WHERE user_id = ? AND code_hash = ? AND used_at IS NULL;
+	`
+	stmt, err := s.db.Prepare(query)
+	if err != nil {
+		return false, fmt.Errorf("%s: %w", op, err)
+	}
+	resp, err := stmt.Exec(userID, codeHash)
+	if err != nil {
+		return false, fmt.Errorf("%s: %w", op, err)
+	}
+	n, err := resp.RowsAffected()
+	if err != nil {
+		return false, fmt.Errorf("%s: %w", op, err)
+	}
+	return n > 0, nil
+}
+
+func (s *service) ReplaceRecoveryCodes(userID int64, recoveryHashes []string) error {
+	const op = "sqlite.database.ReplaceRecoveryCodes"
+	tx, err := s.db.Begin()
+	if err != nil {
+		return fmt.Errorf("%s: %w", op, err)
+	}
+	defer tx.Rollback()
+
+	if err = replaceRecoveryCodes(tx, userID, recoveryHashes); err != nil {
+		return fmt.Errorf("%s: %w", op, err)
+	}
+	if err = tx.Commit(); err != nil {
+		return fmt.Errorf("%s: %w", op, err)
+	}
+	return nil
+}
+
+func replaceRecoveryCodes(tx *sql.Tx, userID int64, recoveryHashes []string) error {
+	if _, err := tx.Exec(`DELETE FROM recovery_codes WHERE user_id = ?;`, userID); err != nil {
+		return err
+	}
+	for _, h := range recoveryHashes {
+		if _, err := tx.Exec(`INSERT INTO recovery_codes (user_id, code_hash) VALUES (?, ?);`, userID, h); err != nil {
+			return err
+		}
+	}
+	return nil
+}
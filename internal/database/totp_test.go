@@ -0,0 +1,28 @@
+package database
+
+import "testing"
+
+func TestUseTOTPStepReplay(t *testing.T) {
+	s := newTestService(t)
+	const userID = 1
+
+	steps := []struct {
+		step int64
+		ok   bool
+	}{
+		{100, true},
+		{100, false}, // тот же код второй раз
+		{99, false},  // код предыдущего шага после более нового
+		{101, true},
+		{101, false},
+	}
+	for _, tt := range steps {
+		ok, err := s.UseTOTPStep(userID, tt.step)
+		if err != nil {
+			t.Fatalf("UseTOTPStep(%d): %v", tt.step, err)
+		}
+		if ok != tt.ok {
+			t.Errorf("UseTOTPStep(%d) = %v, want %v", tt.step, ok, tt.ok)
+		}
+	}
+}
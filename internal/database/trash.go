@@ -0,0 +1,143 @@
+package database
+
+import (
+	"fmt"
+	"practic/internal/models"
+	"time"
+)
+
+// GetDeletedListings returns a page of the trash, most recently deleted
+// first: the listings userID owned and, with editAny, every deleted listing
+// of agencyID, of all agencies if agencyID is 0.
+func (s *service) GetDeletedListings(userID int64, editAny bool, agencyID int64, page models.PageRequest) (models.Page[models.ListingDB], error) {
+	const op = "sqlite.database.GetDeletedListings"
+	const from = `
+		FROM listings LEFT JOIN users ON users.id = listings.user_id
+		WHERE listings.deleted_at IS NOT NULL
+			AND (listings.user_id = ? OR (? AND (? = 0 OR listings.agency_id = ?)))`
+	result := models.Page[models.ListingDB]{Items: []models.ListingDB{}, PageSize: page.Size}
+
+	args := []any{userID, editAny, agencyID, agencyID}
+	if err := s.db.QueryRow(`SELECT COUNT(*)`+from+`;`, args...).Scan(&result.Total); err != nil {
+		return result, fmt.Errorf("%s: %w", op, err)
+	}
+
+	where := ""
+	c, ok, err := decodeCursor(page.Cursor, "deleted_at", true)
+	if err != nil {
+		return result, fmt.Errorf("%s: %w", op, err)
+	}
+	if ok {
+		keyset, keysetArgs := keysetSQL("listings.deleted_at", "listings.id", true, c)
+		where, args = keyset, append(args, keysetArgs...)
+	}
+	query := `
+		SELECT listings.id, listings.name, type, description, listings.status, deal, price, city, COALESCE(listings.user_id, 0), COALESCE(users.name, ''),
+			listings.agency_id, date_created, version, updated_at, deleted_at` + from + where + `
+		ORDER BY listings.deleted_at DESC, listings.id DESC
+		LIMIT ?;
+	`
+	rows, err := s.db.Query(query, append(args, page.Size+1)...)
+	if err != nil {
+		return result, fmt.Errorf("%s: %w", op, err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var l models.ListingDB
+		if err := rows.Scan(&l.ID, &l.Name, &l.Typel, &l.Description, &l.Status, &l.Deal, &l.Price, &l.City, &l.UserID, &l.Agent,
+			&l.AgencyID, &l.Date_created, &l.Version, &l.UpdatedAt, &l.DeletedAt); err != nil {
+			return result, fmt.Errorf("%s: %w", op, err)
+		}
+		result.Items = append(result.Items, l)
+	}
+
+	if err := rows.Err(); err != nil {
+		return result, fmt.Errorf("%s: %w", op, err)
+	}
+	if len(result.Items) > page.Size {
+		result.Items = result.Items[:page.Size]
+		last := result.Items[page.Size-1]
+		result.NextCursor = cursor{Sort: "deleted_at", Desc: true, Value: last.DeletedAt.UTC().Format(dateCreatedLayout), ID: last.ID}.encode()
+	}
+
+	return result, nil
+}
+
+// RestoreListing takes a listing out of the trash. A listing left without an
+// owner by DeleteUser goes to userID, who restores it.
+func (s *service) RestoreListing(id int64, userID int64) error {
+	const op = "sqlite.database.RestoreListing"
+	const query = `
+		UPDATE listings SET deleted_at = NULL,
+			user_id = COALESCE(user_id, ?),
+			version = version + 1, updated_at = datetime('now')
+		WHERE id = ? AND deleted_at IS NOT NULL;
+	`
+	resp, err := s.db.Exec(query, userID, id)
+	if err != nil {
+		return fmt.Errorf("%s: %w", op, err)
+	}
+	if n, _ := resp.RowsAffected(); n == 0 {
+		return fmt.Errorf("%s: %w", op, ErrListingNotFound)
+	}
+	return nil
+}
+
+// PurgeListings removes for good the listings deleted before deletedBefore,
+// with their shares, history and files, and returns the blob keys of the
+// files, which the caller removes from the blob store.
+func (s *service) PurgeListings(deletedBefore time.Time) (blobKeys []string, err error) {
+	const op = "sqlite.database.PurgeListings"
+	const purged = `(SELECT id FROM listings WHERE deleted_at < ?)`
+	dependents := []string{
+		`DELETE FROM listing_shares WHERE listing_id IN ` + purged + `;`,
+		`DELETE FROM listing_price_history WHERE listing_id IN ` + purged + `;`,
+		`DELETE FROM listing_status_history WHERE listing_id IN ` + purged + `;`,
+	}
+	const filesQuery = `
+		DELETE FROM listing_files WHERE listing_id IN ` + purged + ` RETURNING blob_key, thumb_key;
+	`
+	const query = `
+		DELETE FROM listings WHERE deleted_at < ?;
+	`
+	before := deletedBefore.UTC().Format(dateCreatedLayout)
+	tx, err := s.db.Begin()
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", op, err)
+	}
+	defer tx.Rollback()
+
+	for _, q := range dependents {
+		if _, err = tx.Exec(q, before); err != nil {
+			return nil, fmt.Errorf("%s: %w", op, err)
+		}
+	}
+	rows, err := tx.Query(filesQuery, before)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", op, err)
+	}
+	for rows.Next() {
+		var blob, thumb string
+		if err := rows.Scan(&blob, &thumb); err != nil {
+			rows.Close()
+			return nil, fmt.Errorf("%s: %w", op, err)
+		}
+		blobKeys = append(blobKeys, blob)
+		if thumb != "" {
+			blobKeys = append(blobKeys, thumb)
+		}
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return nil, fmt.Errorf("%s: %w", op, err)
+	}
+
+	if _, err = tx.Exec(query, before); err != nil {
+		return nil, fmt.Errorf("%s: %w", op, err)
+	}
+	if err = tx.Commit(); err != nil {
+		return nil, fmt.Errorf("%s: %w", op, err)
+	}
+	return blobKeys, nil
+}
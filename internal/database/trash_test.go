@@ -0,0 +1,54 @@
+package database
+
+import (
+	"practic/internal/models"
+	"testing"
+)
+
+// Listings of a deleted user go to the trash without an owner and to whoever
+// restores them, never to an account that later takes a matching id.
+func TestDeleteUserOrphansListings(t *testing.T) {
+	s := newTestService(t)
+
+	alice, err := s.CreateUser("Alice", "alice", "", []byte("hash"), "active", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	id, err := s.CreateListing(models.Listing{Name: "Flat", Typel: "flat", Status: "active", Deal: "sale", City: "Moscow", Price: 100, UserID: alice})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.DeleteUser(alice); err != nil {
+		t.Fatal(err)
+	}
+	bob, err := s.CreateUser("Bob", "bob", "", []byte("hash"), "active", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	trash, err := s.GetDeletedListings(bob, false, 0, models.PageRequest{Size: 10})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if trash.Total != 0 {
+		t.Errorf("bob's trash holds %d listings of deleted alice", trash.Total)
+	}
+	trash, err = s.GetDeletedListings(1, true, 0, models.PageRequest{Size: 10})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(trash.Items) != 1 || trash.Items[0].ID != id || trash.Items[0].UserID != 0 {
+		t.Fatalf("admin's trash = %+v, want listing %d without an owner", trash.Items, id)
+	}
+
+	if err := s.RestoreListing(id, 1); err != nil {
+		t.Fatal(err)
+	}
+	l, err := s.GetListing(id, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if l.UserID != 1 {
+		t.Errorf("restored listing owner = %d, want the restorer 1", l.UserID)
+	}
+}
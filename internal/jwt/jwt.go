@@ -1,25 +1,148 @@
 package jwt
 
 import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
 	"github.com/golang-jwt/jwt/v5"
-	_ "github.com/joho/godotenv/autoload"
-	"os"
 	"practic/internal/models"
+	"strconv"
 	"time"
 )
 
-func NewToken(user models.UserDB, duration time.Duration) (string, error) {
-	token := jwt.New(jwt.SigningMethodHS256)
-	claims := token.Claims.(jwt.MapClaims)
-	claims["uid"] = user.ID
-	claims["login"] = user.Login
-	claims["name"] = user.Name
-	claims["role"] = user.Role
-	claims["exp"] = time.Now().Add(duration).Unix()
+// Claims is the payload of the access tokens issued at login. Personal
+// access tokens are not JWTs, but are resolved into the same struct with
+// AccessTokenID and Scopes set.
+type Claims struct {
+	UserID       int64  `json:"uid"`
+	SessionID    int64  `json:"sid,omitempty"`
+	Login        string `json:"login,omitempty"`
+	Name         string `json:"name,omitempty"`
+	Role         string `json:"role,omitempty"`
+	AgencyID     int64  `json:"agency,omitempty"`
+	TokenVersion int64  `json:"ver"`
+	MFA          bool   `json:"mfa,omitempty"`
+	Purpose      string `json:"purpose,omitempty"`
 
-	tokenString, err := token.SignedString([]byte(os.Getenv("JWT_KEY")))
+	// ImpersonatorID is the admin acting as the user, 0 for normal logins;
+	// the session and ImpersonatorVersion are the admin's.
+	ImpersonatorID      int64 `json:"imp,omitempty"`
+	ImpersonatorVersion int64 `json:"imp_ver,omitempty"`
+
+	AccessTokenID int64    `json:"-"`
+	Scopes        []string `json:"-"`
+
+	jwt.RegisteredClaims
+}
+
+const purposeMFA = "mfa"
+
+// NewToken issues an access token for user in session sid; mfa records that
+// the session was opened with a second factor.
+func (m *Manager) NewToken(user models.UserDB, sid int64, mfa bool, duration time.Duration) (string, error) {
+	return m.sign(&Claims{
+		UserID:       user.ID,
+		SessionID:    sid,
+		Login:        user.Login,
+		Name:         user.Name,
+		Role:         user.Role,
+		AgencyID:     user.AgencyID,
+		TokenVersion: user.TokenVersion,
+		MFA:          mfa,
+		RegisteredClaims: jwt.RegisteredClaims{
+			Subject:   strconv.FormatInt(user.ID, 10),
+			ExpiresAt: jwt.NewNumericDate(time.Now().Add(duration)),
+		},
+	})
+}
+
+// NewImpersonationToken issues an access token for user on behalf of admin,
+// bound to the admin's session sid.
+func (m *Manager) NewImpersonationToken(user, admin models.UserDB, sid int64, duration time.Duration) (string, error) {
+	return m.sign(&Claims{
+		UserID:              user.ID,
+		SessionID:           sid,
+		Login:               user.Login,
+		Name:                user.Name,
+		Role:                user.Role,
+		AgencyID:            user.AgencyID,
+		TokenVersion:        user.TokenVersion,
+		ImpersonatorID:      admin.ID,
+		ImpersonatorVersion: admin.TokenVersion,
+		RegisteredClaims: jwt.RegisteredClaims{
+			Subject:   strconv.FormatInt(user.ID, 10),
+			ExpiresAt: jwt.NewNumericDate(time.Now().Add(duration)),
+		},
+	})
+}
+
+// ParseToken validates an access token issued by NewToken or
+// NewImpersonationToken.
+func (m *Manager) ParseToken(tokenStr string) (*Claims, error) {
+	claims, err := m.parse(tokenStr)
 	if err != nil {
-		return "", err
+		return nil, err
 	}
-	return tokenString, nil
+	if claims.Purpose != "" || claims.SessionID == 0 {
+		return nil, errors.New("not an access token")
+	}
+	return claims, nil
+}
+
+// NewMFAToken issues a short-lived token proving that the password step of a
+// two-factor login succeeded. It carries no session and is not accepted by
+// ParseToken.
+func (m *Manager) NewMFAToken(userID int64, duration time.Duration) (string, error) {
+	return m.sign(&Claims{
+		UserID:  userID,
+		Purpose: purposeMFA,
+		RegisteredClaims: jwt.RegisteredClaims{
+			Subject:   strconv.FormatInt(userID, 10),
+			ExpiresAt: jwt.NewNumericDate(time.Now().Add(duration)),
+		},
+	})
+}
+
+// ParseMFAToken returns the user id from a token issued by NewMFAToken.
+func (m *Manager) ParseMFAToken(tokenStr string) (int64, error) {
+	claims, err := m.parse(tokenStr)
+	if err != nil {
+		return 0, err
+	}
+	if claims.Purpose != purposeMFA {
+		return 0, errors.New("not an mfa token")
+	}
+	return claims.UserID, nil
+}
+
+// NewOpaqueToken returns a random opaque token (refresh, password reset) and
+// the hash under which it is stored.
+func NewOpaqueToken() (token string, hash string, err error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", "", err
+	}
+	token = base64.RawURLEncoding.EncodeToString(b)
+	return token, HashToken(token), nil
+}
+
+// AccessTokenPrefix marks personal access tokens, so they can be told apart
+// from JWTs in the Authorization header.
+const AccessTokenPrefix = "pat_"
+
+// NewAccessToken returns a new personal access token and its hash.
+func NewAccessToken() (token string, hash string, err error) {
+	token, _, err = NewOpaqueToken()
+	if err != nil {
+		return "", "", err
+	}
+	token = AccessTokenPrefix + token
+	return token, HashToken(token), nil
+}
+
+func HashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
 }
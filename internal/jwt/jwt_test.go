@@ -0,0 +1,222 @@
+package jwt
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"os"
+	"path/filepath"
+	"practic/internal/models"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+const (
+	rsaKid     = "2024-01"
+	ed25519Kid = "2025-01"
+	testSecret = "test-secret"
+)
+
+// newTestManager loads an RSA and an Ed25519 key from a temporary key dir
+// next to the HMAC secret; the Ed25519 key signs, being the last kid.
+func newTestManager(t *testing.T) *Manager {
+	t.Helper()
+
+	dir := t.TempDir()
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	writePEM(t, filepath.Join(dir, rsaKid+".pem"), "RSA PRIVATE KEY", x509.MarshalPKCS1PrivateKey(rsaKey))
+
+	_, edKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	der, err := x509.MarshalPKCS8PrivateKey(edKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	writePEM(t, filepath.Join(dir, ed25519Kid+".pem"), "PRIVATE KEY", der)
+
+	t.Setenv("JWT_KEYS_DIR", dir)
+	t.Setenv("JWT_KEY", testSecret)
+	t.Setenv("JWT_ACTIVE_KID", "")
+	m, err := NewManager()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return m
+}
+
+func writePEM(t *testing.T, file, blockType string, der []byte) {
+	t.Helper()
+	data := pem.EncodeToMemory(&pem.Block{Type: blockType, Bytes: der})
+	if err := os.WriteFile(file, data, 0o600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// forge signs claims with an arbitrary method, kid and key, bypassing the
+// manager's active key.
+func forge(t *testing.T, m *Manager, method jwt.SigningMethod, kid string, signKey any, claims *Claims) string {
+	t.Helper()
+	claims.Issuer = m.issuer
+	claims.Audience = jwt.ClaimStrings{m.audience}
+	token := jwt.NewWithClaims(method, claims)
+	token.Header["kid"] = kid
+	s, err := token.SignedString(signKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+func accessClaims() *Claims {
+	return &Claims{
+		UserID:    7,
+		SessionID: 3,
+		RegisteredClaims: jwt.RegisteredClaims{
+			ExpiresAt: jwt.NewNumericDate(time.Now().Add(time.Minute)),
+		},
+	}
+}
+
+func TestNewManagerKeys(t *testing.T) {
+	m := newTestManager(t)
+
+	if m.active.kid != ed25519Kid {
+		t.Errorf("active kid = %q, want %q", m.active.kid, ed25519Kid)
+	}
+	jwks := m.JWKS()
+	if len(jwks.Keys) != 2 || jwks.Keys[0].Kid != rsaKid || jwks.Keys[1].Kid != ed25519Kid {
+		t.Errorf("JWKS = %+v, want the RSA and Ed25519 keys only", jwks.Keys)
+	}
+
+	t.Setenv("JWT_ACTIVE_KID", rsaKid)
+	m, err := NewManager()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m.active.kid != rsaKid {
+		t.Errorf("active kid = %q, want %q", m.active.kid, rsaKid)
+	}
+
+	t.Setenv("JWT_ACTIVE_KID", "missing")
+	if _, err := NewManager(); err == nil {
+		t.Error("NewManager accepted an unknown JWT_ACTIVE_KID")
+	}
+}
+
+func TestNewManagerBadKeyFile(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "broken.pem"), []byte("not a key"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("JWT_KEYS_DIR", dir)
+	t.Setenv("JWT_KEY", testSecret)
+	if _, err := NewManager(); err == nil {
+		t.Error("NewManager accepted a file without PEM data")
+	}
+}
+
+func TestParseTokenAccepts(t *testing.T) {
+	m := newTestManager(t)
+	user := models.UserDB{ID: 7, Login: "agent", Role: "agent", TokenVersion: 2}
+
+	token, err := m.NewToken(user, 3, true, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	claims, err := m.ParseToken(token)
+	if err != nil {
+		t.Fatalf("ParseToken: %v", err)
+	}
+	if claims.UserID != 7 || claims.SessionID != 3 || claims.TokenVersion != 2 || !claims.MFA {
+		t.Errorf("claims = %+v", claims)
+	}
+
+	// включённая 2FA ещё не значит, что её прошли
+	user.TOTPEnabled = true
+	token, err = m.NewToken(user, 3, false, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if claims, err := m.ParseToken(token); err != nil || claims.MFA {
+		t.Errorf("token without a second factor: claims = %+v, %v", claims, err)
+	}
+
+	// токены, подписанные прежним ключом, действуют до истечения
+	old := forge(t, m, jwt.SigningMethodRS256, rsaKid, m.keys[rsaKid].sign, accessClaims())
+	if _, err := m.ParseToken(old); err != nil {
+		t.Errorf("ParseToken rejected a token of a previous key: %v", err)
+	}
+}
+
+func TestParseTokenRejects(t *testing.T) {
+	m := newTestManager(t)
+
+	_, otherKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mfa, err := m.NewMFAToken(7, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	noSession := accessClaims()
+	noSession.SessionID = 0
+	expired := accessClaims()
+	expired.ExpiresAt = jwt.NewNumericDate(time.Now().Add(-time.Hour))
+
+	tests := []struct {
+		name   string
+		token  string
+		reason string
+	}{
+		{"HS256 with the RSA kid", forge(t, m, jwt.SigningMethodHS256, rsaKid, []byte(testSecret), accessClaims()), "unexpected alg"},
+		{"RS256 with the HMAC kid", forge(t, m, jwt.SigningMethodRS256, hmacKid, m.keys[rsaKid].sign, accessClaims()), "unexpected alg"},
+		{"EdDSA with the RSA kid", forge(t, m, jwt.SigningMethodEdDSA, rsaKid, m.keys[ed25519Kid].sign, accessClaims()), "unexpected alg"},
+		{"unknown kid", forge(t, m, jwt.SigningMethodEdDSA, "2026-01", otherKey, accessClaims()), "unknown kid"},
+		{"signed by another key", forge(t, m, jwt.SigningMethodEdDSA, ed25519Kid, otherKey, accessClaims()), "signature is invalid"},
+		{"mfa token", mfa, "not an access token"},
+		{"no sid", forge(t, m, jwt.SigningMethodEdDSA, ed25519Kid, m.keys[ed25519Kid].sign, noSession), "not an access token"},
+		{"expired", forge(t, m, jwt.SigningMethodEdDSA, ed25519Kid, m.keys[ed25519Kid].sign, expired), "expired"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			claims, err := m.ParseToken(tt.token)
+			if err == nil {
+				t.Fatalf("ParseToken accepted the token: %+v", claims)
+			}
+			if !strings.Contains(err.Error(), tt.reason) {
+				t.Errorf("ParseToken error = %q, want it to mention %q", err, tt.reason)
+			}
+		})
+	}
+}
+
+func TestParseMFAToken(t *testing.T) {
+	m := newTestManager(t)
+
+	mfa, err := m.NewMFAToken(7, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if userID, err := m.ParseMFAToken(mfa); err != nil || userID != 7 {
+		t.Errorf("ParseMFAToken = %d, %v, want 7", userID, err)
+	}
+
+	access, err := m.NewToken(models.UserDB{ID: 7}, 3, false, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := m.ParseMFAToken(access); err == nil {
+		t.Error("ParseMFAToken accepted an access token")
+	}
+}
@@ -0,0 +1,221 @@
+package jwt
+
+import (
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"math/big"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	_ "github.com/joho/godotenv/autoload"
+)
+
+// hmacKid identifies tokens signed with the shared JWT_KEY secret.
+const hmacKid = "hs256"
+
+type key struct {
+	kid    string
+	method jwt.SigningMethod
+	sign   any
+	verify any
+	public crypto.PublicKey // nil for HMAC, such keys are never published
+}
+
+// Manager signs tokens with the active key and accepts tokens signed by any
+// loaded key, so a new key can be rolled out without logging anyone out.
+type Manager struct {
+	active   *key
+	keys     map[string]*key
+	issuer   string
+	audience string
+	leeway   time.Duration
+}
+
+// NewManager loads keys from the environment:
+//
+//   - JWT_KEYS_DIR: directory with PEM encoded RSA or Ed25519 private keys,
+//     the file name without extension is the kid;
+//   - JWT_ACTIVE_KID: key used for signing, defaults to the last kid in
+//     lexical order (name files by date to rotate by adding a file);
+//   - JWT_KEY: HS256 secret, used for signing only when there is no key dir;
+//   - JWT_ISSUER, JWT_AUDIENCE, JWT_LEEWAY: claim checks.
+func NewManager() (*Manager, error) {
+	m := &Manager{
+		keys:     map[string]*key{},
+		issuer:   envOr("JWT_ISSUER", "practic"),
+		audience: envOr("JWT_AUDIENCE", "practic-api"),
+		leeway:   30 * time.Second,
+	}
+	if v := os.Getenv("JWT_LEEWAY"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil {
+			return nil, fmt.Errorf("JWT_LEEWAY: %w", err)
+		}
+		m.leeway = d
+	}
+
+	if secret := os.Getenv("JWT_KEY"); secret != "" {
+		m.keys[hmacKid] = &key{kid: hmacKid, method: jwt.SigningMethodHS256, sign: []byte(secret), verify: []byte(secret)}
+	}
+
+	var kids []string
+	if dir := os.Getenv("JWT_KEYS_DIR"); dir != "" {
+		files, err := filepath.Glob(filepath.Join(dir, "*.pem"))
+		if err != nil {
+			return nil, err
+		}
+		for _, file := range files {
+			k, err := loadKey(file)
+			if err != nil {
+				return nil, fmt.Errorf("%s: %w", file, err)
+			}
+			m.keys[k.kid] = k
+			kids = append(kids, k.kid)
+		}
+	}
+
+	activeKid := os.Getenv("JWT_ACTIVE_KID")
+	if activeKid == "" && len(kids) > 0 {
+		slices.Sort(kids)
+		activeKid = kids[len(kids)-1]
+	}
+	if activeKid == "" {
+		activeKid = hmacKid
+	}
+	m.active = m.keys[activeKid]
+	if m.active == nil {
+		return nil, fmt.Errorf("no signing key %q: set JWT_KEYS_DIR or JWT_KEY", activeKid)
+	}
+
+	return m, nil
+}
+
+func loadKey(file string) (*key, error) {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, errors.New("no PEM data")
+	}
+
+	var private any
+	switch block.Type {
+	case "RSA PRIVATE KEY":
+		private, err = x509.ParsePKCS1PrivateKey(block.Bytes)
+	case "PRIVATE KEY":
+		private, err = x509.ParsePKCS8PrivateKey(block.Bytes)
+	default:
+		err = fmt.Errorf("unsupported PEM block %q", block.Type)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	kid := strings.TrimSuffix(filepath.Base(file), filepath.Ext(file))
+	switch pk := private.(type) {
+	case *rsa.PrivateKey:
+		return &key{kid: kid, method: jwt.SigningMethodRS256, sign: pk, verify: &pk.PublicKey, public: &pk.PublicKey}, nil
+	case ed25519.PrivateKey:
+		pub := pk.Public()
+		return &key{kid: kid, method: jwt.SigningMethodEdDSA, sign: pk, verify: pub, public: pub}, nil
+	default:
+		return nil, fmt.Errorf("unsupported key type %T", private)
+	}
+}
+
+func (m *Manager) sign(claims *Claims) (string, error) {
+	claims.Issuer = m.issuer
+	claims.Audience = jwt.ClaimStrings{m.audience}
+	claims.IssuedAt = jwt.NewNumericDate(time.Now())
+
+	token := jwt.NewWithClaims(m.active.method, claims)
+	token.Header["kid"] = m.active.kid
+	return token.SignedString(m.active.sign)
+}
+
+func (m *Manager) parse(tokenStr string) (*Claims, error) {
+	claims := &Claims{}
+	methods := make([]string, 0, len(m.keys))
+	for _, k := range m.keys {
+		methods = append(methods, k.method.Alg())
+	}
+
+	_, err := jwt.ParseWithClaims(tokenStr, claims, func(token *jwt.Token) (interface{}, error) {
+		kid, _ := token.Header["kid"].(string)
+		k, ok := m.keys[kid]
+		if !ok {
+			return nil, fmt.Errorf("unknown kid %q", kid)
+		}
+		// алгоритм берём из ключа, а не из заголовка токена
+		if token.Method.Alg() != k.method.Alg() {
+			return nil, fmt.Errorf("unexpected alg %q for kid %q", token.Method.Alg(), kid)
+		}
+		return k.verify, nil
+	},
+		jwt.WithValidMethods(methods),
+		jwt.WithIssuer(m.issuer),
+		jwt.WithAudience(m.audience),
+		jwt.WithLeeway(m.leeway),
+		jwt.WithExpirationRequired(),
+	)
+	if err != nil {
+		return nil, err
+	}
+	return claims, nil
+}
+
+type JWK struct {
+	Kty string `json:"kty"`
+	Use string `json:"use"`
+	Alg string `json:"alg"`
+	Kid string `json:"kid"`
+	N   string `json:"n,omitempty"`
+	E   string `json:"e,omitempty"`
+	Crv string `json:"crv,omitempty"`
+	X   string `json:"x,omitempty"`
+}
+
+type JWKS struct {
+	Keys []JWK `json:"keys"`
+}
+
+// JWKS returns the public halves of all asymmetric keys, sorted by kid.
+func (m *Manager) JWKS() JWKS {
+	set := JWKS{Keys: []JWK{}}
+	for _, k := range m.keys {
+		switch pub := k.public.(type) {
+		case *rsa.PublicKey:
+			set.Keys = append(set.Keys, JWK{
+				Kty: "RSA", Use: "sig", Alg: k.method.Alg(), Kid: k.kid,
+				N: base64.RawURLEncoding.EncodeToString(pub.N.Bytes()),
+				E: base64.RawURLEncoding.EncodeToString(big.NewInt(int64(pub.E)).Bytes()),
+			})
+		case ed25519.PublicKey:
+			set.Keys = append(set.Keys, JWK{
+				Kty: "OKP", Use: "sig", Alg: k.method.Alg(), Kid: k.kid,
+				Crv: "Ed25519", X: base64.RawURLEncoding.EncodeToString(pub),
+			})
+		}
+	}
+	slices.SortFunc(set.Keys, func(a, b JWK) int { return strings.Compare(a.Kid, b.Kid) })
+	return set
+}
+
+func envOr(name, fallback string) string {
+	if v := os.Getenv(name); v != "" {
+		return v
+	}
+	return fallback
+}
@@ -0,0 +1,13 @@
+package models
+
+import (
+	"time"
+)
+
+type Agency struct {
+	ID        int64     `json:"id"`
+	Name      string    `json:"name"`
+	CreatedAt time.Time `json:"created_at"`
+	Users     int64     `json:"users"`
+	Listings  int64     `json:"listings"`
+}
@@ -0,0 +1,52 @@
+package models
+
+import "time"
+
+// Portals a listing feed is generated for.
+const (
+	PortalYandex = "yandex"
+	PortalAvito  = "avito"
+)
+
+// FeedOwner is whose listings a feed carries: an agent's (UserID) or a whole
+// agency's (AgencyID), never both.
+type FeedOwner struct {
+	UserID   int64
+	AgencyID int64
+}
+
+// FeedToken describes the token of a feed. The token itself is only shown
+// when it is created.
+type FeedToken struct {
+	CreatedAt  time.Time  `json:"created_at"`
+	LastUsedAt *time.Time `json:"last_used_at,omitempty"`
+}
+
+// FeedListing is a syndicated listing with what a feed publishes besides the
+// listing itself: the agent's contacts, the agency and the photos, cover
+// first.
+type FeedListing struct {
+	ListingDB
+	AgentPhone string
+	AgentEmail string
+	Agency     string
+	Photos     []int64
+}
+
+// FeedProblem lists the fields each portal is missing for a listing.
+type FeedProblem struct {
+	ID      int64               `json:"id"`
+	Title   string              `json:"title"`
+	Status  string              `json:"status"`
+	Missing map[string][]string `json:"missing"`
+}
+
+// FeedReport sums up a feed: how many listings opted in, how many each portal
+// gets and what keeps the rest out.
+type FeedReport struct {
+	Token    *FeedToken     `json:"token"`
+	Phone    string         `json:"phone,omitempty"`
+	Listings int            `json:"listings"`
+	Ready    map[string]int `json:"ready"`
+	Problems []FeedProblem  `json:"problems"`
+}
@@ -0,0 +1,32 @@
+package models
+
+import "time"
+
+const (
+	FilePhoto    = "photo"
+	FileDocument = "document"
+)
+
+// ListingFile is a photo or document attached to a listing. The content
+// lives in the blob store under BlobKey, photos also have a JPEG thumbnail
+// under ThumbKey.
+type ListingFile struct {
+	ID          int64     `json:"id"`
+	ListingID   int64     `json:"listing_id"`
+	Kind        string    `json:"kind"`
+	Name        string    `json:"name"`
+	ContentType string    `json:"content_type"`
+	Size        int64     `json:"size"`
+	Width       int       `json:"width,omitempty"`
+	Height      int       `json:"height,omitempty"`
+	Position    int64     `json:"position"`
+	Cover       bool      `json:"cover"`
+	CreatedBy   int64     `json:"created_by"`
+	CreatedAt   time.Time `json:"created_at"`
+
+	URL      string `json:"url"`
+	ThumbURL string `json:"thumb_url,omitempty"`
+
+	BlobKey  string `json:"-"`
+	ThumbKey string `json:"-"`
+}
@@ -0,0 +1,29 @@
+package models
+
+// Results of an imported row.
+const (
+	ImportCreated = "created"
+	ImportSkipped = "skipped"
+	ImportFailed  = "failed"
+)
+
+// ImportRow is the outcome of one row of a listing import. Row is the line
+// of a CSV file or the 1-based position in a JSON array.
+type ImportRow struct {
+	Row    int      `json:"row"`
+	Result string   `json:"result"`
+	ID     int64    `json:"id,omitempty"`
+	Reason string   `json:"reason,omitempty"`
+	Errors []string `json:"errors,omitempty"`
+}
+
+// ImportReport sums up a listing import. In a dry run nothing is written and
+// Created counts the rows that would be created.
+type ImportReport struct {
+	DryRun         bool        `json:"dry_run"`
+	Created        int         `json:"created"`
+	Skipped        int         `json:"skipped"`
+	Failed         int         `json:"failed"`
+	IgnoredColumns []string    `json:"ignored_columns,omitempty"`
+	Rows           []ImportRow `json:"rows"`
+}
@@ -0,0 +1,15 @@
+package models
+
+import (
+	"time"
+)
+
+type Invite struct {
+	ID        int64      `json:"id"`
+	AgencyID  int64      `json:"agency_id"`
+	CreatedBy *int64     `json:"created_by"`
+	CreatedAt time.Time  `json:"created_at"`
+	ExpiresAt *time.Time `json:"expires_at"`
+	UsedAt    *time.Time `json:"used_at"`
+	UsedBy    *int64     `json:"used_by"`
+}
@@ -10,11 +10,38 @@ type ListingDB struct {
 	Typel        string
 	Description  string
 	Status       string
+	Deal         string
 	Price        float64
 	City         string
 	UserID       int64
 	Date_created time.Time
 	Agent        string
+	AgencyID     int64
+	Version      int64
+	UpdatedAt    time.Time
+	DeletedAt    *time.Time `json:",omitempty"`
+
+	// Address, area, rooms and floors are what the portal feeds need,
+	// Syndicate opts the listing into them.
+	Address   string
+	Area      float64
+	Rooms     int64
+	Floor     int64
+	Floors    int64
+	Syndicate bool
+
+	// Share is the access granted to the requesting user by the owner, "" for
+	// own listings; Actions is what the requesting user may do.
+	Share   string   `json:",omitempty"`
+	Actions []string `json:",omitempty"`
+}
+
+type ListingShare struct {
+	UserID    int64     `json:"user_id"`
+	Login     string    `json:"login"`
+	Name      string    `json:"name"`
+	Access    string    `json:"access"`
+	CreatedAt time.Time `json:"created_at"`
 }
 
 type Listing struct {
@@ -22,7 +49,87 @@ type Listing struct {
 	Typel       string `json:"type"`
 	Description string `json:"description"`
 	Status      string `json:"status"`
+	Deal        string `json:"deal"`
 	Price       int64  `json:"price"`
 	City        string `json:"city"`
 	UserID      int64
+
+	Address   string  `json:"address"`
+	Area      float64 `json:"area"`
+	Rooms     int64   `json:"rooms"`
+	Floor     int64   `json:"floor"`
+	Floors    int64   `json:"floors"`
+	Syndicate bool    `json:"syndicate"`
+
+	// Version is the version the client edited, used when If-Match is not sent.
+	Version int64 `json:"version"`
+}
+
+// ListingFilter narrows and orders a list of listings. Zero values match
+// everything.
+type ListingFilter struct {
+	City     string
+	Type     string
+	Status   string
+	Deal     string
+	PriceMin *int64
+	PriceMax *int64
+
+	// CreatedFrom is inclusive and CreatedTo exclusive.
+	CreatedFrom time.Time
+	CreatedTo   time.Time
+
+	// Query is a full-text search over the title and description.
+	Query string
+
+	// Sort is one of the ListingSort* fields, newest first by default.
+	Sort string
+	Desc bool
+}
+
+const (
+	ListingSortCreated = "date_created"
+	ListingSortUpdated = "updated_at"
+	ListingSortPrice   = "price"
+	ListingSortTitle   = "title"
+	ListingSortCity    = "city"
+)
+
+const (
+	StatusDraft    = "draft"
+	StatusActive   = "active"
+	StatusArchived = "archived"
+
+	DealSale = "sale"
+	DealRent = "rent"
+)
+
+// ListingStatus is a step of the listing lifecycle and the statuses a
+// listing may move to from it.
+type ListingStatus struct {
+	Name  string   `json:"name"`
+	Label string   `json:"label"`
+	Next  []string `json:"next"`
+}
+
+// StatusChange is a recorded transition of a listing. The first one has no
+// From: it is the status the listing was created with.
+type StatusChange struct {
+	ID        int64     `json:"id"`
+	From      *string   `json:"from"`
+	To        string    `json:"to"`
+	UserID    int64     `json:"user_id"`
+	UserName  string    `json:"user_name"`
+	Comment   string    `json:"comment"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// PriceChange is a recorded change of a listing price.
+type PriceChange struct {
+	ID        int64     `json:"id"`
+	OldPrice  int64     `json:"old_price"`
+	NewPrice  int64     `json:"new_price"`
+	UserID    int64     `json:"user_id"`
+	UserName  string    `json:"user_name"`
+	CreatedAt time.Time `json:"created_at"`
 }
@@ -0,0 +1,13 @@
+package models
+
+import (
+	"time"
+)
+
+type LoginFailure struct {
+	Kind          string     `json:"kind"`
+	Value         string     `json:"value"`
+	Failures      int64      `json:"failures"`
+	LastFailureAt time.Time  `json:"last_failure_at"`
+	LockedUntil   *time.Time `json:"locked_until"`
+}
@@ -0,0 +1,17 @@
+package models
+
+// PageRequest asks for Size items following Cursor, from the start if the
+// cursor is empty.
+type PageRequest struct {
+	Size   int
+	Cursor string
+}
+
+// Page is one page of a list. Total counts the items on all pages;
+// NextCursor is empty on the last page.
+type Page[T any] struct {
+	Items      []T    `json:"items"`
+	Total      int64  `json:"total"`
+	PageSize   int    `json:"page_size"`
+	NextCursor string `json:"next_cursor,omitempty"`
+}
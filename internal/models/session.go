@@ -0,0 +1,22 @@
+package models
+
+import (
+	"time"
+)
+
+type SessionDB struct {
+	ID     int64
+	UserID int64
+	// MFA is whether the session was opened with a second factor.
+	MFA bool
+}
+
+type Session struct {
+	ID         int64     `json:"id"`
+	UserAgent  string    `json:"user_agent"`
+	IP         string    `json:"ip"`
+	CreatedAt  time.Time `json:"created_at"`
+	LastUsedAt time.Time `json:"last_used_at"`
+	ExpiresAt  time.Time `json:"expires_at"`
+	Current    bool      `json:"current"`
+}
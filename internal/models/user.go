@@ -1,9 +1,14 @@
 package models
 
+import "time"
+
 type User struct {
 	Login    string
 	Password string
 	Name     string
+	Email    string
+
+	InviteCode string `json:"invite_code"`
 }
 
 type UserDB struct {
@@ -12,12 +17,26 @@ type UserDB struct {
 	Password string `json:"password"`
 	Name     string `json:"name"`
 	Role     string `json:"role"`
+	Email    string `json:"email"`
+	Status   string `json:"status"`
+	AgencyID int64  `json:"agency_id"`
+
+	TokenVersion int64 `json:"token_version"`
+
+	TOTPSecret   string `json:"-"`
+	TOTPEnabled  bool   `json:"totp_enabled"`
+	TOTPLastStep int64  `json:"-"`
 }
 
 type UserAdmin struct {
-	ID    int64  `json:"id"`
-	Login string `json:"login"`
-	Total int64  `json:"total"`
-	Name  string `json:"name"`
-	Role  string `json:"role"`
+	ID       int64  `json:"id"`
+	Login    string `json:"login"`
+	Total    int64  `json:"total"`
+	Name     string `json:"name"`
+	Role     string `json:"role"`
+	Status   string `json:"status"`
+	AgencyID int64  `json:"agency_id"`
+	Agency   string `json:"agency"`
+
+	CreatedAt time.Time `json:"created_at"`
 }
@@ -0,0 +1,121 @@
+// Package policy decides what a user may do with a listing. It holds no
+// state: handlers load the facts from the database and ask Listing.
+package policy
+
+import (
+	"slices"
+)
+
+type Action string
+
+const (
+	Read   Action = "read"
+	Edit   Action = "edit"
+	Delete Action = "delete"
+	Share  Action = "share"
+
+	// Restore takes a listing out of the trash. It is the only action on
+	// a deleted listing.
+	Restore Action = "restore"
+)
+
+// Share levels granted to other users through listing_shares.
+const (
+	ShareRead = "read"
+	ShareEdit = "edit"
+)
+
+// Permissions mirrored from the role_permissions table.
+const (
+	permViewAll     = "listings.view_all"
+	permEditAny     = "listings.edit_any"
+	permAllAgencies = "agencies.manage"
+)
+
+// Principal is the user asking for access.
+type Principal struct {
+	UserID      int64
+	AgencyID    int64
+	Permissions []string
+}
+
+// ListingFacts is what the policy needs to know about a listing: its owner,
+// the agency it belongs to, the share granted to the principal, "" if none,
+// and whether it is in the trash.
+type ListingFacts struct {
+	OwnerID  int64
+	AgencyID int64
+	Share    string
+	Deleted  bool
+}
+
+// has reports whether p holds permission for listings of agencyID. Listing
+// permissions only reach into other agencies together with agencies.manage.
+func (p Principal) has(permission string, agencyID int64) bool {
+	if !slices.Contains(p.Permissions, permission) {
+		return false
+	}
+	return p.AgencyID == agencyID || slices.Contains(p.Permissions, permAllAgencies)
+}
+
+type Decision int
+
+const (
+	// Allow lets the action through.
+	Allow Decision = iota
+	// Forbid means the principal can see the listing but not do this
+	// action, answered with 403.
+	Forbid
+	// Hide means the principal may not know the listing exists, answered
+	// with 404.
+	Hide
+)
+
+// Listing decides whether p may perform action on a listing.
+//
+//   - the owner and holders of listings.edit_any may do anything;
+//   - an edit share allows reading and editing;
+//   - a read share and listings.view_all allow reading only;
+//   - a deleted listing may only be restored, by those who may delete it.
+//
+// listings.view_all and listings.edit_any apply to the principal's own
+// agency unless they also hold agencies.manage.
+func Listing(p Principal, l ListingFacts, action Action) Decision {
+	// a deleted listing exists only for those who could delete it, and
+	// only to be restored
+	if l.Deleted || action == Restore {
+		if l.Deleted && action == Restore && (p.UserID == l.OwnerID || p.has(permEditAny, l.AgencyID)) {
+			return Allow
+		}
+		return Hide
+	}
+	if p.UserID == l.OwnerID || p.has(permEditAny, l.AgencyID) {
+		return Allow
+	}
+
+	canRead := l.Share == ShareRead || l.Share == ShareEdit || p.has(permViewAll, l.AgencyID)
+	if !canRead {
+		return Hide
+	}
+	switch action {
+	case Read:
+		return Allow
+	case Edit:
+		if l.Share == ShareEdit {
+			return Allow
+		}
+	}
+	return Forbid
+}
+
+// Actions lists everything p may do with a listing, for clients that show
+// or hide controls.
+func Actions(p Principal, l ListingFacts) []Action {
+	actions := []Action{}
+	for _, a := range []Action{Read, Edit, Delete, Share, Restore} {
+		if Listing(p, l, a) == Allow {
+			actions = append(actions, a)
+		}
+	}
+	return actions
+}
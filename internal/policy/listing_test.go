@@ -0,0 +1,88 @@
+package policy
+
+import (
+	"slices"
+	"testing"
+)
+
+func TestListing(t *testing.T) {
+	const (
+		owner   = 1
+		agent   = 2
+		agency  = 10
+		agency2 = 20
+	)
+	listing := ListingFacts{OwnerID: owner, AgencyID: agency}
+	shared := func(level string) ListingFacts {
+		l := listing
+		l.Share = level
+		return l
+	}
+	deleted := listing
+	deleted.Deleted = true
+	deletedShared := shared(ShareEdit)
+	deletedShared.Deleted = true
+
+	actions := []Action{Read, Edit, Delete, Share, Restore}
+	tests := []struct {
+		name string
+		p    Principal
+		l    ListingFacts
+		want []Decision // в порядке actions
+	}{
+		{"owner", Principal{UserID: owner, AgencyID: agency}, listing,
+			[]Decision{Allow, Allow, Allow, Allow, Hide}},
+		{"read share", Principal{UserID: agent, AgencyID: agency}, shared(ShareRead),
+			[]Decision{Allow, Forbid, Forbid, Forbid, Hide}},
+		{"edit share", Principal{UserID: agent, AgencyID: agency}, shared(ShareEdit),
+			[]Decision{Allow, Allow, Forbid, Forbid, Hide}},
+		{"same agency", Principal{UserID: agent, AgencyID: agency}, listing,
+			[]Decision{Hide, Hide, Hide, Hide, Hide}},
+		{"other agency", Principal{UserID: agent, AgencyID: agency2}, listing,
+			[]Decision{Hide, Hide, Hide, Hide, Hide}},
+		{"view_all", Principal{UserID: agent, AgencyID: agency, Permissions: []string{permViewAll}}, listing,
+			[]Decision{Allow, Forbid, Forbid, Forbid, Hide}},
+		{"view_all in other agency", Principal{UserID: agent, AgencyID: agency2, Permissions: []string{permViewAll}}, listing,
+			[]Decision{Hide, Hide, Hide, Hide, Hide}},
+		{"view_all with agencies.manage", Principal{UserID: agent, AgencyID: agency2, Permissions: []string{permViewAll, permAllAgencies}}, listing,
+			[]Decision{Allow, Forbid, Forbid, Forbid, Hide}},
+		{"edit_any", Principal{UserID: agent, AgencyID: agency, Permissions: []string{permEditAny}}, listing,
+			[]Decision{Allow, Allow, Allow, Allow, Hide}},
+		{"edit_any in other agency", Principal{UserID: agent, AgencyID: agency2, Permissions: []string{permEditAny}}, listing,
+			[]Decision{Hide, Hide, Hide, Hide, Hide}},
+		{"edit_any with agencies.manage", Principal{UserID: agent, AgencyID: agency2, Permissions: []string{permEditAny, permAllAgencies}}, listing,
+			[]Decision{Allow, Allow, Allow, Allow, Hide}},
+		{"deleted, owner", Principal{UserID: owner, AgencyID: agency}, deleted,
+			[]Decision{Hide, Hide, Hide, Hide, Allow}},
+		{"deleted, edit_any", Principal{UserID: agent, AgencyID: agency, Permissions: []string{permEditAny}}, deleted,
+			[]Decision{Hide, Hide, Hide, Hide, Allow}},
+		{"deleted, view_all", Principal{UserID: agent, AgencyID: agency, Permissions: []string{permViewAll}}, deleted,
+			[]Decision{Hide, Hide, Hide, Hide, Hide}},
+		{"deleted, edit share", Principal{UserID: agent, AgencyID: agency}, deletedShared,
+			[]Decision{Hide, Hide, Hide, Hide, Hide}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for i, action := range actions {
+				if got := Listing(tt.p, tt.l, action); got != tt.want[i] {
+					t.Errorf("%s: got %s, want %s", action, decisionName(got), decisionName(tt.want[i]))
+				}
+			}
+		})
+	}
+}
+
+func TestActions(t *testing.T) {
+	p := Principal{UserID: 2, AgencyID: 10}
+	got := Actions(p, ListingFacts{OwnerID: 1, AgencyID: 10, Share: ShareEdit})
+	if want := []Action{Read, Edit}; !slices.Equal(got, want) {
+		t.Errorf("Actions = %v, want %v", got, want)
+	}
+	if got := Actions(p, ListingFacts{OwnerID: 1, AgencyID: 10}); len(got) != 0 {
+		t.Errorf("Actions without access = %v, want none", got)
+	}
+}
+
+func decisionName(d Decision) string {
+	return [...]string{Allow: "Allow", Forbid: "Forbid", Hide: "Hide"}[d]
+}
@@ -2,13 +2,30 @@ package server
 
 import (
 	"encoding/json"
+	"errors"
 	"net/http"
+	"practic/internal/database"
 	"practic/internal/logger/sl"
 )
 
 func (s *Server) AdminUsersHandler(w http.ResponseWriter, r *http.Request) {
-	users, err := s.db.GetAllUsers()
+	page, err := pageRequest(r.URL.Query())
 	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	scope, err := s.agencyScope(r)
+	if err != nil {
+		s.log.Error("Error getting agency scope", sl.Err(err))
+		http.Error(w, "Failed to fetch users", http.StatusInternalServerError)
+		return
+	}
+	users, err := s.db.GetAllUsers(scope, page)
+	if err != nil {
+		if errors.Is(err, database.ErrInvalidCursor) {
+			http.Error(w, "Invalid cursor", http.StatusBadRequest)
+			return
+		}
 		s.log.Error("Error fetching users", sl.Err(err))
 		http.Error(w, "Failed to fetch users", http.StatusInternalServerError)
 		return
@@ -28,8 +45,28 @@ func (s *Server) AdminUsersHandler(w http.ResponseWriter, r *http.Request) {
 }
 
 func (s *Server) AdminListingsHandler(w http.ResponseWriter, r *http.Request) {
-	listings, err := s.db.GetAllListings()
+	filter, err := parseListingFilter(r.URL.Query())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	page, err := pageRequest(r.URL.Query())
 	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	scope, err := s.agencyScope(r)
+	if err != nil {
+		s.log.Error("Error getting agency scope", sl.Err(err))
+		http.Error(w, "Failed to fetch listings", http.StatusInternalServerError)
+		return
+	}
+	listings, err := s.db.GetAllListings(scope, filter, page)
+	if err != nil {
+		if errors.Is(err, database.ErrInvalidCursor) {
+			http.Error(w, "Invalid cursor", http.StatusBadRequest)
+			return
+		}
 		s.log.Error("Error fetching listings", sl.Err(err))
 		http.Error(w, "Failed to fetch listings", http.StatusInternalServerError)
 		return
@@ -47,6 +84,26 @@ func (s *Server) AdminListingsHandler(w http.ResponseWriter, r *http.Request) {
 	_, _ = w.Write(jsonResp)
 }
 
+func (s *Server) AdminRolesHandler(w http.ResponseWriter, r *http.Request) {
+	roles, err := s.db.GetRoles()
+	if err != nil {
+		s.log.Error("Error fetching roles", sl.Err(err))
+		http.Error(w, "Failed to fetch roles", http.StatusInternalServerError)
+		return
+	}
+
+	jsonResp, err := json.Marshal(roles)
+	if err != nil {
+		s.log.Error("Error marshalling roles", sl.Err(err))
+		http.Error(w, "Failed to process roles data", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	_, _ = w.Write(jsonResp)
+}
+
 func (s *Server) AdminSetRoleHandler(w http.ResponseWriter, r *http.Request) {
 	var req struct {
 		UserID int64  `json:"user_id"`
@@ -60,8 +117,39 @@ func (s *Server) AdminSetRoleHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	if !s.authorizeUser(w, r, req.UserID) {
+		return
+	}
+	// роль с доступом ко всем агентствам выдаёт только тот, у кого он уже есть
+	granted, err := s.hasPermission(req.Role, PermManageAgencies)
+	if err != nil {
+		s.log.Error("Error in getting permissions", sl.Err(err))
+		http.Error(w, "Failed to set user role", http.StatusInternalServerError)
+		return
+	}
+	if granted {
+		held, err := s.hasPermission(userClaims(r).Role, PermManageAgencies)
+		if err != nil {
+			s.log.Error("Error in getting permissions", sl.Err(err))
+			http.Error(w, "Failed to set user role", http.StatusInternalServerError)
+			return
+		}
+		if !held {
+			http.Error(w, "Forbidden", http.StatusForbidden)
+			return
+		}
+	}
+
 	err = s.db.SetUserRole(req.UserID, req.Role)
 	if err != nil {
+		if errors.Is(err, database.ErrRoleNotFound) {
+			http.Error(w, "Unknown role", http.StatusBadRequest)
+			return
+		}
+		if errors.Is(err, database.ErrUserNotFound) {
+			http.Error(w, "User not found", http.StatusNotFound)
+			return
+		}
 		s.log.Error("Error setting user role", sl.Err(err))
 		http.Error(w, "Failed to set user role", http.StatusInternalServerError)
 		return
@@ -82,6 +170,10 @@ func (s *Server) AdminDeleteUserHandler(w http.ResponseWriter, r *http.Request)
 		return
 	}
 
+	if !s.authorizeUser(w, r, req.UserID) {
+		return
+	}
+
 	err = s.db.DeleteUser(req.UserID)
 	if err != nil {
 		s.log.Error("Error deleting user", sl.Err(err))
@@ -91,3 +183,50 @@ func (s *Server) AdminDeleteUserHandler(w http.ResponseWriter, r *http.Request)
 
 	w.WriteHeader(http.StatusOK)
 }
+
+func (s *Server) AdminLockoutsHandler(w http.ResponseWriter, r *http.Request) {
+	failures, err := s.db.GetLoginFailures()
+	if err != nil {
+		s.log.Error("Error fetching login failures", sl.Err(err))
+		http.Error(w, "Failed to fetch lockouts", http.StatusInternalServerError)
+		return
+	}
+
+	jsonResp, err := json.Marshal(failures)
+	if err != nil {
+		s.log.Error("Error marshalling login failures", sl.Err(err))
+		http.Error(w, "Failed to process lockouts data", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	_, _ = w.Write(jsonResp)
+}
+
+func (s *Server) AdminClearLockoutHandler(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Kind  string `json:"kind"`
+		Value string `json:"value"`
+	}
+
+	err := json.NewDecoder(r.Body).Decode(&req)
+	if err != nil {
+		s.log.Error("Error decoding request body", sl.Err(err))
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	if req.Kind != "login" && req.Kind != "ip" {
+		http.Error(w, "Invalid lockout kind", http.StatusBadRequest)
+		return
+	}
+
+	err = s.db.ClearLoginFailures(req.Kind, req.Value)
+	if err != nil {
+		s.log.Error("Error clearing lockout", sl.Err(err))
+		http.Error(w, "Failed to clear lockout", http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+}
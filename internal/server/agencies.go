@@ -0,0 +1,134 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net/http"
+	"practic/internal/database"
+	"practic/internal/logger/sl"
+	"strings"
+)
+
+func (s *Server) AdminAgenciesHandler(w http.ResponseWriter, r *http.Request) {
+	agencies, err := s.db.GetAgencies()
+	if err != nil {
+		s.log.Error("Error fetching agencies", sl.Err(err))
+		http.Error(w, "Failed to fetch agencies", http.StatusInternalServerError)
+		return
+	}
+
+	jsonResp, err := json.Marshal(agencies)
+	if err != nil {
+		s.log.Error("Error marshalling agencies", sl.Err(err))
+		http.Error(w, "Failed to process agencies data", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	_, _ = w.Write(jsonResp)
+}
+
+func (s *Server) AdminCreateAgencyHandler(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Name string `json:"name"`
+	}
+	err := json.NewDecoder(r.Body).Decode(&req)
+	if err != nil {
+		s.log.Error("Error decoding request body", sl.Err(err))
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	req.Name = strings.TrimSpace(req.Name)
+	if err := validateName(req.Name); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	id, err := s.db.CreateAgency(req.Name)
+	if err != nil {
+		if errors.Is(err, database.ErrAgencyExists) {
+			http.Error(w, "Agency already exists", http.StatusConflict)
+			return
+		}
+		s.log.Error("Error creating agency", sl.Err(err))
+		http.Error(w, "Failed to create agency", http.StatusInternalServerError)
+		return
+	}
+
+	s.log.Info("Agency created", slog.Int64("id", id), slog.Int64("admin_id", userClaims(r).UserID))
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(map[string]any{"id": id, "name": req.Name})
+}
+
+// AdminSetAgencyHandler moves a user with their listings to another agency.
+func (s *Server) AdminSetAgencyHandler(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		UserID   int64 `json:"user_id"`
+		AgencyID int64 `json:"agency_id"`
+	}
+	err := json.NewDecoder(r.Body).Decode(&req)
+	if err != nil {
+		s.log.Error("Error decoding request body", sl.Err(err))
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	err = s.db.SetUserAgency(req.UserID, req.AgencyID)
+	if err != nil {
+		if errors.Is(err, database.ErrAgencyNotFound) {
+			http.Error(w, "Agency not found", http.StatusBadRequest)
+			return
+		}
+		if errors.Is(err, database.ErrUserNotFound) {
+			http.Error(w, "User not found", http.StatusNotFound)
+			return
+		}
+		s.log.Error("Error setting user agency", sl.Err(err))
+		http.Error(w, "Failed to set user agency", http.StatusInternalServerError)
+		return
+	}
+
+	s.log.Info("User moved to agency", slog.Int64("id", req.UserID), slog.Int64("agency_id", req.AgencyID), slog.Int64("admin_id", userClaims(r).UserID))
+	w.WriteHeader(http.StatusOK)
+}
+
+// AdminAnalyticsHandler returns the analytics of the caller's agency, of all
+// agencies or the one picked with agency_id for holders of agencies.manage.
+func (s *Server) AdminAnalyticsHandler(w http.ResponseWriter, r *http.Request) {
+	scope, err := s.agencyScope(r)
+	if err != nil {
+		s.log.Error("Error getting agency scope", sl.Err(err))
+		http.Error(w, "Failed to fetch analytics", http.StatusInternalServerError)
+		return
+	}
+	analytics, err := s.db.GetAgencyAnalytics(scope)
+	if err != nil {
+		s.log.Error("Error fetching analytics", sl.Err(err))
+		http.Error(w, "Failed to fetch analytics", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(analytics)
+}
+
+func (s *Server) AdminCitiesHandler(w http.ResponseWriter, r *http.Request) {
+	scope, err := s.agencyScope(r)
+	if err != nil {
+		s.log.Error("Error getting agency scope", sl.Err(err))
+		http.Error(w, "Failed to fetch cities", http.StatusInternalServerError)
+		return
+	}
+	cities, err := s.db.GetAgencyCities(scope)
+	if err != nil {
+		s.log.Error("Error fetching cities", sl.Err(err))
+		http.Error(w, "Failed to fetch cities", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(cities)
+}
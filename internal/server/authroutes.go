@@ -2,62 +2,117 @@ package server
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
-	jwtbib "github.com/golang-jwt/jwt/v5"
 	_ "github.com/joho/godotenv/autoload"
 	"golang.org/x/crypto/bcrypt"
 	"log/slog"
+	"net"
 	"net/http"
+	"practic/internal/database"
 	"practic/internal/jwt"
 	"practic/internal/logger/sl"
 	"practic/internal/models"
+	"strings"
 	"time"
 )
 
+const (
+	accessTokenTTL  = 15 * time.Minute
+	refreshTokenTTL = 30 * 24 * time.Hour
+	refreshCookie   = "refresh_token"
+)
+
+var dummyHash, _ = bcrypt.GenerateFromPassword([]byte("dummy password"), bcrypt.DefaultCost)
+
 func (s *Server) RegisterHandler(w http.ResponseWriter, r *http.Request) {
 	var u models.User
 	err := json.NewDecoder(r.Body).Decode(&u)
-
 	if err != nil {
 		s.log.Error("Error in decoding body", sl.Err(err))
 		http.Error(w, "Invalid request body", http.StatusBadRequest)
 		return
 	}
+	u.Login = strings.TrimSpace(u.Login)
+	u.Name = strings.TrimSpace(u.Name)
+	u.Email = strings.TrimSpace(u.Email)
+	u.InviteCode = strings.TrimSpace(u.InviteCode)
+
+	for _, err := range []error{validateLogin(u.Login), validatePassword(u.Password), validateName(u.Name)} {
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+	if u.Email != "" && !strings.Contains(u.Email, "@") {
+		http.Error(w, "Invalid email", http.StatusBadRequest)
+		return
+	}
+
+	mode, err := s.registrationMode()
+	if err != nil {
+		s.log.Error("Error in getting registration mode", sl.Err(err))
+		http.Error(w, "failed to register", http.StatusInternalServerError)
+		return
+	}
+	status := "active"
+	var inviteHash string
+	switch {
+	// приглашение действует в любом режиме: оно определяет агентство и не требует одобрения
+	case u.InviteCode != "":
+		inviteHash = jwt.HashToken(u.InviteCode)
+	case mode == RegistrationInvite:
+		http.Error(w, "Invite code is required", http.StatusForbidden)
+		return
+	case mode == RegistrationApproval:
+		status = "pending"
+	}
+
 	passHash, err := bcrypt.GenerateFromPassword([]byte(u.Password), bcrypt.DefaultCost)
 	if err != nil {
 		s.log.Error("Error in hashing password", sl.Err(err))
 		http.Error(w, "failed to hash password", http.StatusInternalServerError)
+		return
 	}
-	uid, err := s.db.CreateUser(u.Name, u.Login, passHash)
+	uid, err := s.db.CreateUser(u.Name, u.Login, u.Email, passHash, status, inviteHash)
 	if err != nil {
-		s.log.Error("Error in creating user", sl.Err(err))
-		http.Error(w, fmt.Sprintf("failed to create user: %v", err), http.StatusInternalServerError)
+		switch {
+		case errors.Is(err, database.ErrLoginTaken):
+			http.Error(w, "Login already in use", http.StatusConflict)
+		case errors.Is(err, database.ErrEmailTaken):
+			http.Error(w, "Email already in use", http.StatusConflict)
+		case errors.Is(err, database.ErrInviteInvalid):
+			http.Error(w, "Invalid invite code", http.StatusForbidden)
+		default:
+			s.log.Error("Error in creating user", sl.Err(err))
+			http.Error(w, "failed to create user", http.StatusInternalServerError)
+		}
+		return
 	}
-	user, err := s.db.User(u.Login)
-	if err != nil {
-		s.log.Error("Error in getting user", sl.Err(err))
-		http.Error(w, fmt.Sprintf("failed to get user: %v", err), http.StatusInternalServerError)
+	s.log.Info("User created successfully", slog.Int64("id", uid), slog.String("mode", mode))
+
+	if status == "pending" {
+		// войти можно будет только после одобрения администратором
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusAccepted)
+		json.NewEncoder(w).Encode(map[string]string{"status": status})
 		return
 	}
-	token, err := jwt.NewToken(user, time.Hour)
+
+	user, err := s.db.UserByID(uid)
 	if err != nil {
-		s.log.Error("Error in creating token", sl.Err(err))
-		http.Error(w, fmt.Sprintf("failed to create token: %v", err), http.StatusInternalServerError)
+		s.log.Error("Error in getting user", sl.Err(err))
+		http.Error(w, fmt.Sprintf("failed to get user: %v", err), http.StatusInternalServerError)
 		return
 	}
-	cookie := &http.Cookie{
-		Name:     "token",
-		Path:     "/",
-		HttpOnly: true,
-		Value:    token}
-	http.SetCookie(w, cookie)
-	_, err = w.Write([]byte("Login successful"))
+	err = s.startSession(w, r, user, false)
 	if err != nil {
+		s.log.Error("Error in creating session", sl.Err(err))
+		http.Error(w, fmt.Sprintf("failed to create session: %v", err), http.StatusInternalServerError)
 		return
 	}
-
-	s.log.Info("User created successfully", slog.Int64("id", uid))
 	w.WriteHeader(http.StatusCreated)
+	_, _ = w.Write([]byte("Registration successful"))
 }
 
 func (s *Server) LoginHandler(w http.ResponseWriter, r *http.Request) {
@@ -69,53 +124,200 @@ func (s *Server) LoginHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	ip := clientIP(r)
+	if s.loginLocked(w, u.Login, ip) {
+		return
+	}
+
 	user, err := s.db.User(u.Login)
-	if err != nil {
+	if err != nil && !errors.Is(err, database.ErrUserNotFound) {
 		s.log.Error("Error in getting user", sl.Err(err))
 		http.Error(w, fmt.Sprintf("failed to get user: %v", err), http.StatusInternalServerError)
 		return
 	}
-	err = bcrypt.CompareHashAndPassword([]byte(user.Password), []byte(u.Password))
-	if err != nil {
-		s.log.Error("Error in comparing password", sl.Err(err))
+	found := err == nil
+	// для несуществующего логина сравниваем с фиктивным хешем, чтобы по времени ответа нельзя было понять, есть ли такой пользователь
+	passHash := dummyHash
+	if found {
+		passHash = []byte(user.Password)
+	}
+	if err := bcrypt.CompareHashAndPassword(passHash, []byte(u.Password)); err != nil || !found {
+		s.log.Info("Invalid credentials", slog.String("login", u.Login), slog.String("ip", ip))
+		s.recordLoginFailure(u.Login, ip)
 		http.Error(w, "Invalid credentials", http.StatusUnauthorized)
 		return
 	}
-	token, err := jwt.NewToken(user, time.Hour)
-	if err != nil {
-		s.log.Error("Error in creating token", sl.Err(err))
-		http.Error(w, fmt.Sprintf("failed to create token: %v", err), http.StatusInternalServerError)
+	if user.Status == "pending" {
+		http.Error(w, "Account is awaiting approval", http.StatusForbidden)
 		return
 	}
-	cookie := &http.Cookie{
-		Name:     "token",
-		Path:     "/",
-		HttpOnly: true,
-		Value:    token}
-	http.SetCookie(w, cookie)
-	_, err = w.Write([]byte("Login successful"))
+	if user.TOTPEnabled {
+		mfaToken, err := s.tokens.NewMFAToken(user.ID, mfaTokenTTL)
+		if err != nil {
+			s.log.Error("Error in creating mfa token", sl.Err(err))
+			http.Error(w, fmt.Sprintf("failed to create token: %v", err), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusAccepted)
+		json.NewEncoder(w).Encode(map[string]any{"mfa_required": true, "mfa_token": mfaToken})
+		return
+	}
+	s.clearLoginFailures(u.Login)
+
+	err = s.startSession(w, r, user, false)
 	if err != nil {
+		s.log.Error("Error in creating session", sl.Err(err))
+		http.Error(w, fmt.Sprintf("failed to create session: %v", err), http.StatusInternalServerError)
 		return
 	}
 	s.log.Info("User logged in", slog.Int64("id", user.ID), slog.String("role", user.Role))
-	w.WriteHeader(http.StatusOK)
+	_, _ = w.Write([]byte("Login successful"))
+}
+
+func (s *Server) RefreshHandler(w http.ResponseWriter, r *http.Request) {
+	cookie, err := r.Cookie(refreshCookie)
+	if err != nil {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
 
+	refresh, refreshHash, err := jwt.NewOpaqueToken()
+	if err != nil {
+		s.log.Error("Error in creating refresh token", sl.Err(err))
+		http.Error(w, "failed to create refresh token", http.StatusInternalServerError)
+		return
+	}
+	session, err := s.db.RotateSession(jwt.HashToken(cookie.Value), refreshHash, refreshTokenTTL)
+	if err != nil {
+		if !errors.Is(err, database.ErrSessionNotFound) {
+			s.log.Error("Error in rotating session", sl.Err(err))
+		}
+		s.clearAuthCookies(w)
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+	user, err := s.db.UserByID(session.UserID)
+	if err != nil {
+		s.log.Error("Error in getting user", sl.Err(err))
+		s.clearAuthCookies(w)
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+	token, err := s.tokens.NewToken(user, session.ID, session.MFA, accessTokenTTL)
+	if err != nil {
+		s.log.Error("Error in creating token", sl.Err(err))
+		http.Error(w, fmt.Sprintf("failed to create token: %v", err), http.StatusInternalServerError)
+		return
+	}
+	s.setAuthCookies(w, token, refresh)
+	w.WriteHeader(http.StatusNoContent)
 }
 
 func (s *Server) LogoutHandler(w http.ResponseWriter, r *http.Request) {
+	if cookie, err := r.Cookie(refreshCookie); err == nil {
+		if err := s.db.RevokeSessionByRefresh(jwt.HashToken(cookie.Value)); err != nil {
+			s.log.Error("Error in revoking session", sl.Err(err))
+		}
+	}
+	s.clearAuthCookies(w)
+	http.Redirect(w, r, "/", http.StatusSeeOther)
+}
+
+// startSession opens a new server-side session for user and sets the access
+// and refresh cookies on the response. mfa is true only when the user has
+// just passed a second factor.
+func (s *Server) startSession(w http.ResponseWriter, r *http.Request, user models.UserDB, mfa bool) error {
+	refresh, refreshHash, err := jwt.NewOpaqueToken()
+	if err != nil {
+		return err
+	}
+	sid, err := s.db.CreateSession(user.ID, refreshHash, r.UserAgent(), clientIP(r), mfa, refreshTokenTTL)
+	if err != nil {
+		return err
+	}
+	token, err := s.tokens.NewToken(user, sid, mfa, accessTokenTTL)
+	if err != nil {
+		return err
+	}
+	s.setAuthCookies(w, token, refresh)
+	return nil
+}
+
+func (s *Server) setAuthCookies(w http.ResponseWriter, token, refresh string) {
+	s.setTokenCookie(w, token)
+	// refresh отправляется только запросами со своих страниц
+	http.SetCookie(w, &http.Cookie{
+		Name:     refreshCookie,
+		Path:     "/api",
+		HttpOnly: true,
+		Secure:   s.cookieSecure,
+		SameSite: http.SameSiteStrictMode,
+		MaxAge:   int(refreshTokenTTL.Seconds()),
+		Value:    refresh,
+	})
+}
+
+func (s *Server) setTokenCookie(w http.ResponseWriter, token string) {
+	// Lax, а не Strict: иначе переход по внешней ссылке или возврат после SSO открывает страницу без авторизации
+	http.SetCookie(w, &http.Cookie{
+		Name:     "token",
+		Path:     "/",
+		HttpOnly: true,
+		Secure:   s.cookieSecure,
+		SameSite: http.SameSiteLaxMode,
+		Value:    token,
+	})
+}
+
+func (s *Server) clearAuthCookies(w http.ResponseWriter) {
 	http.SetCookie(w, &http.Cookie{
 		Name:     "token",
 		Value:    "",
 		Path:     "/",  // путь должен совпадать с установленной ранее cookie
 		MaxAge:   -1,   // означает: удалить cookie
 		HttpOnly: true, // опционально
+		Secure:   s.cookieSecure,
+		SameSite: http.SameSiteLaxMode,
+	})
+	http.SetCookie(w, &http.Cookie{
+		Name:     refreshCookie,
+		Value:    "",
+		Path:     "/api",
+		MaxAge:   -1,
+		HttpOnly: true,
+		Secure:   s.cookieSecure,
+		SameSite: http.SameSiteStrictMode,
 	})
-	http.Redirect(w, r, "/", http.StatusSeeOther)
+}
+
+func clientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
 }
 
 func (s *Server) MeHandler(w http.ResponseWriter, r *http.Request) {
-	userID := r.Context().Value("user").(*jwtbib.MapClaims)
-	userIDparsed := *userID
-	userLogin := userIDparsed["login"].(string)
-	json.NewEncoder(w).Encode(map[string]string{"login": userLogin, "role": userIDparsed["role"].(string)})
+	claims := userClaims(r)
+	permissions, err := s.db.RolePermissions(claims.Role)
+	if err != nil {
+		s.log.Error("Error in getting permissions", sl.Err(err))
+		http.Error(w, "failed to get permissions", http.StatusInternalServerError)
+		return
+	}
+	resp := map[string]any{"login": claims.Login, "role": claims.Role, "agency_id": claims.AgencyID, "permissions": permissions}
+
+	// по этому полю страница показывает баннер «вы вошли как ...»
+	if claims.ImpersonatorID != 0 {
+		admin, err := s.db.UserByID(claims.ImpersonatorID)
+		if err != nil {
+			s.log.Error("Error in getting impersonator", sl.Err(err))
+			http.Error(w, "failed to get user", http.StatusInternalServerError)
+			return
+		}
+		resp["impersonator"] = map[string]any{"id": admin.ID, "login": admin.Login, "name": admin.Name}
+	}
+	json.NewEncoder(w).Encode(resp)
 }
@@ -2,29 +2,59 @@ package server
 
 import (
 	"encoding/json"
+	"errors"
 	"github.com/go-chi/chi/v5"
-	"github.com/golang-jwt/jwt/v5"
+	"io"
 	"log/slog"
 	"net/http"
+	"practic/internal/database"
 	"practic/internal/logger/sl"
 	"practic/internal/models"
+	"practic/internal/policy"
 	"strconv"
+	"strings"
 )
 
 func (s *Server) CreateListing(w http.ResponseWriter, r *http.Request) {
-	userID := r.Context().Value("user").(*jwt.MapClaims)
-	userIDparsed := *userID
+	claims := userClaims(r)
 
+	body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxPatchBytes))
+	if err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	feed, err := parseFeedFields(body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
 	var l models.Listing
-	err := json.NewDecoder(r.Body).Decode(&l)
+	err = json.Unmarshal(body, &l)
 	if err != nil {
 		s.log.Error("Error in decoding body", sl.Err(err))
 		http.Error(w, "Invalid request body", http.StatusBadRequest)
 		return
 	}
-	l.UserID = int64(userIDparsed["uid"].(float64))
+	setFeedFields(&l, feed)
+	l.UserID = claims.UserID
+
+	// новое объявление — черновик, если его не публикуют сразу
+	if l.Status == "" {
+		l.Status = models.StatusDraft
+	}
+	if l.Status != models.StatusDraft && l.Status != models.StatusActive {
+		http.Error(w, "status must be draft or active", http.StatusBadRequest)
+		return
+	}
+	if l.Deal == "" {
+		l.Deal = models.DealSale
+	}
+	if err := validateDeal(l.Deal); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
 
-	uid, err := s.db.CreateListing(l.Name, l.Typel, l.Description, l.Status, l.City, l.Price, l.UserID)
+	uid, err := s.db.CreateListing(l)
 	if err != nil {
 		s.log.Error("Error in creating listing", sl.Err(err))
 		http.Error(w, "Ошибка создания", 500)
@@ -36,24 +66,41 @@ func (s *Server) CreateListing(w http.ResponseWriter, r *http.Request) {
 }
 
 func (s *Server) GetListings(w http.ResponseWriter, r *http.Request) {
-	page, _ := strconv.Atoi(r.URL.Query().Get("page"))
-	if page < 1 {
-		page = 1
+	filter, err := parseListingFilter(r.URL.Query())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	page, err := pageRequest(r.URL.Query())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
 	}
-	offset := int64((page - 1) * 10)
-	filter := r.URL.Query().Get("filter")
 
-	userID := r.Context().Value("user").(*jwt.MapClaims)
-	userIDparsed := *userID
-	userIDint := int64(userIDparsed["uid"].(float64))
+	p, err := s.principal(r)
+	if err != nil {
+		s.log.Error("Error in getting permissions", sl.Err(err))
+		http.Error(w, "Ошибка получения списка", 500)
+		return
+	}
 
-	listings, err := s.db.GetListings(userIDint, offset, filter)
+	// свои объявления и те, которыми поделились с пользователем
+	listings, err := s.db.GetListings(p.UserID, filter, page)
 
 	if err != nil {
+		if errors.Is(err, database.ErrInvalidCursor) {
+			http.Error(w, "Invalid cursor", http.StatusBadRequest)
+			return
+		}
 		s.log.Error("Error in getting listings", sl.Err(err))
 		http.Error(w, "Ошибка получения списка", 500)
 		return
 	}
+	for i, l := range listings.Items {
+		for _, a := range policy.Actions(p, policy.ListingFacts{OwnerID: l.UserID, AgencyID: l.AgencyID, Share: l.Share}) {
+			listings.Items[i].Actions = append(listings.Items[i].Actions, string(a))
+		}
+	}
 
 	w.Header().Set("Content-Type", "application/json")
 	if err := json.NewEncoder(w).Encode(listings); err != nil {
@@ -64,9 +111,8 @@ func (s *Server) GetListings(w http.ResponseWriter, r *http.Request) {
 }
 
 func (s *Server) GetCities(w http.ResponseWriter, r *http.Request) {
-	userID := r.Context().Value("user").(*jwt.MapClaims)
-	userIDparsed := *userID
-	userIDint := int64(userIDparsed["uid"].(float64))
+	claims := userClaims(r)
+	userIDint := claims.UserID
 
 	var cities []string
 	cities, err := s.db.GetCities(userIDint)
@@ -80,41 +126,155 @@ func (s *Server) GetCities(w http.ResponseWriter, r *http.Request) {
 }
 
 func (s *Server) UpdateListing(w http.ResponseWriter, r *http.Request) {
-	userID := r.Context().Value("user").(*jwt.MapClaims)
-	userIDparsed := *userID
+	id := chi.URLParam(r, "id")
+	listingID, err := strconv.ParseInt(id, 10, 64)
+	if err != nil {
+		s.log.Error("Error in parsing listing ID", sl.Err(err))
+		http.Error(w, "Invalid listing ID", http.StatusBadRequest)
+		return
+	}
+	if !s.authorizeListing(w, r, listingID, policy.Edit) {
+		return
+	}
 
+	body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxPatchBytes))
+	if err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	feed, err := parseFeedFields(body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
 	var l models.Listing
-	err := json.NewDecoder(r.Body).Decode(&l)
+	err = json.Unmarshal(body, &l)
 	if err != nil {
 		s.log.Error("Error in decoding body", sl.Err(err))
 		http.Error(w, "Invalid request body", http.StatusBadRequest)
 		return
 	}
-	l.UserID = int64(userIDparsed["uid"].(float64))
+	version, ok := expectedVersion(r, l.Version)
+	if !ok {
+		http.Error(w, "If-Match header or version is required", http.StatusPreconditionRequired)
+		return
+	}
 
-	id := chi.URLParam(r, "id")
-	listingID, err := strconv.ParseInt(id, 10, 64)
+	current, err := s.db.GetListing(listingID, userClaims(r).UserID)
 	if err != nil {
-		s.log.Error("Error in parsing listing ID", sl.Err(err))
-		http.Error(w, "Invalid listing ID", http.StatusBadRequest)
+		if errors.Is(err, database.ErrListingNotFound) {
+			http.Error(w, "Listing not found", http.StatusNotFound)
+			return
+		}
+		s.log.Error("Error in getting listing", sl.Err(err))
+		http.Error(w, "Ошибка обновления", 500)
+		return
+	}
+	if l.Status != "" && l.Status != current.Status {
+		http.Error(w, errStatusViaTransition.Error(), http.StatusBadRequest)
 		return
 	}
+	if l.Deal == "" {
+		l.Deal = current.Deal
+	}
+	if err := validateDeal(l.Deal); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	// поля для площадок, которых нет в теле, остаются прежними
+	l.Address, l.Area, l.Rooms, l.Floor, l.Floors, l.Syndicate = current.Address, current.Area, current.Rooms, current.Floor, current.Floors, current.Syndicate
+	setFeedFields(&l, feed)
 
-	err = s.db.UpdateListing(l.Name, l.Typel, l.Description, l.Status, l.City, l.Price, listingID)
+	version, err = s.db.UpdateListing(l, listingID, version, userClaims(r).UserID)
 	if err != nil {
+		if errors.Is(err, database.ErrListingNotFound) {
+			http.Error(w, "Listing not found", http.StatusNotFound)
+			return
+		}
+		if errors.Is(err, database.ErrVersionConflict) {
+			http.Error(w, "Listing was changed by someone else", http.StatusPreconditionFailed)
+			return
+		}
 		s.log.Error("Error in updating listing", sl.Err(err))
 		http.Error(w, "Ошибка обновления", 500)
 		return
 	}
 
-	s.log.Info("Listing updated successfully", slog.Int64("id", listingID))
+	s.log.Info("Listing updated successfully", slog.Int64("id", listingID), slog.Int64("version", version))
+	w.Header().Set("ETag", listingETag(version))
 	w.WriteHeader(http.StatusNoContent)
 }
 
+func (s *Server) GetListing(w http.ResponseWriter, r *http.Request) {
+	listingID, err := strconv.ParseInt(chi.URLParam(r, "id"), 10, 64)
+	if err != nil {
+		s.log.Error("Error in parsing listing ID", sl.Err(err))
+		http.Error(w, "Invalid listing ID", http.StatusBadRequest)
+		return
+	}
+	if !s.authorizeListing(w, r, listingID, policy.Read) {
+		return
+	}
+	p, err := s.principal(r)
+	if err != nil {
+		s.log.Error("Error in getting permissions", sl.Err(err))
+		http.Error(w, "Ошибка получения объявления", 500)
+		return
+	}
+
+	l, err := s.db.GetListing(listingID, p.UserID)
+	if err != nil {
+		if errors.Is(err, database.ErrListingNotFound) {
+			http.Error(w, "Listing not found", http.StatusNotFound)
+			return
+		}
+		s.log.Error("Error in getting listing", sl.Err(err))
+		http.Error(w, "Ошибка получения объявления", 500)
+		return
+	}
+	for _, a := range policy.Actions(p, policy.ListingFacts{OwnerID: l.UserID, AgencyID: l.AgencyID, Share: l.Share}) {
+		l.Actions = append(l.Actions, string(a))
+	}
+
+	etag := listingETag(l.Version)
+	w.Header().Set("ETag", etag)
+	if r.Header.Get("If-None-Match") == etag {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(l); err != nil {
+		s.log.Error("Error in encoding listing", sl.Err(err))
+		http.Error(w, "Ошибка кодирования объявления", 500)
+		return
+	}
+}
+
+// listingETag is the entity tag of a listing version.
+func listingETag(version int64) string {
+	return `"` + strconv.FormatInt(version, 10) + `"`
+}
+
+// expectedVersion returns the listing version the client edited: the
+// If-Match header if present, otherwise the version field of the body. A tag
+// that is not one of ours becomes -1 and never matches. ok is false if the
+// client sent neither; "*" does not count, it would defeat the check.
+func expectedVersion(r *http.Request, bodyVersion int64) (version int64, ok bool) {
+	ifMatch := strings.TrimSpace(r.Header.Get("If-Match"))
+	if ifMatch == "" || ifMatch == "*" {
+		return bodyVersion, bodyVersion > 0
+	}
+	tag, _, _ := strings.Cut(ifMatch, ",")
+	tag = strings.Trim(strings.TrimPrefix(strings.TrimSpace(tag), "W/"), `"`)
+	version, err := strconv.ParseInt(tag, 10, 64)
+	if err != nil {
+		return -1, true
+	}
+	return version, true
+}
+
 func (s *Server) DeleteListing(w http.ResponseWriter, r *http.Request) {
 	id := chi.URLParam(r, "id")
-	user := r.Context().Value("user").(*jwt.MapClaims)
-	userID := int64((*user)["uid"].(float64))
 
 	listingID, err := strconv.ParseInt(id, 10, 64)
 	if err != nil {
@@ -122,22 +282,27 @@ func (s *Server) DeleteListing(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "Invalid listing ID", http.StatusBadRequest)
 		return
 	}
+	if !s.authorizeListing(w, r, listingID, policy.Delete) {
+		return
+	}
 
-	err = s.db.DeleteListing(listingID, userID)
-	if err != nil {
+	if err := s.db.DeleteListing(listingID); err != nil {
+		if errors.Is(err, database.ErrListingNotFound) {
+			http.Error(w, "Listing not found", http.StatusNotFound)
+			return
+		}
 		s.log.Error("Error in deleting listing", sl.Err(err))
 		http.Error(w, "Ошибка удаления", 500)
 		return
 	}
 
-	s.log.Info("Listing deleted successfully", slog.Int64("id", listingID))
+	s.log.Info("Listing deleted successfully", slog.Int64("id", listingID), slog.Int64("user_id", userClaims(r).UserID))
 	w.WriteHeader(http.StatusNoContent)
 }
 
 func (s *Server) AnalyticsHandler(w http.ResponseWriter, r *http.Request) {
-	userID := r.Context().Value("user").(*jwt.MapClaims)
-	userIDparsed := *userID
-	userIDint := int64(userIDparsed["uid"].(float64))
+	claims := userClaims(r)
+	userIDint := claims.UserID
 
 	analytics, err := s.db.GetAnalytics(userIDint)
 	if err != nil {
@@ -153,3 +318,126 @@ func (s *Server) AnalyticsHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 }
+
+func (s *Server) GetListingShares(w http.ResponseWriter, r *http.Request) {
+	listingID, err := strconv.ParseInt(chi.URLParam(r, "id"), 10, 64)
+	if err != nil {
+		s.log.Error("Error in parsing listing ID", sl.Err(err))
+		http.Error(w, "Invalid listing ID", http.StatusBadRequest)
+		return
+	}
+	if !s.authorizeListing(w, r, listingID, policy.Share) {
+		return
+	}
+
+	shares, err := s.db.GetListingShares(listingID)
+	if err != nil {
+		s.log.Error("Error in getting shares", sl.Err(err))
+		http.Error(w, "Ошибка получения доступов", 500)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(shares); err != nil {
+		s.log.Error("Error in encoding shares", sl.Err(err))
+		http.Error(w, "Ошибка кодирования доступов", 500)
+		return
+	}
+}
+
+// ShareListing grants another user read or edit access to a listing. The
+// user is given by login, agents do not know each other's ids.
+func (s *Server) ShareListing(w http.ResponseWriter, r *http.Request) {
+	listingID, err := strconv.ParseInt(chi.URLParam(r, "id"), 10, 64)
+	if err != nil {
+		s.log.Error("Error in parsing listing ID", sl.Err(err))
+		http.Error(w, "Invalid listing ID", http.StatusBadRequest)
+		return
+	}
+	if !s.authorizeListing(w, r, listingID, policy.Share) {
+		return
+	}
+
+	var req struct {
+		Login  string `json:"login"`
+		Access string `json:"access"`
+	}
+	err = json.NewDecoder(r.Body).Decode(&req)
+	if err != nil {
+		s.log.Error("Error in decoding body", sl.Err(err))
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	if req.Access != policy.ShareRead && req.Access != policy.ShareEdit {
+		http.Error(w, "Access must be read or edit", http.StatusBadRequest)
+		return
+	}
+
+	user, err := s.db.User(strings.TrimSpace(req.Login))
+	if err != nil {
+		if errors.Is(err, database.ErrUserNotFound) {
+			http.Error(w, "User not found", http.StatusNotFound)
+			return
+		}
+		s.log.Error("Error in getting user", sl.Err(err))
+		http.Error(w, "Ошибка предоставления доступа", 500)
+		return
+	}
+	facts, err := s.db.ListingFacts(listingID, user.ID)
+	if err != nil {
+		s.log.Error("Error in getting listing facts", sl.Err(err))
+		http.Error(w, "Ошибка предоставления доступа", 500)
+		return
+	}
+	// делиться можно только внутри агентства
+	if user.AgencyID != facts.AgencyID {
+		http.Error(w, "User not found", http.StatusNotFound)
+		return
+	}
+	if facts.OwnerID == user.ID {
+		http.Error(w, "The owner already has full access", http.StatusBadRequest)
+		return
+	}
+
+	err = s.db.ShareListing(listingID, user.ID, req.Access)
+	if err != nil {
+		s.log.Error("Error in sharing listing", sl.Err(err))
+		http.Error(w, "Ошибка предоставления доступа", 500)
+		return
+	}
+
+	s.log.Info("Listing shared", slog.Int64("id", listingID), slog.Int64("user_id", user.ID), slog.String("access", req.Access))
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (s *Server) UnshareListing(w http.ResponseWriter, r *http.Request) {
+	listingID, err := strconv.ParseInt(chi.URLParam(r, "id"), 10, 64)
+	if err != nil {
+		s.log.Error("Error in parsing listing ID", sl.Err(err))
+		http.Error(w, "Invalid listing ID", http.StatusBadRequest)
+		return
+	}
+	userID, err := strconv.ParseInt(chi.URLParam(r, "userID"), 10, 64)
+	if err != nil {
+		s.log.Error("Error in parsing user ID", sl.Err(err))
+		http.Error(w, "Invalid user ID", http.StatusBadRequest)
+		return
+	}
+	if !s.authorizeListing(w, r, listingID, policy.Share) {
+		return
+	}
+
+	err = s.db.UnshareListing(listingID, userID)
+	if err != nil {
+		if errors.Is(err, database.ErrShareNotFound) {
+			http.Error(w, "Share not found", http.StatusNotFound)
+			return
+		}
+		s.log.Error("Error in unsharing listing", sl.Err(err))
+		http.Error(w, "Ошибка отзыва доступа", 500)
+		return
+	}
+
+	s.log.Info("Listing unshared", slog.Int64("id", listingID), slog.Int64("user_id", userID))
+	w.WriteHeader(http.StatusNoContent)
+}
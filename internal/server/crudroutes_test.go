@@ -0,0 +1,135 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"practic/internal/database"
+	"practic/internal/jwt"
+	"practic/internal/models"
+	"practic/internal/policy"
+	"strings"
+	"testing"
+
+	"github.com/go-chi/chi/v5"
+)
+
+// listingStore keeps a single listing in memory for the CRUD handlers,
+// the rest of database.Service is left unimplemented.
+type listingStore struct {
+	database.Service
+	listing models.ListingDB
+}
+
+func (s *listingStore) RolePermissions(role string) ([]string, error) { return nil, nil }
+
+func (s *listingStore) ListingFacts(id int64, userID int64) (policy.ListingFacts, error) {
+	return policy.ListingFacts{OwnerID: s.listing.UserID}, nil
+}
+
+func (s *listingStore) CreateListing(l models.Listing) (int64, error) {
+	s.listing = models.ListingDB{ID: 1, Version: 1}
+	s.store(l)
+	s.listing.Status, s.listing.UserID = l.Status, l.UserID
+	return s.listing.ID, nil
+}
+
+func (s *listingStore) UpdateListing(l models.Listing, id int64, version int64, userID int64) (int64, error) {
+	if version != s.listing.Version {
+		return 0, database.ErrVersionConflict
+	}
+	s.store(l)
+	s.listing.Version++
+	return s.listing.Version, nil
+}
+
+func (s *listingStore) GetListing(id int64, userID int64) (models.ListingDB, error) {
+	return s.listing, nil
+}
+
+func (s *listingStore) store(l models.Listing) {
+	s.listing.Name, s.listing.Typel, s.listing.Description, s.listing.Deal, s.listing.City = l.Name, l.Typel, l.Description, l.Deal, l.City
+	s.listing.Price = float64(l.Price)
+	s.listing.Address, s.listing.Area, s.listing.Rooms = l.Address, l.Area, l.Rooms
+	s.listing.Floor, s.listing.Floors, s.listing.Syndicate = l.Floor, l.Floors, l.Syndicate
+}
+
+func listingRequest(s *Server, method, body string) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(method, "/api/listings/1", strings.NewReader(body))
+	rctx := chi.NewRouteContext()
+	rctx.URLParams.Add("id", "1")
+	ctx := context.WithValue(r.Context(), chi.RouteCtxKey, rctx)
+	r = r.WithContext(context.WithValue(ctx, "user", &jwt.Claims{UserID: 7, Role: "user"}))
+
+	w := httptest.NewRecorder()
+	switch method {
+	case http.MethodPost:
+		s.CreateListing(w, r)
+	case http.MethodPut:
+		s.UpdateListing(w, r)
+	default:
+		s.GetListing(w, r)
+	}
+	return w
+}
+
+func TestListingFeedFieldsThroughPostAndPut(t *testing.T) {
+	store := &listingStore{}
+	s := &Server{log: slog.New(slog.DiscardHandler), db: store}
+
+	w := listingRequest(s, http.MethodPost, `{"title": "Квартира", "type": "flat", "city": "Москва", "price": 100,
+		"address": " Тверская, 1 ", "area": 54.5, "rooms": 2, "floor": 3, "floors": 9, "syndicate": true}`)
+	if w.Code != http.StatusOK {
+		t.Fatalf("POST = %d %s", w.Code, w.Body)
+	}
+	want := models.ListingDB{Address: "Тверская, 1", Area: 54.5, Rooms: 2, Floor: 3, Floors: 9, Syndicate: true}
+	checkFeedFields(t, "after POST", readListing(t, s), want)
+
+	// поля, которых нет в PUT, не меняются
+	w = listingRequest(s, http.MethodPut, `{"title": "Квартира", "type": "flat", "city": "Москва", "price": 100, "version": 1,
+		"rooms": 3, "floor": -1, "syndicate": false}`)
+	if w.Code != http.StatusNoContent {
+		t.Fatalf("PUT = %d %s", w.Code, w.Body)
+	}
+	want.Rooms, want.Floor, want.Syndicate = 3, -1, false
+	checkFeedFields(t, "after PUT", readListing(t, s), want)
+
+	for _, method := range []string{http.MethodPost, http.MethodPut} {
+		w = listingRequest(s, method, `{"title": "Квартира", "type": "flat", "city": "Москва", "version": 2,
+			"area": -1, "rooms": 500, "floor": 2.5, "syndicate": "yes"}`)
+		if w.Code != http.StatusBadRequest {
+			t.Errorf("%s with invalid feed fields = %d, want 400", method, w.Code)
+		}
+		for _, field := range []string{"area", "rooms", "floor", "syndicate"} {
+			if !strings.Contains(w.Body.String(), field+":") {
+				t.Errorf("%s error %q does not name %s", method, w.Body, field)
+			}
+		}
+	}
+	checkFeedFields(t, "after rejected requests", readListing(t, s), want)
+}
+
+func readListing(t *testing.T, s *Server) models.ListingDB {
+	t.Helper()
+	w := listingRequest(s, http.MethodGet, "")
+	if w.Code != http.StatusOK {
+		t.Fatalf("GET = %d %s", w.Code, w.Body)
+	}
+	var l models.ListingDB
+	if err := json.Unmarshal(w.Body.Bytes(), &l); err != nil {
+		t.Fatal(err)
+	}
+	return l
+}
+
+func checkFeedFields(t *testing.T, when string, got, want models.ListingDB) {
+	t.Helper()
+	if got.Address != want.Address || got.Area != want.Area || got.Rooms != want.Rooms ||
+		got.Floor != want.Floor || got.Floors != want.Floors || got.Syndicate != want.Syndicate {
+		t.Errorf("%s: feed fields = %q %v %d %d %d %v, want %q %v %d %d %d %v", when,
+			got.Address, got.Area, got.Rooms, got.Floor, got.Floors, got.Syndicate,
+			want.Address, want.Area, want.Rooms, want.Floor, want.Floors, want.Syndicate)
+	}
+}
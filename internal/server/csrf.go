@@ -0,0 +1,111 @@
+package server
+
+import (
+	"crypto/subtle"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"practic/internal/jwt"
+	"practic/internal/logger/sl"
+	"slices"
+	"strings"
+)
+
+const (
+	csrfCookie = "csrf_token"
+	csrfHeader = "X-CSRF-Token"
+)
+
+// CSRFMiddleware implements the double-submit cookie pattern: every response
+// to a client without a csrf_token cookie sets one, and unsafe requests that
+// rely on cookies must echo it in the X-CSRF-Token header. Requests with a
+// bearer token carry no ambient credentials and are not checked; any other
+// Authorization header still falls back to the cookie in AuthMiddleware.
+func (s *Server) CSRFMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		cookie, err := r.Cookie(csrfCookie)
+		if err != nil || cookie.Value == "" {
+			token, _, err := jwt.NewOpaqueToken()
+			if err != nil {
+				s.log.Error("Error in creating csrf token", sl.Err(err))
+				http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+				return
+			}
+			cookie = &http.Cookie{
+				Name:     csrfCookie,
+				Value:    token,
+				Path:     "/",
+				Secure:   s.cookieSecure,
+				SameSite: http.SameSiteStrictMode,
+				// HttpOnly не ставим: скрипт страницы должен прочитать значение
+			}
+			http.SetCookie(w, cookie)
+		}
+
+		switch r.Method {
+		case http.MethodGet, http.MethodHead, http.MethodOptions:
+			next.ServeHTTP(w, r)
+			return
+		}
+		if token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer "); ok && token != "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+		if origin := r.Header.Get("Origin"); origin != "" && !s.trustedOrigin(r, origin) {
+			http.Error(w, "Origin not allowed", http.StatusForbidden)
+			return
+		}
+		header := r.Header.Get(csrfHeader)
+		if header == "" || subtle.ConstantTimeCompare([]byte(header), []byte(cookie.Value)) != 1 {
+			http.Error(w, "Invalid CSRF token", http.StatusForbidden)
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// trustedOrigin reports whether a browser request from origin may change
+// state: same-origin requests and the CORS allow-list are trusted.
+func (s *Server) trustedOrigin(r *http.Request, origin string) bool {
+	if slices.Contains(s.allowedOrigins, origin) {
+		return true
+	}
+	u, err := url.Parse(origin)
+	return err == nil && u.Host == r.Host
+}
+
+// allowedOrigins reads the CORS allow-list from CORS_ALLOWED_ORIGINS, a comma
+// separated list of exact origins such as https://crm.example.com. Without it
+// only APP_URL is allowed. Wildcards are rejected because the API is called
+// with credentials.
+func allowedOrigins() ([]string, error) {
+	value := os.Getenv("CORS_ALLOWED_ORIGINS")
+	if value == "" {
+		value = os.Getenv("APP_URL")
+	}
+
+	var origins []string
+	for _, origin := range strings.Split(value, ",") {
+		origin = strings.TrimRight(strings.TrimSpace(origin), "/")
+		if origin == "" {
+			continue
+		}
+		u, err := url.Parse(origin)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" || u.Path != "" || strings.Contains(origin, "*") {
+			return nil, fmt.Errorf("CORS_ALLOWED_ORIGINS: invalid origin %q", origin)
+		}
+		origins = append(origins, origin)
+	}
+	return origins, nil
+}
+
+// cookieSecure reports whether cookies get the Secure flag: COOKIE_SECURE if
+// set, otherwise whether APP_URL is served over https.
+func cookieSecure() bool {
+	if v := os.Getenv("COOKIE_SECURE"); v != "" {
+		return v == "true" || v == "1"
+	}
+	return strings.HasPrefix(os.Getenv("APP_URL"), "https://")
+}
@@ -0,0 +1,553 @@
+package server
+
+import (
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"practic/internal/blobstore"
+	"practic/internal/database"
+	"practic/internal/jwt"
+	"practic/internal/logger/sl"
+	"practic/internal/models"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+)
+
+// feedStatuses are the statuses with which an opted-in listing is published
+// on the portals.
+var feedStatuses = []string{models.StatusActive}
+
+var feedPortals = []string{models.PortalYandex, models.PortalAvito}
+
+// feedCategories maps listing types, lower-cased, to the categories of the
+// portals. Listings of other types cannot be syndicated.
+var feedCategories = map[string]struct{ yandex, avito string }{
+	"квартира": {"квартира", "Квартиры"},
+	"дом":      {"дом", "Дома, дачи, коттеджи"},
+}
+
+// feedMissing lists the fields a listing lacks for a portal to accept it,
+// by the JSON names of the listing, plus phone for the agent's phone and
+// status for a listing that is not published.
+func feedMissing(portal string, l models.FeedListing) []string {
+	var missing []string
+	if !slices.Contains(feedStatuses, l.Status) {
+		missing = append(missing, "status")
+	}
+	category, ok := feedCategories[strings.ToLower(l.Typel)]
+	if !ok {
+		missing = append(missing, "type")
+	}
+	if l.Price <= 0 {
+		missing = append(missing, "price")
+	}
+	if l.Address == "" {
+		missing = append(missing, "address")
+	}
+	if l.Area <= 0 {
+		missing = append(missing, "area")
+	}
+	if category.yandex == "квартира" && l.Rooms == 0 {
+		missing = append(missing, "rooms")
+	}
+	if portal == models.PortalAvito {
+		if l.Description == "" {
+			missing = append(missing, "description")
+		}
+		if category.yandex == "квартира" && l.Floor == 0 {
+			missing = append(missing, "floor")
+		}
+		if ok && l.Floors == 0 {
+			missing = append(missing, "floors")
+		}
+	}
+	if l.AgentPhone == "" {
+		missing = append(missing, "phone")
+	}
+	if len(l.Photos) == 0 {
+		missing = append(missing, "photos")
+	}
+	return missing
+}
+
+var errNoAppURL = errors.New("APP_URL is not set")
+
+// feedURL is the absolute address of the feed with token; portals fetch
+// feeds and photos from outside, so links must carry the host. It is only
+// taken from APP_URL: the Host header is whatever the client sent.
+func feedURL(token string) (string, error) {
+	base := strings.TrimRight(os.Getenv("APP_URL"), "/")
+	if base == "" {
+		return "", errNoAppURL
+	}
+	return base + "/feeds/" + token, nil
+}
+
+// noAppURL answers requests that need feed links while APP_URL is unset.
+func (s *Server) noAppURL(w http.ResponseWriter) {
+	s.log.Error("Feed links need APP_URL", sl.Err(errNoAppURL))
+	http.Error(w, "Не задан APP_URL: без него нельзя построить ссылки фидов", http.StatusServiceUnavailable)
+}
+
+// yandexFeed is the Yandex.Realty feed format.
+type yandexFeed struct {
+	XMLName        xml.Name      `xml:"realty-feed"`
+	Xmlns          string        `xml:"xmlns,attr"`
+	GenerationDate string        `xml:"generation-date"`
+	Offers         []yandexOffer `xml:"offer"`
+}
+
+type yandexOffer struct {
+	InternalID     int64       `xml:"internal-id,attr"`
+	Type           string      `xml:"type"`
+	PropertyType   string      `xml:"property-type"`
+	Category       string      `xml:"category"`
+	CreationDate   string      `xml:"creation-date"`
+	LastUpdateDate string      `xml:"last-update-date"`
+	Location       yandexPlace `xml:"location"`
+	SalesAgent     yandexAgent `xml:"sales-agent"`
+	Price          yandexPrice `xml:"price"`
+	Area           yandexArea  `xml:"area"`
+	Rooms          int64       `xml:"rooms,omitempty"`
+	Floor          int64       `xml:"floor,omitempty"`
+	FloorsTotal    int64       `xml:"floors-total,omitempty"`
+	Description    string      `xml:"description,omitempty"`
+	Images         []string    `xml:"image"`
+}
+
+type yandexPlace struct {
+	Country  string `xml:"country"`
+	Locality string `xml:"locality-name"`
+	Address  string `xml:"address"`
+}
+
+type yandexAgent struct {
+	Name         string `xml:"name,omitempty"`
+	Phone        string `xml:"phone"`
+	Category     string `xml:"category"`
+	Organization string `xml:"organization,omitempty"`
+	Email        string `xml:"email,omitempty"`
+}
+
+type yandexPrice struct {
+	Value    int64  `xml:"value"`
+	Currency string `xml:"currency"`
+	Period   string `xml:"period,omitempty"`
+}
+
+type yandexArea struct {
+	Value float64 `xml:"value"`
+	Unit  string  `xml:"unit"`
+}
+
+func newYandexOffer(feed string, l models.FeedListing) yandexOffer {
+	o := yandexOffer{
+		InternalID:     l.ID,
+		Type:           "продажа",
+		PropertyType:   "жилая",
+		Category:       feedCategories[strings.ToLower(l.Typel)].yandex,
+		CreationDate:   l.Date_created.Format(time.RFC3339),
+		LastUpdateDate: l.UpdatedAt.Format(time.RFC3339),
+		Location:       yandexPlace{Country: "Россия", Locality: l.City, Address: l.Address},
+		SalesAgent:     yandexAgent{Name: l.Agent, Phone: l.AgentPhone, Category: "агентство", Organization: l.Agency, Email: l.AgentEmail},
+		Price:          yandexPrice{Value: int64(l.Price), Currency: "RUB"},
+		Area:           yandexArea{Value: l.Area, Unit: "кв. м"},
+		Rooms:          l.Rooms,
+		Floor:          l.Floor,
+		FloorsTotal:    l.Floors,
+		Description:    l.Description,
+	}
+	if l.Deal == models.DealRent {
+		o.Type, o.Price.Period = "аренда", "месяц"
+	}
+	for _, id := range l.Photos {
+		o.Images = append(o.Images, fmt.Sprintf("%s/photos/%d", feed, id))
+	}
+	return o
+}
+
+// avitoFeed is the Avito Autoload feed format.
+type avitoFeed struct {
+	XMLName       xml.Name `xml:"Ads"`
+	FormatVersion string   `xml:"formatVersion,attr"`
+	Target        string   `xml:"target,attr"`
+	Ads           []avitoAd
+}
+
+type avitoAd struct {
+	XMLName        xml.Name     `xml:"Ad"`
+	ID             int64        `xml:"Id"`
+	DateBegin      string       `xml:"DateBegin"`
+	Category       string       `xml:"Category"`
+	OperationType  string       `xml:"OperationType"`
+	LeaseType      string       `xml:"LeaseType,omitempty"`
+	PropertyRights string       `xml:"PropertyRights"`
+	Address        string       `xml:"Address"`
+	Title          string       `xml:"Title"`
+	Description    string       `xml:"Description"`
+	Price          int64        `xml:"Price"`
+	Rooms          int64        `xml:"Rooms,omitempty"`
+	Square         float64      `xml:"Square"`
+	Floor          int64        `xml:"Floor,omitempty"`
+	Floors         int64        `xml:"Floors"`
+	ManagerName    string       `xml:"ManagerName,omitempty"`
+	ContactPhone   string       `xml:"ContactPhone"`
+	Images         []avitoImage `xml:"Images>Image"`
+}
+
+type avitoImage struct {
+	URL string `xml:"url,attr"`
+}
+
+func newAvitoAd(feed string, l models.FeedListing) avitoAd {
+	ad := avitoAd{
+		ID:             l.ID,
+		DateBegin:      l.Date_created.Format("2006-01-02"),
+		Category:       feedCategories[strings.ToLower(l.Typel)].avito,
+		OperationType:  "Продам",
+		PropertyRights: "Посредник",
+		Address:        l.City + ", " + l.Address,
+		Title:          l.Name,
+		Description:    l.Description,
+		Price:          int64(l.Price),
+		Rooms:          l.Rooms,
+		Square:         l.Area,
+		Floor:          l.Floor,
+		Floors:         l.Floors,
+		ManagerName:    l.Agent,
+		ContactPhone:   l.AgentPhone,
+	}
+	if l.Deal == models.DealRent {
+		ad.OperationType, ad.LeaseType = "Сдам", "На длительный срок"
+	}
+	for _, id := range l.Photos {
+		ad.Images = append(ad.Images, avitoImage{URL: fmt.Sprintf("%s/photos/%d", feed, id)})
+	}
+	return ad
+}
+
+// feedOwner resolves the token of a feed URL. On failure it writes the
+// response and returns false.
+func (s *Server) feedOwner(w http.ResponseWriter, r *http.Request) (models.FeedOwner, bool) {
+	owner, err := s.db.FeedOwnerByToken(jwt.HashToken(chi.URLParam(r, "token")))
+	if err != nil {
+		if errors.Is(err, database.ErrFeedTokenNotFound) {
+			http.Error(w, "Feed not found", http.StatusNotFound)
+			return models.FeedOwner{}, false
+		}
+		s.log.Error("Error in resolving feed token", sl.Err(err))
+		http.Error(w, "Ошибка получения фида", 500)
+		return models.FeedOwner{}, false
+	}
+	return owner, true
+}
+
+// serveFeed writes the listings of a feed a portal accepts, encoded by feed
+// with links under the feed's address.
+func (s *Server) serveFeed(w http.ResponseWriter, r *http.Request, portal string, feed func(url string, listings []models.FeedListing) any) {
+	url, err := feedURL(chi.URLParam(r, "token"))
+	if err != nil {
+		s.noAppURL(w)
+		return
+	}
+	owner, ok := s.feedOwner(w, r)
+	if !ok {
+		return
+	}
+	listings, err := s.db.GetFeedListings(owner)
+	if err != nil {
+		s.log.Error("Error in getting feed listings", sl.Err(err))
+		http.Error(w, "Ошибка получения фида", 500)
+		return
+	}
+	ready := listings[:0]
+	for _, l := range listings {
+		if len(feedMissing(portal, l)) == 0 {
+			ready = append(ready, l)
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/xml; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-cache")
+	io.WriteString(w, xml.Header)
+	enc := xml.NewEncoder(w)
+	enc.Indent("", "  ")
+	if err := enc.Encode(feed(url, ready)); err != nil {
+		s.log.Error("Error in encoding feed", sl.Err(err))
+		return
+	}
+	s.log.Info("Feed served", slog.String("portal", portal), slog.Int64("user_id", owner.UserID),
+		slog.Int64("agency_id", owner.AgencyID), slog.Int("listings", len(ready)))
+}
+
+// YandexFeed is the Yandex.Realty feed of the owner of the token.
+func (s *Server) YandexFeed(w http.ResponseWriter, r *http.Request) {
+	s.serveFeed(w, r, models.PortalYandex, func(url string, listings []models.FeedListing) any {
+		feed := yandexFeed{
+			Xmlns:          "http://webmaster.yandex.ru/schemas/feed/realty/2010-06",
+			GenerationDate: time.Now().Format(time.RFC3339),
+			Offers:         []yandexOffer{},
+		}
+		for _, l := range listings {
+			feed.Offers = append(feed.Offers, newYandexOffer(url, l))
+		}
+		return feed
+	})
+}
+
+// AvitoFeed is the Avito Autoload feed of the owner of the token.
+func (s *Server) AvitoFeed(w http.ResponseWriter, r *http.Request) {
+	s.serveFeed(w, r, models.PortalAvito, func(url string, listings []models.FeedListing) any {
+		feed := avitoFeed{FormatVersion: "3", Target: "Avito.ru"}
+		for _, l := range listings {
+			feed.Ads = append(feed.Ads, newAvitoAd(url, l))
+		}
+		return feed
+	})
+}
+
+// FeedPhoto serves a photo a feed links to, so portals can download it
+// without signing in.
+func (s *Server) FeedPhoto(w http.ResponseWriter, r *http.Request) {
+	fileID, err := strconv.ParseInt(chi.URLParam(r, "fileID"), 10, 64)
+	if err != nil {
+		http.Error(w, "Invalid file ID", http.StatusBadRequest)
+		return
+	}
+	owner, ok := s.feedOwner(w, r)
+	if !ok {
+		return
+	}
+	f, err := s.db.GetFeedPhoto(owner, fileID, feedStatuses)
+	if err != nil {
+		if errors.Is(err, database.ErrFileNotFound) {
+			http.Error(w, "File not found", http.StatusNotFound)
+			return
+		}
+		s.log.Error("Error in getting feed photo", sl.Err(err))
+		http.Error(w, "Ошибка получения файла", 500)
+		return
+	}
+
+	blob, err := s.blobs.Open(f.BlobKey)
+	if err != nil {
+		if errors.Is(err, blobstore.ErrNotFound) {
+			http.Error(w, "File not found", http.StatusNotFound)
+			return
+		}
+		s.log.Error("Error in opening blob", sl.Err(err))
+		http.Error(w, "Ошибка получения файла", 500)
+		return
+	}
+	defer blob.Close()
+
+	w.Header().Set("Content-Type", f.ContentType)
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.Header().Set("Cache-Control", "public, max-age=86400")
+	w.Header().Set("Content-Length", strconv.FormatInt(f.Size, 10))
+	if _, err := io.Copy(w, blob); err != nil {
+		s.log.Error("Error in sending file", sl.Err(err))
+	}
+}
+
+// feedReport builds the report of a feed: its token and, for every opted-in
+// listing that a portal would leave out, what it is missing.
+func (s *Server) feedReport(owner models.FeedOwner) (models.FeedReport, error) {
+	report := models.FeedReport{Ready: map[string]int{}, Problems: []models.FeedProblem{}}
+
+	token, err := s.db.GetFeedToken(owner)
+	if err != nil && !errors.Is(err, database.ErrFeedTokenNotFound) {
+		return report, err
+	}
+	if err == nil {
+		report.Token = &token
+	}
+
+	listings, err := s.db.GetFeedListings(owner)
+	if err != nil {
+		return report, err
+	}
+	report.Listings = len(listings)
+	for _, l := range listings {
+		problem := models.FeedProblem{ID: l.ID, Title: l.Name, Status: l.Status, Missing: map[string][]string{}}
+		for _, portal := range feedPortals {
+			if missing := feedMissing(portal, l); len(missing) > 0 {
+				problem.Missing[portal] = missing
+				continue
+			}
+			report.Ready[portal]++
+		}
+		if len(problem.Missing) > 0 {
+			report.Problems = append(report.Problems, problem)
+		}
+	}
+	return report, nil
+}
+
+// writeFeedReport answers with the report of a feed.
+func (s *Server) writeFeedReport(w http.ResponseWriter, report models.FeedReport, err error) {
+	if err != nil {
+		s.log.Error("Error in building feed report", sl.Err(err))
+		http.Error(w, "Ошибка получения фида", 500)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(report)
+}
+
+// createFeedToken gives owner a new feed token, replacing the old one, and
+// answers with the feed URLs. The token is only shown here, only its hash is
+// stored.
+func (s *Server) createFeedToken(w http.ResponseWriter, r *http.Request, owner models.FeedOwner) {
+	token, tokenHash, err := jwt.NewOpaqueToken()
+	if err != nil {
+		s.log.Error("Error in creating feed token", sl.Err(err))
+		http.Error(w, "Ошибка создания фида", 500)
+		return
+	}
+	// ссылки проверяем до замены токена, чтобы не отключить работающий фид
+	url, err := feedURL(token)
+	if err != nil {
+		s.noAppURL(w)
+		return
+	}
+	if err := s.db.SetFeedToken(owner, tokenHash, userClaims(r).UserID); err != nil {
+		s.log.Error("Error in saving feed token", sl.Err(err))
+		http.Error(w, "Ошибка создания фида", 500)
+		return
+	}
+
+	s.log.Info("Feed token created", slog.Int64("user_id", owner.UserID), slog.Int64("agency_id", owner.AgencyID),
+		slog.Int64("created_by", userClaims(r).UserID))
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(map[string]string{
+		models.PortalYandex: url + "/yandex.xml",
+		models.PortalAvito:  url + "/avito.xml",
+	})
+}
+
+func (s *Server) deleteFeedToken(w http.ResponseWriter, r *http.Request, owner models.FeedOwner) {
+	if err := s.db.DeleteFeedToken(owner); err != nil {
+		if errors.Is(err, database.ErrFeedTokenNotFound) {
+			http.Error(w, "Feed not found", http.StatusNotFound)
+			return
+		}
+		s.log.Error("Error in deleting feed token", sl.Err(err))
+		http.Error(w, "Ошибка отключения фида", 500)
+		return
+	}
+	s.log.Info("Feed token deleted", slog.Int64("user_id", owner.UserID), slog.Int64("agency_id", owner.AgencyID))
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// GetFeed reports on the caller's own feed.
+func (s *Server) GetFeed(w http.ResponseWriter, r *http.Request) {
+	userID := userClaims(r).UserID
+	report, err := s.feedReport(models.FeedOwner{UserID: userID})
+	if err == nil {
+		report.Phone, err = s.db.UserPhone(userID)
+	}
+	s.writeFeedReport(w, report, err)
+}
+
+func (s *Server) CreateFeedToken(w http.ResponseWriter, r *http.Request) {
+	s.createFeedToken(w, r, models.FeedOwner{UserID: userClaims(r).UserID})
+}
+
+func (s *Server) DeleteFeedToken(w http.ResponseWriter, r *http.Request) {
+	s.deleteFeedToken(w, r, models.FeedOwner{UserID: userClaims(r).UserID})
+}
+
+// adminFeedOwner is the agency whose feed an administrator manages. Holders
+// of agencies.manage must pick one with agency_id.
+func (s *Server) adminFeedOwner(w http.ResponseWriter, r *http.Request) (models.FeedOwner, bool) {
+	scope, err := s.agencyScope(r)
+	if err != nil {
+		s.log.Error("Error getting agency scope", sl.Err(err))
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return models.FeedOwner{}, false
+	}
+	if scope == 0 {
+		http.Error(w, "agency_id is required", http.StatusBadRequest)
+		return models.FeedOwner{}, false
+	}
+	return models.FeedOwner{AgencyID: scope}, true
+}
+
+// AdminGetFeed reports on the feed of an agency.
+func (s *Server) AdminGetFeed(w http.ResponseWriter, r *http.Request) {
+	owner, ok := s.adminFeedOwner(w, r)
+	if !ok {
+		return
+	}
+	report, err := s.feedReport(owner)
+	s.writeFeedReport(w, report, err)
+}
+
+func (s *Server) AdminCreateFeedToken(w http.ResponseWriter, r *http.Request) {
+	if owner, ok := s.adminFeedOwner(w, r); ok {
+		s.createFeedToken(w, r, owner)
+	}
+}
+
+func (s *Server) AdminDeleteFeedToken(w http.ResponseWriter, r *http.Request) {
+	if owner, ok := s.adminFeedOwner(w, r); ok {
+		s.deleteFeedToken(w, r, owner)
+	}
+}
+
+// SetPhoneHandler sets the phone the feeds give for the caller's listings.
+// An empty phone removes it.
+func (s *Server) SetPhoneHandler(w http.ResponseWriter, r *http.Request) {
+	userID := userClaims(r).UserID
+
+	var req struct {
+		Phone string `json:"phone"`
+	}
+	err := json.NewDecoder(r.Body).Decode(&req)
+	if err != nil {
+		s.log.Error("Error in decoding body", sl.Err(err))
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	req.Phone = strings.TrimSpace(req.Phone)
+	if req.Phone != "" && !validPhone(req.Phone) {
+		http.Error(w, "Invalid phone", http.StatusBadRequest)
+		return
+	}
+
+	err = s.db.SetUserPhone(userID, req.Phone)
+	if err != nil {
+		s.log.Error("Error in setting phone", sl.Err(err))
+		http.Error(w, "failed to set phone", http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// validPhone accepts phones as people write them: 10 to 15 digits with an
+// optional leading plus, spaces, dashes and brackets.
+func validPhone(phone string) bool {
+	digits := 0
+	for i, r := range phone {
+		switch {
+		case r >= '0' && r <= '9':
+			digits++
+		case r == '+' && i == 0, r == ' ', r == '-', r == '(', r == ')':
+		default:
+			return false
+		}
+	}
+	return digits >= 10 && digits <= 15
+}
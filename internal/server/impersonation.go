@@ -0,0 +1,114 @@
+package server
+
+import (
+	"encoding/json"
+	"github.com/go-chi/chi/v5"
+	"log/slog"
+	"net/http"
+	"practic/internal/logger/sl"
+	"strconv"
+	"time"
+)
+
+const impersonationTTL = 15 * time.Minute
+
+// AdminImpersonateHandler lets an admin act as another user. The token
+// replaces the admin's access cookie and is also returned for API clients;
+// it is bound to the admin's session, so logging out ends it, and when it
+// expires the refresh cookie brings back the admin's own token.
+func (s *Server) AdminImpersonateHandler(w http.ResponseWriter, r *http.Request) {
+	claims := userClaims(r)
+
+	userID, err := strconv.ParseInt(chi.URLParam(r, "userID"), 10, 64)
+	if err != nil {
+		http.Error(w, "Invalid user ID", http.StatusBadRequest)
+		return
+	}
+	if userID == claims.UserID {
+		http.Error(w, "Cannot impersonate yourself", http.StatusBadRequest)
+		return
+	}
+	if !s.authorizeUser(w, r, userID) {
+		return
+	}
+
+	user, err := s.db.UserByID(userID)
+	if err != nil {
+		s.log.Error("Error in getting user", sl.Err(err))
+		http.Error(w, "Failed to impersonate user", http.StatusInternalServerError)
+		return
+	}
+	if user.Status != "active" {
+		http.Error(w, "User is not active", http.StatusConflict)
+		return
+	}
+	admin, err := s.db.UserByID(claims.UserID)
+	if err != nil {
+		s.log.Error("Error in getting user", sl.Err(err))
+		http.Error(w, "Failed to impersonate user", http.StatusInternalServerError)
+		return
+	}
+
+	token, err := s.tokens.NewImpersonationToken(user, admin, claims.SessionID, impersonationTTL)
+	if err != nil {
+		s.log.Error("Error in creating token", sl.Err(err))
+		http.Error(w, "Failed to impersonate user", http.StatusInternalServerError)
+		return
+	}
+
+	s.log.Info("Impersonation started", slog.Int64("user_id", user.ID), slog.Int64("impersonator_id", admin.ID))
+	s.setTokenCookie(w, token)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]any{
+		"token":      token,
+		"expires_at": time.Now().Add(impersonationTTL).UTC(),
+		"user":       map[string]any{"id": user.ID, "login": user.Login, "name": user.Name},
+	})
+}
+
+// StopImpersonationHandler gives the admin their own access token back.
+func (s *Server) StopImpersonationHandler(w http.ResponseWriter, r *http.Request) {
+	claims := userClaims(r)
+	if claims.ImpersonatorID == 0 {
+		http.Error(w, "Not impersonating", http.StatusBadRequest)
+		return
+	}
+
+	admin, err := s.db.UserByID(claims.ImpersonatorID)
+	if err != nil {
+		s.log.Error("Error in getting user", sl.Err(err))
+		http.Error(w, "Failed to stop impersonation", http.StatusInternalServerError)
+		return
+	}
+	// второй фактор админ проходил при входе в свою сессию
+	mfa, err := s.db.SessionMFA(claims.SessionID)
+	if err != nil {
+		s.log.Error("Error in getting session", sl.Err(err))
+		http.Error(w, "Failed to stop impersonation", http.StatusInternalServerError)
+		return
+	}
+	token, err := s.tokens.NewToken(admin, claims.SessionID, mfa, accessTokenTTL)
+	if err != nil {
+		s.log.Error("Error in creating token", sl.Err(err))
+		http.Error(w, "Failed to stop impersonation", http.StatusInternalServerError)
+		return
+	}
+
+	s.log.Info("Impersonation stopped", slog.Int64("user_id", claims.UserID), slog.Int64("impersonator_id", admin.ID))
+	s.setTokenCookie(w, token)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// DenyImpersonation blocks actions an admin must not take in another user's
+// name: account security settings and administration.
+func (s *Server) DenyImpersonation(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if claims := userClaims(r); claims.ImpersonatorID != 0 {
+			s.log.Warn("Blocked impersonated request", slog.String("path", r.URL.Path),
+				slog.Int64("user_id", claims.UserID), slog.Int64("impersonator_id", claims.ImpersonatorID))
+			http.Error(w, "Not allowed while impersonating", http.StatusForbidden)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,192 @@
+package server
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"practic/internal/logger/sl"
+	"practic/internal/models"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const exportFlushRows = 100
+
+// exportColumns are the CSV columns of an export. Listing fields use the
+// names the import understands, so an exported file can be imported again.
+var exportColumns = []string{
+	"id", "title", "type", "description", "status", "deal", "price", "city",
+	"address", "area", "rooms", "floor", "floors", "syndicate",
+	"agent", "agency_id", "date_created", "updated_at",
+}
+
+// exportedListing is a line of a JSON Lines export.
+type exportedListing struct {
+	ID          int64     `json:"id"`
+	Title       string    `json:"title"`
+	Type        string    `json:"type"`
+	Description string    `json:"description"`
+	Status      string    `json:"status"`
+	Deal        string    `json:"deal"`
+	Price       float64   `json:"price"`
+	City        string    `json:"city"`
+	Address     string    `json:"address"`
+	Area        float64   `json:"area"`
+	Rooms       int64     `json:"rooms"`
+	Floor       int64     `json:"floor"`
+	Floors      int64     `json:"floors"`
+	Syndicate   bool      `json:"syndicate"`
+	Agent       string    `json:"agent"`
+	AgencyID    int64     `json:"agency_id"`
+	DateCreated time.Time `json:"date_created"`
+	UpdatedAt   time.Time `json:"updated_at"`
+}
+
+func exportRecord(l models.ListingDB) []string {
+	return []string{
+		strconv.FormatInt(l.ID, 10), csvSafe(l.Name), csvSafe(l.Typel), csvSafe(l.Description), l.Status, l.Deal,
+		strconv.FormatFloat(l.Price, 'f', -1, 64), csvSafe(l.City), csvSafe(l.Address), strconv.FormatFloat(l.Area, 'f', -1, 64),
+		strconv.FormatInt(l.Rooms, 10), strconv.FormatInt(l.Floor, 10), strconv.FormatInt(l.Floors, 10), strconv.FormatBool(l.Syndicate),
+		csvSafe(l.Agent), strconv.FormatInt(l.AgencyID, 10),
+		l.Date_created.Format(time.RFC3339), l.UpdatedAt.Format(time.RFC3339),
+	}
+}
+
+// csvSafe keeps spreadsheets from running a cell as a formula.
+func csvSafe(v string) string {
+	if v != "" && strings.ContainsRune("=+-@\t\r", rune(v[0])) {
+		return "'" + v
+	}
+	return v
+}
+
+// streamListings writes the listings export yields as CSV or JSON Lines,
+// chosen by the format query parameter, flushing every exportFlushRows rows
+// so a large export is never held in memory. Once rows are sent an error can
+// only cut the response short.
+func (s *Server) streamListings(w http.ResponseWriter, r *http.Request, export func(each func(models.ListingDB) error) error) {
+	format := r.URL.Query().Get("format")
+	if format == "" {
+		format = "csv"
+	}
+	var (
+		contentType string
+		begin       func() error
+		write       func(models.ListingDB) error
+		flush       func() error
+	)
+	switch format {
+	case "csv":
+		cw := csv.NewWriter(w)
+		contentType = "text/csv; charset=utf-8"
+		begin = func() error {
+			// BOM, чтобы Excel открыл кириллицу в UTF-8
+			if _, err := w.Write([]byte("\ufeff")); err != nil {
+				return err
+			}
+			return cw.Write(exportColumns)
+		}
+		write = func(l models.ListingDB) error { return cw.Write(exportRecord(l)) }
+		flush = func() error {
+			cw.Flush()
+			return cw.Error()
+		}
+	case "jsonl":
+		enc := json.NewEncoder(w)
+		contentType = "application/jsonl; charset=utf-8"
+		begin = func() error { return nil }
+		write = func(l models.ListingDB) error {
+			return enc.Encode(exportedListing{
+				ID: l.ID, Title: l.Name, Type: l.Typel, Description: l.Description, Status: l.Status, Deal: l.Deal,
+				Price: l.Price, City: l.City, Address: l.Address, Area: l.Area, Rooms: l.Rooms, Floor: l.Floor, Floors: l.Floors,
+				Syndicate: l.Syndicate, Agent: l.Agent, AgencyID: l.AgencyID, DateCreated: l.Date_created, UpdatedAt: l.UpdatedAt,
+			})
+		}
+		flush = func() error { return nil }
+	default:
+		http.Error(w, "format must be csv or jsonl", http.StatusBadRequest)
+		return
+	}
+
+	rc := http.NewResponseController(w)
+	// большой выгрузке не хватит общего WriteTimeout сервера
+	_ = rc.SetWriteDeadline(time.Time{})
+	started := false
+	start := func() error {
+		started = true
+		w.Header().Set("Content-Type", contentType)
+		w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="listings-%s.%s"`, time.Now().Format("2006-01-02"), format))
+		return begin()
+	}
+
+	rows := 0
+	err := export(func(l models.ListingDB) error {
+		if !started {
+			if err := start(); err != nil {
+				return err
+			}
+		}
+		if err := write(l); err != nil {
+			return err
+		}
+		rows++
+		if rows%exportFlushRows == 0 {
+			if err := flush(); err != nil {
+				return err
+			}
+			return rc.Flush()
+		}
+		return nil
+	})
+	if err == nil && !started {
+		err = start()
+	}
+	if err == nil {
+		err = flush()
+	}
+	if err != nil {
+		s.log.Error("Error in exporting listings", sl.Err(err), slog.Int("rows", rows))
+		if rows == 0 {
+			w.Header().Del("Content-Disposition")
+			http.Error(w, "Ошибка выгрузки", 500)
+		}
+		return
+	}
+	s.log.Info("Listings exported", slog.Int64("user_id", userClaims(r).UserID), slog.String("format", format), slog.Int("rows", rows))
+}
+
+// ExportListings streams the caller's listings, the same ones and with the
+// same filters and order as GET /api/listings.
+func (s *Server) ExportListings(w http.ResponseWriter, r *http.Request) {
+	filter, err := parseListingFilter(r.URL.Query())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	userID := userClaims(r).UserID
+	s.streamListings(w, r, func(each func(models.ListingDB) error) error {
+		return s.db.ExportListings(userID, filter, each)
+	})
+}
+
+// AdminExportListings streams the listings of the caller's agency scope, like
+// GET /api/admin/listings.
+func (s *Server) AdminExportListings(w http.ResponseWriter, r *http.Request) {
+	filter, err := parseListingFilter(r.URL.Query())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	scope, err := s.agencyScope(r)
+	if err != nil {
+		s.log.Error("Error getting agency scope", sl.Err(err))
+		http.Error(w, "Ошибка выгрузки", http.StatusInternalServerError)
+		return
+	}
+	s.streamListings(w, r, func(each func(models.ListingDB) error) error {
+		return s.db.ExportAllListings(scope, filter, each)
+	})
+}
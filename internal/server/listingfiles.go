@@ -0,0 +1,443 @@
+package server
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"image"
+	_ "image/gif"
+	_ "image/jpeg"
+	_ "image/png"
+	"io"
+	"log/slog"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"path"
+	"practic/internal/blobstore"
+	"practic/internal/database"
+	"practic/internal/logger/sl"
+	"practic/internal/models"
+	"practic/internal/policy"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/go-chi/chi/v5"
+)
+
+const (
+	maxPhotoBytes    = 10 << 20
+	maxDocumentBytes = 20 << 20
+	maxUploadBytes   = 50 << 20 // на весь запрос, в нём может быть несколько файлов
+	maxPhotoPixels   = 50_000_000
+	maxFileNameChars = 200
+)
+
+// fileTypes are the content types accepted for each kind of file, as
+// detected from the content, with the extension used for the blob key.
+var fileTypes = map[string]map[string]string{
+	models.FilePhoto: {
+		"image/jpeg": ".jpg",
+		"image/png":  ".png",
+		"image/gif":  ".gif",
+	},
+	models.FileDocument: {
+		"application/pdf": ".pdf",
+		"image/jpeg":      ".jpg",
+		"image/png":       ".png",
+	},
+}
+
+var fileSizeLimits = map[string]int64{
+	models.FilePhoto:    maxPhotoBytes,
+	models.FileDocument: maxDocumentBytes,
+}
+
+// upload is a file read from the request and checked, not stored yet.
+type upload struct {
+	file  models.ListingFile
+	data  []byte
+	thumb []byte
+}
+
+func (s *Server) UploadListingPhotos(w http.ResponseWriter, r *http.Request) {
+	s.uploadListingFiles(w, r, models.FilePhoto)
+}
+
+func (s *Server) UploadListingDocuments(w http.ResponseWriter, r *http.Request) {
+	s.uploadListingFiles(w, r, models.FileDocument)
+}
+
+// uploadListingFiles stores every "file" part of a multipart request. All
+// files are checked before any is stored, so a bad file rejects the whole
+// request.
+func (s *Server) uploadListingFiles(w http.ResponseWriter, r *http.Request, kind string) {
+	listingID, err := strconv.ParseInt(chi.URLParam(r, "id"), 10, 64)
+	if err != nil {
+		s.log.Error("Error in parsing listing ID", sl.Err(err))
+		http.Error(w, "Invalid listing ID", http.StatusBadRequest)
+		return
+	}
+	if !s.authorizeListing(w, r, listingID, policy.Edit) {
+		return
+	}
+
+	r.Body = http.MaxBytesReader(w, r.Body, maxUploadBytes)
+	mr, err := r.MultipartReader()
+	if err != nil {
+		http.Error(w, "Expected a multipart/form-data body", http.StatusBadRequest)
+		return
+	}
+	var uploads []upload
+	for {
+		part, err := mr.NextPart()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			var maxErr *http.MaxBytesError
+			if errors.As(err, &maxErr) {
+				http.Error(w, fmt.Sprintf("Upload must be at most %d MB", maxUploadBytes>>20), http.StatusRequestEntityTooLarge)
+				return
+			}
+			http.Error(w, "Invalid multipart body", http.StatusBadRequest)
+			return
+		}
+		if part.FormName() != "file" || part.FileName() == "" {
+			continue
+		}
+		u, status, err := readUpload(part, kind)
+		part.Close()
+		if err != nil {
+			http.Error(w, err.Error(), status)
+			return
+		}
+		u.file.ListingID = listingID
+		u.file.CreatedBy = userClaims(r).UserID
+		uploads = append(uploads, u)
+	}
+	if len(uploads) == 0 {
+		http.Error(w, `No files in the "file" field`, http.StatusBadRequest)
+		return
+	}
+
+	files := make([]models.ListingFile, 0, len(uploads))
+	for _, u := range uploads {
+		f, err := s.storeUpload(u)
+		if err != nil {
+			s.log.Error("Error in storing file", sl.Err(err))
+			http.Error(w, "Ошибка сохранения файла", 500)
+			return
+		}
+		s.log.Info("Listing file uploaded", slog.Int64("listing_id", listingID), slog.Int64("file_id", f.ID),
+			slog.String("kind", kind), slog.Int64("size", f.Size))
+		files = append(files, withFileURLs(f))
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(files)
+}
+
+// readUpload reads a file part and checks its size and detected type;
+// photos are decoded to make the thumbnail. On error it returns the status
+// to answer with.
+func readUpload(part *multipart.Part, kind string) (upload, int, error) {
+	limit := fileSizeLimits[kind]
+	data, err := io.ReadAll(io.LimitReader(part, limit+1))
+	if err != nil {
+		var maxErr *http.MaxBytesError
+		if errors.As(err, &maxErr) {
+			return upload{}, http.StatusRequestEntityTooLarge, fmt.Errorf("upload must be at most %d MB", maxUploadBytes>>20)
+		}
+		return upload{}, http.StatusBadRequest, errors.New("invalid multipart body")
+	}
+	name := fileName(part.FileName())
+	if int64(len(data)) > limit {
+		return upload{}, http.StatusRequestEntityTooLarge, fmt.Errorf("%s: file must be at most %d MB", name, limit>>20)
+	}
+	if len(data) == 0 {
+		return upload{}, http.StatusBadRequest, fmt.Errorf("%s: file is empty", name)
+	}
+
+	// тип определяем по содержимому: заголовку и расширению от клиента не доверяем
+	contentType := http.DetectContentType(data)
+	if _, ok := fileTypes[kind][contentType]; !ok {
+		return upload{}, http.StatusUnsupportedMediaType, fmt.Errorf("%s: %s files are not accepted", name, contentType)
+	}
+
+	u := upload{
+		file: models.ListingFile{Kind: kind, Name: name, ContentType: contentType, Size: int64(len(data))},
+		data: data,
+	}
+	if kind != models.FilePhoto {
+		return u, 0, nil
+	}
+
+	cfg, _, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		return upload{}, http.StatusUnsupportedMediaType, fmt.Errorf("%s: not a valid image", name)
+	}
+	if cfg.Width*cfg.Height > maxPhotoPixels {
+		return upload{}, http.StatusRequestEntityTooLarge, fmt.Errorf("%s: image is too large", name)
+	}
+	img, _, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		return upload{}, http.StatusUnsupportedMediaType, fmt.Errorf("%s: not a valid image", name)
+	}
+	if u.thumb, err = thumbnail(img); err != nil {
+		return upload{}, http.StatusUnsupportedMediaType, fmt.Errorf("%s: not a valid image", name)
+	}
+	u.file.Width, u.file.Height = cfg.Width, cfg.Height
+	return u, 0, nil
+}
+
+// fileName keeps the base name the client sent, for display and downloads.
+func fileName(name string) string {
+	name = strings.TrimSpace(path.Base(strings.ReplaceAll(name, "\\", "/")))
+	if name == "" || name == "." || name == "/" {
+		return "file"
+	}
+	if utf8.RuneCountInString(name) > maxFileNameChars {
+		name = string([]rune(name)[:maxFileNameChars])
+	}
+	return name
+}
+
+// storeUpload writes the blobs of a file and then its record, removing the
+// blobs again if the record cannot be saved.
+func (s *Server) storeUpload(u upload) (models.ListingFile, error) {
+	f := u.file
+	key := fmt.Sprintf("listings/%d/%s", f.ListingID, strings.ToLower(rand.Text()))
+	f.BlobKey = key + fileTypes[f.Kind][f.ContentType]
+	if err := s.blobs.Put(f.BlobKey, bytes.NewReader(u.data)); err != nil {
+		return f, err
+	}
+	if u.thumb != nil {
+		f.ThumbKey = key + "_thumb.jpg"
+		if err := s.blobs.Put(f.ThumbKey, bytes.NewReader(u.thumb)); err != nil {
+			s.deleteBlobs(f.BlobKey)
+			return f, err
+		}
+	}
+
+	id, err := s.db.AddListingFile(f)
+	if err != nil {
+		s.deleteBlobs(f.BlobKey, f.ThumbKey)
+		return f, err
+	}
+	return s.db.GetListingFile(f.ListingID, id)
+}
+
+// deleteBlobs removes blobs whose records are already gone. Failures are
+// only logged: the record no longer points to them.
+func (s *Server) deleteBlobs(keys ...string) {
+	for _, key := range keys {
+		if key == "" {
+			continue
+		}
+		if err := s.blobs.Delete(key); err != nil {
+			s.log.Error("Error in deleting blob", slog.String("key", key), sl.Err(err))
+		}
+	}
+}
+
+// withFileURLs fills in where the client downloads a file and its thumbnail.
+func withFileURLs(f models.ListingFile) models.ListingFile {
+	f.URL = fmt.Sprintf("/api/listings/%d/files/%d", f.ListingID, f.ID)
+	if f.ThumbKey != "" {
+		f.ThumbURL = f.URL + "?thumb=1"
+	}
+	return f
+}
+
+func (s *Server) GetListingFiles(w http.ResponseWriter, r *http.Request) {
+	listingID, err := strconv.ParseInt(chi.URLParam(r, "id"), 10, 64)
+	if err != nil {
+		s.log.Error("Error in parsing listing ID", sl.Err(err))
+		http.Error(w, "Invalid listing ID", http.StatusBadRequest)
+		return
+	}
+	if !s.authorizeListing(w, r, listingID, policy.Read) {
+		return
+	}
+
+	files, err := s.db.GetListingFiles(listingID)
+	if err != nil {
+		s.log.Error("Error in getting listing files", sl.Err(err))
+		http.Error(w, "Ошибка получения файлов", 500)
+		return
+	}
+	for i := range files {
+		files[i] = withFileURLs(files[i])
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(files)
+}
+
+// listingFile parses the listing and file IDs of the request, checks that
+// the caller may perform action on the listing and loads the file. It
+// writes the response itself on failure.
+func (s *Server) listingFile(w http.ResponseWriter, r *http.Request, action policy.Action) (models.ListingFile, bool) {
+	listingID, err := strconv.ParseInt(chi.URLParam(r, "id"), 10, 64)
+	if err != nil {
+		http.Error(w, "Invalid listing ID", http.StatusBadRequest)
+		return models.ListingFile{}, false
+	}
+	fileID, err := strconv.ParseInt(chi.URLParam(r, "fileID"), 10, 64)
+	if err != nil {
+		http.Error(w, "Invalid file ID", http.StatusBadRequest)
+		return models.ListingFile{}, false
+	}
+	if !s.authorizeListing(w, r, listingID, action) {
+		return models.ListingFile{}, false
+	}
+
+	f, err := s.db.GetListingFile(listingID, fileID)
+	if err != nil {
+		if errors.Is(err, database.ErrFileNotFound) {
+			http.Error(w, "File not found", http.StatusNotFound)
+			return models.ListingFile{}, false
+		}
+		s.log.Error("Error in getting listing file", sl.Err(err))
+		http.Error(w, "Ошибка получения файла", 500)
+		return models.ListingFile{}, false
+	}
+	return f, true
+}
+
+// DownloadListingFile streams a file, or its thumbnail with ?thumb=1.
+func (s *Server) DownloadListingFile(w http.ResponseWriter, r *http.Request) {
+	f, ok := s.listingFile(w, r, policy.Read)
+	if !ok {
+		return
+	}
+
+	key, name, contentType, size := f.BlobKey, f.Name, f.ContentType, f.Size
+	if r.URL.Query().Get("thumb") != "" {
+		if f.ThumbKey == "" {
+			http.Error(w, "File has no thumbnail", http.StatusNotFound)
+			return
+		}
+		key, name, contentType, size = f.ThumbKey, strings.TrimSuffix(f.Name, path.Ext(f.Name))+"_thumb.jpg", "image/jpeg", 0
+	}
+	blob, err := s.blobs.Open(key)
+	if err != nil {
+		if errors.Is(err, blobstore.ErrNotFound) {
+			http.Error(w, "File not found", http.StatusNotFound)
+			return
+		}
+		s.log.Error("Error in opening blob", sl.Err(err))
+		http.Error(w, "Ошибка получения файла", 500)
+		return
+	}
+	defer blob.Close()
+
+	disposition := "attachment"
+	if f.Kind == models.FilePhoto {
+		disposition = "inline"
+	}
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("Content-Disposition", mime.FormatMediaType(disposition, map[string]string{"filename": name}))
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	// ключ не меняется, пока файл существует
+	w.Header().Set("Cache-Control", "private, max-age=86400")
+	if size > 0 {
+		w.Header().Set("Content-Length", strconv.FormatInt(size, 10))
+	}
+	if _, err := io.Copy(w, blob); err != nil {
+		s.log.Error("Error in sending file", sl.Err(err))
+	}
+}
+
+func (s *Server) DeleteListingFile(w http.ResponseWriter, r *http.Request) {
+	f, ok := s.listingFile(w, r, policy.Edit)
+	if !ok {
+		return
+	}
+
+	f, err := s.db.DeleteListingFile(f.ListingID, f.ID)
+	if err != nil {
+		if errors.Is(err, database.ErrFileNotFound) {
+			http.Error(w, "File not found", http.StatusNotFound)
+			return
+		}
+		s.log.Error("Error in deleting listing file", sl.Err(err))
+		http.Error(w, "Ошибка удаления файла", 500)
+		return
+	}
+	s.deleteBlobs(f.BlobKey, f.ThumbKey)
+
+	s.log.Info("Listing file deleted", slog.Int64("listing_id", f.ListingID), slog.Int64("file_id", f.ID))
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (s *Server) SetListingCover(w http.ResponseWriter, r *http.Request) {
+	f, ok := s.listingFile(w, r, policy.Edit)
+	if !ok {
+		return
+	}
+	if f.Kind != models.FilePhoto {
+		http.Error(w, "Only a photo can be the cover", http.StatusBadRequest)
+		return
+	}
+
+	err := s.db.SetListingCover(f.ListingID, f.ID)
+	if err != nil {
+		if errors.Is(err, database.ErrFileNotFound) {
+			http.Error(w, "File not found", http.StatusNotFound)
+			return
+		}
+		s.log.Error("Error in setting listing cover", sl.Err(err))
+		http.Error(w, "Ошибка сохранения обложки", 500)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// ReorderListingFiles takes {"kind": "photo", "ids": [...]} with every file
+// of the kind in the new order.
+func (s *Server) ReorderListingFiles(w http.ResponseWriter, r *http.Request) {
+	listingID, err := strconv.ParseInt(chi.URLParam(r, "id"), 10, 64)
+	if err != nil {
+		s.log.Error("Error in parsing listing ID", sl.Err(err))
+		http.Error(w, "Invalid listing ID", http.StatusBadRequest)
+		return
+	}
+	if !s.authorizeListing(w, r, listingID, policy.Edit) {
+		return
+	}
+
+	var req struct {
+		Kind string  `json:"kind"`
+		IDs  []int64 `json:"ids"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		s.log.Error("Error in decoding body", sl.Err(err))
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	if req.Kind == "" {
+		req.Kind = models.FilePhoto
+	}
+	if _, ok := fileTypes[req.Kind]; !ok {
+		http.Error(w, "kind must be photo or document", http.StatusBadRequest)
+		return
+	}
+
+	err = s.db.ReorderListingFiles(listingID, req.Kind, req.IDs)
+	if err != nil {
+		if errors.Is(err, database.ErrFileOrder) {
+			http.Error(w, "ids must list every file of the kind exactly once", http.StatusBadRequest)
+			return
+		}
+		s.log.Error("Error in reordering listing files", sl.Err(err))
+		http.Error(w, "Ошибка сохранения порядка", 500)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,355 @@
+package server
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"mime"
+	"net/http"
+	"practic/internal/logger/sl"
+	"practic/internal/models"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+const (
+	maxImportBytes = 5 << 20
+	maxImportRows  = 1000
+)
+
+// importColumns maps CSV headers, lower-cased, to the JSON names of
+// models.Listing. Russian headers let agents upload their spreadsheets as is.
+var importColumns = map[string]string{
+	"title":       "title",
+	"название":    "title",
+	"type":        "type",
+	"тип":         "type",
+	"description": "description",
+	"описание":    "description",
+	"status":      "status",
+	"статус":      "status",
+	"deal":        "deal",
+	"сделка":      "deal",
+	"price":       "price",
+	"цена":        "price",
+	"city":        "city",
+	"город":       "city",
+	"address":     "address",
+	"адрес":       "address",
+	"area":        "area",
+	"площадь":     "area",
+	"rooms":       "rooms",
+	"комнаты":     "rooms",
+	"floor":       "floor",
+	"этаж":        "floor",
+	"floors":      "floors",
+	"этажность":   "floors",
+	"syndicate":   "syndicate",
+	"выгрузка":    "syndicate",
+}
+
+var requiredImportFields = []string{"title", "type", "price", "city"}
+
+// dealAliases lets CSV files name the deal in Russian.
+var dealAliases = map[string]string{
+	"продажа": models.DealSale,
+	"аренда":  models.DealRent,
+}
+
+// boolAliases are the spellings of the syndicate flag spreadsheets use.
+var boolAliases = map[string]bool{
+	"true": true, "1": true, "да": true, "yes": true,
+	"false": false, "0": false, "нет": false, "no": false,
+}
+
+// importRow is a row of an import file before validation: its number in the
+// file and its non-empty fields as JSON values, keyed like models.Listing.
+type importRow struct {
+	row    int
+	fields map[string]json.RawMessage
+}
+
+// parseImportCSV reads a CSV file with a header row. Columns it does not know
+// are returned as ignored rather than failing the file, since spreadsheets
+// often carry extra columns.
+func parseImportCSV(data []byte) (rows []importRow, ignored []string, err error) {
+	data = bytes.TrimPrefix(data, []byte("\ufeff"))
+	reader := csv.NewReader(bytes.NewReader(data))
+	reader.FieldsPerRecord = -1
+	// Excel в русской локали сохраняет CSV через точку с запятой
+	if header, _, _ := bytes.Cut(data, []byte("\n")); bytes.Count(header, []byte(";")) > bytes.Count(header, []byte(",")) {
+		reader.Comma = ';'
+	}
+
+	header, err := reader.Read()
+	if err != nil {
+		return nil, nil, errors.New("CSV file must start with a header row")
+	}
+	columns := make([]string, len(header))
+	seen := map[string]bool{}
+	for i, name := range header {
+		field, ok := importColumns[strings.ToLower(strings.TrimSpace(name))]
+		if !ok {
+			ignored = append(ignored, name)
+			continue
+		}
+		if seen[field] {
+			return nil, nil, fmt.Errorf("column %s appears twice", field)
+		}
+		seen[field] = true
+		columns[i] = field
+	}
+	for _, field := range requiredImportFields {
+		if !seen[field] {
+			return nil, nil, fmt.Errorf("missing column %s", field)
+		}
+	}
+
+	for {
+		record, err := reader.Read()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return nil, nil, fmt.Errorf("CSV: %w", err)
+		}
+		if len(rows) == maxImportRows {
+			return nil, nil, fmt.Errorf("at most %d rows can be imported at once", maxImportRows)
+		}
+		line, _ := reader.FieldPos(0)
+		row := importRow{row: line, fields: map[string]json.RawMessage{}}
+		for i, value := range record {
+			value = strings.TrimSpace(value)
+			if i >= len(columns) || columns[i] == "" || value == "" {
+				continue
+			}
+			row.fields[columns[i]] = csvValue(columns[i], value)
+		}
+		rows = append(rows, row)
+	}
+	return rows, ignored, nil
+}
+
+// csvValue turns a CSV cell into the JSON value the listing fields parse.
+// Cells that are not numbers where one is expected stay strings and fail
+// validation with the field's own message.
+func csvValue(field, value string) json.RawMessage {
+	// «1 500 000» из таблицы
+	digits := strings.Map(func(r rune) rune {
+		if unicode.IsSpace(r) {
+			return -1
+		}
+		return r
+	}, value)
+	switch field {
+	case "price", "rooms", "floor", "floors":
+		if n, err := strconv.ParseInt(digits, 10, 64); err == nil {
+			return json.RawMessage(strconv.FormatInt(n, 10))
+		}
+	case "area":
+		// «45,5» в русской локали
+		if area, err := strconv.ParseFloat(strings.Replace(digits, ",", ".", 1), 64); err == nil {
+			return json.RawMessage(strconv.FormatFloat(area, 'f', -1, 64))
+		}
+	case "syndicate":
+		if v, ok := boolAliases[strings.ToLower(value)]; ok {
+			return json.RawMessage(strconv.FormatBool(v))
+		}
+	case "deal":
+		if deal, ok := dealAliases[strings.ToLower(value)]; ok {
+			value = deal
+		}
+	}
+	raw, _ := json.Marshal(value)
+	return raw
+}
+
+// parseImportJSON reads a JSON array of listings in the format of the API.
+// Null fields count as absent.
+func parseImportJSON(data []byte) ([]importRow, error) {
+	var items []map[string]json.RawMessage
+	if err := json.Unmarshal(data, &items); err != nil {
+		return nil, errors.New("body must be a JSON array of listings")
+	}
+	if len(items) > maxImportRows {
+		return nil, fmt.Errorf("at most %d rows can be imported at once", maxImportRows)
+	}
+
+	rows := make([]importRow, len(items))
+	for i, item := range items {
+		rows[i] = importRow{row: i + 1, fields: map[string]json.RawMessage{}}
+		for name, raw := range item {
+			if string(raw) != "null" {
+				rows[i].fields[name] = raw
+			}
+		}
+	}
+	return rows, nil
+}
+
+// validateImportRow checks a row with the same rules as PATCH and creation:
+// status may only be draft (the default) or active, deal defaults to sale.
+func validateImportRow(fields map[string]json.RawMessage) (models.Listing, []string) {
+	l := models.Listing{Status: models.StatusDraft, Deal: models.DealSale}
+	var errs []string
+
+	names := make([]string, 0, len(fields))
+	for name := range fields {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		raw := fields[name]
+		if name == "status" {
+			var status string
+			if json.Unmarshal(raw, &status) != nil || (status != models.StatusDraft && status != models.StatusActive) {
+				errs = append(errs, "status: must be draft or active")
+				continue
+			}
+			l.Status = status
+			continue
+		}
+		field, ok := listingFields[name]
+		if !ok {
+			errs = append(errs, name+": unknown field")
+			continue
+		}
+		value, err := field.parse(raw)
+		if err != nil {
+			errs = append(errs, fmt.Sprintf("%s: %v", name, err))
+			continue
+		}
+		switch name {
+		case "title":
+			l.Name = value.(string)
+		case "type":
+			l.Typel = value.(string)
+		case "description":
+			l.Description = value.(string)
+		case "deal":
+			l.Deal = value.(string)
+		case "city":
+			l.City = value.(string)
+		case "price":
+			l.Price = value.(int64)
+		case "address":
+			l.Address = value.(string)
+		case "area":
+			l.Area = value.(float64)
+		case "rooms":
+			l.Rooms = value.(int64)
+		case "floor":
+			l.Floor = value.(int64)
+		case "floors":
+			l.Floors = value.(int64)
+		case "syndicate":
+			l.Syndicate = value.(bool)
+		default:
+			errs = append(errs, name+": cannot be imported, set it after the import")
+		}
+	}
+	for _, name := range requiredImportFields {
+		if _, ok := fields[name]; !ok {
+			errs = append(errs, name+": is required")
+		}
+	}
+	return l, errs
+}
+
+// ImportListings creates listings from a CSV file (text/csv) or a JSON array
+// (application/json) in one transaction. Invalid rows are reported and left
+// out; rows repeating a listing the user already has are skipped, so the
+// file can be imported again once the failed rows are fixed. With
+// dry_run=1 the report is built but nothing is written.
+func (s *Server) ImportListings(w http.ResponseWriter, r *http.Request) {
+	dryRun, _ := strconv.ParseBool(r.URL.Query().Get("dry_run"))
+
+	body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxImportBytes))
+	if err != nil {
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			http.Error(w, "Import file is too large", http.StatusRequestEntityTooLarge)
+			return
+		}
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	var (
+		rows    []importRow
+		ignored []string
+	)
+	switch mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type")); mediaType {
+	case "text/csv", "application/csv":
+		rows, ignored, err = parseImportCSV(body)
+	case "application/json":
+		rows, err = parseImportJSON(body)
+	default:
+		http.Error(w, "Content-Type must be text/csv or application/json", http.StatusUnsupportedMediaType)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	report := models.ImportReport{DryRun: dryRun, IgnoredColumns: ignored, Rows: make([]models.ImportRow, len(rows))}
+	var (
+		listings  []models.Listing
+		positions []int
+	)
+	for i, row := range rows {
+		report.Rows[i].Row = row.row
+		if len(row.fields) == 0 {
+			report.Rows[i].Result, report.Rows[i].Reason = models.ImportSkipped, "empty row"
+			continue
+		}
+		l, errs := validateImportRow(row.fields)
+		if len(errs) > 0 {
+			report.Rows[i].Result, report.Rows[i].Errors = models.ImportFailed, errs
+			continue
+		}
+		listings = append(listings, l)
+		positions = append(positions, i)
+	}
+
+	userID := userClaims(r).UserID
+	ids, err := s.db.ImportListings(userID, listings, dryRun)
+	if err != nil {
+		s.log.Error("Error in importing listings", sl.Err(err))
+		http.Error(w, "Ошибка импорта", 500)
+		return
+	}
+	for i, id := range ids {
+		row := &report.Rows[positions[i]]
+		if id == 0 {
+			row.Result, row.Reason = models.ImportSkipped, "duplicate"
+			continue
+		}
+		row.Result = models.ImportCreated
+		if !dryRun {
+			row.ID = id
+		}
+	}
+	for _, row := range report.Rows {
+		switch row.Result {
+		case models.ImportCreated:
+			report.Created++
+		case models.ImportSkipped:
+			report.Skipped++
+		case models.ImportFailed:
+			report.Failed++
+		}
+	}
+	s.log.Info("Listings imported", slog.Int64("user_id", userID), slog.Bool("dry_run", dryRun),
+		slog.Int("created", report.Created), slog.Int("skipped", report.Skipped), slog.Int("failed", report.Failed))
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(report)
+}
@@ -0,0 +1,266 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"mime"
+	"net/http"
+	"practic/internal/database"
+	"practic/internal/logger/sl"
+	"practic/internal/models"
+	"practic/internal/policy"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/go-chi/chi/v5"
+)
+
+const maxPatchBytes = 64 << 10
+
+// listingField is a listing field a PATCH may change: its column and a
+// parser that validates the new value.
+type listingField struct {
+	column string
+	parse  func(raw json.RawMessage) (any, error)
+}
+
+// listingFields are keyed by the JSON names used by models.Listing.
+var listingFields = map[string]listingField{
+	"title":       {"name", textField(1, 200)},
+	"type":        {"type", textField(1, 50)},
+	"description": {"description", textField(0, 5000)},
+	"deal":        {"deal", parseDeal},
+	"city":        {"city", textField(1, 100)},
+	"price":       {"price", parsePrice},
+	"address":     {"address", textField(0, 300)},
+	"area":        {"area", parseArea},
+	"rooms":       {"rooms", countField(0, 100)},
+	"floor":       {"floor", countField(-5, 200)},
+	"floors":      {"floors", countField(0, 200)},
+	"syndicate":   {"syndicate", parseBool},
+}
+
+func textField(minLen, maxLen int) func(json.RawMessage) (any, error) {
+	return func(raw json.RawMessage) (any, error) {
+		var v string
+		if err := json.Unmarshal(raw, &v); err != nil {
+			return nil, errors.New("must be a string")
+		}
+		v = strings.TrimSpace(v)
+		n := utf8.RuneCountInString(v)
+		if n < minLen {
+			return nil, errors.New("must not be empty")
+		}
+		if n > maxLen {
+			return nil, fmt.Errorf("must be at most %d characters long", maxLen)
+		}
+		return v, nil
+	}
+}
+
+func parseDeal(raw json.RawMessage) (any, error) {
+	var v string
+	if err := json.Unmarshal(raw, &v); err != nil {
+		return nil, errors.New("must be a string")
+	}
+	if err := validateDeal(v); err != nil {
+		return nil, errors.New("must be sale or rent")
+	}
+	return v, nil
+}
+
+func parsePrice(raw json.RawMessage) (any, error) {
+	var v int64
+	if err := json.Unmarshal(raw, &v); err != nil || v < 0 {
+		return nil, errors.New("must be a non-negative integer")
+	}
+	return v, nil
+}
+
+func parseArea(raw json.RawMessage) (any, error) {
+	var v float64
+	if err := json.Unmarshal(raw, &v); err != nil || v < 0 || v > 100000 {
+		return nil, errors.New("must be a number of square metres")
+	}
+	return v, nil
+}
+
+func countField(minValue, maxValue int64) func(json.RawMessage) (any, error) {
+	return func(raw json.RawMessage) (any, error) {
+		var v int64
+		if err := json.Unmarshal(raw, &v); err != nil || v < minValue || v > maxValue {
+			return nil, fmt.Errorf("must be an integer from %d to %d", minValue, maxValue)
+		}
+		return v, nil
+	}
+}
+
+func parseBool(raw json.RawMessage) (any, error) {
+	var v bool
+	if err := json.Unmarshal(raw, &v); err != nil {
+		return nil, errors.New("must be true or false")
+	}
+	return v, nil
+}
+
+// parseListingPatch applies the JSON Merge Patch (RFC 7396) rules to a
+// listing: absent fields stay as they are, present fields are replaced and
+// null would remove a field, which listings do not allow. The version field
+// may carry the expected version like in PUT.
+func parseListingPatch(body []byte) (columns map[string]any, version int64, err error) {
+	var patch map[string]json.RawMessage
+	if err := json.Unmarshal(body, &patch); err != nil || patch == nil {
+		return nil, 0, errors.New("body must be a JSON object")
+	}
+
+	columns = map[string]any{}
+	var errs []error
+	names := make([]string, 0, len(patch))
+	for name := range patch {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		raw := patch[name]
+		if name == "version" {
+			if err := json.Unmarshal(raw, &version); err != nil {
+				errs = append(errs, errors.New("version: must be an integer"))
+			}
+			continue
+		}
+		if name == "status" {
+			errs = append(errs, errStatusViaTransition)
+			continue
+		}
+		field, ok := listingFields[name]
+		if !ok {
+			errs = append(errs, fmt.Errorf("%s: unknown field", name))
+			continue
+		}
+		if string(raw) == "null" {
+			errs = append(errs, fmt.Errorf("%s: cannot be removed", name))
+			continue
+		}
+		value, err := field.parse(raw)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", name, err))
+			continue
+		}
+		columns[field.column] = value
+	}
+	if len(errs) > 0 {
+		return nil, 0, errors.Join(errs...)
+	}
+	return columns, version, nil
+}
+
+// feedFields are the listing fields POST and PUT check with the same parsers
+// as PATCH; the rest of those bodies is checked by the handlers.
+var feedFields = []string{"address", "area", "rooms", "floor", "floors", "syndicate"}
+
+// parseFeedFields validates the feed fields present in a listing body and
+// returns their parsed values keyed by JSON name.
+func parseFeedFields(body []byte) (map[string]any, error) {
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(body, &fields); err != nil || fields == nil {
+		return nil, errors.New("body must be a JSON object")
+	}
+
+	values := map[string]any{}
+	var errs []error
+	for _, name := range feedFields {
+		raw, ok := fields[name]
+		if !ok || string(raw) == "null" {
+			continue
+		}
+		value, err := listingFields[name].parse(raw)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", name, err))
+			continue
+		}
+		values[name] = value
+	}
+	if len(errs) > 0 {
+		return nil, errors.Join(errs...)
+	}
+	return values, nil
+}
+
+// setFeedFields copies the values parsed by parseFeedFields into l.
+func setFeedFields(l *models.Listing, values map[string]any) {
+	if v, ok := values["address"].(string); ok {
+		l.Address = v
+	}
+	if v, ok := values["area"].(float64); ok {
+		l.Area = v
+	}
+	if v, ok := values["rooms"].(int64); ok {
+		l.Rooms = v
+	}
+	if v, ok := values["floor"].(int64); ok {
+		l.Floor = v
+	}
+	if v, ok := values["floors"].(int64); ok {
+		l.Floors = v
+	}
+	if v, ok := values["syndicate"].(bool); ok {
+		l.Syndicate = v
+	}
+}
+
+// PatchListing changes only the fields present in the body and returns the
+// updated listing. If-Match or version is honoured when sent but, unlike PUT,
+// not required: a patch does not overwrite fields the client did not see.
+func (s *Server) PatchListing(w http.ResponseWriter, r *http.Request) {
+	listingID, err := strconv.ParseInt(chi.URLParam(r, "id"), 10, 64)
+	if err != nil {
+		s.log.Error("Error in parsing listing ID", sl.Err(err))
+		http.Error(w, "Invalid listing ID", http.StatusBadRequest)
+		return
+	}
+	if mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type")); mediaType != "application/merge-patch+json" && mediaType != "application/json" {
+		http.Error(w, "Content-Type must be application/merge-patch+json", http.StatusUnsupportedMediaType)
+		return
+	}
+	if !s.authorizeListing(w, r, listingID, policy.Edit) {
+		return
+	}
+
+	body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxPatchBytes))
+	if err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	columns, bodyVersion, err := parseListingPatch(body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	version, ok := expectedVersion(r, bodyVersion)
+	if !ok {
+		version = 0
+	}
+
+	version, err = s.db.PatchListing(listingID, columns, version, userClaims(r).UserID)
+	if err != nil {
+		if errors.Is(err, database.ErrListingNotFound) {
+			http.Error(w, "Listing not found", http.StatusNotFound)
+			return
+		}
+		if errors.Is(err, database.ErrVersionConflict) {
+			http.Error(w, "Listing was changed by someone else", http.StatusPreconditionFailed)
+			return
+		}
+		s.log.Error("Error in patching listing", sl.Err(err))
+		http.Error(w, "Ошибка обновления", 500)
+		return
+	}
+	s.log.Info("Listing patched successfully", slog.Int64("id", listingID), slog.Int64("version", version))
+
+	s.GetListing(w, r)
+}
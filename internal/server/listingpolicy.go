@@ -0,0 +1,51 @@
+package server
+
+import (
+	"errors"
+	"net/http"
+	"practic/internal/database"
+	"practic/internal/logger/sl"
+	"practic/internal/policy"
+)
+
+// principal describes the caller for the listing policy.
+func (s *Server) principal(r *http.Request) (policy.Principal, error) {
+	claims := userClaims(r)
+	permissions, err := s.db.RolePermissions(claims.Role)
+	if err != nil {
+		return policy.Principal{}, err
+	}
+	return policy.Principal{UserID: claims.UserID, AgencyID: claims.AgencyID, Permissions: permissions}, nil
+}
+
+// authorizeListing asks the listing policy whether the caller may perform
+// action on the listing. On refusal it answers 404 for listings the caller
+// may not see and 403 for the rest, and returns false.
+func (s *Server) authorizeListing(w http.ResponseWriter, r *http.Request, listingID int64, action policy.Action) bool {
+	p, err := s.principal(r)
+	if err != nil {
+		s.log.Error("Error in getting permissions", sl.Err(err))
+		http.Error(w, "Ошибка проверки доступа", 500)
+		return false
+	}
+	facts, err := s.db.ListingFacts(listingID, p.UserID)
+	if err != nil {
+		if errors.Is(err, database.ErrListingNotFound) {
+			http.Error(w, "Listing not found", http.StatusNotFound)
+			return false
+		}
+		s.log.Error("Error in getting listing facts", sl.Err(err))
+		http.Error(w, "Ошибка проверки доступа", 500)
+		return false
+	}
+
+	switch policy.Listing(p, facts, action) {
+	case policy.Allow:
+		return true
+	case policy.Forbid:
+		http.Error(w, "Forbidden", http.StatusForbidden)
+	default:
+		http.Error(w, "Listing not found", http.StatusNotFound)
+	}
+	return false
+}
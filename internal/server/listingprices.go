@@ -0,0 +1,34 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"practic/internal/logger/sl"
+	"practic/internal/policy"
+	"strconv"
+
+	"github.com/go-chi/chi/v5"
+)
+
+// GetPriceHistory lists how the price of a listing changed, oldest first.
+func (s *Server) GetPriceHistory(w http.ResponseWriter, r *http.Request) {
+	listingID, err := strconv.ParseInt(chi.URLParam(r, "id"), 10, 64)
+	if err != nil {
+		s.log.Error("Error in parsing listing ID", sl.Err(err))
+		http.Error(w, "Invalid listing ID", http.StatusBadRequest)
+		return
+	}
+	if !s.authorizeListing(w, r, listingID, policy.Read) {
+		return
+	}
+
+	history, err := s.db.GetPriceHistory(listingID)
+	if err != nil {
+		s.log.Error("Error in getting price history", sl.Err(err))
+		http.Error(w, "Ошибка получения истории цен", 500)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(history)
+}
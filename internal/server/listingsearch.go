@@ -0,0 +1,112 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"practic/internal/models"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var listingSorts = []string{
+	models.ListingSortCreated,
+	models.ListingSortUpdated,
+	models.ListingSortPrice,
+	models.ListingSortTitle,
+	models.ListingSortCity,
+}
+
+// parseListingFilter reads the listing search parameters:
+//
+//	city (or the older filter), type, status, deal - exact match
+//	price_min, price_max                            - inclusive bounds
+//	created_from, created_to                        - inclusive dates, 2006-01-02
+//	q                                               - full-text search in title and description
+//	sort, order                                     - one of listingSorts, asc or desc
+func parseListingFilter(q url.Values) (models.ListingFilter, error) {
+	f := models.ListingFilter{
+		City:   strings.TrimSpace(q.Get("city")),
+		Type:   strings.TrimSpace(q.Get("type")),
+		Status: strings.TrimSpace(q.Get("status")),
+		Deal:   strings.TrimSpace(q.Get("deal")),
+		Query:  strings.TrimSpace(q.Get("q")),
+	}
+	if f.City == "" {
+		f.City = q.Get("filter")
+	}
+	if f.Deal != "" {
+		if err := validateDeal(f.Deal); err != nil {
+			return f, err
+		}
+	}
+
+	var err error
+	if f.PriceMin, err = priceParam(q, "price_min"); err != nil {
+		return f, err
+	}
+	if f.PriceMax, err = priceParam(q, "price_max"); err != nil {
+		return f, err
+	}
+	if f.PriceMin != nil && f.PriceMax != nil && *f.PriceMin > *f.PriceMax {
+		return f, errors.New("price_min must not exceed price_max")
+	}
+
+	if f.CreatedFrom, err = dateParam(q, "created_from"); err != nil {
+		return f, err
+	}
+	if f.CreatedTo, err = dateParam(q, "created_to"); err != nil {
+		return f, err
+	}
+	if !f.CreatedTo.IsZero() {
+		// created_to включает весь указанный день
+		f.CreatedTo = f.CreatedTo.AddDate(0, 0, 1)
+	}
+
+	sort := q.Get("sort")
+	if sort != "" && !slices.Contains(listingSorts, sort) {
+		return f, fmt.Errorf("sort must be one of %s", strings.Join(listingSorts, ", "))
+	}
+	f.Sort = sort
+	if f.Sort == "" {
+		f.Sort = models.ListingSortCreated
+	}
+	switch q.Get("order") {
+	case "":
+		// по умолчанию новые сверху, а для явной сортировки — по возрастанию
+		f.Desc = sort == ""
+	case "asc":
+		f.Desc = false
+	case "desc":
+		f.Desc = true
+	default:
+		return f, errors.New("order must be asc or desc")
+	}
+	return f, nil
+}
+
+func priceParam(q url.Values, name string) (*int64, error) {
+	v := q.Get(name)
+	if v == "" {
+		return nil, nil
+	}
+	price, err := strconv.ParseInt(v, 10, 64)
+	if err != nil || price < 0 {
+		return nil, fmt.Errorf("%s must be a non-negative integer", name)
+	}
+	return &price, nil
+}
+
+func dateParam(q url.Values, name string) (time.Time, error) {
+	v := q.Get(name)
+	if v == "" {
+		return time.Time{}, nil
+	}
+	date, err := time.Parse(time.DateOnly, v)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("%s must be a date like 2006-01-02", name)
+	}
+	return date, nil
+}
@@ -0,0 +1,44 @@
+package server
+
+import (
+	"net/url"
+	"practic/internal/models"
+	"testing"
+)
+
+func TestParseListingFilterOrder(t *testing.T) {
+	tests := []struct {
+		query string
+		sort  string
+		desc  bool
+	}{
+		{"", models.ListingSortCreated, true},
+		{"order=asc", models.ListingSortCreated, false},
+		{"order=desc", models.ListingSortCreated, true},
+		{"sort=price", models.ListingSortPrice, false},
+		{"sort=price&order=asc", models.ListingSortPrice, false},
+		{"sort=price&order=desc", models.ListingSortPrice, true},
+		{"sort=date_created", models.ListingSortCreated, false},
+	}
+	for _, tt := range tests {
+		q, err := url.ParseQuery(tt.query)
+		if err != nil {
+			t.Fatal(err)
+		}
+		f, err := parseListingFilter(q)
+		if err != nil {
+			t.Errorf("?%s: %v", tt.query, err)
+			continue
+		}
+		if f.Sort != tt.sort || f.Desc != tt.desc {
+			t.Errorf("?%s: sort %q desc %v, want %q %v", tt.query, f.Sort, f.Desc, tt.sort, tt.desc)
+		}
+	}
+
+	for _, query := range []string{"order=up", "sort=agent"} {
+		q, _ := url.ParseQuery(query)
+		if _, err := parseListingFilter(q); err == nil {
+			t.Errorf("?%s: no error", query)
+		}
+	}
+}
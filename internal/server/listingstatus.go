@@ -0,0 +1,121 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net/http"
+	"practic/internal/database"
+	"practic/internal/logger/sl"
+	"practic/internal/models"
+	"practic/internal/policy"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/go-chi/chi/v5"
+)
+
+const maxTransitionComment = 1000
+
+var errStatusViaTransition = errors.New("status: change it with POST /api/listings/{id}/transition")
+
+func validateDeal(deal string) error {
+	if deal != models.DealSale && deal != models.DealRent {
+		return errors.New("deal must be sale or rent")
+	}
+	return nil
+}
+
+// GetListingStatuses describes the listing lifecycle for clients.
+func (s *Server) GetListingStatuses(w http.ResponseWriter, r *http.Request) {
+	statuses, err := s.db.GetListingStatuses()
+	if err != nil {
+		s.log.Error("Error in getting listing statuses", sl.Err(err))
+		http.Error(w, "Ошибка получения статусов", 500)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(statuses)
+}
+
+// TransitionListing moves a listing along its lifecycle. The body is
+// {"to": "active", "comment": "..."}; If-Match or version is checked when
+// sent, like in PATCH. The response is the updated listing.
+func (s *Server) TransitionListing(w http.ResponseWriter, r *http.Request) {
+	listingID, err := strconv.ParseInt(chi.URLParam(r, "id"), 10, 64)
+	if err != nil {
+		s.log.Error("Error in parsing listing ID", sl.Err(err))
+		http.Error(w, "Invalid listing ID", http.StatusBadRequest)
+		return
+	}
+	if !s.authorizeListing(w, r, listingID, policy.Edit) {
+		return
+	}
+
+	var req struct {
+		To      string `json:"to"`
+		Comment string `json:"comment"`
+		Version int64  `json:"version"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		s.log.Error("Error in decoding body", sl.Err(err))
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	req.Comment = strings.TrimSpace(req.Comment)
+	if utf8.RuneCountInString(req.Comment) > maxTransitionComment {
+		http.Error(w, "Comment is too long", http.StatusBadRequest)
+		return
+	}
+	version, ok := expectedVersion(r, req.Version)
+	if !ok {
+		version = 0
+	}
+
+	userID := userClaims(r).UserID
+	version, err = s.db.TransitionListing(listingID, req.To, userID, req.Comment, version)
+	if err != nil {
+		switch {
+		case errors.Is(err, database.ErrListingNotFound):
+			http.Error(w, "Listing not found", http.StatusNotFound)
+		case errors.Is(err, database.ErrVersionConflict):
+			http.Error(w, "Listing was changed by someone else", http.StatusPreconditionFailed)
+		case errors.Is(err, database.ErrUnknownStatus):
+			http.Error(w, "Unknown status", http.StatusBadRequest)
+		case errors.Is(err, database.ErrTransitionNotAllowed):
+			http.Error(w, "This status change is not allowed", http.StatusConflict)
+		default:
+			s.log.Error("Error in changing listing status", sl.Err(err))
+			http.Error(w, "Ошибка смены статуса", 500)
+		}
+		return
+	}
+	s.log.Info("Listing status changed", slog.Int64("id", listingID), slog.String("to", req.To),
+		slog.Int64("user_id", userID), slog.Int64("version", version))
+
+	s.GetListing(w, r)
+}
+
+func (s *Server) GetStatusHistory(w http.ResponseWriter, r *http.Request) {
+	listingID, err := strconv.ParseInt(chi.URLParam(r, "id"), 10, 64)
+	if err != nil {
+		s.log.Error("Error in parsing listing ID", sl.Err(err))
+		http.Error(w, "Invalid listing ID", http.StatusBadRequest)
+		return
+	}
+	if !s.authorizeListing(w, r, listingID, policy.Read) {
+		return
+	}
+
+	history, err := s.db.GetStatusHistory(listingID)
+	if err != nil {
+		s.log.Error("Error in getting status history", sl.Err(err))
+		http.Error(w, "Ошибка получения истории", 500)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(history)
+}
@@ -0,0 +1,126 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"practic/internal/database"
+	"practic/internal/logger/sl"
+	"practic/internal/policy"
+	"strconv"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+)
+
+const (
+	defaultTrashRetentionDays = 30
+	purgeInterval             = time.Hour
+)
+
+// trashRetention is how long deleted listings stay in the trash, from
+// TRASH_RETENTION_DAYS. Zero keeps them until restored.
+func trashRetention() (time.Duration, error) {
+	days := defaultTrashRetentionDays
+	if v := os.Getenv("TRASH_RETENTION_DAYS"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 {
+			return 0, fmt.Errorf("TRASH_RETENTION_DAYS must be a non-negative number of days, got %q", v)
+		}
+		days = n
+	}
+	return time.Duration(days) * 24 * time.Hour, nil
+}
+
+// purgeTrash removes listings that stayed in the trash longer than
+// retention, now and then every purgeInterval.
+func (s *Server) purgeTrash(retention time.Duration) {
+	for ; ; time.Sleep(purgeInterval) {
+		blobKeys, err := s.db.PurgeListings(time.Now().Add(-retention))
+		if err != nil {
+			s.log.Error("Error in purging deleted listings", sl.Err(err))
+			continue
+		}
+		if len(blobKeys) > 0 {
+			s.log.Info("Purged deleted listings", slog.Int("blobs", len(blobKeys)))
+		}
+		s.deleteBlobs(blobKeys...)
+	}
+}
+
+// GetTrash lists the deleted listings the caller may restore: their own and,
+// with listings.edit_any, those of their agency scope.
+func (s *Server) GetTrash(w http.ResponseWriter, r *http.Request) {
+	page, err := pageRequest(r.URL.Query())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	p, err := s.principal(r)
+	if err != nil {
+		s.log.Error("Error in getting permissions", sl.Err(err))
+		http.Error(w, "Ошибка получения корзины", 500)
+		return
+	}
+	editAny, err := s.hasPermission(userClaims(r).Role, PermEditAnyListing)
+	if err != nil {
+		s.log.Error("Error in getting permissions", sl.Err(err))
+		http.Error(w, "Ошибка получения корзины", 500)
+		return
+	}
+	scope, err := s.agencyScope(r)
+	if err != nil {
+		s.log.Error("Error getting agency scope", sl.Err(err))
+		http.Error(w, "Ошибка получения корзины", 500)
+		return
+	}
+
+	listings, err := s.db.GetDeletedListings(p.UserID, editAny, scope, page)
+	if err != nil {
+		if errors.Is(err, database.ErrInvalidCursor) {
+			http.Error(w, "Invalid cursor", http.StatusBadRequest)
+			return
+		}
+		s.log.Error("Error in getting deleted listings", sl.Err(err))
+		http.Error(w, "Ошибка получения корзины", 500)
+		return
+	}
+	for i, l := range listings.Items {
+		for _, a := range policy.Actions(p, policy.ListingFacts{OwnerID: l.UserID, AgencyID: l.AgencyID, Deleted: true}) {
+			listings.Items[i].Actions = append(listings.Items[i].Actions, string(a))
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(listings)
+}
+
+// RestoreListing takes a listing out of the trash and returns it.
+func (s *Server) RestoreListing(w http.ResponseWriter, r *http.Request) {
+	listingID, err := strconv.ParseInt(chi.URLParam(r, "id"), 10, 64)
+	if err != nil {
+		s.log.Error("Error in parsing listing ID", sl.Err(err))
+		http.Error(w, "Invalid listing ID", http.StatusBadRequest)
+		return
+	}
+	if !s.authorizeListing(w, r, listingID, policy.Restore) {
+		return
+	}
+
+	userID := userClaims(r).UserID
+	if err := s.db.RestoreListing(listingID, userID); err != nil {
+		if errors.Is(err, database.ErrListingNotFound) {
+			http.Error(w, "Listing not found", http.StatusNotFound)
+			return
+		}
+		s.log.Error("Error in restoring listing", sl.Err(err))
+		http.Error(w, "Ошибка восстановления", 500)
+		return
+	}
+	s.log.Info("Listing restored", slog.Int64("id", listingID), slog.Int64("user_id", userID))
+
+	s.GetListing(w, r)
+}
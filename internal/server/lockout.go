@@ -0,0 +1,81 @@
+package server
+
+import (
+	"log/slog"
+	"math"
+	"net/http"
+	"practic/internal/logger/sl"
+	"strconv"
+	"time"
+)
+
+const (
+	// число неудачных попыток подряд, после которого включается блокировка
+	loginFreeAttempts = 5
+	ipFreeAttempts    = 20
+
+	lockoutBase = 30 * time.Second
+	lockoutMax  = time.Hour
+)
+
+// lockoutDuration doubles the lock for every failure over the free limit.
+func lockoutDuration(failures, free int64) time.Duration {
+	if failures <= free {
+		return 0
+	}
+	d := float64(lockoutBase) * math.Pow(2, float64(failures-free-1))
+	if d > float64(lockoutMax) {
+		return lockoutMax
+	}
+	return time.Duration(d)
+}
+
+// loginLocked answers 429 while the login or the client ip is locked out and
+// reports whether it did. Every check of a password or a second factor goes
+// through it, so they all share one failure counter.
+func (s *Server) loginLocked(w http.ResponseWriter, login, ip string) bool {
+	locked, err := s.db.LoginLockout(login, ip)
+	if err != nil {
+		s.log.Error("Error in checking lockout", sl.Err(err))
+		http.Error(w, "failed to check lockout", http.StatusInternalServerError)
+		return true
+	}
+	if locked > 0 {
+		w.Header().Set("Retry-After", strconv.Itoa(int(locked.Seconds())))
+		http.Error(w, "Too many attempts", http.StatusTooManyRequests)
+		return true
+	}
+	return false
+}
+
+func (s *Server) recordLoginFailure(login, ip string) {
+	for _, key := range []struct {
+		kind, value string
+		free        int64
+	}{
+		{"login", login, loginFreeAttempts},
+		{"ip", ip, ipFreeAttempts},
+	} {
+		failures, err := s.db.RecordLoginFailure(key.kind, key.value)
+		if err != nil {
+			s.log.Error("Error in recording login failure", sl.Err(err))
+			continue
+		}
+		if d := lockoutDuration(failures, key.free); d > 0 {
+			if err := s.db.LockLogin(key.kind, key.value, d); err != nil {
+				s.log.Error("Error in locking login", sl.Err(err))
+				continue
+			}
+			s.log.Warn("Login locked", slog.String("kind", key.kind), slog.String("value", key.value), slog.Duration("for", d))
+		}
+	}
+}
+
+// clearLoginFailures forgets the failures of a login after it signs in. The
+// ip counter is left to expire on its own: one valid account must not reset
+// it for an attacker guessing other logins from the same address.
+func (s *Server) clearLoginFailures(login string) {
+	if err := s.db.ClearLoginFailures("login", login); err != nil {
+		s.log.Error("Error in clearing login failures", sl.Err(err))
+	}
+}
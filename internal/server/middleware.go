@@ -2,19 +2,29 @@ package server
 
 import (
 	"context"
-	"github.com/golang-jwt/jwt/v5"
+	"errors"
 	"log/slog"
 	"net/http"
-	"os"
+	"practic/internal/database"
+	"practic/internal/jwt"
 	"practic/internal/logger/sl"
+	"slices"
+	"strings"
 )
 
-var jwtKey = os.Getenv("JWT_KEY")
+var errUnauthorized = errors.New("unauthorized")
+
+// userClaims returns the claims AuthMiddleware stored for the request.
+func userClaims(r *http.Request) *jwt.Claims {
+	return r.Context().Value("user").(*jwt.Claims)
+}
 
 func (s *Server) AuthMiddleware(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 
-		notAuth := []string{"/register", "/", "/api/register", "/api/login", "/styles.css", "/app.js", "/register/", "/api/logout", "/health"}
+		notAuth := []string{"/register", "/", "/api/register", "/api/login", "/api/login/2fa", "/styles.css", "/app.js", "/register/", "/api/logout", "/api/token/refresh", "/health",
+			"/reset", "/reset/", "/api/password/forgot", "/api/password/reset", "/api/email/confirm", "/.well-known/jwks.json",
+			"/api/oidc/config", "/api/oidc/login", "/api/oidc/callback"}
 		requestPath := r.URL.Path
 
 		for _, value := range notAuth {
@@ -23,41 +33,132 @@ func (s *Server) AuthMiddleware(next http.Handler) http.Handler {
 				return
 			}
 		}
-		cookie, err := r.Cookie("token")
-		if err != nil {
-			s.log.Error("Error in getting cookie", sl.Err(err))
-			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		// площадки забирают фиды без входа, доступ даёт токен в адресе
+		if strings.HasPrefix(requestPath, "/feeds/") {
+			next.ServeHTTP(w, r)
 			return
 		}
+		tokenStr, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if !ok {
+			cookie, err := r.Cookie("token")
+			if err != nil {
+				s.log.Error("Error in getting cookie", sl.Err(err))
+				http.Error(w, "Unauthorized", http.StatusUnauthorized)
+				return
+			}
+			tokenStr = cookie.Value
+		}
 
-		tokenStr := cookie.Value
-		claims := &jwt.MapClaims{}
-		token, err := jwt.ParseWithClaims(tokenStr, claims, func(token *jwt.Token) (interface{}, error) {
-			return []byte(jwtKey), nil
-		})
-		if err != nil || !token.Valid {
-			s.log.Error("Error in parsing token", sl.Err(err), slog.Any("token", token))
+		var claims *jwt.Claims
+		var err error
+		if strings.HasPrefix(tokenStr, jwt.AccessTokenPrefix) {
+			if !accessTokenPath(requestPath) {
+				http.Error(w, "Forbidden", http.StatusForbidden)
+				return
+			}
+			claims, err = s.accessTokenClaims(tokenStr)
+		} else {
+			claims, err = s.sessionClaims(tokenStr)
+		}
+		if err != nil {
 			http.Error(w, "Unauthorized", http.StatusUnauthorized)
 			return
 		}
 
+		if claims.ImpersonatorID != 0 {
+			s.log.Info("Impersonated request", slog.String("method", r.Method), slog.String("path", requestPath),
+				slog.Int64("user_id", claims.UserID), slog.Int64("impersonator_id", claims.ImpersonatorID))
+		}
+
 		ctx := context.WithValue(r.Context(), "user", claims)
 		next.ServeHTTP(w, r.WithContext(ctx))
 	})
 }
 
-func (s *Server) AdminOnly(next http.Handler) http.Handler {
-	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		userID := r.Context().Value("user").(*jwt.MapClaims)
-		userIDparsed := *userID
-		userrole := userIDparsed["role"].(string)
+// sessionClaims validates a JWT issued at login against its server-side session.
+func (s *Server) sessionClaims(tokenStr string) (*jwt.Claims, error) {
+	claims, err := s.tokens.ParseToken(tokenStr)
+	if err != nil {
+		s.log.Error("Error in parsing token", sl.Err(err))
+		return nil, errUnauthorized
+	}
 
-		//role, err := s.db.AdminOnly(userIDint)
-		if userrole != "admin" {
-			http.Error(w, "Forbidden", http.StatusForbidden)
-			return
+	// роль или аккаунт могли измениться после выдачи токена
+	version, err := s.db.SessionTokenVersion(claims.SessionID)
+	if err != nil {
+		if !errors.Is(err, database.ErrSessionNotFound) {
+			s.log.Error("Error in checking session", sl.Err(err))
+		}
+		return nil, errUnauthorized
+	}
+	if claims.ImpersonatorID == 0 {
+		if version != claims.TokenVersion {
+			return nil, errUnauthorized
 		}
+		return claims, nil
+	}
 
-		next.ServeHTTP(w, r)
-	})
+	// сессия принадлежит администратору, версию пользователя проверяем отдельно
+	if version != claims.ImpersonatorVersion {
+		return nil, errUnauthorized
+	}
+	user, err := s.db.UserByID(claims.UserID)
+	if err != nil {
+		if !errors.Is(err, database.ErrUserNotFound) {
+			s.log.Error("Error in getting user", sl.Err(err))
+		}
+		return nil, errUnauthorized
+	}
+	if user.TokenVersion != claims.TokenVersion || user.Status != "active" {
+		return nil, errUnauthorized
+	}
+	return claims, nil
+}
+
+// accessTokenClaims resolves a personal access token into the same claims a
+// session token carries, plus the token id and its scopes.
+func (s *Server) accessTokenClaims(tokenStr string) (*jwt.Claims, error) {
+	user, token, err := s.db.AccessTokenUser(jwt.HashToken(tokenStr))
+	if err != nil {
+		if !errors.Is(err, database.ErrAccessTokenNotFound) && !errors.Is(err, database.ErrUserNotFound) {
+			s.log.Error("Error in checking access token", sl.Err(err))
+		}
+		return nil, errUnauthorized
+	}
+	return &jwt.Claims{
+		UserID:        user.ID,
+		Login:         user.Login,
+		Name:          user.Name,
+		Role:          user.Role,
+		AgencyID:      user.AgencyID,
+		TokenVersion:  user.TokenVersion,
+		AccessTokenID: token.ID,
+		Scopes:        token.Scopes,
+	}, nil
+}
+
+// accessTokenPath reports whether personal access tokens may be used on path.
+// Account, session and admin endpoints require a real login.
+func accessTokenPath(path string) bool {
+	for _, prefix := range []string{"/api/listings", "/api/cities", "/api/analytics"} {
+		if path == prefix || strings.HasPrefix(path, prefix+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+// RequireScope rejects personal access tokens that lack scope. Session
+// tokens are not limited by scopes.
+func (s *Server) RequireScope(scope string) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			claims := userClaims(r)
+			if claims.AccessTokenID != 0 && !slices.Contains(claims.Scopes, scope) {
+				http.Error(w, "Insufficient scope", http.StatusForbidden)
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
 }
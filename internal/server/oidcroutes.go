@@ -0,0 +1,461 @@
+package server
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"os"
+	"practic/internal/database"
+	"practic/internal/jwt"
+	"practic/internal/logger/sl"
+	"practic/internal/models"
+	"practic/internal/oidc"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	oidcStateCookie = "oidc_state"
+	oidcStateTTL    = 10 * time.Minute
+	oidcLinkMark    = "link"
+)
+
+var (
+	errSSONotProvisioned = errors.New("no account for this identity")
+	errSSOLinkRequired   = errors.New("account with this email must link the identity itself")
+	errSSOIdentityTaken  = errors.New("identity is linked to another account")
+)
+
+// ssoConfig is the OpenID Connect login configuration, nil when OIDC_ISSUER
+// is not set.
+type ssoConfig struct {
+	provider      *oidc.Provider
+	name          string
+	defaultRole   string
+	groupRoles    []groupRole
+	autoProvision bool
+	autoLink      bool
+}
+
+type groupRole struct {
+	group string
+	role  string
+}
+
+// newSSOConfig reads the identity provider settings from the environment.
+// OIDC_GROUP_ROLES is a comma separated list of group=role pairs; the first
+// pair whose group the user is in decides the role, so list admin groups
+// first.
+func newSSOConfig() (*ssoConfig, error) {
+	issuer := os.Getenv("OIDC_ISSUER")
+	if issuer == "" {
+		return nil, nil
+	}
+	clientID := os.Getenv("OIDC_CLIENT_ID")
+	if clientID == "" {
+		return nil, errors.New("OIDC_CLIENT_ID is required")
+	}
+	redirectURL := os.Getenv("OIDC_REDIRECT_URL")
+	if redirectURL == "" {
+		redirectURL = strings.TrimRight(os.Getenv("APP_URL"), "/") + "/api/oidc/callback"
+	}
+
+	c := &ssoConfig{
+		provider: oidc.New(oidc.Config{
+			Issuer:       issuer,
+			ClientID:     clientID,
+			ClientSecret: os.Getenv("OIDC_CLIENT_SECRET"),
+			RedirectURL:  redirectURL,
+			Scopes:       strings.Fields(os.Getenv("OIDC_SCOPES")),
+			GroupsClaim:  os.Getenv("OIDC_GROUPS_CLAIM"),
+		}),
+		name:          os.Getenv("OIDC_NAME"),
+		defaultRole:   os.Getenv("OIDC_DEFAULT_ROLE"),
+		autoProvision: os.Getenv("OIDC_AUTO_PROVISION") != "false",
+		autoLink:      os.Getenv("OIDC_AUTO_LINK") == "true",
+	}
+	if c.name == "" {
+		c.name = "SSO"
+	}
+	if c.defaultRole == "" {
+		c.defaultRole = "agent"
+	}
+	for _, pair := range strings.Split(os.Getenv("OIDC_GROUP_ROLES"), ",") {
+		if strings.TrimSpace(pair) == "" {
+			continue
+		}
+		group, role, ok := strings.Cut(pair, "=")
+		group, role = strings.TrimSpace(group), strings.TrimSpace(role)
+		if !ok || group == "" || role == "" {
+			return nil, fmt.Errorf("OIDC_GROUP_ROLES: invalid pair %q", pair)
+		}
+		c.groupRoles = append(c.groupRoles, groupRole{group: group, role: role})
+	}
+	return c, nil
+}
+
+// mappedRole returns the role granted by the user's groups, "" if none of
+// them is mapped.
+func (c *ssoConfig) mappedRole(groups []string) string {
+	for _, gr := range c.groupRoles {
+		for _, g := range groups {
+			if g == gr.group {
+				return gr.role
+			}
+		}
+	}
+	return ""
+}
+
+func (s *Server) OIDCConfigHandler(w http.ResponseWriter, r *http.Request) {
+	resp := map[string]any{"enabled": s.sso != nil}
+	if s.sso != nil {
+		resp["name"] = s.sso.name
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
+
+// OIDCLoginHandler starts the authorization code flow.
+func (s *Server) OIDCLoginHandler(w http.ResponseWriter, r *http.Request) {
+	if s.sso == nil {
+		http.NotFound(w, r)
+		return
+	}
+
+	authURL, ok := s.startSSO(w, r, false)
+	if !ok {
+		return
+	}
+	http.Redirect(w, r, authURL, http.StatusFound)
+}
+
+// OIDCLinkHandler starts the authorization code flow for linking an identity
+// to the signed-in account and returns the provider URL to go to. It is a
+// POST so that another site cannot start it in the user's name.
+func (s *Server) OIDCLinkHandler(w http.ResponseWriter, r *http.Request) {
+	if s.sso == nil {
+		http.NotFound(w, r)
+		return
+	}
+
+	authURL, ok := s.startSSO(w, r, true)
+	if !ok {
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{"url": authURL})
+}
+
+// startSSO returns the provider URL of a new authorization code flow. State,
+// nonce and the PKCE verifier are kept in a short-lived cookie until the
+// callback, with a mark when the flow links an identity instead of signing
+// in. On failure it writes the response and returns false.
+func (s *Server) startSSO(w http.ResponseWriter, r *http.Request, link bool) (string, bool) {
+	var values [3]string
+	for i := range values {
+		v, _, err := jwt.NewOpaqueToken()
+		if err != nil {
+			s.log.Error("Error in creating oidc state", sl.Err(err))
+			http.Error(w, "failed to start login", http.StatusInternalServerError)
+			return "", false
+		}
+		values[i] = v
+	}
+	state, nonce, verifier := values[0], values[1], values[2]
+
+	authURL, err := s.sso.provider.AuthCodeURL(r.Context(), state, nonce, verifier)
+	if err != nil {
+		s.log.Error("Error in building auth url", sl.Err(err))
+		http.Error(w, "Identity provider is unavailable", http.StatusBadGateway)
+		return "", false
+	}
+
+	value := strings.Join(values[:], ".")
+	if link {
+		value += "." + oidcLinkMark
+	}
+	http.SetCookie(w, &http.Cookie{
+		Name:     oidcStateCookie,
+		Value:    value,
+		Path:     "/api/oidc",
+		MaxAge:   int(oidcStateTTL.Seconds()),
+		HttpOnly: true,
+		Secure:   s.cookieSecure,
+		// Lax, иначе браузер не отправит cookie при возврате с сайта провайдера
+		SameSite: http.SameSiteLaxMode,
+	})
+	return authURL, true
+}
+
+func (s *Server) OIDCCallbackHandler(w http.ResponseWriter, r *http.Request) {
+	if s.sso == nil {
+		http.NotFound(w, r)
+		return
+	}
+
+	cookie, err := r.Cookie(oidcStateCookie)
+	http.SetCookie(w, &http.Cookie{Name: oidcStateCookie, Path: "/api/oidc", MaxAge: -1, HttpOnly: true})
+	if err != nil {
+		s.ssoFailed(w, r, "error", errors.New("no state cookie"))
+		return
+	}
+	parts := strings.Split(cookie.Value, ".")
+	query := r.URL.Query()
+	link := len(parts) == 4 && parts[3] == oidcLinkMark
+	if (len(parts) != 3 && !link) || subtle.ConstantTimeCompare([]byte(parts[0]), []byte(query.Get("state"))) != 1 {
+		s.ssoFailed(w, r, "error", errors.New("state mismatch"))
+		return
+	}
+	if e := query.Get("error"); e != "" {
+		s.ssoFailed(w, r, "error", fmt.Errorf("provider error: %s %s", e, query.Get("error_description")))
+		return
+	}
+
+	identity, err := s.sso.provider.Exchange(r.Context(), query.Get("code"), parts[2], parts[1])
+	if err != nil {
+		s.ssoFailed(w, r, "error", err)
+		return
+	}
+	if link {
+		s.linkSSOIdentity(w, r, identity)
+		return
+	}
+
+	user, err := s.ssoUser(identity)
+	if err != nil {
+		if errors.Is(err, errSSONotProvisioned) {
+			s.ssoFailed(w, r, "forbidden", err)
+			return
+		}
+		if errors.Is(err, errSSOLinkRequired) {
+			s.ssoFailed(w, r, "link_required", err)
+			return
+		}
+		s.ssoFailed(w, r, "error", err)
+		return
+	}
+	if user.Status == "pending" {
+		http.Redirect(w, r, "/?sso=pending", http.StatusSeeOther)
+		return
+	}
+	if user.TOTPEnabled {
+		// второй фактор вводится на странице входа; токен во фрагменте не попадает в логи
+		mfaToken, err := s.tokens.NewMFAToken(user.ID, mfaTokenTTL)
+		if err != nil {
+			s.ssoFailed(w, r, "error", err)
+			return
+		}
+		http.Redirect(w, r, "/#mfa_token="+url.QueryEscape(mfaToken), http.StatusSeeOther)
+		return
+	}
+
+	err = s.startSession(w, r, user, false)
+	if err != nil {
+		s.ssoFailed(w, r, "error", err)
+		return
+	}
+	s.log.Info("User logged in", slog.Int64("id", user.ID), slog.String("role", user.Role), slog.Bool("sso", true))
+
+	target := "/dashboard"
+	if ok, err := s.hasPermission(user.Role, PermViewAllListings); err == nil && ok {
+		target = "/admin"
+	}
+	http.Redirect(w, r, target, http.StatusSeeOther)
+}
+
+func (s *Server) ssoFailed(w http.ResponseWriter, r *http.Request, reason string, err error) {
+	s.log.Error("Error in sso login", slog.String("reason", reason), sl.Err(err))
+	http.Redirect(w, r, "/?sso="+reason, http.StatusSeeOther)
+}
+
+// linkSSOIdentity links identity to the account of the session that started
+// the flow. The session is checked again here, the state cookie only says
+// that a link was asked for.
+func (s *Server) linkSSOIdentity(w http.ResponseWriter, r *http.Request, identity oidc.Identity) {
+	linkFailed := func(reason string, err error) {
+		s.log.Error("Error in linking sso identity", slog.String("reason", reason), sl.Err(err))
+		http.Redirect(w, r, "/dashboard?sso="+reason, http.StatusSeeOther)
+	}
+
+	cookie, err := r.Cookie("token")
+	if err != nil {
+		linkFailed("error", err)
+		return
+	}
+	claims, err := s.sessionClaims(cookie.Value)
+	if err != nil {
+		linkFailed("error", err)
+		return
+	}
+	if claims.ImpersonatorID != 0 {
+		linkFailed("error", errors.New("linking while impersonating"))
+		return
+	}
+
+	linked, err := s.db.UserByIdentity(identity.Issuer, identity.Subject)
+	switch {
+	case err == nil && linked.ID == claims.UserID:
+	case err == nil:
+		linkFailed("taken", errSSOIdentityTaken)
+		return
+	case errors.Is(err, database.ErrUserNotFound):
+		email := identity.Email
+		if !identity.EmailVerified {
+			email = ""
+		}
+		if err := s.db.LinkIdentity(claims.UserID, identity.Issuer, identity.Subject, email); err != nil {
+			linkFailed("error", err)
+			return
+		}
+		s.log.Info("Identity linked", slog.Int64("id", claims.UserID), slog.String("issuer", identity.Issuer))
+	default:
+		linkFailed("error", err)
+		return
+	}
+	http.Redirect(w, r, "/dashboard?sso=linked", http.StatusSeeOther)
+}
+
+// autoLinkable reports whether the first SSO login may link an identity to
+// an existing account by its email alone. Local emails are not verified, so
+// this is only allowed when OIDC_AUTO_LINK is on, and never for accounts
+// that sign in with a password or a second factor or that administer users
+// or agencies: those link the identity themselves from their session.
+func (s *Server) autoLinkable(user models.UserDB) (bool, error) {
+	if !s.sso.autoLink || user.Password != "" || user.TOTPEnabled {
+		return false, nil
+	}
+	for _, permission := range []string{PermManageUsers, PermManageAgencies} {
+		ok, err := s.hasPermission(user.Role, permission)
+		if err != nil || ok {
+			return false, err
+		}
+	}
+	return true, nil
+}
+
+// ssoUser finds the user linked to identity, links an existing account with
+// the same verified email when autoLinkable allows it, or provisions a new
+// one. The role is synced from the identity provider groups on every login
+// when any of them is mapped.
+func (s *Server) ssoUser(identity oidc.Identity) (models.UserDB, error) {
+	role := s.sso.mappedRole(identity.Groups)
+
+	user, err := s.db.UserByIdentity(identity.Issuer, identity.Subject)
+	if errors.Is(err, database.ErrUserNotFound) && identity.Email != "" && identity.EmailVerified {
+		existing, lookupErr := s.db.UserByEmail(identity.Email)
+		switch {
+		case lookupErr == nil:
+			ok, linkErr := s.autoLinkable(existing)
+			if linkErr != nil {
+				return models.UserDB{}, linkErr
+			}
+			if !ok {
+				return models.UserDB{}, errSSOLinkRequired
+			}
+			linkErr = s.db.LinkIdentity(existing.ID, identity.Issuer, identity.Subject, identity.Email)
+			if linkErr != nil {
+				return models.UserDB{}, linkErr
+			}
+			s.log.Info("Identity linked", slog.Int64("id", existing.ID), slog.String("issuer", identity.Issuer))
+			user, err = existing, nil
+		case !errors.Is(lookupErr, database.ErrUserNotFound):
+			return models.UserDB{}, lookupErr
+		}
+	}
+	if errors.Is(err, database.ErrUserNotFound) {
+		if role == "" {
+			role = s.sso.defaultRole
+		}
+		return s.provisionSSOUser(identity, role)
+	}
+	if err != nil {
+		return models.UserDB{}, err
+	}
+
+	if role != "" && role != user.Role {
+		if err := s.db.SetUserRole(user.ID, role); err != nil {
+			return models.UserDB{}, err
+		}
+		s.log.Info("Role synced from identity provider", slog.Int64("id", user.ID), slog.String("role", role))
+		return s.db.UserByID(user.ID)
+	}
+	return user, nil
+}
+
+func (s *Server) provisionSSOUser(identity oidc.Identity, role string) (models.UserDB, error) {
+	if !s.sso.autoProvision {
+		return models.UserDB{}, errSSONotProvisioned
+	}
+	mode, err := s.registrationMode()
+	if err != nil {
+		return models.UserDB{}, err
+	}
+	status := "active"
+	if mode == RegistrationApproval {
+		status = "pending"
+	}
+
+	base := ssoLogin(identity)
+	name := identity.Name
+	if name == "" {
+		name = base
+	}
+	email := identity.Email
+	if !identity.EmailVerified {
+		email = ""
+	}
+
+	// логин мог быть уже занят, пробуем base, base2, base3...
+	for i := 1; i <= 20; i++ {
+		login := base
+		if i > 1 {
+			login += strconv.Itoa(i)
+		}
+		uid, err := s.db.CreateIdentityUser(name, login, email, role, status, identity.Issuer, identity.Subject)
+		switch {
+		case errors.Is(err, database.ErrLoginTaken):
+			continue
+		case errors.Is(err, database.ErrEmailTaken):
+			email = ""
+			i--
+			continue
+		case err != nil:
+			return models.UserDB{}, err
+		}
+		s.log.Info("User provisioned from identity provider", slog.Int64("id", uid), slog.String("role", role), slog.String("status", status))
+		return s.db.UserByID(uid)
+	}
+	return models.UserDB{}, fmt.Errorf("no free login for %q", base)
+}
+
+// ssoLogin derives a login that passes validateLogin from the preferred
+// username or the email of the identity.
+func ssoLogin(identity oidc.Identity) string {
+	source := identity.Username
+	if source == "" {
+		source, _, _ = strings.Cut(identity.Email, "@")
+	}
+	var b strings.Builder
+	for _, c := range source {
+		if c < 128 && (c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || strings.ContainsRune("_.-", c)) {
+			b.WriteRune(c)
+		}
+	}
+	login := b.String()
+	if login != "" && !(login[0] >= 'a' && login[0] <= 'z' || login[0] >= 'A' && login[0] <= 'Z') {
+		login = "u" + login
+	}
+	if len(login) > 28 {
+		login = login[:28]
+	}
+	if validateLogin(login) != nil {
+		login = "user"
+	}
+	return login
+}
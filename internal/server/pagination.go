@@ -0,0 +1,32 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"practic/internal/models"
+	"strconv"
+)
+
+const (
+	defaultPageSize = 10
+	maxPageSize     = 100
+)
+
+// pageRequest reads page_size and the cursor returned as next_cursor by the
+// previous page. The old page number is rejected rather than ignored, so
+// clients still sending it do not get the first page over and over.
+func pageRequest(q url.Values) (models.PageRequest, error) {
+	page := models.PageRequest{Size: defaultPageSize, Cursor: q.Get("cursor")}
+	if q.Has("page") {
+		return page, errors.New("page is no longer supported, pass next_cursor from the previous response as cursor")
+	}
+	if v := q.Get("page_size"); v != "" {
+		size, err := strconv.Atoi(v)
+		if err != nil || size < 1 || size > maxPageSize {
+			return page, fmt.Errorf("page_size must be between 1 and %d", maxPageSize)
+		}
+		page.Size = size
+	}
+	return page, nil
+}
@@ -0,0 +1,286 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"golang.org/x/crypto/bcrypt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"os"
+	"practic/internal/database"
+	"practic/internal/jwt"
+	"practic/internal/logger/sl"
+	"practic/internal/mailer"
+	"strings"
+	"time"
+)
+
+const (
+	passwordResetTTL = time.Hour
+	emailChangeTTL   = 24 * time.Hour
+)
+
+func (s *Server) ChangePasswordHandler(w http.ResponseWriter, r *http.Request) {
+	userID := userClaims(r).UserID
+
+	var req struct {
+		CurrentPassword string `json:"current_password"`
+		NewPassword     string `json:"new_password"`
+	}
+	err := json.NewDecoder(r.Body).Decode(&req)
+	if err != nil {
+		s.log.Error("Error in decoding body", sl.Err(err))
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	if err := validatePassword(req.NewPassword); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	user, err := s.db.UserByID(userID)
+	if err != nil {
+		s.log.Error("Error in getting user", sl.Err(err))
+		http.Error(w, fmt.Sprintf("failed to get user: %v", err), http.StatusInternalServerError)
+		return
+	}
+	err = bcrypt.CompareHashAndPassword([]byte(user.Password), []byte(req.CurrentPassword))
+	if err != nil {
+		http.Error(w, "Invalid credentials", http.StatusUnauthorized)
+		return
+	}
+
+	passHash, err := bcrypt.GenerateFromPassword([]byte(req.NewPassword), bcrypt.DefaultCost)
+	if err != nil {
+		s.log.Error("Error in hashing password", sl.Err(err))
+		http.Error(w, "failed to hash password", http.StatusInternalServerError)
+		return
+	}
+	err = s.db.UpdatePassword(userID, passHash)
+	if err != nil {
+		s.log.Error("Error in updating password", sl.Err(err))
+		http.Error(w, "failed to update password", http.StatusInternalServerError)
+		return
+	}
+
+	// все сессии завершены, текущему устройству выдаём новую
+	user, err = s.db.UserByID(userID)
+	if err != nil {
+		s.log.Error("Error in getting user", sl.Err(err))
+		http.Error(w, fmt.Sprintf("failed to get user: %v", err), http.StatusInternalServerError)
+		return
+	}
+	err = s.startSession(w, r, user, false)
+	if err != nil {
+		s.log.Error("Error in creating session", sl.Err(err))
+		http.Error(w, fmt.Sprintf("failed to create session: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	s.log.Info("Password changed", slog.Int64("id", userID))
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// SetEmailHandler asks for the current password, as the email is where
+// password resets go. A new address is only stored once the link mailed to
+// it is opened, see ConfirmEmailHandler; an empty one clears the email.
+func (s *Server) SetEmailHandler(w http.ResponseWriter, r *http.Request) {
+	userID := userClaims(r).UserID
+
+	var req struct {
+		Email           string `json:"email"`
+		CurrentPassword string `json:"current_password"`
+	}
+	err := json.NewDecoder(r.Body).Decode(&req)
+	if err != nil {
+		s.log.Error("Error in decoding body", sl.Err(err))
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	req.Email = strings.TrimSpace(req.Email)
+	if req.Email != "" && !strings.Contains(req.Email, "@") {
+		http.Error(w, "Invalid email", http.StatusBadRequest)
+		return
+	}
+
+	user, err := s.db.UserByID(userID)
+	if err != nil {
+		s.log.Error("Error in getting user", sl.Err(err))
+		http.Error(w, fmt.Sprintf("failed to get user: %v", err), http.StatusInternalServerError)
+		return
+	}
+	err = bcrypt.CompareHashAndPassword([]byte(user.Password), []byte(req.CurrentPassword))
+	if err != nil {
+		http.Error(w, "Invalid credentials", http.StatusUnauthorized)
+		return
+	}
+
+	if req.Email == "" {
+		err = s.db.SetUserEmail(userID, "")
+		if err != nil {
+			s.log.Error("Error in setting email", sl.Err(err))
+			http.Error(w, "failed to set email", http.StatusInternalServerError)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	if owner, err := s.db.UserByEmail(req.Email); err == nil && owner.ID != userID {
+		http.Error(w, "Email already in use", http.StatusConflict)
+		return
+	}
+	token, tokenHash, err := jwt.NewOpaqueToken()
+	if err != nil {
+		s.log.Error("Error in generating token", sl.Err(err))
+		http.Error(w, "failed to set email", http.StatusInternalServerError)
+		return
+	}
+	err = s.db.CreateEmailChange(userID, req.Email, tokenHash, emailChangeTTL)
+	if err != nil {
+		s.log.Error("Error in creating email change", sl.Err(err))
+		http.Error(w, "failed to set email", http.StatusInternalServerError)
+		return
+	}
+
+	link := strings.TrimRight(os.Getenv("APP_URL"), "/") + "/api/email/confirm?token=" + url.QueryEscape(token)
+	msg := mailer.Message{
+		To:      req.Email,
+		Subject: "Подтверждение email",
+		Body: fmt.Sprintf("Здравствуйте, %s!\n\nЧтобы указать этот адрес в своём аккаунте, перейдите по ссылке:\n%s\n\nСсылка действует %d ч. Если вы не меняли email, просто проигнорируйте это письмо.\n",
+			user.Name, link, int(emailChangeTTL.Hours())),
+	}
+	go func() {
+		if err := s.mailer.Send(msg); err != nil {
+			s.log.Error("Error in sending email confirmation", sl.Err(err))
+		}
+	}()
+
+	s.log.Info("Email change requested", slog.Int64("id", userID))
+	w.WriteHeader(http.StatusAccepted)
+}
+
+// ConfirmEmailHandler opens from the link in the confirmation mail and
+// reports the outcome on the login page.
+func (s *Server) ConfirmEmailHandler(w http.ResponseWriter, r *http.Request) {
+	userID, err := s.db.ConfirmEmailChange(jwt.HashToken(r.URL.Query().Get("token")))
+	switch {
+	case errors.Is(err, database.ErrEmailChangeTokenInvalid):
+		http.Redirect(w, r, "/?email=invalid", http.StatusSeeOther)
+	case errors.Is(err, database.ErrEmailTaken):
+		http.Redirect(w, r, "/?email=taken", http.StatusSeeOther)
+	case err != nil:
+		s.log.Error("Error in confirming email change", sl.Err(err))
+		http.Error(w, "failed to confirm email", http.StatusInternalServerError)
+	default:
+		s.log.Info("Email changed", slog.Int64("id", userID))
+		http.Redirect(w, r, "/?email=confirmed", http.StatusSeeOther)
+	}
+}
+
+// ForgotPasswordHandler always answers 202 so the response does not reveal
+// which logins or emails exist. The lookup and the mail run in the
+// background, otherwise the SMTP round trip would give existing accounts
+// away by timing.
+func (s *Server) ForgotPasswordHandler(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Login string `json:"login"`
+	}
+	err := json.NewDecoder(r.Body).Decode(&req)
+	if err != nil {
+		s.log.Error("Error in decoding body", sl.Err(err))
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	login := strings.TrimSpace(req.Login)
+	go func() {
+		if err := s.sendPasswordReset(login); err != nil {
+			s.log.Error("Error in sending password reset", sl.Err(err))
+		}
+	}()
+
+	w.WriteHeader(http.StatusAccepted)
+}
+
+func (s *Server) sendPasswordReset(login string) error {
+	if login == "" {
+		return nil
+	}
+	user, err := s.db.User(login)
+	if err != nil {
+		user, err = s.db.UserByEmail(login)
+	}
+	if err != nil || user.Email == "" {
+		return nil
+	}
+
+	token, tokenHash, err := jwt.NewOpaqueToken()
+	if err != nil {
+		return err
+	}
+	err = s.db.CreatePasswordReset(user.ID, tokenHash, passwordResetTTL)
+	if err != nil {
+		return err
+	}
+
+	link := strings.TrimRight(os.Getenv("APP_URL"), "/") + "/reset/?token=" + url.QueryEscape(token)
+	err = s.mailer.Send(mailer.Message{
+		To:      user.Email,
+		Subject: "Восстановление пароля",
+		Body: fmt.Sprintf("Здравствуйте, %s!\n\nЧтобы задать новый пароль, перейдите по ссылке:\n%s\n\nСсылка действует %d мин. Если вы не запрашивали восстановление, просто проигнорируйте это письмо.\n",
+			user.Name, link, int(passwordResetTTL.Minutes())),
+	})
+	if err != nil {
+		return err
+	}
+
+	s.log.Info("Password reset requested", slog.Int64("id", user.ID))
+	return nil
+}
+
+func (s *Server) ResetPasswordHandler(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Token       string `json:"token"`
+		NewPassword string `json:"new_password"`
+	}
+	err := json.NewDecoder(r.Body).Decode(&req)
+	if err != nil {
+		s.log.Error("Error in decoding body", sl.Err(err))
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	if err := validatePassword(req.NewPassword); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	passHash, err := bcrypt.GenerateFromPassword([]byte(req.NewPassword), bcrypt.DefaultCost)
+	if err != nil {
+		s.log.Error("Error in hashing password", sl.Err(err))
+		http.Error(w, "failed to hash password", http.StatusInternalServerError)
+		return
+	}
+
+	userID, err := s.db.ConsumePasswordReset(jwt.HashToken(req.Token))
+	if err != nil {
+		if errors.Is(err, database.ErrResetTokenInvalid) {
+			http.Error(w, "Invalid or expired token", http.StatusBadRequest)
+			return
+		}
+		s.log.Error("Error in consuming reset token", sl.Err(err))
+		http.Error(w, "failed to reset password", http.StatusInternalServerError)
+		return
+	}
+	err = s.db.UpdatePassword(userID, passHash)
+	if err != nil {
+		s.log.Error("Error in updating password", sl.Err(err))
+		http.Error(w, "failed to reset password", http.StatusInternalServerError)
+		return
+	}
+
+	s.log.Info("Password reset", slog.Int64("id", userID))
+	w.WriteHeader(http.StatusNoContent)
+}
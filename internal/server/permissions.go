@@ -0,0 +1,115 @@
+package server
+
+import (
+	"errors"
+	"net/http"
+	"practic/internal/database"
+	"practic/internal/logger/sl"
+	"slices"
+	"strconv"
+)
+
+// Permissions are fixed in code; which roles hold them is stored in the
+// role_permissions table.
+const (
+	PermManageUsers     = "users.manage"
+	PermViewAllListings = "listings.view_all"
+	PermEditAnyListing  = "listings.edit_any"
+	PermViewAnalytics   = "analytics.view"
+	PermManageAgencies  = "agencies.manage"
+)
+
+func (s *Server) hasPermission(role, permission string) (bool, error) {
+	permissions, err := s.db.RolePermissions(role)
+	if err != nil {
+		return false, err
+	}
+	return slices.Contains(permissions, permission), nil
+}
+
+// agencyScope returns the agency whose data the caller works with. Holders of
+// agencies.manage see all agencies (0) unless they pick one with the
+// agency_id query parameter; everyone else is limited to their own agency.
+func (s *Server) agencyScope(r *http.Request) (int64, error) {
+	claims := userClaims(r)
+	all, err := s.hasPermission(claims.Role, PermManageAgencies)
+	if err != nil {
+		return 0, err
+	}
+	if !all {
+		return claims.AgencyID, nil
+	}
+	agencyID, _ := strconv.ParseInt(r.URL.Query().Get("agency_id"), 10, 64)
+	return agencyID, nil
+}
+
+// authorizeUser checks that the caller may manage userID: the user must be
+// in the caller's agency scope, and only holders of agencies.manage may touch
+// users who hold it too. On refusal it writes the response and returns false.
+func (s *Server) authorizeUser(w http.ResponseWriter, r *http.Request, userID int64) bool {
+	claims := userClaims(r)
+	all, err := s.hasPermission(claims.Role, PermManageAgencies)
+	if err != nil {
+		s.log.Error("Error in getting permissions", sl.Err(err))
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return false
+	}
+	user, err := s.db.UserByID(userID)
+	if errors.Is(err, database.ErrUserNotFound) || (err == nil && !all && user.AgencyID != claims.AgencyID) {
+		http.Error(w, "User not found", http.StatusNotFound)
+		return false
+	}
+	if err != nil {
+		s.log.Error("Error getting user", sl.Err(err))
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return false
+	}
+	if all {
+		return true
+	}
+
+	target, err := s.hasPermission(user.Role, PermManageAgencies)
+	if err != nil {
+		s.log.Error("Error in getting permissions", sl.Err(err))
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return false
+	}
+	if target {
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return false
+	}
+	return true
+}
+
+// RequirePermission rejects users whose role lacks permission. Roles that
+// manage users must also pass the two-factor policy.
+func (s *Server) RequirePermission(permission string) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			claims := userClaims(r)
+
+			ok, err := s.hasPermission(claims.Role, permission)
+			if err != nil {
+				s.log.Error("Error in getting permissions", sl.Err(err))
+				http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+				return
+			}
+			if !ok {
+				http.Error(w, "Forbidden", http.StatusForbidden)
+				return
+			}
+			required, err := s.require2FA(claims.Role)
+			if err != nil {
+				s.log.Error("Error in getting setting", sl.Err(err))
+				http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+				return
+			}
+			if required && !claims.MFA {
+				http.Error(w, "Two-factor authentication required", http.StatusForbidden)
+				return
+			}
+
+			next.ServeHTTP(w, r)
+		})
+	}
+}
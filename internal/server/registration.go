@@ -0,0 +1,290 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"practic/internal/database"
+	"practic/internal/jwt"
+	"practic/internal/logger/sl"
+	"practic/internal/models"
+	"regexp"
+	"slices"
+	"time"
+	"unicode"
+	"unicode/utf8"
+)
+
+const (
+	RegistrationOpen     = "open"
+	RegistrationInvite   = "invite"
+	RegistrationApproval = "approval"
+
+	settingRegistrationMode = "registration_mode"
+
+	minPasswordLength = 8
+	maxPasswordLength = 72 // bcrypt использует только первые 72 байта
+	maxNameLength     = 100
+)
+
+var (
+	registrationModes = []string{RegistrationOpen, RegistrationInvite, RegistrationApproval}
+	loginPattern      = regexp.MustCompile(`^[A-Za-z][A-Za-z0-9_.-]{2,31}$`)
+)
+
+func validateLogin(login string) error {
+	if !loginPattern.MatchString(login) {
+		return errors.New("login must be 3-32 characters: latin letters, digits, '_', '.' or '-', starting with a letter")
+	}
+	return nil
+}
+
+func validatePassword(password string) error {
+	if utf8.RuneCountInString(password) < minPasswordLength {
+		return fmt.Errorf("password must be at least %d characters long", minPasswordLength)
+	}
+	if len(password) > maxPasswordLength {
+		return fmt.Errorf("password must be at most %d bytes long", maxPasswordLength)
+	}
+	var letter, digit bool
+	for _, c := range password {
+		switch {
+		case unicode.IsLetter(c):
+			letter = true
+		case unicode.IsDigit(c):
+			digit = true
+		}
+	}
+	if !letter || !digit {
+		return errors.New("password must contain both letters and digits")
+	}
+	return nil
+}
+
+func validateName(name string) error {
+	if name == "" {
+		return errors.New("name is required")
+	}
+	if utf8.RuneCountInString(name) > maxNameLength {
+		return fmt.Errorf("name must be at most %d characters long", maxNameLength)
+	}
+	return nil
+}
+
+// registrationMode returns the mode set by an admin, falling back to
+// REGISTRATION_MODE and then to open registration.
+func (s *Server) registrationMode() (string, error) {
+	mode, err := s.db.Setting(settingRegistrationMode)
+	if err != nil {
+		return "", err
+	}
+	if mode == "" {
+		mode = os.Getenv("REGISTRATION_MODE")
+	}
+	if !slices.Contains(registrationModes, mode) {
+		mode = RegistrationOpen
+	}
+	return mode, nil
+}
+
+func (s *Server) AdminRegistrationModeHandler(w http.ResponseWriter, r *http.Request) {
+	mode, err := s.registrationMode()
+	if err != nil {
+		s.log.Error("Error getting setting", sl.Err(err))
+		http.Error(w, "Failed to get registration mode", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{"mode": mode})
+}
+
+func (s *Server) AdminSetRegistrationModeHandler(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Mode string `json:"mode"`
+	}
+	err := json.NewDecoder(r.Body).Decode(&req)
+	if err != nil {
+		s.log.Error("Error decoding request body", sl.Err(err))
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	if !slices.Contains(registrationModes, req.Mode) {
+		http.Error(w, "Unknown registration mode", http.StatusBadRequest)
+		return
+	}
+
+	err = s.db.SetSetting(settingRegistrationMode, req.Mode)
+	if err != nil {
+		s.log.Error("Error saving setting", sl.Err(err))
+		http.Error(w, "Failed to save setting", http.StatusInternalServerError)
+		return
+	}
+
+	s.log.Info("Registration mode changed", slog.String("mode", req.Mode), slog.Int64("admin_id", userClaims(r).UserID))
+	w.WriteHeader(http.StatusOK)
+}
+
+func (s *Server) AdminInvitesHandler(w http.ResponseWriter, r *http.Request) {
+	scope, err := s.agencyScope(r)
+	if err != nil {
+		s.log.Error("Error getting agency scope", sl.Err(err))
+		http.Error(w, "Failed to fetch invites", http.StatusInternalServerError)
+		return
+	}
+	invites, err := s.db.GetInvites(scope)
+	if err != nil {
+		s.log.Error("Error fetching invites", sl.Err(err))
+		http.Error(w, "Failed to fetch invites", http.StatusInternalServerError)
+		return
+	}
+
+	jsonResp, err := json.Marshal(invites)
+	if err != nil {
+		s.log.Error("Error marshalling invites", sl.Err(err))
+		http.Error(w, "Failed to process invites data", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	_, _ = w.Write(jsonResp)
+}
+
+func (s *Server) AdminCreateInviteHandler(w http.ResponseWriter, r *http.Request) {
+	adminID := userClaims(r).UserID
+
+	var req struct {
+		ExpiresInDays int   `json:"expires_in_days"`
+		AgencyID      int64 `json:"agency_id"`
+	}
+	err := json.NewDecoder(r.Body).Decode(&req)
+	if err != nil {
+		s.log.Error("Error decoding request body", sl.Err(err))
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	if req.ExpiresInDays < 0 {
+		http.Error(w, "Invalid expiry", http.StatusBadRequest)
+		return
+	}
+
+	// приглашение ведёт в агентство администратора; суперадмин может выбрать любое
+	agencyID, ok := s.inviteAgency(w, r, req.AgencyID)
+	if !ok {
+		return
+	}
+
+	code, codeHash, err := jwt.NewOpaqueToken()
+	if err != nil {
+		s.log.Error("Error creating invite code", sl.Err(err))
+		http.Error(w, "Failed to create invite", http.StatusInternalServerError)
+		return
+	}
+	id, err := s.db.CreateInvite(adminID, agencyID, codeHash, time.Duration(req.ExpiresInDays)*24*time.Hour)
+	if err != nil {
+		s.log.Error("Error saving invite", sl.Err(err))
+		http.Error(w, "Failed to create invite", http.StatusInternalServerError)
+		return
+	}
+
+	s.log.Info("Invite created", slog.Int64("id", id), slog.Int64("agency_id", agencyID), slog.Int64("admin_id", adminID))
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	// код показывается только один раз, в базе хранится лишь его хеш
+	json.NewEncoder(w).Encode(map[string]any{"id": id, "code": code})
+}
+
+func (s *Server) AdminRevokeInviteHandler(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		ID int64 `json:"id"`
+	}
+	err := json.NewDecoder(r.Body).Decode(&req)
+	if err != nil {
+		s.log.Error("Error decoding request body", sl.Err(err))
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	scope, err := s.agencyScope(r)
+	if err != nil {
+		s.log.Error("Error getting agency scope", sl.Err(err))
+		http.Error(w, "Failed to revoke invite", http.StatusInternalServerError)
+		return
+	}
+	err = s.db.RevokeInvite(req.ID, scope)
+	if err != nil {
+		if errors.Is(err, database.ErrInviteInvalid) {
+			http.Error(w, "Invite not found or already used", http.StatusNotFound)
+			return
+		}
+		s.log.Error("Error revoking invite", sl.Err(err))
+		http.Error(w, "Failed to revoke invite", http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+}
+
+func (s *Server) AdminApproveUserHandler(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		UserID int64 `json:"user_id"`
+	}
+	err := json.NewDecoder(r.Body).Decode(&req)
+	if err != nil {
+		s.log.Error("Error decoding request body", sl.Err(err))
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	if !s.authorizeUser(w, r, req.UserID) {
+		return
+	}
+
+	err = s.db.ApproveUser(req.UserID)
+	if err != nil {
+		if errors.Is(err, database.ErrUserNotFound) {
+			http.Error(w, "No pending user with this id", http.StatusNotFound)
+			return
+		}
+		s.log.Error("Error approving user", sl.Err(err))
+		http.Error(w, "Failed to approve user", http.StatusInternalServerError)
+		return
+	}
+
+	s.log.Info("User approved", slog.Int64("id", req.UserID), slog.Int64("admin_id", userClaims(r).UserID))
+	w.WriteHeader(http.StatusOK)
+}
+
+// inviteAgency picks the agency a new invite leads to. Agency admins always
+// invite to their own agency, holders of agencies.manage may name another.
+func (s *Server) inviteAgency(w http.ResponseWriter, r *http.Request, requested int64) (int64, bool) {
+	claims := userClaims(r)
+	if requested == 0 || requested == claims.AgencyID {
+		return claims.AgencyID, true
+	}
+	all, err := s.hasPermission(claims.Role, PermManageAgencies)
+	if err != nil {
+		s.log.Error("Error in getting permissions", sl.Err(err))
+		http.Error(w, "Failed to create invite", http.StatusInternalServerError)
+		return 0, false
+	}
+	if !all {
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return 0, false
+	}
+	agencies, err := s.db.GetAgencies()
+	if err != nil {
+		s.log.Error("Error fetching agencies", sl.Err(err))
+		http.Error(w, "Failed to create invite", http.StatusInternalServerError)
+		return 0, false
+	}
+	if !slices.ContainsFunc(agencies, func(a models.Agency) bool { return a.ID == requested }) {
+		http.Error(w, "Agency not found", http.StatusBadRequest)
+		return 0, false
+	}
+	return requested, true
+}
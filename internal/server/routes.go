@@ -11,42 +11,137 @@ import (
 func (s *Server) RegisterRoutes() http.Handler {
 	r := chi.NewRouter()
 	r.Use(middleware.Logger)
+	// CORS идёт до авторизации, иначе preflight-запросы получают 401.
+	// Пустой список cors понимает как "*", поэтому без настроенных источников разрешены только запросы со своего домена.
+	if len(s.allowedOrigins) > 0 {
+		r.Use(cors.Handler(cors.Options{
+			AllowedOrigins:   s.allowedOrigins,
+			AllowedMethods:   []string{"GET", "POST", "PUT", "DELETE", "OPTIONS", "PATCH"},
+			AllowedHeaders:   []string{"Accept", "Authorization", "Content-Type", "If-Match", "If-None-Match", csrfHeader},
+			ExposedHeaders:   []string{"ETag"},
+			AllowCredentials: true,
+			MaxAge:           300,
+		}))
+	}
+	r.Use(s.CSRFMiddleware)
 	r.Use(s.AuthMiddleware)
-	r.Use(cors.Handler(cors.Options{
-		AllowedOrigins:   []string{"https://*", "http://*"},
-		AllowedMethods:   []string{"GET", "POST", "PUT", "DELETE", "OPTIONS", "PATCH"},
-		AllowedHeaders:   []string{"Accept", "Authorization", "Content-Type"},
-		AllowCredentials: true,
-		MaxAge:           300,
-	}))
 
 	r.Get("/health", s.healthHandler)
+	r.Get("/.well-known/jwks.json", s.JWKSHandler)
+
+	r.Get("/feeds/{token}/yandex.xml", s.YandexFeed)
+	r.Get("/feeds/{token}/avito.xml", s.AvitoFeed)
+	r.Get("/feeds/{token}/photos/{fileID}", s.FeedPhoto)
 
 	fs := http.StripPrefix("/", http.FileServer(http.Dir("front/")))
 	r.Handle("/*", fs)
 
 	r.Post("/api/register", s.RegisterHandler)
 	r.Post("/api/login", s.LoginHandler)
+	r.Post("/api/login/2fa", s.LoginMFAHandler)
+	r.Get("/api/oidc/config", s.OIDCConfigHandler)
+	r.Get("/api/oidc/login", s.OIDCLoginHandler)
+	r.Get("/api/oidc/callback", s.OIDCCallbackHandler)
 	r.Post("/api/logout", s.LogoutHandler)
+	r.Post("/api/token/refresh", s.RefreshHandler)
+	r.Post("/api/password/forgot", s.ForgotPasswordHandler)
+	r.Post("/api/password/reset", s.ResetPasswordHandler)
+	r.Get("/api/email/confirm", s.ConfirmEmailHandler)
 	r.Get("/api/me", s.MeHandler)
+	r.Post("/api/impersonation/stop", s.StopImpersonationHandler)
+	r.Get("/api/sessions", s.GetSessions)
+	r.Get("/api/me/tokens", s.GetAccessTokens)
+	r.Put("/api/me/phone", s.SetPhoneHandler)
+	r.Get("/api/feeds", s.GetFeed)
+	r.Post("/api/feeds/token", s.CreateFeedToken)
+	r.Delete("/api/feeds/token", s.DeleteFeedToken)
+	r.Group(func(r chi.Router) {
+		// безопасность аккаунта меняет только сам пользователь
+		r.Use(s.DenyImpersonation)
+		r.Put("/api/me/password", s.ChangePasswordHandler)
+		r.Put("/api/me/email", s.SetEmailHandler)
+		r.Post("/api/me/2fa/setup", s.TOTPSetupHandler)
+		r.Post("/api/me/2fa/enable", s.TOTPEnableHandler)
+		r.Post("/api/me/2fa/disable", s.TOTPDisableHandler)
+		r.Post("/api/me/2fa/recovery-codes", s.TOTPRecoveryCodesHandler)
+		r.Delete("/api/sessions", s.RevokeAllSessions)
+		r.Delete("/api/sessions/{id}", s.RevokeSession)
+		r.Post("/api/me/tokens", s.CreateAccessToken)
+		r.Delete("/api/me/tokens/{id}", s.RevokeAccessToken)
+		r.Post("/api/oidc/link", s.OIDCLinkHandler)
+	})
 	r.Group(func(r chi.Router) {
+		r.Use(s.RequireScope(ScopeListingsRead))
 		r.Get("/api/cities", s.GetCities)
 		r.Get("/api/listings", s.GetListings)
+		r.Get("/api/listings/statuses", s.GetListingStatuses)
+		r.Get("/api/listings/trash", s.GetTrash)
+		r.Get("/api/listings/export", s.ExportListings)
+		r.Get("/api/listings/{id}", s.GetListing)
+		r.Get("/api/listings/{id}/history", s.GetStatusHistory)
+		r.Get("/api/listings/{id}/prices", s.GetPriceHistory)
+		r.Get("/api/listings/{id}/shares", s.GetListingShares)
+		r.Get("/api/listings/{id}/files", s.GetListingFiles)
+		r.Get("/api/listings/{id}/files/{fileID}", s.DownloadListingFile)
+
+		r.With(s.RequirePermission(PermViewAnalytics)).Get("/api/analytics", s.AnalyticsHandler)
+
+	})
+	r.Group(func(r chi.Router) {
+		r.Use(s.RequireScope(ScopeListingsWrite))
 		r.Post("/api/listings", s.CreateListing)
+		r.Post("/api/listings/import", s.ImportListings)
 		r.Put("/api/listings/{id}", s.UpdateListing)
+		r.Patch("/api/listings/{id}", s.PatchListing)
+		r.Post("/api/listings/{id}/transition", s.TransitionListing)
 		r.Delete("/api/listings/{id}", s.DeleteListing)
-
-		r.Get("/api/analytics", s.AnalyticsHandler)
-
+		r.Post("/api/listings/{id}/restore", s.RestoreListing)
+		r.Post("/api/listings/{id}/shares", s.ShareListing)
+		r.Delete("/api/listings/{id}/shares/{userID}", s.UnshareListing)
+		r.Post("/api/listings/{id}/photos", s.UploadListingPhotos)
+		r.Post("/api/listings/{id}/documents", s.UploadListingDocuments)
+		r.Put("/api/listings/{id}/files/order", s.ReorderListingFiles)
+		r.Post("/api/listings/{id}/files/{fileID}/cover", s.SetListingCover)
+		r.Delete("/api/listings/{id}/files/{fileID}", s.DeleteListingFile)
+	})
+	r.Group(func(r chi.Router) {
+		r.Use(s.DenyImpersonation)
+		r.With(s.RequirePermission(PermManageUsers)).Get("/api/admin/users", s.AdminUsersHandler)
+		r.With(s.RequirePermission(PermViewAllListings)).Get("/api/admin/listings", s.AdminListingsHandler)
+		r.With(s.RequirePermission(PermViewAllListings)).Get("/api/admin/listings/export", s.AdminExportListings)
+		r.With(s.RequirePermission(PermManageUsers)).Get("/api/admin/roles", s.AdminRolesHandler)
+		r.With(s.RequirePermission(PermManageUsers)).Post("/api/admin/set-role", s.AdminSetRoleHandler)
+		r.With(s.RequirePermission(PermManageUsers)).Post("/api/admin/delete-user", s.AdminDeleteUserHandler)
+		r.With(s.RequirePermission(PermViewAllListings)).Get("/api/admin/analytics", s.AdminAnalyticsHandler)
+		r.With(s.RequirePermission(PermViewAllListings)).Get("/api/admin/cities", s.AdminCitiesHandler)
+		r.With(s.RequirePermission(PermEditAnyListing)).Get("/api/admin/feeds", s.AdminGetFeed)
+		r.With(s.RequirePermission(PermEditAnyListing)).Post("/api/admin/feeds/token", s.AdminCreateFeedToken)
+		r.With(s.RequirePermission(PermEditAnyListing)).Delete("/api/admin/feeds/token", s.AdminDeleteFeedToken)
+		// настройки ниже общие для всех агентств
+		r.With(s.RequirePermission(PermManageAgencies)).Get("/api/admin/lockouts", s.AdminLockoutsHandler)
+		r.With(s.RequirePermission(PermManageAgencies)).Post("/api/admin/clear-lockout", s.AdminClearLockoutHandler)
+		r.With(s.RequirePermission(PermManageAgencies)).Post("/api/admin/require-2fa", s.AdminRequire2FAHandler)
+		r.With(s.RequirePermission(PermManageUsers)).Post("/api/admin/approve-user", s.AdminApproveUserHandler)
+		r.With(s.RequirePermission(PermManageUsers)).Get("/api/admin/registration-mode", s.AdminRegistrationModeHandler)
+		r.With(s.RequirePermission(PermManageAgencies)).Post("/api/admin/registration-mode", s.AdminSetRegistrationModeHandler)
+		r.With(s.RequirePermission(PermManageUsers)).Get("/api/admin/invites", s.AdminInvitesHandler)
+		r.With(s.RequirePermission(PermManageUsers)).Post("/api/admin/invites", s.AdminCreateInviteHandler)
+		r.With(s.RequirePermission(PermManageUsers)).Post("/api/admin/revoke-invite", s.AdminRevokeInviteHandler)
+		r.With(s.RequirePermission(PermManageAgencies)).Get("/api/admin/agencies", s.AdminAgenciesHandler)
+		r.With(s.RequirePermission(PermManageAgencies)).Post("/api/admin/agencies", s.AdminCreateAgencyHandler)
+		r.With(s.RequirePermission(PermManageAgencies)).Post("/api/admin/set-agency", s.AdminSetAgencyHandler)
+		r.With(s.RequirePermission(PermManageUsers)).Post("/api/admin/impersonate/{userID}", s.AdminImpersonateHandler)
 	})
-	r.With(s.AdminOnly).Get("/api/admin/users", s.AdminUsersHandler)
-	r.With(s.AdminOnly).Get("/api/admin/listings", s.AdminListingsHandler)
-	r.With(s.AdminOnly).Post("/api/admin/set-role", s.AdminSetRoleHandler)
-	r.With(s.AdminOnly).Post("/api/admin/delete-user", s.AdminDeleteUserHandler)
 
 	return r
 }
 
+func (s *Server) JWKSHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "public, max-age=300")
+	_ = json.NewEncoder(w).Encode(s.tokens.JWKS())
+}
+
 func (s *Server) healthHandler(w http.ResponseWriter, r *http.Request) {
 	jsonResp, _ := json.Marshal(s.db.Health())
 	_, _ = w.Write(jsonResp)
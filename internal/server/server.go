@@ -10,22 +10,62 @@ import (
 
 	_ "github.com/joho/godotenv/autoload"
 
+	"practic/internal/blobstore"
 	"practic/internal/database"
+	"practic/internal/jwt"
+	"practic/internal/mailer"
 )
 
 type Server struct {
 	log  *slog.Logger
 	port int
 
-	db database.Service
+	db     database.Service
+	mailer mailer.Mailer
+	blobs  blobstore.BlobStore
+	tokens *jwt.Manager
+	sso    *ssoConfig
+
+	allowedOrigins []string
+	cookieSecure   bool
 }
 
-func NewServer(log *slog.Logger) *http.Server {
+func NewServer(log *slog.Logger) (*http.Server, error) {
 	port, _ := strconv.Atoi(os.Getenv("PORT"))
+	tokens, err := jwt.NewManager()
+	if err != nil {
+		return nil, fmt.Errorf("jwt keys: %w", err)
+	}
+	sso, err := newSSOConfig()
+	if err != nil {
+		return nil, fmt.Errorf("oidc: %w", err)
+	}
+	origins, err := allowedOrigins()
+	if err != nil {
+		return nil, err
+	}
+	blobs, err := blobstore.New(log)
+	if err != nil {
+		return nil, fmt.Errorf("blob store: %w", err)
+	}
+	retention, err := trashRetention()
+	if err != nil {
+		return nil, err
+	}
 	NewServer := &Server{
-		port: port,
-		log:  log,
-		db:   database.New(log),
+		port:   port,
+		log:    log,
+		db:     database.New(log),
+		mailer: mailer.New(log),
+		blobs:  blobs,
+		tokens: tokens,
+		sso:    sso,
+
+		allowedOrigins: origins,
+		cookieSecure:   cookieSecure(),
+	}
+	if retention > 0 {
+		go NewServer.purgeTrash(retention)
 	}
 
 	// Declare Server config
@@ -37,5 +77,5 @@ func NewServer(log *slog.Logger) *http.Server {
 		WriteTimeout: 30 * time.Second,
 	}
 
-	return server
+	return server, nil
 }
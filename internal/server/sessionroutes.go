@@ -0,0 +1,75 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"github.com/go-chi/chi/v5"
+	"log/slog"
+	"net/http"
+	"practic/internal/database"
+	"practic/internal/logger/sl"
+	"strconv"
+)
+
+func (s *Server) GetSessions(w http.ResponseWriter, r *http.Request) {
+	claims := userClaims(r)
+	userID, sid := claims.UserID, claims.SessionID
+
+	sessions, err := s.db.GetSessions(userID)
+	if err != nil {
+		s.log.Error("Error in getting sessions", sl.Err(err))
+		http.Error(w, "Ошибка получения сессий", 500)
+		return
+	}
+	for i := range sessions {
+		sessions[i].Current = sessions[i].ID == sid
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(sessions); err != nil {
+		s.log.Error("Error in encoding sessions", sl.Err(err))
+		http.Error(w, "Ошибка кодирования сессий", 500)
+		return
+	}
+}
+
+func (s *Server) RevokeSession(w http.ResponseWriter, r *http.Request) {
+	userID := userClaims(r).UserID
+
+	sessionID, err := strconv.ParseInt(chi.URLParam(r, "id"), 10, 64)
+	if err != nil {
+		s.log.Error("Error in parsing session ID", sl.Err(err))
+		http.Error(w, "Invalid session ID", http.StatusBadRequest)
+		return
+	}
+
+	err = s.db.RevokeSession(sessionID, userID)
+	if err != nil {
+		if errors.Is(err, database.ErrSessionNotFound) {
+			http.Error(w, "Session not found", http.StatusNotFound)
+			return
+		}
+		s.log.Error("Error in revoking session", sl.Err(err))
+		http.Error(w, "Ошибка завершения сессии", 500)
+		return
+	}
+
+	s.log.Info("Session revoked", slog.Int64("id", sessionID), slog.Int64("user_id", userID))
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// RevokeAllSessions logs the user out everywhere, including the current device.
+func (s *Server) RevokeAllSessions(w http.ResponseWriter, r *http.Request) {
+	userID := userClaims(r).UserID
+
+	err := s.db.RevokeUserSessions(userID)
+	if err != nil {
+		s.log.Error("Error in revoking sessions", sl.Err(err))
+		http.Error(w, "Ошибка завершения сессий", 500)
+		return
+	}
+
+	s.clearAuthCookies(w)
+	s.log.Info("All sessions revoked", slog.Int64("user_id", userID))
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,49 @@
+package server
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"image/jpeg"
+)
+
+const thumbnailSize = 320
+
+// thumbnail scales img down to fit a thumbnailSize square, averaging the
+// source pixels under every target pixel, and encodes it as JPEG on a white
+// background.
+func thumbnail(img image.Image) ([]byte, error) {
+	src := img.Bounds()
+	w, h := src.Dx(), src.Dy()
+	if w > thumbnailSize || h > thumbnailSize {
+		if w >= h {
+			w, h = thumbnailSize, max(1, h*thumbnailSize/w)
+		} else {
+			w, h = max(1, w*thumbnailSize/h), thumbnailSize
+		}
+	}
+
+	dst := image.NewRGBA(image.Rect(0, 0, w, h))
+	for y := 0; y < h; y++ {
+		y0, y1 := src.Min.Y+y*src.Dy()/h, src.Min.Y+(y+1)*src.Dy()/h
+		for x := 0; x < w; x++ {
+			x0, x1 := src.Min.X+x*src.Dx()/w, src.Min.X+(x+1)*src.Dx()/w
+			var r, g, b, a, n uint64
+			for sy := y0; sy < max(y1, y0+1); sy++ {
+				for sx := x0; sx < max(x1, x0+1); sx++ {
+					cr, cg, cb, ca := img.At(sx, sy).RGBA()
+					r, g, b, a, n = r+uint64(cr), g+uint64(cg), b+uint64(cb), a+uint64(ca), n+1
+				}
+			}
+			// цвета premultiplied, поэтому белый фон — это просто добавка 0xffff - alpha
+			white := 0xffff - a/n
+			dst.SetRGBA(x, y, color.RGBA{R: uint8((r/n + white) >> 8), G: uint8((g/n + white) >> 8), B: uint8((b/n + white) >> 8), A: 0xff})
+		}
+	}
+
+	var buf bytes.Buffer
+	if err := jpeg.Encode(&buf, dst, &jpeg.Options{Quality: 80}); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
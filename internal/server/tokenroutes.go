@@ -0,0 +1,120 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"github.com/go-chi/chi/v5"
+	"log/slog"
+	"net/http"
+	"practic/internal/database"
+	"practic/internal/jwt"
+	"practic/internal/logger/sl"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	ScopeListingsRead  = "listings:read"
+	ScopeListingsWrite = "listings:write"
+)
+
+var accessTokenScopes = []string{ScopeListingsRead, ScopeListingsWrite}
+
+func (s *Server) GetAccessTokens(w http.ResponseWriter, r *http.Request) {
+	userID := userClaims(r).UserID
+
+	tokens, err := s.db.GetAccessTokens(userID)
+	if err != nil {
+		s.log.Error("Error in getting access tokens", sl.Err(err))
+		http.Error(w, "Ошибка получения токенов", 500)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(tokens); err != nil {
+		s.log.Error("Error in encoding access tokens", sl.Err(err))
+		http.Error(w, "Ошибка кодирования токенов", 500)
+		return
+	}
+}
+
+func (s *Server) CreateAccessToken(w http.ResponseWriter, r *http.Request) {
+	userID := userClaims(r).UserID
+
+	var req struct {
+		Name          string   `json:"name"`
+		Scopes        []string `json:"scopes"`
+		ExpiresInDays int      `json:"expires_in_days"`
+	}
+	err := json.NewDecoder(r.Body).Decode(&req)
+	if err != nil {
+		s.log.Error("Error in decoding body", sl.Err(err))
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	req.Name = strings.TrimSpace(req.Name)
+	if req.Name == "" {
+		http.Error(w, "Token name is required", http.StatusBadRequest)
+		return
+	}
+	if len(req.Scopes) == 0 {
+		http.Error(w, "At least one scope is required", http.StatusBadRequest)
+		return
+	}
+	for _, scope := range req.Scopes {
+		if !slices.Contains(accessTokenScopes, scope) {
+			http.Error(w, "Unknown scope: "+scope, http.StatusBadRequest)
+			return
+		}
+	}
+	if req.ExpiresInDays < 0 {
+		http.Error(w, "Invalid expiry", http.StatusBadRequest)
+		return
+	}
+
+	token, tokenHash, err := jwt.NewAccessToken()
+	if err != nil {
+		s.log.Error("Error in creating access token", sl.Err(err))
+		http.Error(w, "Ошибка создания токена", 500)
+		return
+	}
+	id, err := s.db.CreateAccessToken(userID, req.Name, tokenHash, req.Scopes, time.Duration(req.ExpiresInDays)*24*time.Hour)
+	if err != nil {
+		s.log.Error("Error in saving access token", sl.Err(err))
+		http.Error(w, "Ошибка создания токена", 500)
+		return
+	}
+
+	s.log.Info("Access token created", slog.Int64("id", id), slog.Int64("user_id", userID))
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	// сам токен показывается только один раз, в базе хранится лишь его хеш
+	json.NewEncoder(w).Encode(map[string]any{"id": id, "token": token})
+}
+
+func (s *Server) RevokeAccessToken(w http.ResponseWriter, r *http.Request) {
+	userID := userClaims(r).UserID
+
+	tokenID, err := strconv.ParseInt(chi.URLParam(r, "id"), 10, 64)
+	if err != nil {
+		s.log.Error("Error in parsing token ID", sl.Err(err))
+		http.Error(w, "Invalid token ID", http.StatusBadRequest)
+		return
+	}
+
+	err = s.db.RevokeAccessToken(tokenID, userID)
+	if err != nil {
+		if errors.Is(err, database.ErrAccessTokenNotFound) {
+			http.Error(w, "Token not found", http.StatusNotFound)
+			return
+		}
+		s.log.Error("Error in revoking access token", sl.Err(err))
+		http.Error(w, "Ошибка отзыва токена", 500)
+		return
+	}
+
+	s.log.Info("Access token revoked", slog.Int64("id", tokenID), slog.Int64("user_id", userID))
+	w.WriteHeader(http.StatusNoContent)
+}
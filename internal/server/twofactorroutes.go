@@ -0,0 +1,367 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"practic/internal/database"
+	"practic/internal/jwt"
+	"practic/internal/logger/sl"
+	"practic/internal/models"
+	"practic/internal/totp"
+	"time"
+)
+
+const (
+	totpIssuer         = "practic"
+	mfaTokenTTL        = 5 * time.Minute
+	recoveryCodesCount = 10
+
+	settingRequire2FAAdmin = "require_2fa_admin"
+)
+
+// LoginMFAHandler is the second step of a two-factor login: it exchanges the
+// token returned by LoginHandler and a TOTP or recovery code for a session.
+func (s *Server) LoginMFAHandler(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		MFAToken string `json:"mfa_token"`
+		Code     string `json:"code"`
+	}
+	err := json.NewDecoder(r.Body).Decode(&req)
+	if err != nil {
+		s.log.Error("Error in decoding body", sl.Err(err))
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	userID, err := s.tokens.ParseMFAToken(req.MFAToken)
+	if err != nil {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+	user, err := s.db.UserByID(userID)
+	if err != nil {
+		if !errors.Is(err, database.ErrUserNotFound) {
+			s.log.Error("Error in getting user", sl.Err(err))
+		}
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	ip := clientIP(r)
+	if s.loginLocked(w, user.Login, ip) {
+		return
+	}
+
+	ok, err := s.verifySecondFactor(user, req.Code)
+	if err != nil {
+		s.log.Error("Error in verifying code", sl.Err(err))
+		http.Error(w, "failed to verify code", http.StatusInternalServerError)
+		return
+	}
+	if !ok {
+		s.log.Info("Invalid 2fa code", slog.Int64("id", user.ID), slog.String("ip", ip))
+		s.recordLoginFailure(user.Login, ip)
+		http.Error(w, "Invalid code", http.StatusUnauthorized)
+		return
+	}
+	s.clearLoginFailures(user.Login)
+
+	err = s.startSession(w, r, user, true)
+	if err != nil {
+		s.log.Error("Error in creating session", sl.Err(err))
+		http.Error(w, fmt.Sprintf("failed to create session: %v", err), http.StatusInternalServerError)
+		return
+	}
+	_, err = w.Write([]byte("Login successful"))
+	if err != nil {
+		return
+	}
+	s.log.Info("User logged in", slog.Int64("id", user.ID), slog.String("role", user.Role), slog.Bool("mfa", true))
+}
+
+// verifySecondFactor accepts a current TOTP code or an unused recovery code.
+func (s *Server) verifySecondFactor(user models.UserDB, code string) (bool, error) {
+	if !user.TOTPEnabled {
+		return false, nil
+	}
+	if step, ok := totp.Validate(user.TOTPSecret, code, time.Now()); ok {
+		return s.db.UseTOTPStep(user.ID, step)
+	}
+	return s.db.UseRecoveryCode(user.ID, jwt.HashToken(totp.NormalizeRecoveryCode(code)))
+}
+
+func (s *Server) TOTPSetupHandler(w http.ResponseWriter, r *http.Request) {
+	userID := userClaims(r).UserID
+
+	user, err := s.db.UserByID(userID)
+	if err != nil {
+		s.log.Error("Error in getting user", sl.Err(err))
+		http.Error(w, fmt.Sprintf("failed to get user: %v", err), http.StatusInternalServerError)
+		return
+	}
+	if user.TOTPEnabled {
+		http.Error(w, "Two-factor authentication is already enabled", http.StatusConflict)
+		return
+	}
+
+	secret, err := totp.GenerateSecret()
+	if err != nil {
+		s.log.Error("Error in generating secret", sl.Err(err))
+		http.Error(w, "failed to generate secret", http.StatusInternalServerError)
+		return
+	}
+	err = s.db.SetTOTPSecret(userID, secret)
+	if err != nil {
+		s.log.Error("Error in saving secret", sl.Err(err))
+		http.Error(w, "failed to save secret", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{
+		"secret": secret,
+		"uri":    totp.ProvisioningURI(totpIssuer, user.Login, secret),
+	})
+}
+
+func (s *Server) TOTPEnableHandler(w http.ResponseWriter, r *http.Request) {
+	userID := userClaims(r).UserID
+
+	var req struct {
+		Code string `json:"code"`
+	}
+	err := json.NewDecoder(r.Body).Decode(&req)
+	if err != nil {
+		s.log.Error("Error in decoding body", sl.Err(err))
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	user, err := s.db.UserByID(userID)
+	if err != nil {
+		s.log.Error("Error in getting user", sl.Err(err))
+		http.Error(w, fmt.Sprintf("failed to get user: %v", err), http.StatusInternalServerError)
+		return
+	}
+	if user.TOTPEnabled {
+		http.Error(w, "Two-factor authentication is already enabled", http.StatusConflict)
+		return
+	}
+	if user.TOTPSecret == "" {
+		http.Error(w, "Call /api/me/2fa/setup first", http.StatusBadRequest)
+		return
+	}
+	step, ok := totp.Validate(user.TOTPSecret, req.Code, time.Now())
+	if !ok {
+		http.Error(w, "Invalid code", http.StatusBadRequest)
+		return
+	}
+
+	codes, hashes, err := newRecoveryCodes()
+	if err != nil {
+		s.log.Error("Error in generating recovery codes", sl.Err(err))
+		http.Error(w, "failed to generate recovery codes", http.StatusInternalServerError)
+		return
+	}
+	if _, err = s.db.UseTOTPStep(userID, step); err != nil {
+		s.log.Error("Error in saving totp step", sl.Err(err))
+		http.Error(w, "failed to enable 2fa", http.StatusInternalServerError)
+		return
+	}
+	err = s.db.EnableTOTP(userID, hashes)
+	if err != nil {
+		s.log.Error("Error in enabling 2fa", sl.Err(err))
+		http.Error(w, "failed to enable 2fa", http.StatusInternalServerError)
+		return
+	}
+
+	// остальные сессии завершены, текущему устройству выдаём новую, код только что проверен
+	user, err = s.db.UserByID(userID)
+	if err != nil {
+		s.log.Error("Error in getting user", sl.Err(err))
+		http.Error(w, fmt.Sprintf("failed to get user: %v", err), http.StatusInternalServerError)
+		return
+	}
+	err = s.startSession(w, r, user, true)
+	if err != nil {
+		s.log.Error("Error in creating session", sl.Err(err))
+		http.Error(w, fmt.Sprintf("failed to create session: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	s.log.Info("2fa enabled", slog.Int64("id", userID))
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string][]string{"recovery_codes": codes})
+}
+
+func (s *Server) TOTPDisableHandler(w http.ResponseWriter, r *http.Request) {
+	userID := userClaims(r).UserID
+
+	var req struct {
+		Code string `json:"code"`
+	}
+	err := json.NewDecoder(r.Body).Decode(&req)
+	if err != nil {
+		s.log.Error("Error in decoding body", sl.Err(err))
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	user, err := s.db.UserByID(userID)
+	if err != nil {
+		s.log.Error("Error in getting user", sl.Err(err))
+		http.Error(w, fmt.Sprintf("failed to get user: %v", err), http.StatusInternalServerError)
+		return
+	}
+	required, err := s.require2FA(user.Role)
+	if err != nil {
+		s.log.Error("Error in getting setting", sl.Err(err))
+		http.Error(w, "failed to disable 2fa", http.StatusInternalServerError)
+		return
+	}
+	if required {
+		http.Error(w, "Two-factor authentication is required for your role", http.StatusForbidden)
+		return
+	}
+	ip := clientIP(r)
+	if s.loginLocked(w, user.Login, ip) {
+		return
+	}
+	ok, err := s.verifySecondFactor(user, req.Code)
+	if err != nil {
+		s.log.Error("Error in verifying code", sl.Err(err))
+		http.Error(w, "failed to verify code", http.StatusInternalServerError)
+		return
+	}
+	if !ok {
+		s.log.Info("Invalid 2fa code", slog.Int64("id", user.ID), slog.String("ip", ip))
+		s.recordLoginFailure(user.Login, ip)
+		http.Error(w, "Invalid code", http.StatusBadRequest)
+		return
+	}
+	s.clearLoginFailures(user.Login)
+
+	err = s.db.DisableTOTP(userID)
+	if err != nil {
+		s.log.Error("Error in disabling 2fa", sl.Err(err))
+		http.Error(w, "failed to disable 2fa", http.StatusInternalServerError)
+		return
+	}
+
+	s.log.Info("2fa disabled", slog.Int64("id", userID))
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (s *Server) TOTPRecoveryCodesHandler(w http.ResponseWriter, r *http.Request) {
+	userID := userClaims(r).UserID
+
+	var req struct {
+		Code string `json:"code"`
+	}
+	err := json.NewDecoder(r.Body).Decode(&req)
+	if err != nil {
+		s.log.Error("Error in decoding body", sl.Err(err))
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	user, err := s.db.UserByID(userID)
+	if err != nil {
+		s.log.Error("Error in getting user", sl.Err(err))
+		http.Error(w, fmt.Sprintf("failed to get user: %v", err), http.StatusInternalServerError)
+		return
+	}
+	ip := clientIP(r)
+	if s.loginLocked(w, user.Login, ip) {
+		return
+	}
+	ok, err := s.verifySecondFactor(user, req.Code)
+	if err != nil {
+		s.log.Error("Error in verifying code", sl.Err(err))
+		http.Error(w, "failed to verify code", http.StatusInternalServerError)
+		return
+	}
+	if !ok {
+		s.log.Info("Invalid 2fa code", slog.Int64("id", user.ID), slog.String("ip", ip))
+		s.recordLoginFailure(user.Login, ip)
+		http.Error(w, "Invalid code", http.StatusBadRequest)
+		return
+	}
+	s.clearLoginFailures(user.Login)
+
+	codes, hashes, err := newRecoveryCodes()
+	if err != nil {
+		s.log.Error("Error in generating recovery codes", sl.Err(err))
+		http.Error(w, "failed to generate recovery codes", http.StatusInternalServerError)
+		return
+	}
+	err = s.db.ReplaceRecoveryCodes(userID, hashes)
+	if err != nil {
+		s.log.Error("Error in saving recovery codes", sl.Err(err))
+		http.Error(w, "failed to save recovery codes", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string][]string{"recovery_codes": codes})
+}
+
+func (s *Server) AdminRequire2FAHandler(w http.ResponseWriter, r *http.Request) {
+	claims := userClaims(r)
+
+	var req struct {
+		Required bool `json:"required"`
+	}
+	err := json.NewDecoder(r.Body).Decode(&req)
+	if err != nil {
+		s.log.Error("Error decoding request body", sl.Err(err))
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	// иначе администратор сразу потеряет доступ к админке
+	if req.Required && !claims.MFA {
+		http.Error(w, "Enable two-factor authentication for your own account first", http.StatusConflict)
+		return
+	}
+
+	value := "0"
+	if req.Required {
+		value = "1"
+	}
+	err = s.db.SetSetting(settingRequire2FAAdmin, value)
+	if err != nil {
+		s.log.Error("Error saving setting", sl.Err(err))
+		http.Error(w, "Failed to save setting", http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+}
+
+// require2FA reports whether the admin two-factor policy applies to role,
+// that is whether the role can manage users and the policy is switched on.
+func (s *Server) require2FA(role string) (bool, error) {
+	privileged, err := s.hasPermission(role, PermManageUsers)
+	if err != nil || !privileged {
+		return false, err
+	}
+	value, err := s.db.Setting(settingRequire2FAAdmin)
+	if err != nil {
+		return false, err
+	}
+	return value == "1", nil
+}
+
+func newRecoveryCodes() (codes []string, hashes []string, err error) {
+	codes, err = totp.RecoveryCodes(recoveryCodesCount)
+	if err != nil {
+		return nil, nil, err
+	}
+	for _, c := range codes {
+		hashes = append(hashes, jwt.HashToken(c))
+	}
+	return codes, hashes, nil
+}
@@ -0,0 +1,41 @@
+create table if not exists roles (
+    name text primary key,
+    description text not null
+);
+
+create table if not exists permissions (
+    name text primary key,
+    description text not null
+);
+
+create table if not exists role_permissions (
+    role text not null,
+    permission text not null,
+    primary key (role, permission),
+    foreign key (role) references roles(name) on delete cascade,
+    foreign key (permission) references permissions(name) on delete cascade
+);
+
+INSERT INTO roles (name, description) VALUES
+    ('agent', 'Агент: работает со своими объявлениями'),
+    ('manager', 'Менеджер: видит и редактирует все объявления'),
+    ('admin', 'Администратор: полный доступ');
+
+INSERT INTO permissions (name, description) VALUES
+    ('users.manage', 'Управление пользователями'),
+    ('listings.view_all', 'Просмотр всех объявлений'),
+    ('listings.edit_any', 'Редактирование любых объявлений'),
+    ('analytics.view', 'Просмотр аналитики');
+
+INSERT INTO role_permissions (role, permission) VALUES
+    ('agent', 'analytics.view'),
+    ('manager', 'listings.view_all'),
+    ('manager', 'listings.edit_any'),
+    ('manager', 'analytics.view'),
+    ('admin', 'users.manage'),
+    ('admin', 'listings.view_all'),
+    ('admin', 'listings.edit_any'),
+    ('admin', 'analytics.view');
+
+-- роли, которых нет в таблице, считаем агентами
+UPDATE users SET role = 'agent' WHERE role IS NULL OR role NOT IN (SELECT name FROM roles);
@@ -0,0 +1,11 @@
+create table if not exists listing_shares (
+    listing_id integer not null,
+    user_id integer not null,
+    access text not null check (access in ('read', 'edit')),
+    created_at datetime not null default (datetime('now')),
+    primary key (listing_id, user_id),
+    foreign key (listing_id) references listings(id) on delete cascade,
+    foreign key (user_id) references users(id) on delete cascade
+);
+
+create index if not exists listing_shares_user_id on listing_shares(user_id);
@@ -0,0 +1,17 @@
+UPDATE users SET role = 'admin' WHERE role = 'superadmin';
+
+DELETE FROM role_permissions WHERE role = 'superadmin' OR permission = 'agencies.manage';
+DELETE FROM roles WHERE name = 'superadmin';
+DELETE FROM permissions WHERE name = 'agencies.manage';
+
+UPDATE roles SET description = 'Администратор: полный доступ' WHERE name = 'admin';
+UPDATE roles SET description = 'Менеджер: видит и редактирует все объявления' WHERE name = 'manager';
+
+DROP INDEX IF EXISTS listings_agency_id;
+DROP INDEX IF EXISTS users_agency_id;
+
+ALTER TABLE invites DROP COLUMN agency_id;
+ALTER TABLE listings DROP COLUMN agency_id;
+ALTER TABLE users DROP COLUMN agency_id;
+
+DROP TABLE IF EXISTS agencies;
@@ -0,0 +1,29 @@
+create table if not exists agencies (
+    id INTEGER primary key,
+    name text not null unique,
+    created_at datetime not null default (datetime('now'))
+);
+
+-- все, кто был до появления агентств, попадают в главный офис
+INSERT INTO agencies (id, name) VALUES (1, 'Главный офис');
+
+ALTER TABLE users ADD COLUMN agency_id integer not null default 1;
+ALTER TABLE listings ADD COLUMN agency_id integer not null default 1;
+ALTER TABLE invites ADD COLUMN agency_id integer not null default 1;
+
+create index if not exists users_agency_id ON users(agency_id);
+create index if not exists listings_agency_id ON listings(agency_id);
+
+INSERT INTO permissions (name, description) VALUES
+    ('agencies.manage', 'Управление агентствами и доступ ко всем агентствам');
+
+INSERT INTO roles (name, description) VALUES
+    ('superadmin', 'Суперадминистратор: все агентства');
+
+INSERT INTO role_permissions (role, permission) SELECT 'superadmin', name FROM permissions;
+
+UPDATE roles SET description = 'Администратор агентства' WHERE name = 'admin';
+UPDATE roles SET description = 'Менеджер: видит и редактирует все объявления агентства' WHERE name = 'manager';
+
+-- встроенный администратор управлял всей системой, оставляем ему этот доступ
+UPDATE users SET role = 'superadmin' WHERE username = 'admin' AND role = 'admin';
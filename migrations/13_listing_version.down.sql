@@ -0,0 +1,2 @@
+ALTER TABLE listings DROP COLUMN updated_at;
+ALTER TABLE listings DROP COLUMN version;
@@ -0,0 +1,4 @@
+ALTER TABLE listings ADD COLUMN version integer not null default 1;
+ALTER TABLE listings ADD COLUMN updated_at datetime;
+
+UPDATE listings SET updated_at = date_created;
@@ -0,0 +1,6 @@
+DROP INDEX IF EXISTS listings_date_created;
+DROP INDEX IF EXISTS listings_price;
+DROP TRIGGER IF EXISTS listings_fts_update;
+DROP TRIGGER IF EXISTS listings_fts_delete;
+DROP TRIGGER IF EXISTS listings_fts_insert;
+DROP TABLE IF EXISTS listings_fts;
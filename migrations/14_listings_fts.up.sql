@@ -0,0 +1,26 @@
+create virtual table if not exists listings_fts using fts5(
+    name,
+    description,
+    content = 'listings',
+    content_rowid = 'id',
+    tokenize = 'unicode61 remove_diacritics 2'
+);
+
+-- индекс живёт отдельно от таблицы, поэтому держим его в актуальном состоянии триггерами
+create trigger if not exists listings_fts_insert after insert on listings begin
+    insert into listings_fts (rowid, name, description) values (new.id, new.name, new.description);
+end;
+
+create trigger if not exists listings_fts_delete after delete on listings begin
+    insert into listings_fts (listings_fts, rowid, name, description) values ('delete', old.id, old.name, old.description);
+end;
+
+create trigger if not exists listings_fts_update after update of name, description on listings begin
+    insert into listings_fts (listings_fts, rowid, name, description) values ('delete', old.id, old.name, old.description);
+    insert into listings_fts (rowid, name, description) values (new.id, new.name, new.description);
+end;
+
+insert into listings_fts (listings_fts) values ('rebuild');
+
+create index if not exists listings_price on listings(price);
+create index if not exists listings_date_created on listings(date_created);
@@ -0,0 +1,4 @@
+create index if not exists listings_date_created on listings(date_created);
+DROP INDEX IF EXISTS listings_date_created_id;
+DROP INDEX IF EXISTS users_created_at;
+ALTER TABLE users DROP COLUMN created_at;
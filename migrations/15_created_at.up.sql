@@ -0,0 +1,8 @@
+ALTER TABLE users ADD COLUMN created_at datetime;
+
+-- точная дата регистрации старых пользователей неизвестна
+UPDATE users SET created_at = datetime('now');
+
+create index if not exists users_created_at on users(created_at, id);
+create index if not exists listings_date_created_id on listings(date_created, id);
+DROP INDEX IF EXISTS listings_date_created;
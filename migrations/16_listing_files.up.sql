@@ -0,0 +1,21 @@
+create table if not exists listing_files (
+    id INTEGER primary key,
+    listing_id integer not null,
+    kind text not null check (kind in ('photo', 'document')),
+    name text not null,
+    content_type text not null,
+    size integer not null,
+    width integer not null default 0,
+    height integer not null default 0,
+    blob_key text not null,
+    thumb_key text not null default '',
+    position integer not null,
+    cover integer not null default 0,
+    created_by integer not null,
+    created_at datetime not null default (datetime('now')),
+    foreign key (listing_id) references listings(id) on delete cascade
+);
+
+create index if not exists listing_files_listing_id on listing_files(listing_id, kind, position);
+-- у объявления не больше одной обложки
+create unique index if not exists listing_files_cover on listing_files(listing_id) where cover = 1;
@@ -0,0 +1,7 @@
+DROP TRIGGER IF EXISTS listings_status_update;
+DROP TRIGGER IF EXISTS listings_status_insert;
+UPDATE listings SET status = CASE deal WHEN 'rent' THEN 'Аренда' ELSE 'Продажа' END;
+ALTER TABLE listings DROP COLUMN deal;
+DROP TABLE IF EXISTS listing_status_history;
+DROP TABLE IF EXISTS listing_status_transitions;
+DROP TABLE IF EXISTS listing_statuses;
@@ -0,0 +1,69 @@
+create table if not exists listing_statuses (
+    name text primary key,
+    label text not null,
+    position integer not null
+);
+
+INSERT INTO listing_statuses (name, label, position) VALUES
+    ('draft', 'Черновик', 1),
+    ('active', 'Опубликовано', 2),
+    ('under_offer', 'На сделке', 3),
+    ('sold', 'Продано', 4),
+    ('rented', 'Сдано', 5),
+    ('archived', 'В архиве', 6);
+
+create table if not exists listing_status_transitions (
+    from_status text not null,
+    to_status text not null,
+    primary key (from_status, to_status),
+    foreign key (from_status) references listing_statuses(name),
+    foreign key (to_status) references listing_statuses(name)
+);
+
+INSERT INTO listing_status_transitions (from_status, to_status) VALUES
+    ('draft', 'active'),
+    ('draft', 'archived'),
+    ('active', 'draft'),
+    ('active', 'under_offer'),
+    ('active', 'sold'),
+    ('active', 'rented'),
+    ('active', 'archived'),
+    ('under_offer', 'active'),
+    ('under_offer', 'sold'),
+    ('under_offer', 'rented'),
+    ('under_offer', 'archived'),
+    ('sold', 'archived'),
+    ('rented', 'active'),
+    ('rented', 'archived'),
+    ('archived', 'draft');
+
+create table if not exists listing_status_history (
+    id INTEGER primary key,
+    listing_id integer not null,
+    from_status text not null,
+    to_status text not null,
+    changed_by integer not null,
+    comment text not null default '',
+    created_at datetime not null default (datetime('now')),
+    foreign key (listing_id) references listings(id) on delete cascade
+);
+
+create index if not exists listing_status_history_listing_id on listing_status_history(listing_id, id);
+
+-- раньше в status писали вид сделки («Продажа», «Аренда»), теперь для него отдельное поле
+ALTER TABLE listings ADD COLUMN deal text not null default 'sale' check (deal in ('sale', 'rent'));
+UPDATE listings SET deal = 'rent' WHERE status = 'Аренда';
+UPDATE listings SET status = 'active' WHERE status NOT IN (SELECT name FROM listing_statuses);
+
+-- жизненный цикл проверяет сама база, какой бы код ни менял объявление
+create trigger if not exists listings_status_insert before insert on listings
+when new.status NOT IN (SELECT name FROM listing_statuses) begin
+    select raise(abort, 'unknown listing status');
+end;
+
+create trigger if not exists listings_status_update before update of status on listings
+when new.status <> old.status AND NOT EXISTS (
+    SELECT 1 FROM listing_status_transitions WHERE from_status = old.status AND to_status = new.status
+) begin
+    select raise(abort, 'listing status transition not allowed');
+end;
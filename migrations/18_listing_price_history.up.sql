@@ -0,0 +1,11 @@
+create table if not exists listing_price_history (
+    id INTEGER primary key,
+    listing_id integer not null,
+    old_price integer not null,
+    new_price integer not null,
+    changed_by integer not null,
+    created_at datetime not null default (datetime('now')),
+    foreign key (listing_id) references listings(id) on delete cascade
+);
+
+create index if not exists listing_price_history_listing_id on listing_price_history(listing_id, id);
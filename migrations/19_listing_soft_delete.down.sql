@@ -0,0 +1,3 @@
+DROP INDEX IF EXISTS listings_deleted_at;
+DELETE FROM listings WHERE deleted_at IS NOT NULL;
+ALTER TABLE listings DROP COLUMN deleted_at;
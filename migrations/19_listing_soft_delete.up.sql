@@ -0,0 +1,3 @@
+ALTER TABLE listings ADD COLUMN deleted_at datetime;
+
+create index if not exists listings_deleted_at on listings(deleted_at) where deleted_at IS NOT NULL;
@@ -0,0 +1,9 @@
+DROP INDEX IF EXISTS listings_syndicate;
+DROP TABLE IF EXISTS feed_tokens;
+ALTER TABLE users DROP COLUMN phone;
+ALTER TABLE listings DROP COLUMN syndicate;
+ALTER TABLE listings DROP COLUMN floors;
+ALTER TABLE listings DROP COLUMN floor;
+ALTER TABLE listings DROP COLUMN rooms;
+ALTER TABLE listings DROP COLUMN area;
+ALTER TABLE listings DROP COLUMN address;
@@ -0,0 +1,28 @@
+-- поля, без которых площадки не принимают объявление
+ALTER TABLE listings ADD COLUMN address text not null default '';
+ALTER TABLE listings ADD COLUMN area real not null default 0;
+ALTER TABLE listings ADD COLUMN rooms integer not null default 0;
+ALTER TABLE listings ADD COLUMN floor integer not null default 0;
+ALTER TABLE listings ADD COLUMN floors integer not null default 0;
+-- объявление попадает в фиды, только если агент его отметил
+ALTER TABLE listings ADD COLUMN syndicate integer not null default 0;
+
+ALTER TABLE users ADD COLUMN phone text not null default '';
+
+-- фид принадлежит агенту или агентству, в адресе фида — токен, здесь только его хеш
+create table if not exists feed_tokens (
+    id INTEGER primary key,
+    token_hash text not null unique,
+    user_id integer,
+    agency_id integer,
+    created_by integer not null,
+    created_at datetime not null default (datetime('now')),
+    last_used_at datetime,
+    check ((user_id IS NULL) <> (agency_id IS NULL)),
+    foreign key (user_id) references users(id) on delete cascade,
+    foreign key (agency_id) references agencies(id) on delete cascade
+);
+
+create unique index if not exists feed_tokens_user_id on feed_tokens(user_id) where user_id IS NOT NULL;
+create unique index if not exists feed_tokens_agency_id on feed_tokens(agency_id) where agency_id IS NOT NULL;
+create index if not exists listings_syndicate on listings(syndicate) where syndicate = 1;
@@ -0,0 +1,10 @@
+create table if not exists email_changes (
+    id INTEGER primary key,
+    user_id integer not null,
+    email text not null,
+    token_hash text not null unique,
+    created_at datetime not null default (datetime('now')),
+    expires_at datetime not null,
+    used_at datetime,
+    foreign key (user_id) references users(id) on delete cascade
+);
@@ -0,0 +1,18 @@
+create table listing_status_history_old (
+    id INTEGER primary key,
+    listing_id integer not null,
+    from_status text not null,
+    to_status text not null,
+    changed_by integer not null,
+    comment text not null default '',
+    created_at datetime not null default (datetime('now')),
+    foreign key (listing_id) references listings(id) on delete cascade
+);
+
+INSERT INTO listing_status_history_old (id, listing_id, from_status, to_status, changed_by, comment, created_at)
+SELECT id, listing_id, from_status, to_status, changed_by, comment, created_at FROM listing_status_history
+WHERE from_status IS NOT NULL;
+
+DROP TABLE listing_status_history;
+ALTER TABLE listing_status_history_old RENAME TO listing_status_history;
+create index if not exists listing_status_history_listing_id on listing_status_history(listing_id, id);
@@ -0,0 +1,25 @@
+-- первая запись истории — начальный статус, from_status у неё пустой
+create table listing_status_history_new (
+    id INTEGER primary key,
+    listing_id integer not null,
+    from_status text,
+    to_status text not null,
+    changed_by integer not null,
+    comment text not null default '',
+    created_at datetime not null default (datetime('now')),
+    foreign key (listing_id) references listings(id) on delete cascade
+);
+
+-- у старых объявлений начальный статус — тот, с которого ушла первая записанная смена, иначе текущий
+INSERT INTO listing_status_history_new (listing_id, from_status, to_status, changed_by, created_at)
+SELECT listings.id, NULL,
+    COALESCE((SELECT from_status FROM listing_status_history WHERE listing_id = listings.id ORDER BY id LIMIT 1), listings.status),
+    COALESCE(listings.user_id, 0), listings.date_created
+FROM listings ORDER BY listings.id;
+
+INSERT INTO listing_status_history_new (listing_id, from_status, to_status, changed_by, comment, created_at)
+SELECT listing_id, from_status, to_status, changed_by, comment, created_at FROM listing_status_history ORDER BY id;
+
+DROP TABLE listing_status_history;
+ALTER TABLE listing_status_history_new RENAME TO listing_status_history;
+create index if not exists listing_status_history_listing_id on listing_status_history(listing_id, id);
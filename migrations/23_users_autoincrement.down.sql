@@ -0,0 +1,25 @@
+create table users_old (
+    id INTEGER primary key,
+    username text not null unique,
+    password VARCHAR(256) not null,
+    name text not null,
+    role TEXT DEFAULT 'agent',
+    token_version integer not null default 0,
+    email text,
+    totp_secret text,
+    totp_enabled integer not null default 0,
+    totp_last_step integer not null default 0,
+    status text not null default 'active',
+    agency_id integer not null default 1,
+    created_at datetime,
+    phone text not null default ''
+);
+
+INSERT INTO users_old (id, username, password, name, role, token_version, email, totp_secret, totp_enabled, totp_last_step, status, agency_id, created_at, phone)
+SELECT id, username, password, name, role, token_version, email, totp_secret, totp_enabled, totp_last_step, status, agency_id, created_at, phone FROM users;
+
+DROP TABLE users;
+ALTER TABLE users_old RENAME TO users;
+create unique index if not exists users_email on users(email);
+create index if not exists users_agency_id on users(agency_id);
+create index if not exists users_created_at on users(created_at, id);
@@ -0,0 +1,2 @@
+-- у осиротевших объявлений владельца не восстановить
+select 1;
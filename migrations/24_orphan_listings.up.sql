@@ -0,0 +1,3 @@
+-- объявления удалённых раньше пользователей остаются без владельца, как теперь делает DeleteUser
+update listings set user_id = null, deleted_at = coalesce(deleted_at, datetime('now'))
+where user_id is not null and user_id not in (select id from users);
@@ -0,0 +1,2 @@
+-- прошёл ли вход второй фактор: токены сессии наследуют это при обновлении
+ALTER TABLE sessions ADD COLUMN mfa integer not null default 0;
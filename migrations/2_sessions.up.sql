@@ -0,0 +1,15 @@
+create table if not exists sessions (
+    id INTEGER primary key,
+    user_id integer not null,
+    refresh_hash text not null unique,
+    previous_hash text,
+    user_agent text not null default '',
+    ip text not null default '',
+    created_at datetime not null default (datetime('now')),
+    last_used_at datetime not null default (datetime('now')),
+    expires_at datetime not null,
+    revoked_at datetime,
+    foreign key (user_id) references users(id) on delete cascade
+);
+
+create index if not exists sessions_user_id on sessions(user_id);
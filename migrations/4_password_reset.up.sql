@@ -0,0 +1,13 @@
+ALTER TABLE users ADD COLUMN email text;
+
+create unique index if not exists users_email on users(email);
+
+create table if not exists password_resets (
+    id INTEGER primary key,
+    user_id integer not null,
+    token_hash text not null unique,
+    created_at datetime not null default (datetime('now')),
+    expires_at datetime not null,
+    used_at datetime,
+    foreign key (user_id) references users(id) on delete cascade
+);
@@ -0,0 +1,8 @@
+create table if not exists login_failures (
+    kind text not null,
+    value text not null,
+    failures integer not null default 0,
+    last_failure_at datetime not null default (datetime('now')),
+    locked_until datetime,
+    primary key (kind, value)
+);
@@ -0,0 +1,18 @@
+ALTER TABLE users ADD COLUMN totp_secret text;
+ALTER TABLE users ADD COLUMN totp_enabled integer not null default 0;
+ALTER TABLE users ADD COLUMN totp_last_step integer not null default 0;
+
+create table if not exists recovery_codes (
+    id INTEGER primary key,
+    user_id integer not null,
+    code_hash text not null,
+    used_at datetime,
+    foreign key (user_id) references users(id) on delete cascade
+);
+
+create index if not exists recovery_codes_user_id on recovery_codes(user_id);
+
+create table if not exists settings (
+    key text primary key,
+    value text not null
+);
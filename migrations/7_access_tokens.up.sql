@@ -0,0 +1,14 @@
+create table if not exists access_tokens (
+    id INTEGER primary key,
+    user_id integer not null,
+    name text not null,
+    token_hash text not null unique,
+    scopes text not null,
+    created_at datetime not null default (datetime('now')),
+    last_used_at datetime,
+    expires_at datetime,
+    revoked_at datetime,
+    foreign key (user_id) references users(id) on delete cascade
+);
+
+create index if not exists access_tokens_user_id on access_tokens(user_id);
@@ -0,0 +1,13 @@
+ALTER TABLE users ADD COLUMN status text not null default 'active';
+
+create table if not exists invites (
+    id INTEGER primary key,
+    code_hash text not null unique,
+    created_by integer,
+    created_at datetime not null default (datetime('now')),
+    expires_at datetime,
+    used_at datetime,
+    used_by integer,
+    foreign key (created_by) references users(id) on delete set null,
+    foreign key (used_by) references users(id) on delete set null
+);
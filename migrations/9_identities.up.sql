@@ -0,0 +1,13 @@
+create table if not exists user_identities (
+    id INTEGER primary key,
+    user_id integer not null,
+    issuer text not null,
+    subject text not null,
+    email text,
+    created_at datetime not null default (datetime('now')),
+    last_login_at datetime,
+    unique (issuer, subject),
+    foreign key (user_id) references users(id) on delete cascade
+);
+
+create index if not exists user_identities_user_id on user_identities(user_id);